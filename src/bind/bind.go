@@ -0,0 +1,157 @@
+// Package bind makes the connections of the client leave from given local addresses, e.g. the ones of the
+// network interface of a storage VLAN on a host with several of them. IPv4 and IPv6 connections are bound
+// separately, each to an address of their own family.
+package bind
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ErrNoAddress is returned when connecting to an address of a family no local address is bound for, while
+// the other family is bound: such a connection would leave from an interface it isn't meant to.
+var ErrNoAddress = errors.New("no local address is bound for the address family")
+
+// Addrs are the local addresses the connections of each family leave from. A family whose address is nil
+// isn't bound, and if neither is, connections leave from wherever the system routes them.
+type Addrs struct {
+	IPv4 net.IP // Address IPv4 connections leave from.
+	IPv6 net.IP // Address IPv6 connections leave from.
+}
+
+// Resolve returns the address of the given family `s` stands for: either that address itself, or the first
+// address of that family of the network interface named `s`. IPv6 link-local addresses are skipped, since
+// they can't reach peers outside the link.
+// Returns an error if `s` is an address of the other family, or an interface without an address of the
+// family.
+func Resolve(s string, ipv6 bool) (net.IP, error) {
+	var family = "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+
+	if ip := net.ParseIP(s); ip != nil {
+		if (ip.To4() == nil) != ipv6 {
+			return nil, fmt.Errorf("%s is not an %s address", s, family)
+		}
+
+		return ip, nil
+	}
+
+	var iface, err = net.InterfaceByName(s)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither an %s address nor a network interface: %w", s, family, err)
+	}
+
+	var addrs []net.Addr
+	addrs, err = iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		var network, ok = addr.(*net.IPNet)
+		if !ok || (network.IP.To4() == nil) != ipv6 || network.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		return network.IP, nil
+	}
+
+	return nil, fmt.Errorf("the network interface %s has no %s address", s, family)
+}
+
+// IsZero reports whether neither family is bound.
+func (addrs Addrs) IsZero() bool {
+	return addrs.IPv4 == nil && addrs.IPv6 == nil
+}
+
+// For returns the local address the connections to `ip` leave from, nil if they aren't bound.
+// Returns ErrNoAddress if the family of `ip` isn't bound while the other one is.
+func (addrs Addrs) For(ip net.IP) (net.IP, error) {
+	if addrs.IsZero() {
+		return nil, nil
+	}
+
+	var local = addrs.IPv6
+	if ip.To4() != nil {
+		local = addrs.IPv4
+	}
+
+	if local == nil {
+		return nil, fmt.Errorf("%w: can't connect to %s", ErrNoAddress, ip)
+	}
+
+	return local, nil
+}
+
+// ListenAddrs returns the addresses to listen on for connections on `port`: the one of each bound family,
+// or every address of the host if neither is bound.
+func (addrs Addrs) ListenAddrs(port uint16) []string {
+	var portString = strconv.Itoa(int(port))
+	if addrs.IsZero() {
+		return []string{net.JoinHostPort("", portString)}
+	}
+
+	var result []string
+	for _, ip := range []net.IP{addrs.IPv4, addrs.IPv6} {
+		if ip != nil {
+			result = append(result, net.JoinHostPort(ip.String(), portString))
+		}
+	}
+
+	return result
+}
+
+// Dialer opens TCP connections from the bound local addresses. It satisfies proxy.Dialer.
+type Dialer struct {
+	Addrs Addrs // Addresses the connections leave from.
+}
+
+// DialContext connects to `addr` on the named TCP network from the local address of its family. A host name
+// is resolved first, and its addresses of the bound families are tried in turn.
+// Returns ErrNoAddress if `addr` has no address of a bound family, or the error of the last address tried.
+func (dialer *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var host, port, err = net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = fmt.Errorf("%w: can't connect to %s", ErrNoAddress, addr)
+	for _, ip := range ips {
+		var local, bindErr = dialer.Addrs.For(ip)
+		if bindErr != nil {
+			continue
+		}
+
+		var netDialer = net.Dialer{}
+		if local != nil {
+			netDialer.LocalAddr = &net.TCPAddr{IP: local}
+		}
+
+		var conn net.Conn
+		conn, err = netDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, err
+}
@@ -0,0 +1,179 @@
+package bind
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	/*
+		test cases:
+		1. addresses of the family are taken as they are
+		2. network interfaces are resolved to their address of the family
+		3. addresses of the other family and unknown interfaces are rejected
+	*/
+
+	t.Run("addresses of the family are taken as they are", func(t *testing.T) {
+		var ip, err = Resolve("192.0.2.7", false)
+		assert.Nil(t, err)
+		assert.Equal(t, "192.0.2.7", ip.String())
+
+		ip, err = Resolve("2001:db8::7", true)
+		assert.Nil(t, err)
+		assert.Equal(t, "2001:db8::7", ip.String())
+	})
+
+	t.Run("network interfaces are resolved to their address of the family", func(t *testing.T) {
+		var loopback = loopbackInterface(t)
+
+		var ip, err = Resolve(loopback, false)
+		assert.Nil(t, err)
+		assert.True(t, ip.IsLoopback())
+		assert.NotNil(t, ip.To4())
+	})
+
+	t.Run("addresses of the other family and unknown interfaces are rejected", func(t *testing.T) {
+		var _, err = Resolve("192.0.2.7", true)
+		assert.NotNil(t, err)
+
+		_, err = Resolve("2001:db8::7", false)
+		assert.NotNil(t, err)
+
+		_, err = Resolve("no-such-interface0", false)
+		assert.NotNil(t, err)
+	})
+}
+
+// loopbackInterface returns the name of the loopback interface with an IPv4 address, skipping the test if
+// there is none.
+func loopbackInterface(t *testing.T) string {
+	var ifaces, err = net.Interfaces()
+	require.Nil(t, err)
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 {
+			continue
+		}
+
+		var addrs, _ = iface.Addrs()
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok && network.IP.To4() != nil {
+				return iface.Name
+			}
+		}
+	}
+
+	t.Skip("no loopback interface with an IPv4 address")
+	return ""
+}
+
+func TestAddrs(t *testing.T) {
+	/*
+		test cases:
+		1. connections leave from the address of their family
+		2. connections to an unbound family are refused once the other is bound
+		3. the listen addresses are the bound ones, or every address
+	*/
+
+	var bound = Addrs{IPv4: net.IP{192, 0, 2, 7}, IPv6: net.ParseIP("2001:db8::7")}
+
+	t.Run("connections leave from the address of their family", func(t *testing.T) {
+		var local, err = bound.For(net.IP{198, 51, 100, 1})
+		assert.Nil(t, err)
+		assert.Equal(t, bound.IPv4, local)
+
+		local, err = bound.For(net.ParseIP("2001:db8::1"))
+		assert.Nil(t, err)
+		assert.Equal(t, bound.IPv6, local)
+
+		local, err = Addrs{}.For(net.IP{198, 51, 100, 1})
+		assert.Nil(t, err)
+		assert.Nil(t, local)
+	})
+
+	t.Run("connections to an unbound family are refused once the other is bound", func(t *testing.T) {
+		var _, err = Addrs{IPv4: bound.IPv4}.For(net.ParseIP("2001:db8::1"))
+		assert.ErrorIs(t, err, ErrNoAddress)
+
+		_, err = Addrs{IPv6: bound.IPv6}.For(net.IP{198, 51, 100, 1})
+		assert.ErrorIs(t, err, ErrNoAddress)
+	})
+
+	t.Run("the listen addresses are the bound ones, or every address", func(t *testing.T) {
+		assert.Equal(t, []string{"192.0.2.7:6881", "[2001:db8::7]:6881"}, bound.ListenAddrs(6881))
+		assert.Equal(t, []string{"[2001:db8::7]:6881"}, Addrs{IPv6: bound.IPv6}.ListenAddrs(6881))
+		assert.Equal(t, []string{":6881"}, Addrs{}.ListenAddrs(6881))
+	})
+}
+
+func TestDialer(t *testing.T) {
+	/*
+		test cases:
+		1. connections leave from the bound address
+		2. host names are resolved to an address of a bound family
+		3. connections to an unbound family are refused
+	*/
+
+	// startServer returns the address of a server sending the address connections come from on them
+	var startServer = func(t *testing.T) string {
+		var ln, err = net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		t.Cleanup(func() { ln.Close() })
+
+		go func() {
+			for {
+				var conn, err = ln.Accept()
+				if err != nil {
+					return
+				}
+
+				conn.Write([]byte(conn.RemoteAddr().(*net.TCPAddr).IP.String() + "\n"))
+				conn.Close()
+			}
+		}()
+
+		return ln.Addr().String()
+	}
+
+	// remoteIP returns the address the server saw the connection come from
+	var remoteIP = func(t *testing.T, conn net.Conn) string {
+		defer conn.Close()
+
+		var buf = make([]byte, 64)
+		var n, _ = conn.Read(buf)
+		return string(buf[:n])
+	}
+
+	t.Run("connections leave from the bound address", func(t *testing.T) {
+		var dialer = &Dialer{Addrs: Addrs{IPv4: net.IP{127, 0, 0, 2}}}
+
+		var conn, err = dialer.DialContext(context.Background(), "tcp", startServer(t))
+		require.Nil(t, err)
+		assert.Equal(t, "127.0.0.2\n", remoteIP(t, conn))
+
+		// without a bound address, they leave from wherever they are routed
+		conn, err = (&Dialer{}).DialContext(context.Background(), "tcp", startServer(t))
+		require.Nil(t, err)
+		assert.Equal(t, "127.0.0.1\n", remoteIP(t, conn))
+	})
+
+	t.Run("host names are resolved to an address of a bound family", func(t *testing.T) {
+		var _, port, _ = net.SplitHostPort(startServer(t))
+		var dialer = &Dialer{Addrs: Addrs{IPv4: net.IP{127, 0, 0, 3}}}
+
+		var conn, err = dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+		require.Nil(t, err)
+		assert.Equal(t, "127.0.0.3\n", remoteIP(t, conn))
+	})
+
+	t.Run("connections to an unbound family are refused", func(t *testing.T) {
+		var dialer = &Dialer{Addrs: Addrs{IPv6: net.IPv6loopback}}
+
+		var _, err = dialer.DialContext(context.Background(), "tcp", startServer(t))
+		assert.ErrorIs(t, err, ErrNoAddress)
+	})
+}
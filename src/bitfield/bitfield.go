@@ -3,6 +3,22 @@ package bitfield
 // Bitfield represents a bitfield used in a BitTorrent client.
 type Bitfield []byte
 
+// New creates an empty Bitfield large enough to hold `numPieces` pieces.
+func New(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8)
+}
+
+// NewFull creates a Bitfield with each of the `numPieces` pieces set.
+// The spare bits at the end of the last byte are left cleared, as the protocol requires.
+func NewFull(numPieces int) Bitfield {
+	var bf = New(numPieces)
+	for i := 0; i != numPieces; i++ {
+		bf.SetPiece(i)
+	}
+
+	return bf
+}
+
 // HasPiece checks if the specified piece index is present in the Bitfield.
 // It returns true if the piece is present, otherwise false.
 func (bf *Bitfield) HasPiece(index int) bool {
@@ -53,3 +53,17 @@ func TestSetPiece(t *testing.T) {
 		assert.Equal(t, test.output, inputBitfield)
 	}
 }
+
+func TestNew(t *testing.T) {
+	assert.Equal(t, Bitfield{}, New(0))
+	assert.Equal(t, Bitfield{0x00}, New(1))
+	assert.Equal(t, Bitfield{0x00}, New(8))
+	assert.Equal(t, Bitfield{0x00, 0x00}, New(9))
+}
+
+func TestNewFull(t *testing.T) {
+	assert.Equal(t, Bitfield{}, NewFull(0))
+	assert.Equal(t, Bitfield{0b10000000}, NewFull(1))
+	assert.Equal(t, Bitfield{0b11111111}, NewFull(8))
+	assert.Equal(t, Bitfield{0b11111111, 0b11100000}, NewFull(11))
+}
@@ -0,0 +1,138 @@
+package bufpool
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultBudget is the budget of a pool created with a budget that is not positive.
+const DefaultBudget = 256 << 20
+
+// Pool hands out byte buffers within a memory budget and recycles the ones given back.
+// The buffers handed out and the ones kept for reuse never add up to more than the budget, except
+// for a single buffer larger than the whole budget, which is handed out once nothing else is.
+// It is safe for concurrent use, so several downloads can share one pool to cap their memory together.
+type Pool struct {
+	budget int64
+
+	mu      sync.Mutex
+	freed   *sync.Cond       // signalled whenever buffers are given back
+	inUse   int64            // bytes of the buffers handed out
+	idle    int64            // bytes of the buffers in `free`
+	free    map[int][][]byte // buffers kept for reuse, keyed by length
+	waiting int              // number of callers waiting for room in the budget
+}
+
+// New creates a pool whose buffers add up to at most `budget` bytes, or DefaultBudget if `budget` is not positive.
+func New(budget int64) *Pool {
+	if budget <= 0 {
+		budget = DefaultBudget
+	}
+
+	var pool = &Pool{budget: budget, free: make(map[int][][]byte)}
+	pool.freed = sync.NewCond(&pool.mu)
+
+	return pool
+}
+
+// Budget returns the most bytes the pool's buffers add up to.
+func (pool *Pool) Budget() int64 {
+	return pool.budget
+}
+
+// InUse returns the number of bytes of the buffers that have been handed out and not given back yet.
+func (pool *Pool) InUse() int64 {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	return pool.inUse
+}
+
+// fits reports whether a buffer of `size` bytes can be handed out without going over the budget.
+// The caller must hold the pool's lock.
+func (pool *Pool) fits(size int) bool {
+	return pool.inUse == 0 || pool.inUse+int64(size) <= pool.budget
+}
+
+// TryGet hands out a buffer of `size` bytes if that fits in the budget. The buffer is not zeroed.
+// It returns false if the budget is used up.
+func (pool *Pool) TryGet(size int) ([]byte, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if !pool.fits(size) {
+		return nil, false
+	}
+
+	return pool.take(size), true
+}
+
+// Wait blocks until a buffer of `size` bytes fits in the budget, without taking it.
+// Returns ctx.Err() if `ctx` is cancelled first.
+func (pool *Pool) Wait(ctx context.Context, size int) error {
+	// wake the waiters up when the context is cancelled, so that they notice
+	var stop = context.AfterFunc(ctx, func() {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+
+		pool.freed.Broadcast()
+	})
+	defer stop()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.waiting++
+	defer func() { pool.waiting-- }()
+
+	for !pool.fits(size) && ctx.Err() == nil {
+		pool.freed.Wait()
+	}
+
+	return ctx.Err()
+}
+
+// take hands out a buffer of `size` bytes, reusing a free one if there is one. Free buffers of other
+// lengths are dropped as needed to keep within the budget.
+// The caller must hold the pool's lock and make sure that the buffer fits in the budget.
+func (pool *Pool) take(size int) []byte {
+	pool.inUse += int64(size)
+
+	var buffers = pool.free[size]
+	if len(buffers) != 0 {
+		var buf = buffers[len(buffers)-1]
+		pool.free[size] = buffers[:len(buffers)-1]
+		pool.idle -= int64(size)
+
+		return buf
+	}
+
+	for length, buffers := range pool.free {
+		if pool.inUse+pool.idle <= pool.budget {
+			break
+		}
+
+		pool.idle -= int64(length * len(buffers))
+		delete(pool.free, length)
+	}
+
+	return make([]byte, size)
+}
+
+// Put gives back a buffer handed out by the pool, which must not be used afterwards.
+// The buffer is kept for reuse if there is room for it in the budget.
+func (pool *Pool) Put(buf []byte) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	var size = len(buf)
+	pool.inUse -= int64(size)
+	if pool.inUse+pool.idle+int64(size) <= pool.budget {
+		pool.free[size] = append(pool.free[size], buf)
+		pool.idle += int64(size)
+	}
+
+	if pool.waiting != 0 {
+		pool.freed.Broadcast()
+	}
+}
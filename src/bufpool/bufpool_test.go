@@ -0,0 +1,110 @@
+package bufpool
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	/*
+		test cases:
+		1. buffers are handed out within the budget
+		2. a buffer larger than the budget is handed out once nothing else is
+		3. Wait blocks until a buffer is given back
+		4. Wait gives up when the context is cancelled
+		5. buffers given back are reused
+		6. the buffers kept for reuse stay within the budget
+	*/
+
+	t.Run("buffers are handed out within the budget", func(t *testing.T) {
+		var pool = New(10)
+
+		var buf, ok = pool.TryGet(6)
+		assert.True(t, ok)
+		assert.Len(t, buf, 6)
+		assert.Equal(t, int64(6), pool.InUse())
+
+		_, ok = pool.TryGet(5)
+		assert.False(t, ok)
+
+		_, ok = pool.TryGet(4)
+		assert.True(t, ok)
+		assert.Equal(t, int64(10), pool.InUse())
+	})
+
+	t.Run("a buffer larger than the budget is handed out once nothing else is", func(t *testing.T) {
+		var pool = New(10)
+
+		var small, _ = pool.TryGet(1)
+		var _, ok = pool.TryGet(20)
+		assert.False(t, ok)
+
+		pool.Put(small)
+		_, ok = pool.TryGet(20)
+		assert.True(t, ok)
+		assert.Equal(t, int64(20), pool.InUse())
+	})
+
+	t.Run("Wait blocks until a buffer is given back", func(t *testing.T) {
+		var pool = New(10)
+		var first, _ = pool.TryGet(8)
+
+		var done = make(chan error)
+		go func() { done <- pool.Wait(context.Background(), 8) }()
+
+		select {
+		case <-done:
+			assert.Fail(t, "Wait didn't wait for room in the budget")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		pool.Put(first)
+		assert.Nil(t, <-done)
+
+		// waiting doesn't take the buffer
+		assert.Equal(t, int64(0), pool.InUse())
+		var _, ok = pool.TryGet(8)
+		assert.True(t, ok)
+	})
+
+	t.Run("Wait gives up when the context is cancelled", func(t *testing.T) {
+		var pool = New(10)
+		pool.TryGet(8)
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		var err = pool.Wait(ctx, 8)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Equal(t, int64(8), pool.InUse())
+	})
+
+	t.Run("buffers given back are reused", func(t *testing.T) {
+		var pool = New(10)
+
+		var buf, _ = pool.TryGet(4)
+		buf[0] = 'x'
+		pool.Put(buf)
+		assert.Equal(t, int64(0), pool.InUse())
+
+		var again, _ = pool.TryGet(4)
+		assert.Equal(t, &buf[0], &again[0])
+	})
+
+	t.Run("the buffers kept for reuse stay within the budget", func(t *testing.T) {
+		var pool = New(10)
+
+		var a, _ = pool.TryGet(4)
+		var b, _ = pool.TryGet(4)
+		pool.Put(a)
+		pool.Put(b)
+		assert.Equal(t, int64(8), pool.idle)
+
+		// the free buffers of another length make room for the new one
+		pool.TryGet(6)
+		assert.LessOrEqual(t, pool.inUse+pool.idle, pool.Budget())
+	})
+}
@@ -0,0 +1,323 @@
+// Package choker decides which peers we upload to, with BitTorrent's tit-for-tat choking algorithm.
+package choker
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSlots       = 4                // peers unchoked at a time, including the optimistic unchoke
+	RechokeInterval    = 10 * time.Second // how often the regular unchoke slots are handed out again
+	OptimisticInterval = 30 * time.Second // how often the optimistic unchoke moves to another peer
+	newPeerRounds      = 3                // optimistic rounds for which a peer counts as newly connected
+	newPeerWeight      = 3                // how much likelier newly connected peers are to be unchoked optimistically
+)
+
+// Peer is a connection the choker decides about. Its methods are called from the choker's goroutines, so they
+// must be safe for concurrent use.
+type Peer interface {
+	// Interested reports whether the peer wants pieces from us.
+	Interested() bool
+
+	// Transferred returns the bytes of block data received from the peer and sent to it so far.
+	Transferred() (downloaded, uploaded int64)
+
+	// SetChoked chokes or unchokes the peer. It is only called when the peer's state changes, from a goroutine
+	// of the choker's that is the only one telling the peer, so it may block.
+	SetChoked(choked bool)
+}
+
+// peerState is what the choker remembers about a peer.
+type peerState struct {
+	peer       Peer
+	added      time.Time // when the peer was added
+	choked     bool      // whether the peer is choked
+	sampled    time.Time // when the transfer counters were last sampled
+	downloaded int64     // bytes received from the peer when last sampled
+	uploaded   int64     // bytes sent to the peer when last sampled
+	downRate   float64   // bytes per second received from the peer between the last two samples
+	upRate     float64   // bytes per second sent to the peer between the last two samples
+
+	told    bool // whether the peer was last told it is choked
+	telling bool // whether a goroutine is telling the peer about its state
+}
+
+// sample measures the peer's rates since the previous sample.
+func (state *peerState) sample(now time.Time) {
+	var downloaded, uploaded = state.peer.Transferred()
+
+	var elapsed = now.Sub(state.sampled).Seconds()
+	if elapsed > 0 {
+		state.downRate = float64(downloaded-state.downloaded) / elapsed
+		state.upRate = float64(uploaded-state.uploaded) / elapsed
+	}
+
+	state.sampled = now
+	state.downloaded = downloaded
+	state.uploaded = uploaded
+}
+
+// Choker hands out a fixed number of upload slots to the peers interested in our pieces.
+// Every RechokeInterval, all slots but one go to the peers we download from the fastest, or, once we are
+// seeding, to the peers we upload to the fastest, so that peers giving us data get data back. The last slot
+// is an optimistic unchoke, which moves to another interested peer every OptimisticInterval to find faster
+// peers and to let newly connected peers get their first pieces; newly connected peers are more likely to
+// get it. Between rechokes, peers that become interested are unchoked right away while a slot is free.
+// It is safe for concurrent use.
+type Choker struct {
+	mu             sync.Mutex
+	slots          int
+	peers          []*peerState // in the order they were added
+	optimistic     *peerState   // peer holding the optimistic unchoke, if any
+	lastOptimistic time.Time    // when the optimistic unchoke last moved
+	random         *rand.Rand
+	tells          sync.WaitGroup // goroutines telling peers about their state
+}
+
+// New creates a choker with the given number of upload slots. Defaults to DefaultSlots if `slots` isn't positive.
+func New(slots int) *Choker {
+	if slots <= 0 {
+		slots = DefaultSlots
+	}
+
+	return &Choker{slots: slots, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Slots returns the number of upload slots.
+func (choker *Choker) Slots() int {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	return choker.slots
+}
+
+// SetSlots changes the number of upload slots, which takes effect at the next rechoke.
+// Defaults to DefaultSlots if `slots` isn't positive.
+func (choker *Choker) SetSlots(slots int) {
+	if slots <= 0 {
+		slots = DefaultSlots
+	}
+
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	choker.slots = slots
+}
+
+// Add adds a peer for the choker to decide about. Peers start out choked, as the protocol has it.
+func (choker *Choker) Add(peer Peer) {
+	choker.addAt(peer, time.Now())
+}
+
+// addAt adds a peer as if it was connected at `now`.
+func (choker *Choker) addAt(peer Peer, now time.Time) {
+	var downloaded, uploaded = peer.Transferred()
+
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	choker.peers = append(choker.peers, &peerState{
+		peer:       peer,
+		added:      now,
+		choked:     true,
+		sampled:    now,
+		downloaded: downloaded,
+		uploaded:   uploaded,
+		told:       true,
+	})
+}
+
+// Remove removes a peer, e.g. once its connection ended. Its slot is handed out again at the next rechoke.
+func (choker *Choker) Remove(peer Peer) {
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	for i, state := range choker.peers {
+		if state.peer != peer {
+			continue
+		}
+
+		choker.peers = append(choker.peers[:i], choker.peers[i+1:]...)
+		if choker.optimistic == state {
+			choker.optimistic = nil
+		}
+		return
+	}
+}
+
+// PeerInterested tells the choker that the peer became interested in our pieces. It is unchoked right away
+// if a slot is free, rather than at the next rechoke.
+func (choker *Choker) PeerInterested(peer Peer) {
+	choker.mu.Lock()
+
+	var unchoked int
+	var found *peerState
+	for _, state := range choker.peers {
+		if !state.choked {
+			unchoked++
+		}
+
+		if state.peer == peer {
+			found = state
+		}
+	}
+
+	if found == nil || !found.choked || unchoked >= choker.slots {
+		choker.mu.Unlock()
+		return
+	}
+
+	found.choked = false
+	choker.tell(found)
+	choker.mu.Unlock()
+}
+
+// Rechoke hands out the upload slots again, as explained in Choker, based on the rates measured since the
+// previous rechoke. When `seeding`, peers are ranked by how fast we upload to them rather than by how fast
+// we download from them.
+func (choker *Choker) Rechoke(now time.Time, seeding bool) {
+	choker.mu.Lock()
+
+	for _, state := range choker.peers {
+		state.sample(now)
+	}
+
+	var rotate = choker.optimistic == nil || now.Sub(choker.lastOptimistic) >= OptimisticInterval
+
+	// the regular slots go to the fastest interested peers
+	var candidates []*peerState
+	for _, state := range choker.peers {
+		if state.peer.Interested() && (rotate || state != choker.optimistic) {
+			candidates = append(candidates, state)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if seeding {
+			return candidates[i].upRate > candidates[j].upRate
+		}
+
+		return candidates[i].downRate > candidates[j].downRate
+	})
+
+	var unchoke = make(map[*peerState]bool)
+	for _, state := range candidates[:min(len(candidates), choker.slots-1)] {
+		unchoke[state] = true
+	}
+
+	// the optimistic unchoke goes to one of the other interested peers
+	if rotate {
+		choker.optimistic = choker.pickOptimistic(candidates, unchoke, now)
+		choker.lastOptimistic = now
+	}
+
+	if choker.optimistic != nil {
+		unchoke[choker.optimistic] = true
+	}
+
+	for _, state := range choker.peers {
+		var choked = !unchoke[state]
+		if state.choked != choked {
+			state.choked = choked
+			choker.tell(state)
+		}
+	}
+
+	choker.mu.Unlock()
+}
+
+// tell has the peer told whether it is choked, as the choker decided, on a goroutine of its own, so that a slow
+// or stalled peer holds up neither the choker nor any other peer. A peer has a single such goroutine at a
+// time, which tells it its latest state until it is up to date, so it never ends up in a state decided before
+// the one it was last told.
+// The caller must hold the choker's lock.
+func (choker *Choker) tell(state *peerState) {
+	if state.telling {
+		return
+	}
+	state.telling = true
+
+	choker.tells.Add(1)
+	go func() {
+		defer choker.tells.Done()
+
+		choker.mu.Lock()
+		for state.choked != state.told {
+			var choked = state.choked
+			state.told = choked
+			choker.mu.Unlock()
+
+			state.peer.SetChoked(choked)
+
+			choker.mu.Lock()
+		}
+
+		state.telling = false
+		choker.mu.Unlock()
+	}()
+}
+
+// pickOptimistic picks the peer to unchoke optimistically at random among the candidates that didn't get a
+// regular slot, preferring any peer over the one holding the optimistic unchoke now. Newly connected peers
+// are newPeerWeight times likelier to be picked.
+// It returns nil if there is no candidate.
+// The caller must hold the choker's lock.
+func (choker *Choker) pickOptimistic(candidates []*peerState, unchoked map[*peerState]bool, now time.Time) *peerState {
+	var eligible []*peerState
+	var weights []int
+	var total int
+	for _, state := range candidates {
+		if unchoked[state] || state == choker.optimistic {
+			continue
+		}
+
+		var weight = 1
+		if now.Sub(state.added) < newPeerRounds*OptimisticInterval {
+			weight = newPeerWeight
+		}
+
+		eligible = append(eligible, state)
+		weights = append(weights, weight)
+		total += weight
+	}
+
+	if len(eligible) == 0 {
+		// keep the current optimistic unchoke if nobody else can have it
+		if choker.optimistic != nil && choker.optimistic.peer.Interested() && !unchoked[choker.optimistic] {
+			return choker.optimistic
+		}
+
+		return nil
+	}
+
+	var pick = choker.random.Intn(total)
+	for i, weight := range weights {
+		if pick < weight {
+			return eligible[i]
+		}
+		pick -= weight
+	}
+
+	return eligible[len(eligible)-1]
+}
+
+// Run rechokes every RechokeInterval, starting right away, until `ctx` is cancelled.
+// When `seeding`, peers are ranked by how fast we upload to them.
+func (choker *Choker) Run(ctx context.Context, seeding bool) {
+	var ticker = time.NewTicker(RechokeInterval)
+	defer ticker.Stop()
+
+	for {
+		choker.Rechoke(time.Now(), seeding)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
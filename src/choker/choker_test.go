@@ -0,0 +1,278 @@
+package choker
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePeer is a peer with simulated transfers.
+type fakePeer struct {
+	mu         sync.Mutex
+	name       string
+	interested bool
+	downloaded int64
+	uploaded   int64
+	choked     bool
+	changes    int // number of times the peer was choked or unchoked
+}
+
+func newFakePeer(name string, interested bool) *fakePeer {
+	return &fakePeer{name: name, interested: interested, choked: true}
+}
+
+func (peer *fakePeer) Interested() bool {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	return peer.interested
+}
+
+func (peer *fakePeer) Transferred() (int64, int64) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	return peer.downloaded, peer.uploaded
+}
+
+func (peer *fakePeer) SetChoked(choked bool) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	peer.choked = choked
+	peer.changes++
+}
+
+// transfer simulates the given amounts of data being received from and sent to the peer.
+func (peer *fakePeer) transfer(downloaded, uploaded int64) {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+
+	peer.downloaded += downloaded
+	peer.uploaded += uploaded
+}
+
+// unchoked returns the names of the unchoked peers, once the choker told them about their state.
+func unchoked(choker *Choker, peers ...*fakePeer) []string {
+	choker.tells.Wait()
+
+	var names []string
+	for _, peer := range peers {
+		peer.mu.Lock()
+		if !peer.choked {
+			names = append(names, peer.name)
+		}
+		peer.mu.Unlock()
+	}
+
+	return names
+}
+
+func TestRechoke(t *testing.T) {
+	/*
+		test cases:
+		1. the peers we download from the fastest get the regular slots
+		2. once seeding, the peers we upload to the fastest get the regular slots
+		3. the optimistic unchoke moves to another interested peer every optimistic interval
+		4. peers that aren't interested stay choked
+		5. peers are only told about changes
+		6. removed peers free their slot and the number of slots can be changed
+	*/
+
+	var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("the peers we download from the fastest get the regular slots", func(t *testing.T) {
+		var choker = New(3)
+		var a, b, c, d = newFakePeer("a", true), newFakePeer("b", true), newFakePeer("c", true), newFakePeer("d", true)
+		for _, peer := range []*fakePeer{a, b, c, d} {
+			choker.addAt(peer, start.Add(-time.Hour))
+		}
+		choker.Rechoke(start, false)
+
+		// c and a give us the most, so they keep their slots whoever holds the optimistic unchoke
+		for i := 1; i <= 3; i++ {
+			a.transfer(5000, 0)
+			b.transfer(1000, 90000)
+			c.transfer(9000, 0)
+			choker.Rechoke(start.Add(time.Duration(i)*RechokeInterval), false)
+			assert.Subset(t, unchoked(choker, a, b, c, d), []string{"a", "c"})
+			assert.Len(t, unchoked(choker, a, b, c, d), 3)
+		}
+
+		// rates are measured over the last interval only
+		b.transfer(100000, 0)
+		choker.Rechoke(start.Add(4*RechokeInterval), false)
+		assert.Contains(t, unchoked(choker, a, b, c, d), "b")
+	})
+
+	t.Run("once seeding, the peers we upload to the fastest get the regular slots", func(t *testing.T) {
+		var choker = New(2)
+		var a, b, c = newFakePeer("a", true), newFakePeer("b", true), newFakePeer("c", true)
+		for _, peer := range []*fakePeer{a, b, c} {
+			choker.addAt(peer, start)
+		}
+
+		a.transfer(9000, 100)
+		b.transfer(0, 5000)
+		c.transfer(0, 100)
+		choker.Rechoke(start.Add(RechokeInterval), true)
+
+		var names = unchoked(choker, a, b, c)
+		assert.Len(t, names, 2)
+		assert.Contains(t, names, "b")
+	})
+
+	t.Run("the optimistic unchoke moves to another interested peer every optimistic interval", func(t *testing.T) {
+		var choker = New(2)
+		var fast, a, b = newFakePeer("fast", true), newFakePeer("a", true), newFakePeer("b", true)
+		for _, peer := range []*fakePeer{fast, a, b} {
+			choker.addAt(peer, start)
+		}
+
+		var optimistic = func() string {
+			var names = unchoked(choker, a, b)
+			assert.Len(t, names, 1)
+			return names[0]
+		}
+
+		fast.transfer(1<<20, 0)
+		choker.Rechoke(start.Add(RechokeInterval), false)
+		assert.Contains(t, unchoked(choker, fast), "fast")
+		var first = optimistic()
+
+		// it stays put in between
+		choker.Rechoke(start.Add(2*RechokeInterval), false)
+		choker.Rechoke(start.Add(3*RechokeInterval), false)
+		assert.Equal(t, first, optimistic())
+
+		choker.Rechoke(start.Add(RechokeInterval+OptimisticInterval), false)
+		assert.NotEqual(t, first, optimistic())
+		assert.Contains(t, unchoked(choker, fast), "fast")
+	})
+
+	t.Run("peers that aren't interested stay choked", func(t *testing.T) {
+		var choker = New(4)
+		var a, b = newFakePeer("a", false), newFakePeer("b", true)
+		choker.addAt(a, start)
+		choker.addAt(b, start)
+
+		a.transfer(1<<20, 0)
+		choker.Rechoke(start.Add(RechokeInterval), false)
+		assert.Equal(t, []string{"b"}, unchoked(choker, a, b))
+	})
+
+	t.Run("peers are only told about changes", func(t *testing.T) {
+		var choker = New(4)
+		var a = newFakePeer("a", true)
+		choker.addAt(a, start)
+
+		choker.Rechoke(start.Add(RechokeInterval), false)
+		choker.Rechoke(start.Add(2*RechokeInterval), false)
+		choker.PeerInterested(a)
+		choker.tells.Wait()
+		assert.Equal(t, 1, a.changes)
+	})
+
+	t.Run("removed peers free their slot and the number of slots can be changed", func(t *testing.T) {
+		var choker = New(2)
+		var a, b, c = newFakePeer("a", true), newFakePeer("b", true), newFakePeer("c", true)
+		for _, peer := range []*fakePeer{a, b, c} {
+			choker.addAt(peer, start)
+		}
+
+		a.transfer(3000, 0)
+		b.transfer(2000, 0)
+		c.transfer(1000, 0)
+		choker.Rechoke(start.Add(RechokeInterval), false)
+		assert.Len(t, unchoked(choker, a, b, c), 2)
+
+		choker.Remove(a)
+		choker.SetSlots(3)
+		assert.Equal(t, 3, choker.Slots())
+		choker.Rechoke(start.Add(2*RechokeInterval), false)
+		assert.Equal(t, []string{"b", "c"}, unchoked(choker, b, c))
+	})
+}
+
+func TestPeerInterested(t *testing.T) {
+	/*
+		test cases:
+		1. interested peers are unchoked right away while a slot is free
+		2. peers the choker doesn't know are left alone
+		3. a peer is told about its changes in the order they were decided
+		4. a stalled peer holds up no other peer
+	*/
+
+	t.Run("interested peers are unchoked right away while a slot is free", func(t *testing.T) {
+		var choker = New(2)
+		var a, b, c = newFakePeer("a", true), newFakePeer("b", true), newFakePeer("c", true)
+		for _, peer := range []*fakePeer{a, b, c} {
+			choker.Add(peer)
+			choker.PeerInterested(peer)
+		}
+
+		assert.Equal(t, []string{"a", "b"}, unchoked(choker, a, b, c))
+	})
+
+	t.Run("peers the choker doesn't know are left alone", func(t *testing.T) {
+		var choker = New(2)
+		var a = newFakePeer("a", true)
+		choker.PeerInterested(a)
+
+		assert.Empty(t, unchoked(choker, a))
+	})
+
+	t.Run("a peer is told about its changes in the order they were decided", func(t *testing.T) {
+		var choker = New(2)
+		var a = &slowPeer{fakePeer: newFakePeer("a", true), gate: make(chan struct{})}
+		choker.Add(a)
+
+		// the peer is still being told it is unchoked when it loses interest and gets choked again
+		choker.PeerInterested(a)
+		assert.Eventually(t, func() bool { return a.waiting.Load() }, time.Second, time.Millisecond)
+
+		a.mu.Lock()
+		a.interested = false
+		a.mu.Unlock()
+		choker.Rechoke(time.Now(), false)
+
+		close(a.gate)
+		assert.Empty(t, unchoked(choker, a.fakePeer))
+		assert.Equal(t, 2, a.changes)
+	})
+
+	t.Run("a stalled peer holds up no other peer", func(t *testing.T) {
+		var choker = New(2)
+		var a = &slowPeer{fakePeer: newFakePeer("a", true), gate: make(chan struct{})}
+		var b = newFakePeer("b", true)
+		choker.Add(a)
+		choker.Add(b)
+
+		choker.Rechoke(time.Now(), false)
+		assert.Eventually(t, func() bool {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			return !b.choked
+		}, time.Second, time.Millisecond)
+
+		close(a.gate)
+		assert.Equal(t, []string{"a", "b"}, unchoked(choker, a.fakePeer, b))
+	})
+}
+
+// slowPeer is a peer whose first SetChoked waits for `gate` to be open.
+type slowPeer struct {
+	*fakePeer
+	gate    chan struct{}
+	waiting atomic.Bool // whether SetChoked was called
+}
+
+func (peer *slowPeer) SetChoked(choked bool) {
+	if !peer.waiting.Swap(true) {
+		<-peer.gate
+	}
+	peer.fakePeer.SetChoked(choked)
+}
@@ -2,6 +2,8 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -10,17 +12,35 @@ import (
 	"github.com/winterrdog/lean-bit-torrent-client/common"
 	"github.com/winterrdog/lean-bit-torrent-client/handshake"
 	"github.com/winterrdog/lean-bit-torrent-client/message"
+	"github.com/winterrdog/lean-bit-torrent-client/mse"
 	"github.com/winterrdog/lean-bit-torrent-client/peers"
+	"github.com/winterrdog/lean-bit-torrent-client/proxy"
+	"github.com/winterrdog/lean-bit-torrent-client/ratelimit"
 )
 
+const (
+	ClientVersion       = "leechy"        // name of the client sent to peers in the extended handshake
+	DefaultRequestQueue = 250             // outstanding requests a peer is assumed to accept unless it says otherwise
+	dialTimeout         = 3 * time.Second // how long connecting to a peer may take, through a proxy included
+)
+
+// ErrUnknownTorrent is returned by Accept when a peer asks for a torrent we don't serve.
+var ErrUnknownTorrent = errors.New("unknown info hash")
+
 // Client represents a BitTorrent client.
 type Client struct {
-	Conn     net.Conn          // connection to the peer
-	Choked   bool              // whether the client is choked by the peer. If true, the client cannot request pieces from the peer
-	Bitfield bitfield.Bitfield // bitfield representing the pieces the client has
-	Peer     peers.Peer        // peer information
-	InfoHash common.Sha1Hash   // infohash of the torrent
-	PeerId   common.Sha1Hash   // peer ID
+	Conn        net.Conn          // connection to the peer
+	Encrypted   bool              // whether the Bittorrent stream on the connection is encrypted with MSE
+	Choked      bool              // whether the client is choked by the peer. If true, the client cannot request pieces from the peer
+	Bitfield    bitfield.Bitfield // bitfield representing the pieces the client has
+	Peer        peers.Peer        // peer information
+	InfoHash    common.Sha1Hash   // infohash of the torrent
+	PeerId      common.Sha1Hash   // peer ID
+	RemoteId    common.Sha1Hash   // peer ID the peer sent in its handshake
+	Extensions  bool              // whether the peer supports the extension protocol (BEP 10)
+	Fast        bool              // whether both sides support the Fast Extension (BEP 6)
+	HaveAll     bool              // whether the peer announced that it has every piece with a 'have all' message
+	MaxRequests int               // number of outstanding requests the peer accepts
 }
 
 // CompleteHandshake performs a complete handshake with a BitTorrent peer.
@@ -36,6 +56,8 @@ func CompleteHandshake(conn *net.Conn, infoHash, peerId *common.Sha1Hash) (*hand
 
 	// send handshake request
 	var req = handshake.New(infoHash, peerId)
+	req.EnableExtensionProtocol()
+	req.EnableFastExtension()
 	var _, err = pConn.Write(req.Serialize())
 	if err != nil {
 		return nil, err
@@ -79,49 +101,247 @@ func RecvBitField(conn *net.Conn) (bitfield.Bitfield, error) {
 	return msg.Payload, nil
 }
 
+// RecvFastBitField receives the first message of a connection on which the Fast Extension was negotiated.
+// Such a peer may announce the pieces it has with a 'have all' or 'have none' message instead of a bitfield.
+// It returns the bitfield payload, if any, and whether the peer has every piece.
+// If an error occurs while reading or if the received message is none of those messages, it returns an error.
+func RecvFastBitField(conn *net.Conn) (bitfield.Bitfield, bool, error) {
+	var pConn = *conn
+
+	pConn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer pConn.SetDeadline(time.Time{}) // disable deadline
+
+	var msg, err = message.Read(pConn)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if msg == nil {
+		return nil, false, fmt.Errorf("expected 'bitfield', 'have-all' or 'have-none' message, got %s", msg.Name())
+	}
+
+	switch msg.Id {
+	case message.MsgBitfield:
+		return msg.Payload, false, nil
+	case message.MsgHaveAll:
+		return nil, true, nil
+	case message.MsgHaveNone:
+		return bitfield.Bitfield{}, false, nil
+	default:
+		return nil, false, fmt.Errorf("expected 'bitfield', 'have-all' or 'have-none' message, got %s", msg.Name())
+	}
+}
+
 // New creates a new client for a BitTorrent peer connection.
 // It takes a `peer` object representing the peer to connect to,
 // `peerId` and `infoHash` representing the peer ID and info hash respectively.
 // It returns a pointer to the created `Client` object and an error, if any.
 // The function establishes a TCP connection with the peer, completes the handshake,
 // receives the bitfield from the peer, and creates the client with the necessary information.
+// The connection is opened with `dialer`, e.g. through a proxy, or directly if it is nil, and encrypted as
+// `policy` tells, see dial.
+// Cancelling `ctx` aborts the dial and the handshake.
 // If any error occurs during the process, the function cleans up and returns the error.
-func New(peer *peers.Peer, peerId, infoHash *common.Sha1Hash) (*Client, error) {
+func New(ctx context.Context, dialer proxy.Dialer, policy mse.Policy, peer *peers.Peer, peerId, infoHash *common.Sha1Hash) (*Client, error) {
 	var bf bitfield.Bitfield
+	var hs *handshake.Handshake
+	var client *Client
+	var fast, haveAll bool
+	var stopClosing func() bool
+
+	if dialer == nil {
+		dialer = proxy.Direct
+	}
 
 	// connect to peer
-	var conn, err = net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	var conn, err = dial(ctx, dialer, policy, peer, *infoHash)
 	if err != nil {
 		return nil, err
 	}
 
+	// unblock the handshake if we're cancelled halfway through it
+	stopClosing = context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClosing()
+
 	// complete handshake
-	_, err = CompleteHandshake(&conn, infoHash, peerId)
+	hs, err = CompleteHandshake(&conn, infoHash, peerId)
 	if err != nil {
 		goto cleanup
 	}
 
 	// receive bitfield from peer to know which pieces it has
-	bf, err = RecvBitField(&conn)
+	fast = hs.SupportsFastExtension()
+	if fast {
+		bf, haveAll, err = RecvFastBitField(&conn)
+	} else {
+		bf, err = RecvBitField(&conn)
+	}
 	if err != nil {
 		goto cleanup
 	}
 
 	// create client for peer connection
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		Peer:     *peer,
-		InfoHash: *infoHash,
-		PeerId:   *peerId,
-	}, nil
+	client = &Client{
+		Conn:        conn,
+		Encrypted:   encrypted(conn),
+		Choked:      true,
+		Bitfield:    bf,
+		Peer:        *peer,
+		InfoHash:    *infoHash,
+		PeerId:      *peerId,
+		RemoteId:    hs.PeerId,
+		Extensions:  hs.SupportsExtensionProtocol(),
+		Fast:        fast,
+		HaveAll:     haveAll,
+		MaxRequests: DefaultRequestQueue,
+	}
+
+	// tell peers that speak the extension protocol about ourselves
+	if client.Extensions {
+		err = client.SendExtendedHandshake()
+		if err != nil {
+			goto cleanup
+		}
+	}
+
+	return client, nil
+
+cleanup:
+	conn.Close()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return nil, err
+}
+
+// dial connects to the peer with `dialer` and encrypts the connection as `policy` tells. If the peer doesn't
+// speak MSE and encryption is only preferred, it connects to the peer again and leaves the connection plaintext.
+// Returns an error if the peer can't be connected to, or if the connection can't be encrypted while encryption
+// is required.
+func dial(ctx context.Context, dialer proxy.Dialer, policy mse.Policy, peer *peers.Peer, infoHash common.Sha1Hash) (net.Conn, error) {
+	var dialCtx, cancelDial = context.WithTimeout(ctx, dialTimeout)
+	var conn, err = dialer.DialContext(dialCtx, "tcp", peer.String())
+	cancelDial()
+	if err != nil || policy == mse.Disabled {
+		return conn, err
+	}
+
+	var encrypted net.Conn
+	encrypted, err = mse.Initiate(ctx, conn, infoHash, policy)
+	if err == nil {
+		return encrypted, nil
+	}
+
+	// the peer may have dropped the connection on not understanding the key exchange
+	conn.Close()
+	if policy == mse.Required || ctx.Err() != nil {
+		return nil, err
+	}
+
+	return dial(ctx, dialer, mse.Disabled, peer, infoHash)
+}
+
+// Accept completes the handshake of a connection a peer opened to us.
+// It reads the peer's handshake and answers it with ours if `lookup` tells that we serve the torrent the peer
+// asks for. `lookup` returns the peer ID we use for the torrent with the given info hash, and false if we
+// don't serve it.
+// Unlike New, it doesn't wait for the peer's bitfield, since a peer without pieces may not send one: the
+// client's Bitfield is left empty for the caller to fill in from the messages that follow.
+// The connection may be one mse.Accept encrypted, which the handshake is then read from.
+// The client's Peer is the address the connection comes from, whose port is not the one the peer listens on.
+// Cancelling `ctx` aborts the handshake.
+// If any error occurs, the connection is closed and the error is returned. It wraps ErrUnknownTorrent if we
+// don't serve the torrent.
+func Accept(ctx context.Context, conn net.Conn, lookup func(infoHash common.Sha1Hash) (common.Sha1Hash, bool)) (*Client, error) {
+	var hs *handshake.Handshake
+	var client *Client
+	var peerId common.Sha1Hash
+	var known bool
+	var reply *handshake.Handshake
+	var err error
+
+	// unblock the handshake if we're cancelled halfway through it
+	var stopClosing = context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClosing()
+
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	// find out which torrent the peer is after
+	hs, err = handshake.Read(conn)
+	if err != nil {
+		goto cleanup
+	}
+
+	peerId, known = lookup(hs.InfoHash)
+	if !known {
+		err = fmt.Errorf("%w %x", ErrUnknownTorrent, hs.InfoHash)
+		goto cleanup
+	}
+
+	reply = handshake.New(&hs.InfoHash, &peerId)
+	reply.EnableExtensionProtocol()
+	reply.EnableFastExtension()
+	_, err = conn.Write(reply.Serialize())
+	if err != nil {
+		goto cleanup
+	}
+
+	client = &Client{
+		Conn:        conn,
+		Encrypted:   encrypted(conn),
+		Choked:      true,
+		Bitfield:    bitfield.Bitfield{},
+		Peer:        remotePeer(conn),
+		InfoHash:    hs.InfoHash,
+		PeerId:      peerId,
+		RemoteId:    hs.PeerId,
+		Extensions:  hs.SupportsExtensionProtocol(),
+		Fast:        hs.SupportsFastExtension(),
+		MaxRequests: DefaultRequestQueue,
+	}
+
+	// tell peers that speak the extension protocol about ourselves
+	if client.Extensions {
+		err = client.SendExtendedHandshake()
+		if err != nil {
+			goto cleanup
+		}
+	}
+
+	return client, nil
 
 cleanup:
 	conn.Close()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
 	return nil, err
 }
 
+// encrypted reports whether the Bittorrent stream on the connection is encrypted, rather than plaintext or
+// only past an MSE handshake that selected plaintext.
+func encrypted(conn net.Conn) bool {
+	var mseConn, ok = conn.(*mse.Conn)
+	return ok && mseConn.Encrypted()
+}
+
+// remotePeer returns the peer at the other end of the connection.
+func remotePeer(conn net.Conn) peers.Peer {
+	var addr, ok = conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return peers.Peer{}
+	}
+
+	return peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+// LimitRate makes the reads and writes on the client's connection go no faster than `limits` and `parents`
+// allow, see ratelimit.Limits.Wrap. It must be called before the connection is used by other goroutines.
+func (client *Client) LimitRate(limits *ratelimit.Limits, parents ...*ratelimit.Limits) {
+	client.Conn = limits.Wrap(client.Conn, parents...)
+}
+
 // Read reads a message from the client's connection.
 // It returns the read message and any error encountered.
 func (client *Client) Read() (*message.Message, error) {
@@ -143,6 +363,47 @@ func (client *Client) SendRequest(index, begin, length int) error {
 	return err
 }
 
+// SendExtendedHandshake sends an extension protocol handshake to the connected peer.
+// It tells the peer the name of our client and how many outstanding requests we accept.
+// Returns an error if there was a problem sending the message.
+func (client *Client) SendExtendedHandshake() error {
+	var msg, err = message.FormatExtendedHandshake(&message.ExtendedHandshake{
+		V:    ClientVersion,
+		Reqq: DefaultRequestQueue,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Conn.Write(msg.Serialize())
+	return err
+}
+
+// HandleExtendedHandshake updates the client with what the peer told us in its extension protocol handshake.
+// It returns an error if the handshake cannot be parsed.
+func (client *Client) HandleExtendedHandshake(msg *message.Message) error {
+	var hs, err = message.ParseExtendedHandshake(msg)
+	if err != nil {
+		return err
+	}
+
+	if hs.Reqq > 0 {
+		client.MaxRequests = hs.Reqq
+	}
+
+	return nil
+}
+
+// SendCancel sends a cancel message for the request with the specified index, begin, and length.
+// It tells the peer that we no longer need the block so that it doesn't waste bandwidth on it.
+// Returns an error if there was a problem sending the message.
+func (client *Client) SendCancel(index, begin, length int) error {
+	var msg = message.FormatCancel(index, begin, length)
+	var _, err = client.Conn.Write(msg.Serialize())
+
+	return err
+}
+
 // SendHave sends a "have" message to the connected peer, indicating
 // that the client has a particular piece of the file.
 // It takes an index parameter specifying the index of the piece.
@@ -183,3 +444,70 @@ func (client *Client) SendUnchoke() error {
 
 	return err
 }
+
+// SendChoke sends a choke message to the connected peer.
+// A choke message is used to inform the peer that its requests will not be answered until it is unchoked.
+// Returns an error if there was a problem sending the message.
+func (client *Client) SendChoke() error {
+	var msg = message.Message{Id: message.MsgChoke}
+	var _, err = client.Conn.Write(msg.Serialize())
+
+	return err
+}
+
+// SendBitfield tells the connected peer which pieces we have.
+// Peers that speak the Fast Extension are sent a 'have all' or 'have none' message instead if we have
+// every piece or none of them. Other peers aren't sent anything if we have no pieces, as the protocol allows.
+// `numPieces` is the number of pieces in the torrent.
+// Returns an error if there was a problem sending the message.
+func (client *Client) SendBitfield(bf bitfield.Bitfield, numPieces int) error {
+	var have int
+	for index := 0; index != numPieces; index++ {
+		if bf.HasPiece(index) {
+			have++
+		}
+	}
+
+	var msg = &message.Message{Id: message.MsgBitfield, Payload: bf}
+	switch {
+	case client.Fast && have == numPieces:
+		msg = &message.Message{Id: message.MsgHaveAll}
+	case client.Fast && have == 0:
+		msg = &message.Message{Id: message.MsgHaveNone}
+	case have == 0:
+		return nil
+	}
+
+	var _, err = client.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendPiece sends the block of data at offset `begin` of the piece at `index` to the connected peer,
+// in answer to its request.
+// Returns an error if there was a problem sending the message.
+func (client *Client) SendPiece(index, begin int, data []byte) error {
+	var msg = message.FormatPiece(index, begin, data)
+	var _, err = client.Conn.Write(msg.Serialize())
+
+	return err
+}
+
+// SendRejectRequest tells the connected peer that its request for the block with the specified index, begin,
+// and length will not be answered. It is only understood by peers that speak the Fast Extension.
+// Returns an error if there was a problem sending the message.
+func (client *Client) SendRejectRequest(index, begin, length int) error {
+	var msg = message.FormatRejectRequest(index, begin, length)
+	var _, err = client.Conn.Write(msg.Serialize())
+
+	return err
+}
+
+// SendKeepAlive sends a keep-alive message, which keeps the peer from dropping a connection we have nothing
+// to send on.
+// Returns an error if there was a problem sending the message.
+func (client *Client) SendKeepAlive() error {
+	var msg *message.Message
+	var _, err = client.Conn.Write(msg.Serialize())
+
+	return err
+}
@@ -1,8 +1,12 @@
 package client
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -10,7 +14,9 @@ import (
 	"github.com/winterrdog/lean-bit-torrent-client/common"
 	"github.com/winterrdog/lean-bit-torrent-client/handshake"
 	"github.com/winterrdog/lean-bit-torrent-client/message"
+	"github.com/winterrdog/lean-bit-torrent-client/mse"
 	"github.com/winterrdog/lean-bit-torrent-client/peers"
+	"github.com/winterrdog/lean-bit-torrent-client/ratelimit"
 )
 
 func createClientAndServer(t *testing.T) (clientConn, serverConn net.Conn) {
@@ -37,6 +43,13 @@ func createClientAndServer(t *testing.T) (clientConn, serverConn net.Conn) {
 	return
 }
 
+// dialerFunc is a dialer calling a function.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (dial dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dial(ctx, network, addr)
+}
+
 func TestNew(t *testing.T) {
 	/*
 		test cases:
@@ -44,6 +57,10 @@ func TestNew(t *testing.T) {
 		2. when a wrong infohash is provided
 		3. when client receives a message that's not a bitfield message
 		4. when fails to connect to peer
+		5. when the context is cancelled during the handshake
+		6. the connection is opened with the given dialer
+		7. the connection is encrypted with peers that speak MSE
+		8. plaintext is fallen back to with peers that don't speak MSE unless encryption is required
 	*/
 
 	// Start a mock server
@@ -106,12 +123,13 @@ func TestNew(t *testing.T) {
 
 		go runServer(listener)
 
-		client, err := New(peer, peerId, infoHash)
+		client, err := New(context.Background(), nil, mse.Disabled, peer, peerId, infoHash)
 		assert.Nil(t, err)
 		assert.Equal(t, expected.Bitfield, client.Bitfield)
 		assert.Equal(t, expected.Peer, client.Peer)
 		assert.Equal(t, expected.InfoHash, client.InfoHash)
 		assert.Equal(t, expected.PeerId, client.PeerId)
+		assert.Equal(t, *peerId, client.RemoteId)
 		assert.Equal(t, expected.Choked, client.Choked)
 
 		// Ensure the goroutine completes
@@ -129,7 +147,7 @@ func TestNew(t *testing.T) {
 			0x16, 0x17, 0x18, 0x19, 0x21,
 		}
 
-		var client, err = New(peer, peerId, wrongInfoHash)
+		var client, err = New(context.Background(), nil, mse.Disabled, peer, peerId, wrongInfoHash)
 		assert.NotNil(t, err)
 		assert.Nil(t, client)
 	})
@@ -171,7 +189,7 @@ func TestNew(t *testing.T) {
 
 		go runServerWithNonBitFieldMsg(listener)
 
-		client, err := New(peer, peerId, infoHash)
+		client, err := New(context.Background(), nil, mse.Disabled, peer, peerId, infoHash)
 		assert.NotNil(t, err)
 		assert.Nil(t, client)
 
@@ -181,8 +199,134 @@ func TestNew(t *testing.T) {
 
 	t.Run("fails to connect to peer", func(t *testing.T) {
 		peer = &peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: 12345}
-		var client, err = New(peer, peerId, infoHash)
+		var client, err = New(context.Background(), nil, mse.Disabled, peer, peerId, infoHash)
+
+		assert.NotNil(t, err)
+		assert.Nil(t, client)
+	})
+
+	t.Run("the context is cancelled during the handshake", func(t *testing.T) {
+		var listener, err = net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer listener.Close()
+
+		// a peer that accepts the connection but never answers the handshake
+		go func() {
+			var serverConn, err = listener.Accept()
+			if err != nil {
+				return
+			}
+			defer serverConn.Close()
+
+			var buf = make([]byte, 68)
+			serverConn.Read(buf)
+			time.Sleep(time.Second)
+		}()
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		peer = &peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+		var start = time.Now()
+		var client *Client
+		client, err = New(ctx, nil, mse.Disabled, peer, peerId, infoHash)
+
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Nil(t, client)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("the connection is opened with the given dialer", func(t *testing.T) {
+		var errUnreachable = errors.New("unreachable")
+		var dialed string
+		var dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var _, hasDeadline = ctx.Deadline()
+			assert.True(t, hasDeadline)
+			dialed = addr
+			return nil, errUnreachable
+		})
+
+		peer = &peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}
+		var client, err = New(context.Background(), dialer, mse.Disabled, peer, peerId, infoHash)
+
+		assert.ErrorIs(t, err, errUnreachable)
+		assert.Nil(t, client)
+		assert.Equal(t, "192.0.2.1:6881", dialed)
+	})
+
+	// servePeer answers the handshake on `conn` with ours and a bitfield, as a peer would
+	var servePeer = func(conn net.Conn) {
+		var buf = make([]byte, 68)
+		var _, err = io.ReadFull(conn, buf)
+		if err != nil || string(buf[:20]) != "\x13BitTorrent protocol" {
+			return
+		}
+
+		conn.Write(handshake.New(infoHash, peerId).Serialize())
+		conn.Write([]byte{0x00, 0x00, 0x00, 0x02, 0x05, 0x80})
+	}
+
+	t.Run("the connection is encrypted with peers that speak MSE", func(t *testing.T) {
+		var listener, err = net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer listener.Close()
+
+		go func() {
+			var serverConn, err = listener.Accept()
+			if err != nil {
+				return
+			}
+			defer serverConn.Close()
+
+			var encrypted net.Conn
+			encrypted, err = mse.Accept(context.Background(), serverConn, mse.Required, func() []common.Sha1Hash {
+				return []common.Sha1Hash{*infoHash}
+			})
+			if err == nil {
+				servePeer(encrypted)
+			}
+		}()
+
+		peer = &peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+		var client *Client
+		client, err = New(context.Background(), nil, mse.Required, peer, peerId, infoHash)
+		require.Nil(t, err)
+		defer client.Conn.Close()
+
+		assert.Equal(t, bitfield.Bitfield{0x80}, client.Bitfield)
+		assert.IsType(t, &mse.Conn{}, client.Conn)
+		assert.True(t, client.Encrypted)
+	})
+
+	t.Run("plaintext is fallen back to with peers that don't speak MSE unless encryption is required", func(t *testing.T) {
+		var listener, err = net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer listener.Close()
+
+		// a plaintext peer, dropping the connections that don't start with a handshake
+		go func() {
+			for {
+				var serverConn, err = listener.Accept()
+				if err != nil {
+					return
+				}
+
+				servePeer(serverConn)
+				serverConn.Close()
+			}
+		}()
+
+		peer = &peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+		var client *Client
+		client, err = New(context.Background(), nil, mse.Preferred, peer, peerId, infoHash)
+		require.Nil(t, err)
+		defer client.Conn.Close()
+
+		assert.Equal(t, bitfield.Bitfield{0x80}, client.Bitfield)
+		assert.IsType(t, &net.TCPConn{}, client.Conn)
+		assert.False(t, client.Encrypted)
 
+		client, err = New(context.Background(), nil, mse.Required, peer, peerId, infoHash)
 		assert.NotNil(t, err)
 		assert.Nil(t, client)
 	})
@@ -526,3 +670,302 @@ func TestSendHave(t *testing.T) {
 		assert.NotNil(t, err)
 	})
 }
+
+func TestHandleExtendedHandshake(t *testing.T) {
+	/*
+		test cases:
+		1. the peer advertises how many requests it accepts
+		2. the peer doesn't advertise how many requests it accepts
+		3. a malformed extended handshake
+	*/
+
+	t.Run("the peer advertises how many requests it accepts", func(t *testing.T) {
+		var client = Client{MaxRequests: DefaultRequestQueue}
+		var msg = &message.Message{Id: message.MsgExtended, Payload: []byte("\x00d1:mde4:reqqi64ee")}
+
+		var err = client.HandleExtendedHandshake(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, 64, client.MaxRequests)
+	})
+
+	t.Run("the peer doesn't advertise how many requests it accepts", func(t *testing.T) {
+		var client = Client{MaxRequests: DefaultRequestQueue}
+		var msg = &message.Message{Id: message.MsgExtended, Payload: []byte("\x00d1:mdee")}
+
+		var err = client.HandleExtendedHandshake(msg)
+		assert.Nil(t, err)
+		assert.Equal(t, DefaultRequestQueue, client.MaxRequests)
+	})
+
+	t.Run("a malformed extended handshake", func(t *testing.T) {
+		var client = Client{MaxRequests: DefaultRequestQueue}
+		var msg = &message.Message{Id: message.MsgExtended, Payload: []byte("\x00d4:reqq")}
+
+		var err = client.HandleExtendedHandshake(msg)
+		assert.NotNil(t, err)
+		assert.Equal(t, DefaultRequestQueue, client.MaxRequests)
+	})
+}
+
+func TestRecvFastBitField(t *testing.T) {
+	/*
+		test cases:
+		1. valid bitfield message
+		2. have all message
+		3. have none message
+		4. read a message that is none of the above
+	*/
+
+	// create client and server connections
+	var clientConn, serverConn = createClientAndServer(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	t.Run("valid bitfield message", func(t *testing.T) {
+		serverConn.Write([]byte{0x00, 0x00, 0x00, 0x03, 0x05, 0x03, 0x02})
+
+		var bf, haveAll, err = RecvFastBitField(&clientConn)
+		assert.Nil(t, err)
+		assert.False(t, haveAll)
+		assert.Equal(t, bitfield.Bitfield{0x03, 0x02}, bf)
+	})
+
+	t.Run("have all message", func(t *testing.T) {
+		serverConn.Write([]byte{0x00, 0x00, 0x00, 0x01, 0x0e})
+
+		var _, haveAll, err = RecvFastBitField(&clientConn)
+		assert.Nil(t, err)
+		assert.True(t, haveAll)
+	})
+
+	t.Run("have none message", func(t *testing.T) {
+		serverConn.Write([]byte{0x00, 0x00, 0x00, 0x01, 0x0f})
+
+		var bf, haveAll, err = RecvFastBitField(&clientConn)
+		assert.Nil(t, err)
+		assert.False(t, haveAll)
+		assert.Empty(t, bf)
+	})
+
+	t.Run("read a message that is none of the above", func(t *testing.T) {
+		serverConn.Write([]byte{0x00, 0x00, 0x00, 0x05, 0x04, 0x00, 0x00, 0x00, 0x3})
+
+		var bf, _, err = RecvFastBitField(&clientConn)
+		assert.NotNil(t, err)
+		assert.Nil(t, bf)
+	})
+}
+
+func TestSendCancel(t *testing.T) {
+	/*
+		test cases:
+		1. server receives a valid cancel message
+		2. connection is closed before sending the message
+	*/
+
+	// create client and server connections
+	var clientConn, serverConn = createClientAndServer(t)
+	defer serverConn.Close()
+
+	t.Run("server receives a valid cancel message", func(t *testing.T) {
+		var client = Client{Conn: clientConn}
+		var err = client.SendCancel(3, 5, 7)
+		assert.Nil(t, err)
+
+		var expected = []byte{0x00, 0x00, 0x00, 0x0d, 0x08, 0x00, 0x00, 0x00, 0x3, 0x00, 0x00, 0x00, 0x5, 0x00, 0x00, 0x00, 0x7}
+		var buf = make([]byte, len(expected))
+		_, err = serverConn.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, buf)
+	})
+
+	t.Run("connection is closed before sending the message", func(t *testing.T) {
+		clientConn.Close()
+		var client = Client{Conn: clientConn}
+		var err = client.SendCancel(3, 5, 7)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestAccept(t *testing.T) {
+	/*
+		test cases:
+		1. accept a peer asking for a torrent we serve
+		2. when the peer asks for a torrent we don't serve
+		3. when the peer doesn't complete its handshake in time
+	*/
+
+	var infoHash = common.Sha1Hash{0x01, 0x02, 0x03}
+	var ourId = common.Sha1Hash{0x04, 0x05, 0x06}
+	var theirId = common.Sha1Hash{0x07, 0x08, 0x09}
+	var lookup = func(hash common.Sha1Hash) (common.Sha1Hash, bool) {
+		return ourId, hash == infoHash
+	}
+
+	t.Run("accept a peer asking for a torrent we serve", func(t *testing.T) {
+		var clientConn, serverConn = createClientAndServer(t)
+		defer clientConn.Close()
+
+		var req = handshake.New(&infoHash, &theirId)
+		req.EnableExtensionProtocol()
+		req.EnableFastExtension()
+		clientConn.Write(req.Serialize())
+
+		var client, err = Accept(context.Background(), serverConn, lookup)
+		require.Nil(t, err)
+		defer client.Conn.Close()
+
+		assert.Equal(t, infoHash, client.InfoHash)
+		assert.Equal(t, ourId, client.PeerId)
+		assert.Equal(t, theirId, client.RemoteId)
+		assert.True(t, client.Extensions)
+		assert.True(t, client.Fast)
+		assert.True(t, client.Choked)
+		assert.Equal(t, uint16(clientConn.LocalAddr().(*net.TCPAddr).Port), client.Peer.Port)
+
+		var reply *handshake.Handshake
+		reply, err = handshake.Read(clientConn)
+		assert.Nil(t, err)
+		assert.Equal(t, infoHash, reply.InfoHash)
+		assert.Equal(t, ourId, reply.PeerId)
+		assert.True(t, reply.SupportsFastExtension())
+
+		// peers speaking the extension protocol hear about us right away
+		var msg *message.Message
+		msg, err = message.Read(clientConn)
+		assert.Nil(t, err)
+		assert.Equal(t, message.MsgExtended, msg.Id)
+	})
+
+	t.Run("when the peer asks for a torrent we don't serve", func(t *testing.T) {
+		var clientConn, serverConn = createClientAndServer(t)
+		defer clientConn.Close()
+
+		clientConn.Write(handshake.New(&common.Sha1Hash{0xff}, &theirId).Serialize())
+
+		var client, err = Accept(context.Background(), serverConn, lookup)
+		assert.ErrorIs(t, err, ErrUnknownTorrent)
+		assert.Nil(t, client)
+
+		// the connection was closed without an answer
+		_, err = clientConn.Read(make([]byte, 1))
+		assert.NotNil(t, err)
+	})
+
+	t.Run("when the peer doesn't complete its handshake in time", func(t *testing.T) {
+		var clientConn, serverConn = createClientAndServer(t)
+		defer clientConn.Close()
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		var _, err = Accept(ctx, serverConn, lookup)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestSendChoke(t *testing.T) {
+	var clientConn, serverConn = createClientAndServer(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	var client = Client{Conn: clientConn}
+	assert.Nil(t, client.SendChoke())
+
+	var msg, err = message.Read(serverConn)
+	assert.Nil(t, err)
+	assert.Equal(t, message.MsgChoke, msg.Id)
+}
+
+func TestSendBitfield(t *testing.T) {
+	/*
+		test cases:
+		1. the pieces we have are sent as a bitfield
+		2. peers speaking the Fast Extension are told about all or none of the pieces with a single message
+		3. other peers aren't sent anything while we have no pieces
+	*/
+
+	var clientConn, serverConn = createClientAndServer(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	var read = func(t *testing.T) *message.Message {
+		var msg, err = message.Read(serverConn)
+		require.Nil(t, err)
+		return msg
+	}
+
+	t.Run("the pieces we have are sent as a bitfield", func(t *testing.T) {
+		var client = Client{Conn: clientConn, Fast: true}
+		assert.Nil(t, client.SendBitfield(bitfield.Bitfield{0xa0}, 3))
+
+		var msg = read(t)
+		assert.Equal(t, message.MsgBitfield, msg.Id)
+		assert.Equal(t, []byte{0xa0}, msg.Payload)
+	})
+
+	t.Run("peers speaking the Fast Extension are told about all or none of the pieces with a single message", func(t *testing.T) {
+		var client = Client{Conn: clientConn, Fast: true}
+		assert.Nil(t, client.SendBitfield(bitfield.NewFull(3), 3))
+		assert.Equal(t, message.MsgHaveAll, read(t).Id)
+
+		assert.Nil(t, client.SendBitfield(bitfield.New(3), 3))
+		assert.Equal(t, message.MsgHaveNone, read(t).Id)
+	})
+
+	t.Run("other peers aren't sent anything while we have no pieces", func(t *testing.T) {
+		var client = Client{Conn: clientConn}
+		assert.Nil(t, client.SendBitfield(bitfield.New(3), 3))
+		assert.Nil(t, client.SendBitfield(bitfield.NewFull(3), 3))
+
+		var msg = read(t)
+		assert.Equal(t, message.MsgBitfield, msg.Id)
+		assert.Equal(t, []byte{0xe0}, msg.Payload)
+	})
+}
+
+func TestSendPiece(t *testing.T) {
+	var clientConn, serverConn = createClientAndServer(t)
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	var client = Client{Conn: clientConn}
+	assert.Nil(t, client.SendPiece(3, 16384, []byte("data")))
+	assert.Nil(t, client.SendRejectRequest(3, 0, 16384))
+	assert.Nil(t, client.SendKeepAlive())
+
+	var msg, err = message.Read(serverConn)
+	assert.Nil(t, err)
+	var index, begin, data, _ = message.ParseBlock(msg)
+	assert.Equal(t, 3, index)
+	assert.Equal(t, 16384, begin)
+	assert.Equal(t, []byte("data"), data)
+
+	msg, err = message.Read(serverConn)
+	assert.Nil(t, err)
+	assert.Equal(t, message.FormatRejectRequest(3, 0, 16384), msg)
+
+	msg, err = message.Read(serverConn)
+	assert.Nil(t, err)
+	assert.Nil(t, msg)
+}
+
+func TestLimitRate(t *testing.T) {
+	var clientConn, serverConn = createClientAndServer(t)
+	defer serverConn.Close()
+
+	var limits = ratelimit.NewLimits(ratelimit.Unlimited, 1000)
+	var client = Client{Conn: clientConn}
+	client.LimitRate(limits, nil)
+	defer client.Conn.Close()
+
+	// with the limiter 100 bytes in debt, the message waits for 100ms
+	limits.Upload.Take(1000 + 100)
+	var start = time.Now()
+	assert.Nil(t, client.SendInterested())
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+	var msg, err = message.Read(serverConn)
+	assert.Nil(t, err)
+	assert.Equal(t, message.MsgInterested, msg.Id)
+}
@@ -0,0 +1,451 @@
+package connmgr
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+var (
+	// ErrSelf is returned for connections whose peer turns out to be ourselves.
+	ErrSelf = errors.New("connected to ourselves")
+
+	// ErrDuplicate is returned for connections to a peer we are connected to already, e.g. under another address.
+	ErrDuplicate = errors.New("already connected to the peer")
+
+	// ErrTooMany is returned for incoming connections beyond the connection limits.
+	ErrTooMany = errors.New("too many connections")
+)
+
+// PeerSource provides peers to connect to, e.g. a tracker.
+type PeerSource interface {
+	// Peers returns the peers the source currently knows about.
+	Peers(ctx context.Context) ([]peers.Peer, error)
+}
+
+// ConnectFunc connects to a peer and keeps the connection going until it ends or `ctx` is cancelled.
+// Until it calls `established` with the peer ID the peer sent in its handshake, the connection counts as
+// half-open. `established` returns ErrSelf if the peer is ourselves and ErrDuplicate if we are connected to
+// the peer already, in which case the connection must be dropped and the error returned.
+// It returns nil if the connection ended because it was no longer needed, or the error that ended it.
+type ConnectFunc func(ctx context.Context, peer peers.Peer, established func(peerId common.Sha1Hash) error) error
+
+// BlockFunc reports whether a peer must not be connected to.
+type BlockFunc func(peer peers.Peer) bool
+
+// RefreshFunc is told what a source returned when it was asked for peers, including the error it failed with.
+type RefreshFunc func(source PeerSource, newPeers []peers.Peer, err error)
+
+// Config controls how the manager keeps peers connected.
+// Zero values are replaced by the values from DefaultConfig.
+type Config struct {
+	TargetPeers     int             // number of connections to keep up, beyond which no connection is opened or accepted
+	MaxHalfOpen     int             // number of connections being opened at once
+	MinBackoff      time.Duration   // time to wait before reconnecting to a peer after its first failure
+	MaxBackoff      time.Duration   // longest time to wait before reconnecting to a failing peer
+	MaxFailures     int             // consecutive failures after which a peer is forgotten
+	RefreshInterval time.Duration   // shortest time between two requests for fresh peers from the sources
+	TickInterval    time.Duration   // how often the manager looks for peers to connect to
+	PeerId          common.Sha1Hash // our own peer ID, which connections to ourselves are told apart by
+	Global          *Limits         // limits shared with other managers, e.g. of every torrent of the client, if set
+	Blocked         BlockFunc       // peers that must not be connected to, e.g. because they are banned, if set
+	Refreshed       RefreshFunc     // told what each source returned when asked for peers, e.g. to report its failures, if set
+}
+
+// DefaultConfig returns the configuration used for the values left out of a Config.
+func DefaultConfig() Config {
+	return Config{
+		TargetPeers:     30,
+		MaxHalfOpen:     8,
+		MinBackoff:      5 * time.Second,
+		MaxBackoff:      5 * time.Minute,
+		MaxFailures:     8,
+		RefreshInterval: time.Minute,
+		TickInterval:    time.Second,
+	}
+}
+
+// withDefaults returns the config with its zero values replaced by the defaults.
+func (config Config) withDefaults() Config {
+	var defaults = DefaultConfig()
+
+	if config.TargetPeers <= 0 {
+		config.TargetPeers = defaults.TargetPeers
+	}
+	if config.MaxHalfOpen <= 0 {
+		config.MaxHalfOpen = defaults.MaxHalfOpen
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaults.MinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaults.MaxBackoff
+	}
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = defaults.MaxFailures
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = defaults.RefreshInterval
+	}
+	if config.TickInterval <= 0 {
+		config.TickInterval = defaults.TickInterval
+	}
+
+	return config
+}
+
+// peerState is what the manager remembers about a peer.
+type peerState struct {
+	peer        peers.Peer
+	connected   bool            // whether a connection to the peer is up or being opened
+	halfOpen    bool            // whether the connection to the peer is being opened
+	peerId      common.Sha1Hash // peer ID of the peer, once a connection was established
+	successes   int             // connections to the peer that were established
+	failures    int             // consecutive failed connections to the peer
+	nextAttempt time.Time       // earliest time to connect to the peer again
+}
+
+// before reports whether the manager connects to the peer before the `other` one: peers we connected to more
+// often come first, then peers that failed less often.
+func (state *peerState) before(other *peerState) bool {
+	if state.successes != other.successes {
+		return state.successes > other.successes
+	}
+
+	if state.failures != other.failures {
+		return state.failures < other.failures
+	}
+
+	return state.peer.String() < other.peer.String()
+}
+
+// Manager keeps a target number of peers connected.
+// Peers that connections were established to before are connected to first, and no more than MaxHalfOpen
+// connections are opened at once. Connections that fail are retried with exponential backoff, and the peer
+// sources are asked for fresh peers whenever fewer peers than the target are connected. Connections to
+// ourselves and second connections to a peer are dropped by peer ID.
+// It is safe for concurrent use.
+type Manager struct {
+	mu          sync.Mutex
+	config      Config
+	connect     ConnectFunc
+	sources     []PeerSource
+	peers       map[string]*peerState        // keyed by the peer's address
+	ignored     map[string]struct{}          // addresses that turned out to be our own, never connected to again
+	peerIds     map[common.Sha1Hash]struct{} // peer IDs of the established connections, incoming ones included
+	active      int                          // number of connections that are up or being opened, incoming ones included
+	halfOpen    int                          // number of connections being opened
+	refreshing  bool                         // whether the sources are being asked for peers
+	lastRefresh time.Time                    // when the sources were last asked for peers
+	wake        chan struct{}                // nudges the manager to look for peers to connect to
+	running     sync.WaitGroup               // connections and refreshes that haven't returned yet
+	now         func() time.Time             // tells the time, replaced by tests
+}
+
+// New creates a manager that connects to peers with `connect` and asks `sources` for more peers.
+func New(config Config, connect ConnectFunc, sources ...PeerSource) *Manager {
+	return &Manager{
+		config:  config.withDefaults(),
+		connect: connect,
+		sources: sources,
+		peers:   make(map[string]*peerState),
+		ignored: make(map[string]struct{}),
+		peerIds: make(map[common.Sha1Hash]struct{}),
+		wake:    make(chan struct{}, 1),
+		now:     time.Now,
+	}
+}
+
+// backoff returns how long to wait before connecting to a peer that failed `failures` times in a row.
+// The wait doubles with every failure, starting at MinBackoff and capped at MaxBackoff.
+func (config *Config) backoff(failures int) time.Duration {
+	var wait = config.MinBackoff
+	for i := 1; i < failures && wait < config.MaxBackoff; i++ {
+		wait *= 2
+	}
+
+	return min(wait, config.MaxBackoff)
+}
+
+// AddPeers adds peers for the manager to connect to. Peers it already knows are ignored, and so are the
+// addresses that turned out to be our own and the peers the config blocks.
+func (manager *Manager) AddPeers(newPeers []peers.Peer) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	for _, peer := range newPeers {
+		var addr = peer.String()
+		if _, ignored := manager.ignored[addr]; ignored || manager.peers[addr] != nil || manager.blocked(peer) {
+			continue
+		}
+
+		manager.peers[addr] = &peerState{peer: peer}
+	}
+
+	manager.nudge()
+}
+
+// NumActive returns the number of connections that are up or being opened, incoming ones included.
+func (manager *Manager) NumActive() int {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	return manager.active
+}
+
+// NumHalfOpen returns the number of connections being opened.
+func (manager *Manager) NumHalfOpen() int {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	return manager.halfOpen
+}
+
+// NumKnown returns the number of peers the manager knows about, connected or not.
+func (manager *Manager) NumKnown() int {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	return len(manager.peers)
+}
+
+// nudge wakes the manager up without blocking.
+func (manager *Manager) nudge() {
+	select {
+	case manager.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run connects to peers until `ctx` is cancelled.
+// Cancelling `ctx` also cancels the connections that are up, and Run only returns once all of them have ended.
+func (manager *Manager) Run(ctx context.Context) {
+	defer manager.running.Wait()
+
+	var ticker = time.NewTicker(manager.config.TickInterval)
+	defer ticker.Stop()
+
+	// the peers we were started with are as fresh as it gets
+	manager.mu.Lock()
+	if len(manager.peers) != 0 {
+		manager.lastRefresh = manager.now()
+	}
+	manager.mu.Unlock()
+
+	for {
+		manager.tick(ctx, manager.now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-manager.wake:
+		}
+	}
+}
+
+// tick starts connections to the peers that are due, best ones first, up to the target and as long as
+// connections can be opened without going over the limits. It asks the sources for fresh peers if the
+// target can't be met.
+func (manager *Manager) tick(ctx context.Context, now time.Time) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	var due []*peerState
+	for addr, state := range manager.peers {
+		if state.connected {
+			continue
+		}
+
+		// peers may be blocked after they were added
+		if manager.blocked(state.peer) {
+			delete(manager.peers, addr)
+			continue
+		}
+
+		if !now.Before(state.nextAttempt) {
+			due = append(due, state)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].before(due[j]) })
+
+	for _, state := range due {
+		if manager.active >= manager.config.TargetPeers || manager.halfOpen >= manager.config.MaxHalfOpen {
+			break
+		}
+
+		if !manager.config.Global.dial() {
+			break
+		}
+
+		state.connected = true
+		state.halfOpen = true
+		manager.active++
+		manager.halfOpen++
+		manager.running.Add(1)
+		go manager.run(ctx, state)
+	}
+
+	if manager.active >= manager.config.TargetPeers {
+		return
+	}
+
+	if manager.refreshing || now.Sub(manager.lastRefresh) < manager.config.RefreshInterval || len(manager.sources) == 0 {
+		return
+	}
+
+	manager.refreshing = true
+	manager.lastRefresh = now
+	manager.running.Add(1)
+	go manager.refresh(ctx)
+}
+
+// run runs a connection to the peer and schedules the next one once it ends.
+func (manager *Manager) run(ctx context.Context, state *peerState) {
+	defer manager.running.Done()
+
+	var err = manager.connect(ctx, state.peer, func(peerId common.Sha1Hash) error {
+		return manager.establish(state, peerId)
+	})
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	state.connected = false
+	manager.active--
+	manager.config.Global.release(state.halfOpen)
+	if state.halfOpen {
+		state.halfOpen = false
+		manager.halfOpen--
+	} else {
+		delete(manager.peerIds, state.peerId)
+	}
+
+	if errors.Is(err, ErrSelf) {
+		delete(manager.peers, state.peer.String())
+		manager.ignored[state.peer.String()] = struct{}{}
+	} else if err == nil {
+		state.failures = 0
+		state.nextAttempt = manager.now().Add(manager.config.MinBackoff)
+	} else {
+		state.failures++
+		state.nextAttempt = manager.now().Add(manager.config.backoff(state.failures))
+
+		if state.failures >= manager.config.MaxFailures {
+			delete(manager.peers, state.peer.String())
+		}
+	}
+
+	manager.nudge()
+}
+
+// blocked reports whether the config blocks the peer.
+func (manager *Manager) blocked(peer peers.Peer) bool {
+	return manager.config.Blocked != nil && manager.config.Blocked(peer)
+}
+
+// establish records that the connection to the peer is up, unless the peer is ourselves or we are connected
+// to it already.
+// Returns ErrSelf or ErrDuplicate if the connection must be dropped.
+func (manager *Manager) establish(state *peerState, peerId common.Sha1Hash) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	var err = manager.admit(peerId)
+	if err != nil {
+		return err
+	}
+
+	state.halfOpen = false
+	state.peerId = peerId
+	state.successes++
+	manager.halfOpen--
+	manager.peerIds[peerId] = struct{}{}
+	manager.config.Global.establish()
+
+	// another connection can be opened in its place
+	manager.nudge()
+	return nil
+}
+
+// admit checks that a connection to the peer with the given ID can be kept.
+// Returns ErrSelf if the peer is ourselves, or ErrDuplicate if we are connected to it already.
+// The caller must hold the manager's lock.
+func (manager *Manager) admit(peerId common.Sha1Hash) error {
+	if peerId == manager.config.PeerId && peerId != (common.Sha1Hash{}) {
+		return ErrSelf
+	}
+
+	if _, connected := manager.peerIds[peerId]; connected {
+		return ErrDuplicate
+	}
+
+	return nil
+}
+
+// Accept counts a connection a peer opened to us towards the limits, once its handshake told the peer's ID.
+// It returns the function to call once the connection ended, which may be called more than once.
+// Returns ErrSelf if the peer is ourselves, ErrDuplicate if we are connected to it already, or ErrTooMany
+// if the manager already has TargetPeers connections or the global limits are reached.
+func (manager *Manager) Accept(peerId common.Sha1Hash) (func(), error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	var err = manager.admit(peerId)
+	if err != nil {
+		return nil, err
+	}
+
+	if manager.active >= manager.config.TargetPeers || !manager.config.Global.accept() {
+		return nil, ErrTooMany
+	}
+
+	manager.active++
+	manager.peerIds[peerId] = struct{}{}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			manager.mu.Lock()
+			defer manager.mu.Unlock()
+
+			manager.active--
+			delete(manager.peerIds, peerId)
+			manager.config.Global.release(false)
+			manager.nudge()
+		})
+	}, nil
+}
+
+// refresh asks every source for peers and adds them, then tells the config's Refreshed what each one returned.
+func (manager *Manager) refresh(ctx context.Context) {
+	defer manager.running.Done()
+
+	for _, source := range manager.sources {
+		var newPeers, err = source.Peers(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err == nil {
+			manager.AddPeers(newPeers)
+		}
+
+		if manager.config.Refreshed != nil {
+			manager.config.Refreshed(source, newPeers, err)
+		}
+	}
+
+	manager.mu.Lock()
+	manager.refreshing = false
+	manager.mu.Unlock()
+}
@@ -0,0 +1,476 @@
+package connmgr
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+// fakeSource is a peer source handing out a fixed list of peers.
+type fakeSource struct {
+	mu    sync.Mutex
+	peers []peers.Peer
+	err   error // returned instead of the peers, if set
+	calls int
+}
+
+func (source *fakeSource) Peers(ctx context.Context) ([]peers.Peer, error) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	source.calls++
+	if source.err != nil {
+		return nil, source.err
+	}
+
+	return source.peers, nil
+}
+
+func (source *fakeSource) numCalls() int {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	return source.calls
+}
+
+// testConfig returns a config with intervals short enough for tests.
+func testConfig() Config {
+	return Config{
+		TargetPeers:     2,
+		MinBackoff:      10 * time.Millisecond,
+		MaxBackoff:      40 * time.Millisecond,
+		MaxFailures:     100,
+		RefreshInterval: 20 * time.Millisecond,
+		TickInterval:    5 * time.Millisecond,
+	}
+}
+
+// tickAt moves the manager's clock to `now` and has it look for peers to connect to, as Run does on every tick.
+func tickAt(ctx context.Context, manager *Manager, now time.Time) {
+	manager.mu.Lock()
+	manager.now = func() time.Time { return now }
+	manager.mu.Unlock()
+
+	manager.tick(ctx, now)
+}
+
+func testPeer(port uint16) peers.Peer {
+	return peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: port}
+}
+
+func TestBackoff(t *testing.T) {
+	var config = testConfig()
+
+	assert.Equal(t, 10*time.Millisecond, config.backoff(1))
+	assert.Equal(t, 20*time.Millisecond, config.backoff(2))
+	assert.Equal(t, 40*time.Millisecond, config.backoff(3))
+	assert.Equal(t, 40*time.Millisecond, config.backoff(30))
+}
+
+func TestWithDefaults(t *testing.T) {
+	var config = Config{TargetPeers: 5}.withDefaults()
+	var expected = DefaultConfig()
+	expected.TargetPeers = 5
+
+	assert.Equal(t, expected, config)
+}
+
+func TestManager(t *testing.T) {
+	/*
+		test cases:
+		1. a failing peer is retried with backoff until it connects
+		2. peers that keep failing are forgotten
+		3. the sources are asked for fresh peers when too few are connected
+		4. no more than the target number of peers are connected at once
+		5. cancelling the context ends the connections before Run returns
+		6. no more than MaxHalfOpen connections are opened at once
+		7. peers that were connected before are connected to first
+		8. connections to ourselves are dropped and their address is never tried again
+		9. second connections to a peer are dropped, incoming ones included
+		10. incoming connections count towards the target
+		11. blocked peers are never connected to
+		12. what the sources return is reported, failures included
+	*/
+
+	var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("a failing peer is retried with backoff until it connects", func(t *testing.T) {
+		var attempts atomic.Int32
+		var manager = New(testConfig(), func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			if attempts.Add(1) < 4 {
+				return fmt.Errorf("connection refused")
+			}
+
+			return nil
+		})
+		manager.AddPeers([]peers.Peer{testPeer(1)})
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		// waits of 10ms, 20ms and 40ms between the attempts
+		for _, step := range []struct {
+			elapsed  time.Duration
+			attempts int32
+		}{{0, 1}, {9 * time.Millisecond, 1}, {10 * time.Millisecond, 2}, {29 * time.Millisecond, 2},
+			{30 * time.Millisecond, 3}, {69 * time.Millisecond, 3}, {70 * time.Millisecond, 4}} {
+			tickAt(ctx, manager, start.Add(step.elapsed))
+			manager.running.Wait()
+			assert.Equal(t, step.attempts, attempts.Load(), step.elapsed)
+		}
+	})
+
+	t.Run("peers that keep failing are forgotten", func(t *testing.T) {
+		var config = testConfig()
+		config.MaxFailures = 2
+
+		var manager = New(config, func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			return fmt.Errorf("connection refused")
+		})
+		manager.AddPeers([]peers.Peer{testPeer(1)})
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		tickAt(ctx, manager, start)
+		manager.running.Wait()
+		assert.Equal(t, 1, manager.NumKnown())
+
+		tickAt(ctx, manager, start.Add(config.MinBackoff))
+		manager.running.Wait()
+		assert.Equal(t, 0, manager.NumKnown())
+	})
+
+	t.Run("the sources are asked for fresh peers when too few are connected", func(t *testing.T) {
+		var source = &fakeSource{peers: []peers.Peer{testPeer(1), testPeer(2)}}
+
+		var config = testConfig()
+		var refreshed = make(chan struct{}, 10)
+		config.Refreshed = func(PeerSource, []peers.Peer, error) { refreshed <- struct{}{} }
+
+		var manager = New(config, func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			<-ctx.Done()
+			return nil
+		}, source)
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		tickAt(ctx, manager, start)
+		<-refreshed
+		tickAt(ctx, manager, start.Add(time.Millisecond))
+		assert.Equal(t, 2, manager.NumActive())
+
+		// with the target met, the sources are left alone
+		tickAt(ctx, manager, start.Add(5*config.RefreshInterval))
+		assert.Equal(t, 1, source.numCalls())
+		assert.Empty(t, refreshed)
+	})
+
+	t.Run("no more than the target number of peers are connected at once", func(t *testing.T) {
+		var manager = New(testConfig(), func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			<-ctx.Done()
+			return nil
+		})
+		manager.AddPeers([]peers.Peer{testPeer(1), testPeer(2), testPeer(3), testPeer(1)})
+		assert.Equal(t, 3, manager.NumKnown())
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		tickAt(ctx, manager, start)
+		assert.Equal(t, 2, manager.NumActive())
+		tickAt(ctx, manager, start.Add(time.Second))
+		assert.Equal(t, 2, manager.NumActive())
+	})
+
+	t.Run("cancelling the context ends the connections before Run returns", func(t *testing.T) {
+		var started = make(chan struct{}, 2)
+		var closing = make(chan struct{})
+		var ended atomic.Int32
+
+		var manager = New(testConfig(), func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			<-closing // closing the connection takes a moment
+			ended.Add(1)
+			return ctx.Err()
+		})
+		manager.AddPeers([]peers.Peer{testPeer(1), testPeer(2)})
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		var returned = make(chan struct{})
+		go func() {
+			manager.Run(ctx)
+			close(returned)
+		}()
+
+		<-started
+		<-started
+		cancel()
+		close(closing)
+		<-returned
+
+		assert.Equal(t, int32(2), ended.Load())
+		assert.Equal(t, 0, manager.NumActive())
+	})
+
+	t.Run("no more than MaxHalfOpen connections are opened at once", func(t *testing.T) {
+		var config = testConfig()
+		config.TargetPeers = 4
+		config.MaxHalfOpen = 2
+
+		// connections hang in the handshake until told to go on
+		var proceed = make(chan struct{})
+		var up = make(chan struct{}, 4)
+		var manager = New(config, func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			select {
+			case <-proceed:
+			case <-ctx.Done():
+				return nil
+			}
+
+			var err = established(common.Sha1Hash{byte(peer.Port)})
+			if err != nil {
+				return err
+			}
+
+			up <- struct{}{}
+			<-ctx.Done()
+			return nil
+		})
+		manager.AddPeers([]peers.Peer{testPeer(1), testPeer(2), testPeer(3), testPeer(4)})
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		tickAt(ctx, manager, start)
+		tickAt(ctx, manager, start.Add(time.Millisecond))
+		assert.Equal(t, 2, manager.NumHalfOpen())
+		assert.Equal(t, 2, manager.NumActive())
+
+		// established connections make room for the next ones
+		proceed <- struct{}{}
+		proceed <- struct{}{}
+		<-up
+		<-up
+		tickAt(ctx, manager, start.Add(2*time.Millisecond))
+		assert.Equal(t, 4, manager.NumActive())
+		assert.Equal(t, 2, manager.NumHalfOpen())
+	})
+
+	t.Run("peers that were connected before are connected to first", func(t *testing.T) {
+		var config = testConfig()
+		config.TargetPeers = 1
+
+		var connected = make(chan uint16, 1)
+		var manager = New(config, func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			connected <- peer.Port
+			<-ctx.Done()
+			return nil
+		})
+		manager.AddPeers([]peers.Peer{testPeer(1), testPeer(2), testPeer(3), testPeer(4)})
+
+		var stateOf = func(port uint16) *peerState {
+			var peer = testPeer(port)
+			return manager.peers[peer.String()]
+		}
+
+		// the fourth peer never connected, the first one failed last time, the others were connected to before
+		stateOf(1).successes = 3
+		stateOf(1).failures = 1
+		stateOf(2).successes = 1
+		stateOf(3).successes = 3
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		var order []uint16
+		for range 4 {
+			manager.tick(ctx, time.Now())
+			var port = <-connected
+			order = append(order, port)
+
+			// makes room for the next peer, while the connected ones stay out of the running
+			manager.mu.Lock()
+			manager.active--
+			manager.halfOpen--
+			manager.mu.Unlock()
+		}
+
+		assert.Equal(t, []uint16{3, 1, 2, 4}, order)
+	})
+
+	t.Run("connections to ourselves are dropped and their address is never tried again", func(t *testing.T) {
+		var config = testConfig()
+		config.PeerId = common.Sha1Hash{0xaa}
+
+		var mu sync.Mutex
+		var results = make(map[uint16][]error)
+		var manager = New(config, func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			var peerId = common.Sha1Hash{byte(peer.Port)}
+			if peer.Port == 1 {
+				peerId = config.PeerId
+			}
+
+			var err = established(peerId)
+			mu.Lock()
+			results[peer.Port] = append(results[peer.Port], err)
+			mu.Unlock()
+			return err
+		})
+		manager.AddPeers([]peers.Peer{testPeer(1), testPeer(2)})
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		tickAt(ctx, manager, start)
+		manager.running.Wait()
+		assert.Equal(t, 1, manager.NumKnown())
+		manager.AddPeers([]peers.Peer{testPeer(1)})
+		assert.Equal(t, 1, manager.NumKnown())
+
+		tickAt(ctx, manager, start.Add(5*config.MaxBackoff))
+		manager.running.Wait()
+		assert.Equal(t, []error{ErrSelf}, results[1])
+		assert.Equal(t, []error{nil, nil}, results[2])
+	})
+
+	t.Run("second connections to a peer are dropped, incoming ones included", func(t *testing.T) {
+		var config = testConfig()
+		config.TargetPeers = 3
+
+		var duplicates = make(chan error, 10)
+		var manager = New(config, func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			// both addresses are the same peer
+			var err = established(common.Sha1Hash{0x01})
+			if err != nil {
+				duplicates <- err
+				return err
+			}
+
+			<-ctx.Done()
+			return nil
+		})
+		manager.AddPeers([]peers.Peer{testPeer(1), testPeer(2)})
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		go manager.Run(ctx)
+
+		select {
+		case err := <-duplicates:
+			assert.ErrorIs(t, err, ErrDuplicate)
+		case <-time.After(2 * time.Second):
+			t.Fatal("the second connection to the peer wasn't dropped")
+		}
+
+		var _, err = manager.Accept(common.Sha1Hash{0x01})
+		assert.ErrorIs(t, err, ErrDuplicate)
+
+		var release func()
+		release, err = manager.Accept(common.Sha1Hash{0x02})
+		require.Nil(t, err)
+		release()
+	})
+
+	t.Run("incoming connections count towards the target", func(t *testing.T) {
+		var config = testConfig()
+		config.PeerId = common.Sha1Hash{0xaa}
+		var manager = New(config, nil)
+
+		var _, err = manager.Accept(config.PeerId)
+		assert.ErrorIs(t, err, ErrSelf)
+
+		var first, second func()
+		first, err = manager.Accept(common.Sha1Hash{0x01})
+		require.Nil(t, err)
+		second, err = manager.Accept(common.Sha1Hash{0x02})
+		require.Nil(t, err)
+		assert.Equal(t, 2, manager.NumActive())
+
+		_, err = manager.Accept(common.Sha1Hash{0x03})
+		assert.ErrorIs(t, err, ErrTooMany)
+
+		// releasing twice counts once
+		first()
+		first()
+		assert.Equal(t, 1, manager.NumActive())
+		second()
+		assert.Equal(t, 0, manager.NumActive())
+	})
+
+	t.Run("blocked peers are never connected to", func(t *testing.T) {
+		var blocked sync.Map
+		blocked.Store(testPeer(1).Port, true)
+
+		var config = testConfig()
+		config.Blocked = func(peer peers.Peer) bool {
+			var _, ok = blocked.Load(peer.Port)
+			return ok
+		}
+
+		var connected = make(chan uint16, 10)
+		var manager = New(config, func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			connected <- peer.Port
+			return fmt.Errorf("connection refused")
+		})
+		manager.AddPeers([]peers.Peer{testPeer(1), testPeer(2)})
+		assert.Equal(t, 1, manager.NumKnown())
+
+		// the second peer gets blocked once known
+		blocked.Store(testPeer(2).Port, true)
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		tickAt(ctx, manager, start)
+		manager.running.Wait()
+		assert.Equal(t, 0, manager.NumKnown())
+		assert.Empty(t, connected)
+	})
+
+	t.Run("what the sources return is reported, failures included", func(t *testing.T) {
+		var working = &fakeSource{peers: []peers.Peer{testPeer(1)}}
+		var failing = &fakeSource{err: fmt.Errorf("tracker unreachable")}
+
+		type refresh struct {
+			source   PeerSource
+			newPeers []peers.Peer
+			err      error
+		}
+		var refreshes = make(chan refresh, 10)
+
+		var config = testConfig()
+		config.Refreshed = func(source PeerSource, newPeers []peers.Peer, err error) {
+			select {
+			case refreshes <- refresh{source, newPeers, err}:
+			default:
+			}
+		}
+
+		var manager = New(config, func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			<-ctx.Done()
+			return nil
+		}, working, failing)
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		go manager.Run(ctx)
+
+		var first, second = <-refreshes, <-refreshes
+		assert.Equal(t, refresh{working, working.peers, nil}, first)
+		assert.Equal(t, PeerSource(failing), second.source)
+		assert.Empty(t, second.newPeers)
+		assert.EqualError(t, second.err, "tracker unreachable")
+	})
+}
@@ -0,0 +1,123 @@
+package connmgr
+
+import "sync"
+
+// DefaultMaxConnections and DefaultMaxHalfOpen are the limits NewLimits uses for the ones it isn't given.
+const (
+	DefaultMaxConnections = 200
+	DefaultMaxHalfOpen    = 16
+)
+
+// Limits caps the connections of several managers together, e.g. of every torrent of the client: the
+// connections that are up or being opened, incoming ones included, and the connections being opened.
+// A nil Limits doesn't cap anything. It is safe for concurrent use.
+type Limits struct {
+	mu             sync.Mutex
+	maxConnections int
+	maxHalfOpen    int
+	connections    int // connections that are up or being opened
+	halfOpen       int // connections being opened
+}
+
+// NewLimits creates limits allowing `maxConnections` connections and `maxHalfOpen` connections being opened
+// at once. Limits that aren't positive use DefaultMaxConnections and DefaultMaxHalfOpen.
+func NewLimits(maxConnections, maxHalfOpen int) *Limits {
+	if maxConnections <= 0 {
+		maxConnections = DefaultMaxConnections
+	}
+	if maxHalfOpen <= 0 {
+		maxHalfOpen = DefaultMaxHalfOpen
+	}
+
+	return &Limits{maxConnections: maxConnections, maxHalfOpen: maxHalfOpen}
+}
+
+// numConnections returns the number of connections that are up or being opened, and the number of
+// connections being opened.
+func (limits *Limits) numConnections() (int, int) {
+	if limits == nil {
+		return 0, 0
+	}
+
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	return limits.connections, limits.halfOpen
+}
+
+// Accept counts a connection a peer opened to us, if it doesn't go over the limits.
+// It returns the function to call once the connection ended, which may be called more than once, and false
+// if the connection goes over the limits and must be dropped.
+func (limits *Limits) Accept() (func(), bool) {
+	if !limits.accept() {
+		return nil, false
+	}
+
+	var once sync.Once
+	return func() { once.Do(func() { limits.release(false) }) }, true
+}
+
+// dial counts a connection being opened, if it doesn't go over the limits.
+// It reports whether the connection can be opened.
+func (limits *Limits) dial() bool {
+	if limits == nil {
+		return true
+	}
+
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	if limits.connections >= limits.maxConnections || limits.halfOpen >= limits.maxHalfOpen {
+		return false
+	}
+
+	limits.connections++
+	limits.halfOpen++
+	return true
+}
+
+// establish records that a connection counted by dial is up.
+func (limits *Limits) establish() {
+	if limits == nil {
+		return
+	}
+
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	limits.halfOpen--
+}
+
+// accept counts a connection that is up, if it doesn't go over the limits.
+// It reports whether the connection can be kept.
+func (limits *Limits) accept() bool {
+	if limits == nil {
+		return true
+	}
+
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	if limits.connections >= limits.maxConnections {
+		return false
+	}
+
+	limits.connections++
+	return true
+}
+
+// release records that a connection counted by dial or accept ended, which was still being opened if
+// `halfOpen` is set.
+func (limits *Limits) release(halfOpen bool) {
+	if limits == nil {
+		return
+	}
+
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	limits.connections--
+	if halfOpen {
+		limits.halfOpen--
+	}
+}
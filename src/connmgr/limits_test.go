@@ -0,0 +1,102 @@
+package connmgr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+func TestLimits(t *testing.T) {
+	/*
+		test cases:
+		1. connections beyond the limits are refused until others end
+		2. managers sharing limits stay within them together
+		3. nil limits don't cap anything
+	*/
+
+	t.Run("connections beyond the limits are refused until others end", func(t *testing.T) {
+		var limits = NewLimits(3, 2)
+
+		assert.True(t, limits.dial())
+		assert.True(t, limits.dial())
+		assert.False(t, limits.dial(), "too many half-open connections")
+
+		limits.establish()
+		var release, ok = limits.Accept()
+		require.True(t, ok)
+		assert.False(t, limits.dial(), "too many connections")
+		var _, accepted = limits.Accept()
+		assert.False(t, accepted)
+
+		var connections, halfOpen = limits.numConnections()
+		assert.Equal(t, 3, connections)
+		assert.Equal(t, 1, halfOpen)
+
+		release()
+		release()
+		limits.release(true)
+		connections, halfOpen = limits.numConnections()
+		assert.Equal(t, 1, connections)
+		assert.Equal(t, 0, halfOpen)
+		assert.True(t, limits.dial())
+	})
+
+	t.Run("managers sharing limits stay within them together", func(t *testing.T) {
+		var config = testConfig()
+		config.TargetPeers = 5
+		config.Global = NewLimits(3, 3)
+
+		var connect = func(ctx context.Context, peer peers.Peer, established func(common.Sha1Hash) error) error {
+			var err = established(common.Sha1Hash{byte(peer.Port)})
+			if err != nil {
+				return err
+			}
+
+			<-ctx.Done()
+			return nil
+		}
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		var first, second = New(config, connect), New(config, connect)
+		first.AddPeers([]peers.Peer{testPeer(1), testPeer(2), testPeer(3)})
+		second.AddPeers([]peers.Peer{testPeer(4), testPeer(5), testPeer(6)})
+
+		var now = time.Now()
+		for range 2 {
+			tickAt(ctx, first, now)
+			tickAt(ctx, second, now)
+			now = now.Add(time.Second)
+		}
+
+		var connections, _ = config.Global.numConnections()
+		assert.Equal(t, 3, connections)
+		assert.Equal(t, 3, first.NumActive()+second.NumActive())
+
+		var _, err = first.Accept(common.Sha1Hash{0x10})
+		assert.ErrorIs(t, err, ErrTooMany)
+	})
+
+	t.Run("nil limits don't cap anything", func(t *testing.T) {
+		var limits *Limits
+		for i := 0; i < 1000; i++ {
+			assert.True(t, limits.dial())
+		}
+		limits.establish()
+		limits.release(true)
+
+		var release, ok = limits.Accept()
+		assert.True(t, ok)
+		release()
+
+		var connections, halfOpen = limits.numConnections()
+		assert.Equal(t, 0, connections)
+		assert.Equal(t, 0, halfOpen)
+	})
+}
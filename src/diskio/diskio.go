@@ -0,0 +1,367 @@
+package diskio
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+// MaxCoalesce is the most bytes of adjacent pieces written to the storage at once.
+const MaxCoalesce = 4 << 20
+
+// ErrClosed is returned when pieces are written to a closed disk.
+var ErrClosed = errors.New("disk is closed")
+
+// SyncPolicy tells when the storage is asked to flush what has been written to it.
+type SyncPolicy int
+
+const (
+	SyncOnClose    SyncPolicy = iota // only when the disk is flushed or closed
+	SyncOnWrite                      // after every write, which is the safest and the slowest
+	SyncOnInterval                   // after a write once Config.SyncInterval went by since the last flush
+)
+
+// Config controls how pieces are written to the storage.
+// Zero values are replaced by the values from DefaultConfig.
+type Config struct {
+	Workers      int           // number of goroutines writing to the storage
+	CacheSize    int           // most bytes of pieces waiting to be written before writers are made to wait
+	Sync         SyncPolicy    // when the storage is flushed
+	SyncInterval time.Duration // shortest time between two flushes with SyncOnInterval
+
+	// Release is called with the data of every piece once the disk is done with it, whether it was written or
+	// not, so that its buffer can be reused. It is called with the disk's lock held, so it must return quickly.
+	Release func(data []byte)
+}
+
+// DefaultConfig returns the configuration used for the values left out of a Config.
+func DefaultConfig() Config {
+	return Config{
+		Workers:      2,
+		CacheSize:    16 << 20,
+		Sync:         SyncOnClose,
+		SyncInterval: 30 * time.Second,
+	}
+}
+
+// withDefaults returns the config with its zero values replaced by the defaults.
+func (config Config) withDefaults() Config {
+	var defaults = DefaultConfig()
+
+	if config.Workers <= 0 {
+		config.Workers = defaults.Workers
+	}
+	if config.CacheSize <= 0 {
+		config.CacheSize = defaults.CacheSize
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = defaults.SyncInterval
+	}
+
+	return config
+}
+
+// Disk writes verified pieces to a storage in the background, so that the goroutines downloading them don't
+// wait on the disk. Pieces wait in a write cache until a worker picks them up; when the cache is full,
+// writers are made to wait until there is room again. A worker picking up a piece also takes the pieces
+// adjacent to it that are waiting, and writes them at once if the storage implements io.WriterAt and the
+// cache has room for the buffer they are coalesced into, which counts towards the cache until the write ends.
+// That happens as soon as the disk falls behind, which is when fewer and larger writes pay off.
+// It is safe for concurrent use.
+type Disk struct {
+	store       storage.Storage
+	pieceLength int
+	config      Config
+
+	mu       sync.Mutex
+	changed  *sync.Cond     // signalled whenever pieces are queued or written, and when the disk closes
+	pending  map[int][]byte // pieces waiting to be written, keyed by index
+	writing  map[int][]byte // pieces being written, keyed by index
+	cached   int            // bytes in `pending` and `writing`, and in the buffers pieces are coalesced into
+	lastSync time.Time      // when the storage was last flushed
+	err      error          // first error that occurred while writing
+	closed   bool
+	workers  sync.WaitGroup
+
+	closeOnce sync.Once // makes sure only one caller closes the disk
+	closeErr  error     // what closing the disk returned
+}
+
+// New creates a disk that writes pieces of `pieceLength` bytes to `store` and starts its workers.
+// The disk must be closed to stop them. Closing the disk doesn't close the storage.
+func New(store storage.Storage, pieceLength int, config Config) *Disk {
+	var disk = &Disk{
+		store:       store,
+		pieceLength: pieceLength,
+		config:      config.withDefaults(),
+		pending:     make(map[int][]byte),
+		writing:     make(map[int][]byte),
+		lastSync:    time.Now(),
+	}
+	disk.changed = sync.NewCond(&disk.mu)
+
+	disk.workers.Add(disk.config.Workers)
+	for i := 0; i != disk.config.Workers; i++ {
+		go disk.work()
+	}
+
+	return disk
+}
+
+// WritePiece queues the verified piece at `index` to be written to the storage and marked as complete.
+// The disk takes ownership of `data`, which must not be modified afterwards, unless an error is returned.
+// It blocks while the write cache is full.
+// Returns the error that made an earlier write fail, or ErrClosed if the disk is closed.
+func (disk *Disk) WritePiece(index int, data []byte) error {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+
+	// a piece larger than the whole cache still gets in once the cache is empty
+	for disk.cached != 0 && disk.cached+len(data) > disk.config.CacheSize && disk.err == nil && !disk.closed {
+		disk.changed.Wait()
+	}
+
+	if disk.err != nil {
+		return disk.err
+	}
+
+	if disk.closed {
+		return ErrClosed
+	}
+
+	if disk.pending[index] != nil || disk.writing[index] != nil {
+		if disk.config.Release != nil {
+			disk.config.Release(data)
+		}
+		return nil
+	}
+
+	disk.pending[index] = data
+	disk.cached += len(data)
+	disk.changed.Broadcast()
+
+	return nil
+}
+
+// ReadBlock reads len(buf) bytes starting at offset `begin` of the piece at `index` into `buf`.
+// Pieces that are still in the write cache are read from there, the others from the storage.
+func (disk *Disk) ReadBlock(index, begin int, buf []byte) error {
+	disk.mu.Lock()
+	var data = disk.pending[index]
+	if data == nil {
+		data = disk.writing[index]
+	}
+
+	if data != nil {
+		defer disk.mu.Unlock()
+
+		if begin < 0 || begin+len(buf) > len(data) {
+			return storage.ErrOutOfBounds
+		}
+
+		copy(buf, data[begin:])
+		return nil
+	}
+	disk.mu.Unlock()
+
+	return disk.store.ReadBlock(index, begin, buf)
+}
+
+// Flush waits until every piece queued so far has been written and flushes the storage.
+// Returns the error that made a write fail, if any did.
+func (disk *Disk) Flush() error {
+	disk.mu.Lock()
+	for (len(disk.pending) != 0 || len(disk.writing) != 0) && disk.err == nil {
+		disk.changed.Wait()
+	}
+
+	var err = disk.err
+	disk.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return disk.store.Flush()
+}
+
+// Close flushes the disk and stops its workers. Closing a closed disk does nothing more, and callers closing
+// it at the same time all wait until it is closed.
+// Returns the error that made a write or the flush fail, if any did.
+func (disk *Disk) Close() error {
+	disk.closeOnce.Do(func() {
+		disk.closeErr = disk.Flush()
+
+		disk.mu.Lock()
+		disk.closed = true
+		disk.changed.Broadcast()
+		disk.mu.Unlock()
+
+		disk.workers.Wait()
+	})
+
+	return disk.closeErr
+}
+
+// work writes pieces from the cache until the disk is closed.
+func (disk *Disk) work() {
+	defer disk.workers.Done()
+
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+
+	for {
+		for len(disk.pending) == 0 && !disk.closed {
+			disk.changed.Wait()
+		}
+
+		if len(disk.pending) == 0 {
+			return
+		}
+
+		var first, pieces = disk.take()
+		var reserved = disk.reserve(pieces)
+		disk.mu.Unlock()
+		var err = disk.write(first, pieces, reserved != 0)
+		disk.mu.Lock()
+
+		disk.cached -= reserved
+
+		for i, data := range pieces {
+			delete(disk.writing, first+i)
+			disk.cached -= len(data)
+
+			if disk.config.Release != nil {
+				disk.config.Release(data)
+			}
+		}
+
+		if err != nil && disk.err == nil {
+			disk.err = err
+		}
+
+		disk.changed.Broadcast()
+	}
+}
+
+// take moves the waiting piece with the lowest index, along with the waiting pieces right after it, from
+// the pending pieces to the ones being written, up to MaxCoalesce bytes.
+// It returns the index of the first piece and the pieces taken.
+// The caller must hold the disk's lock and make sure that pieces are pending.
+func (disk *Disk) take() (int, [][]byte) {
+	var first = -1
+	for index := range disk.pending {
+		if first < 0 || index < first {
+			first = index
+		}
+	}
+
+	var pieces [][]byte
+	var size int
+	for index := first; ; index++ {
+		var data = disk.pending[index]
+		if data == nil || (size != 0 && size+len(data) > MaxCoalesce) {
+			break
+		}
+
+		pieces = append(pieces, data)
+		size += len(data)
+		delete(disk.pending, index)
+		disk.writing[index] = data
+
+		// only full pieces line up with the piece after them
+		if len(data) != disk.pieceLength {
+			break
+		}
+	}
+
+	return first, pieces
+}
+
+// reserve charges the buffer the adjacent `pieces` are coalesced into to the write cache, if the storage
+// implements io.WriterAt and the cache has room for it. Otherwise the pieces are written one by one.
+// It returns the bytes charged, zero if the pieces aren't to be coalesced.
+// The caller must hold the disk's lock.
+func (disk *Disk) reserve(pieces [][]byte) int {
+	var _, ok = disk.store.(io.WriterAt)
+	if !ok || len(pieces) < 2 {
+		return 0
+	}
+
+	var size int
+	for _, data := range pieces {
+		size += len(data)
+	}
+
+	if disk.cached+size > disk.config.CacheSize {
+		return 0
+	}
+
+	disk.cached += size
+	return size
+}
+
+// write writes the adjacent pieces starting at index `first` to the storage, at once if `coalesce` is set
+// and one by one otherwise, marks them as complete and flushes the storage if the sync policy asks for it.
+// Coalescing the pieces requires the storage to implement io.WriterAt.
+func (disk *Disk) write(first int, pieces [][]byte, coalesce bool) error {
+	var err error
+
+	if coalesce {
+		var size int
+		for _, data := range pieces {
+			size += len(data)
+		}
+
+		var buf = make([]byte, 0, size)
+		for _, data := range pieces {
+			buf = append(buf, data...)
+		}
+
+		_, err = disk.store.(io.WriterAt).WriteAt(buf, int64(first)*int64(disk.pieceLength))
+	} else {
+		for i, data := range pieces {
+			err = disk.store.WriteBlock(first+i, 0, data)
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for i := range pieces {
+		err = disk.store.MarkComplete(first + i)
+		if err != nil {
+			return err
+		}
+	}
+
+	return disk.sync()
+}
+
+// sync flushes the storage if the sync policy asks for it after a write.
+func (disk *Disk) sync() error {
+	switch disk.config.Sync {
+	case SyncOnWrite:
+		return disk.store.Flush()
+	case SyncOnInterval:
+		disk.mu.Lock()
+		var due = time.Since(disk.lastSync) >= disk.config.SyncInterval
+		if due {
+			disk.lastSync = time.Now()
+		}
+		disk.mu.Unlock()
+
+		if due {
+			return disk.store.Flush()
+		}
+	}
+
+	return nil
+}
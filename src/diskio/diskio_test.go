@@ -0,0 +1,275 @@
+package diskio
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+// slowStorage is an in-memory storage whose writes wait for `gate` to be open, and which records its writes.
+type slowStorage struct {
+	*storage.Memory
+	gate        chan struct{} // writes wait for a value, or for the channel to be closed
+	fail        error         // returned by every write, if set
+	pieceLength int
+	mu          sync.Mutex
+	writes      []int64 // offsets written at by every write, in order
+	flushes     int     // number of flushes
+}
+
+func newSlowStorage(pieceLength int, length int64) *slowStorage {
+	return &slowStorage{
+		Memory:      storage.NewMemory(pieceLength, length),
+		gate:        make(chan struct{}),
+		pieceLength: pieceLength,
+	}
+}
+
+func (store *slowStorage) record(off int64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.writes = append(store.writes, off)
+}
+
+func (store *slowStorage) WriteBlock(index, begin int, data []byte) error {
+	<-store.gate
+	if store.fail != nil {
+		return store.fail
+	}
+
+	store.record(int64(index)*int64(store.pieceLength) + int64(begin))
+	return store.Memory.WriteBlock(index, begin, data)
+}
+
+func (store *slowStorage) WriteAt(data []byte, off int64) (int, error) {
+	<-store.gate
+	if store.fail != nil {
+		return 0, store.fail
+	}
+
+	store.record(off)
+	return store.Memory.WriteAt(data, off)
+}
+
+func (store *slowStorage) Flush() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.flushes++
+	return nil
+}
+
+func (store *slowStorage) numWrites() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return len(store.writes)
+}
+
+// piece returns a piece of `length` bytes filled with `b`.
+func piece(b byte, length int) []byte {
+	var data = make([]byte, length)
+	for i := range data {
+		data[i] = b
+	}
+
+	return data
+}
+
+// cached returns the bytes the disk's write cache holds.
+func cached(disk *Disk) int {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+
+	return disk.cached
+}
+
+func TestDisk(t *testing.T) {
+	/*
+		test cases:
+		1. pieces are written and marked as complete
+		2. adjacent pieces waiting in the cache are written at once while the cache has room for it
+		3. writers wait while the cache is full
+		4. pieces in the cache are read from there
+		5. a failed write is reported
+		6. the storage is flushed according to the sync policy
+		7. the buffers of written pieces are released
+		8. a disk closed by several goroutines at once is closed once
+	*/
+
+	t.Run("pieces are written and marked as complete", func(t *testing.T) {
+		var store = newSlowStorage(4, 10)
+		close(store.gate)
+
+		var disk = New(store, 4, Config{})
+		assert.Nil(t, disk.WritePiece(2, []byte("ij")))
+		assert.Nil(t, disk.WritePiece(0, []byte("abcd")))
+		assert.Nil(t, disk.WritePiece(1, []byte("efgh")))
+		assert.Nil(t, disk.Close())
+
+		assert.Equal(t, []byte("abcdefghij"), store.Bytes())
+		for index := 0; index != 3; index++ {
+			assert.True(t, store.IsComplete(index))
+		}
+		assert.Equal(t, 0, cached(disk))
+		assert.ErrorIs(t, disk.WritePiece(0, []byte("abcd")), ErrClosed)
+	})
+
+	t.Run("adjacent pieces waiting in the cache are written at once while the cache has room for it", func(t *testing.T) {
+		// the pieces are coalesced with a cache twice their size, and written one by one in a cache just as large
+		for cacheSize, writes := range map[int][]int64{32: {0, 4}, 16: {0, 4, 8, 12}} {
+			var store = newSlowStorage(4, 20)
+			var disk = New(store, 4, Config{Workers: 1, CacheSize: cacheSize})
+
+			// the worker is stuck writing the first piece while the others pile up
+			assert.Nil(t, disk.WritePiece(0, []byte("abcd")))
+			assert.Eventually(t, func() bool {
+				disk.mu.Lock()
+				defer disk.mu.Unlock()
+				return len(disk.writing) == 1
+			}, time.Second, time.Millisecond)
+			assert.Nil(t, disk.WritePiece(3, []byte("mnop")))
+			assert.Nil(t, disk.WritePiece(1, []byte("efgh")))
+			assert.Nil(t, disk.WritePiece(2, []byte("ijkl")))
+
+			close(store.gate)
+			assert.Nil(t, disk.Close())
+
+			assert.Equal(t, writes, store.writes, cacheSize)
+			assert.Equal(t, []byte("abcdefghijklmnop\x00\x00\x00\x00"), store.Bytes())
+			assert.Equal(t, 0, cached(disk))
+		}
+	})
+
+	t.Run("writers wait while the cache is full", func(t *testing.T) {
+		var store = newSlowStorage(4, 20)
+		var disk = New(store, 4, Config{Workers: 1, CacheSize: 8})
+
+		assert.Nil(t, disk.WritePiece(0, []byte("abcd")))
+		assert.Nil(t, disk.WritePiece(2, []byte("ijkl")))
+
+		var written = make(chan struct{})
+		go func() {
+			disk.WritePiece(4, []byte("qrst"))
+			close(written)
+		}()
+
+		select {
+		case <-written:
+			assert.Fail(t, "the write didn't wait for room in the cache")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		store.gate <- struct{}{}
+		<-written
+		assert.LessOrEqual(t, cached(disk), 8)
+
+		close(store.gate)
+		assert.Nil(t, disk.Close())
+	})
+
+	t.Run("pieces in the cache are read from there", func(t *testing.T) {
+		var store = newSlowStorage(4, 10)
+		var disk = New(store, 4, Config{})
+
+		assert.Nil(t, disk.WritePiece(1, []byte("efgh")))
+
+		var buf = make([]byte, 2)
+		assert.Nil(t, disk.ReadBlock(1, 1, buf))
+		assert.Equal(t, []byte("fg"), buf)
+		assert.ErrorIs(t, disk.ReadBlock(1, 3, buf), storage.ErrOutOfBounds)
+		assert.Equal(t, 0, store.numWrites())
+
+		close(store.gate)
+		assert.Nil(t, disk.Close())
+
+		assert.Nil(t, disk.ReadBlock(1, 2, buf))
+		assert.Equal(t, []byte("gh"), buf)
+	})
+
+	t.Run("a failed write is reported", func(t *testing.T) {
+		var store = newSlowStorage(4, 10)
+		store.fail = errors.New("disk full")
+		close(store.gate)
+
+		var disk = New(store, 4, Config{})
+		assert.Nil(t, disk.WritePiece(0, []byte("abcd")))
+		assert.ErrorIs(t, disk.Flush(), store.fail)
+		assert.ErrorIs(t, disk.WritePiece(1, []byte("efgh")), store.fail)
+		assert.ErrorIs(t, disk.Close(), store.fail)
+		assert.False(t, store.IsComplete(0))
+	})
+
+	t.Run("the storage is flushed according to the sync policy", func(t *testing.T) {
+		var flushes = func(config Config) int {
+			var store = newSlowStorage(4, 10)
+			close(store.gate)
+
+			var disk = New(store, 4, config)
+			for index := 0; index != 3; index++ {
+				require.Nil(t, disk.WritePiece(index, piece('x', min(4, 10-index*4))))
+				require.Nil(t, disk.Flush())
+			}
+			require.Nil(t, disk.Close())
+
+			// every Flush and the Close flush the storage too
+			return store.flushes - 4
+		}
+
+		assert.Equal(t, 0, flushes(Config{Sync: SyncOnClose}))
+		assert.Equal(t, 3, flushes(Config{Sync: SyncOnWrite}))
+		assert.Equal(t, 0, flushes(Config{Sync: SyncOnInterval, SyncInterval: time.Hour}))
+		assert.Equal(t, 3, flushes(Config{Sync: SyncOnInterval, SyncInterval: time.Nanosecond}))
+	})
+
+	t.Run("the buffers of written pieces are released", func(t *testing.T) {
+		var store = newSlowStorage(4, 10)
+		close(store.gate)
+
+		var mu sync.Mutex
+		var released []string
+		var disk = New(store, 4, Config{Release: func(data []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			released = append(released, string(data))
+		}})
+
+		assert.Nil(t, disk.WritePiece(0, []byte("abcd")))
+		assert.Nil(t, disk.WritePiece(2, []byte("ij")))
+		assert.Nil(t, disk.Close())
+
+		assert.ElementsMatch(t, []string{"abcd", "ij"}, released)
+	})
+
+	t.Run("a disk closed by several goroutines at once is closed once", func(t *testing.T) {
+		var store = newSlowStorage(4, 10)
+		var disk = New(store, 4, Config{})
+		assert.Nil(t, disk.WritePiece(0, []byte("abcd")))
+
+		var wg sync.WaitGroup
+		var errs = make(chan error, 4)
+		for i := 0; i != 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- disk.Close()
+			}()
+		}
+
+		close(store.gate)
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, 1, store.flushes)
+		assert.True(t, store.IsComplete(0))
+	})
+}
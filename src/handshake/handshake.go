@@ -7,8 +7,16 @@ import (
 	"github.com/winterrdog/lean-bit-torrent-client/common"
 )
 
+const (
+	extensionProtocolByte = 5    // reserved byte holding the extension protocol bit (BEP 10)
+	extensionProtocolMask = 0x10 // bit of the extension protocol in its reserved byte
+	fastExtensionByte     = 7    // reserved byte holding the Fast Extension bit (BEP 6)
+	fastExtensionMask     = 0x04 // bit of the Fast Extension in its reserved byte
+)
+
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte // reserved bytes, used to advertise protocol extensions
 	InfoHash common.Sha1Hash
 	PeerId   common.Sha1Hash
 }
@@ -33,8 +41,7 @@ func (hs *Handshake) Serialize() []byte {
 	offset += copy(buf[offset:], []byte(hs.Pstr))
 
 	// reserved 8 bytes -- for extensions
-	var reservedBytes = [8]byte{0, 0, 0, 0, 0, 0, 0, 0}
-	offset += copy(buf[offset:], reservedBytes[:])
+	offset += copy(buf[offset:], hs.Reserved[:])
 
 	// info hash
 	offset += copy(buf[offset:], hs.InfoHash[:])
@@ -71,8 +78,11 @@ func Read(reader io.Reader) (*Handshake, error) {
 	// get protocol ID
 	var protocolIdStr = string(handshakeBuf[0:protocolIdLength])
 
+	// get the reserved bytes
+	var offset = protocolIdLength
+	offset += copy(hs.Reserved[:], handshakeBuf[offset:offset+8])
+
 	// get the info hash and peer id
-	var offset = protocolIdLength + 8
 	var infoHash, peerId common.Sha1Hash
 	offset += copy(infoHash[:], handshakeBuf[offset:offset+20])
 	copy(peerId[:], handshakeBuf[offset:offset+20])
@@ -84,3 +94,23 @@ func Read(reader io.Reader) (*Handshake, error) {
 
 	return &hs, nil
 }
+
+// EnableExtensionProtocol advertises support for the extension protocol (BEP 10) in the reserved bytes.
+func (hs *Handshake) EnableExtensionProtocol() {
+	hs.Reserved[extensionProtocolByte] |= extensionProtocolMask
+}
+
+// SupportsExtensionProtocol reports whether the sender of the handshake supports the extension protocol (BEP 10).
+func (hs *Handshake) SupportsExtensionProtocol() bool {
+	return hs.Reserved[extensionProtocolByte]&extensionProtocolMask != 0
+}
+
+// EnableFastExtension advertises support for the Fast Extension (BEP 6) in the reserved bytes.
+func (hs *Handshake) EnableFastExtension() {
+	hs.Reserved[fastExtensionByte] |= fastExtensionMask
+}
+
+// SupportsFastExtension reports whether the sender of the handshake supports the Fast Extension (BEP 6).
+func (hs *Handshake) SupportsFastExtension() bool {
+	return hs.Reserved[fastExtensionByte]&fastExtensionMask != 0
+}
@@ -106,3 +106,53 @@ func TestRead(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, hs2)
 }
+
+func TestExtensionProtocol(t *testing.T) {
+	/*
+		test cases
+		1. a new handshake doesn't advertise the extension protocol
+		2. the extension protocol bit survives a round trip over the wire
+	*/
+
+	var infoHash = common.Sha1Hash{0x13, 0x9a, 0x26}
+	var peerId = common.Sha1Hash{0x7e, 0x0b, 0x7f}
+
+	// 1. a new handshake doesn't advertise the extension protocol
+	var hs = New(&infoHash, &peerId)
+	assert.False(t, hs.SupportsExtensionProtocol())
+
+	// 2. the extension protocol bit survives a round trip over the wire
+	hs.EnableExtensionProtocol()
+	var serialized = hs.Serialize()
+	assert.Equal(t, byte(0x10), serialized[1+19+5])
+
+	var hs2, err = Read(bytes.NewReader(serialized))
+	assert.NoError(t, err)
+	assert.True(t, hs2.SupportsExtensionProtocol())
+	assert.Equal(t, hs, hs2)
+}
+
+func TestFastExtension(t *testing.T) {
+	/*
+		test cases
+		1. a new handshake doesn't advertise the Fast Extension
+		2. the Fast Extension bit survives a round trip over the wire
+	*/
+
+	var infoHash = common.Sha1Hash{0x13, 0x9a, 0x26}
+	var peerId = common.Sha1Hash{0x7e, 0x0b, 0x7f}
+
+	// 1. a new handshake doesn't advertise the Fast Extension
+	var hs = New(&infoHash, &peerId)
+	assert.False(t, hs.SupportsFastExtension())
+
+	// 2. the Fast Extension bit survives a round trip over the wire
+	hs.EnableFastExtension()
+	var serialized = hs.Serialize()
+	assert.Equal(t, byte(0x04), serialized[1+19+7])
+
+	var hs2, err = Read(bytes.NewReader(serialized))
+	assert.NoError(t, err)
+	assert.True(t, hs2.SupportsFastExtension())
+	assert.False(t, hs2.SupportsExtensionProtocol())
+}
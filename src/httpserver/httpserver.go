@@ -0,0 +1,112 @@
+// Package httpserver serves the files of a torrent over HTTP while the torrent downloads, so that media players
+// and other HTTP clients can read them as if they were plain URLs.
+package httpserver
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/p2p"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+// DefaultReadAhead is the number of pieces past each read of a client that are fetched ahead of its next reads.
+const DefaultReadAhead = 4
+
+// file is a file of the torrent served at a path.
+type file struct {
+	path   string // URL path the file is served at, relative to the root
+	offset int64  // offset of the file within the torrent's content
+	length int64  // length of the file in bytes
+}
+
+// Server is an http.Handler serving the files of a torrent at their paths, and an index of them at the root.
+// Files are read through readers of the torrent, so the pieces the clients read are downloaded before any
+// other piece and the priorities of the download follow the open requests. Range requests are supported.
+type Server struct {
+	ReadAhead int // Pieces past each read fetched ahead of the next reads of the client. Defaults to DefaultReadAhead.
+
+	torrent *p2p.Torrent
+	files   []file
+}
+
+// New creates a server of the given files of the torrent, which are laid out in its content in the given order.
+func New(torrent *p2p.Torrent, files []storage.File) *Server {
+	var server = &Server{torrent: torrent, files: make([]file, len(files))}
+
+	var offset int64
+	for i, f := range files {
+		server.files[i] = file{path: strings.TrimPrefix(path.Clean("/"+f.Path), "/"), offset: offset, length: f.Length}
+		offset += f.Length
+	}
+
+	return server
+}
+
+// ServeHTTP answers GET and HEAD requests for the files of the torrent and for the index at the root.
+// A request for a file waits for the pieces it covers to be downloaded, until the client goes away.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var name = strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" {
+		server.serveIndex(w)
+		return
+	}
+
+	for index, f := range server.files {
+		if f.path == name {
+			server.serveFile(w, r, index, f)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+// serveIndex writes an HTML page linking to the files of the torrent.
+func (server *Server) serveIndex(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	fmt.Fprintf(w, "<!doctype html>\n<title>%s</title>\n<ul>\n", html.EscapeString(server.torrent.Name))
+	for _, f := range server.files {
+		var link = (&url.URL{Path: f.path}).String()
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> (%d bytes)</li>\n", html.EscapeString(link), html.EscapeString(f.path), f.length)
+	}
+	fmt.Fprintln(w, "</ul>")
+}
+
+// serveFile writes the file at the given index, or the ranges of it the request asks for.
+// The content type is told by the file's extension rather than by sniffing its content, which might not be
+// downloaded yet.
+func (server *Server) serveFile(w http.ResponseWriter, r *http.Request, index int, f file) {
+	var contentType = mime.TypeByExtension(path.Ext(f.path))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%d\"", server.torrent.InfoHash, index))
+
+	// the read gives up once the client goes away
+	var reader = server.torrent.NewReader(r.Context())
+	defer reader.Close()
+
+	reader.ReadAhead = server.ReadAhead
+	if reader.ReadAhead <= 0 {
+		reader.ReadAhead = DefaultReadAhead
+	}
+
+	http.ServeContent(w, r, f.path, time.Time{}, io.NewSectionReader(reader, f.offset, f.length))
+}
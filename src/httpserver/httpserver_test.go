@@ -0,0 +1,113 @@
+package httpserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/p2p"
+	"github.com/winterrdog/lean-bit-torrent-client/p2p/p2ptest"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+// newDownloadedTorrent returns a torrent whose content is downloaded already, and its content.
+func newDownloadedTorrent(t *testing.T, length, pieceLength int) (*p2p.Torrent, []byte) {
+	var data, hashes = p2ptest.Content(length, pieceLength)
+	var torrent = &p2p.Torrent{Name: "test", Length: length, PieceLength: pieceLength, PiecesHashes: hashes, Recheck: true}
+	require.Nil(t, torrent.Download(context.Background(), p2ptest.NewStore(t, pieceLength, data)))
+
+	return torrent, data
+}
+
+func TestServer(t *testing.T) {
+	/*
+		test cases:
+		1. files are served whole, with their length and content type
+		2. ranges of files are served
+		3. HEAD requests tell the length without the content
+		4. the index links to the files
+		5. unknown paths and methods are turned down
+	*/
+
+	var torrent, data = newDownloadedTorrent(t, 5000, 1024)
+	var files = []storage.File{{Path: "movie.mp4", Length: 3000}, {Path: "extras/notes of mine", Length: 2000}}
+	var server = httptest.NewServer(New(torrent, files))
+	defer server.Close()
+
+	var get = func(t *testing.T, method, path string, header http.Header) (*http.Response, []byte) {
+		var req, err = http.NewRequest(method, server.URL+path, nil)
+		require.Nil(t, err)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+
+		var body []byte
+		body, err = io.ReadAll(resp.Body)
+		require.Nil(t, err)
+
+		return resp, body
+	}
+
+	t.Run("files are served whole, with their length and content type", func(t *testing.T) {
+		var resp, body = get(t, http.MethodGet, "/movie.mp4", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "3000", resp.Header.Get("Content-Length"))
+		assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+		assert.Equal(t, data[:3000], body)
+
+		resp, body = get(t, http.MethodGet, "/extras/notes%20of%20mine", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+		assert.Equal(t, data[3000:], body)
+	})
+
+	t.Run("ranges of files are served", func(t *testing.T) {
+		var resp, body = get(t, http.MethodGet, "/extras/notes%20of%20mine", http.Header{"Range": {"bytes=100-1199"}})
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "bytes 100-1199/2000", resp.Header.Get("Content-Range"))
+		assert.Equal(t, "1100", resp.Header.Get("Content-Length"))
+		assert.Equal(t, data[3100:4200], body)
+
+		resp, body = get(t, http.MethodGet, "/movie.mp4", http.Header{"Range": {"bytes=-10"}})
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, data[2990:3000], body)
+
+		resp, _ = get(t, http.MethodGet, "/movie.mp4", http.Header{"Range": {"bytes=3000-"}})
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	})
+
+	t.Run("HEAD requests tell the length without the content", func(t *testing.T) {
+		var resp, body = get(t, http.MethodHead, "/movie.mp4", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "3000", resp.Header.Get("Content-Length"))
+		assert.Empty(t, body)
+	})
+
+	t.Run("the index links to the files", func(t *testing.T) {
+		var resp, body = get(t, http.MethodGet, "/", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"))
+		assert.Contains(t, string(body), `href="movie.mp4"`)
+		assert.Contains(t, string(body), `href="extras/notes%20of%20mine"`)
+	})
+
+	t.Run("unknown paths and methods are turned down", func(t *testing.T) {
+		var resp, _ = get(t, http.MethodGet, "/missing.mp4", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+		resp, _ = get(t, http.MethodPost, "/movie.mp4", nil)
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		assert.Equal(t, "GET, HEAD", resp.Header.Get("Allow"))
+	})
+}
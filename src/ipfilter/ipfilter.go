@@ -0,0 +1,183 @@
+// Package ipfilter blocks ranges of IP addresses, e.g. private networks or known bad peers, so that no
+// connection is made to or accepted from them.
+// The ranges are read from blocklists in the eMule ipfilter.dat, PeerGuardian P2P text or CIDR formats.
+package ipfilter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ErrBlocked is returned for connections to and from the addresses an IP filter blocks.
+var ErrBlocked = errors.New("peer address is blocked by the IP filter")
+
+// Range is a range of IP addresses, both ends included.
+type Range struct {
+	First net.IP // First address of the range.
+	Last  net.IP // Last address of the range, not before First.
+}
+
+// String returns the range as its first and last addresses, e.g. "10.0.0.0-10.255.255.255".
+func (r Range) String() string {
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// span is a range of addresses in their 16-byte form, IPv4 addresses being mapped to IPv6 ones, so that
+// addresses of either family compare byte by byte.
+type span struct {
+	first, last [net.IPv6len]byte
+}
+
+// Filter blocks the addresses in a set of ranges, which are kept sorted and merged so that looking an address
+// up takes a binary search. The ranges can be replaced at any time, e.g. by reloading the blocklist they
+// were read from.
+// A nil filter blocks nothing. It is safe for concurrent use.
+type Filter struct {
+	mu    sync.RWMutex
+	path  string // blocklist the ranges were loaded from, if any, see Reload
+	spans []span // sorted by first address, neither overlapping nor adjacent
+}
+
+// New creates a filter blocking the addresses in `ranges`.
+func New(ranges []Range) *Filter {
+	var filter = &Filter{}
+	filter.Set(ranges)
+
+	return filter
+}
+
+// Load creates a filter blocking the ranges of the blocklist at `path`, see Parse, which Reload reads again.
+// Returns an error if the file can't be read or the blocklist is malformed.
+func Load(path string) (*Filter, error) {
+	var filter = &Filter{path: path}
+	var err = filter.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return filter, nil
+}
+
+// Reload reads the blocklist the filter was loaded from again, and blocks its ranges instead of the ones
+// blocked so far. The filter is left as it is if the blocklist can't be read.
+// Returns an error if the filter wasn't loaded from a file, the file can't be read or the blocklist is
+// malformed.
+func (filter *Filter) Reload() error {
+	if filter.path == "" {
+		return errors.New("the IP filter wasn't loaded from a file")
+	}
+
+	var file, err = os.Open(filter.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var ranges []Range
+	ranges, err = Parse(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filter.path, err)
+	}
+
+	filter.Set(ranges)
+	return nil
+}
+
+// Set makes the filter block the addresses in `ranges` instead of the ones it blocked so far.
+func (filter *Filter) Set(ranges []Range) {
+	var spans = make([]span, 0, len(ranges))
+	for _, r := range ranges {
+		var s span
+		copy(s.first[:], r.First.To16())
+		copy(s.last[:], r.Last.To16())
+		spans = append(spans, s)
+	}
+
+	spans = merge(spans)
+
+	filter.mu.Lock()
+	defer filter.mu.Unlock()
+
+	filter.spans = spans
+}
+
+// Blocked reports whether the filter blocks `ip`. A nil filter blocks nothing, and neither does any filter
+// block an invalid address.
+func (filter *Filter) Blocked(ip net.IP) bool {
+	if filter == nil {
+		return false
+	}
+
+	var addr = ip.To16()
+	if addr == nil {
+		return false
+	}
+
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+
+	// the first range not ending before the address is the only one that may hold it
+	var i = sort.Search(len(filter.spans), func(i int) bool {
+		return bytes.Compare(filter.spans[i].last[:], addr) >= 0
+	})
+
+	return i < len(filter.spans) && bytes.Compare(filter.spans[i].first[:], addr) <= 0
+}
+
+// NumRanges returns the number of ranges the filter blocks, once overlapping and adjacent ones are merged.
+// A nil filter blocks none.
+func (filter *Filter) NumRanges() int {
+	if filter == nil {
+		return 0
+	}
+
+	filter.mu.RLock()
+	defer filter.mu.RUnlock()
+
+	return len(filter.spans)
+}
+
+// merge sorts the spans by their first address and merges the ones that overlap or are adjacent.
+func merge(spans []span) []span {
+	sort.Slice(spans, func(i, j int) bool {
+		return bytes.Compare(spans[i].first[:], spans[j].first[:]) < 0
+	})
+
+	var merged = spans[:0]
+	for _, s := range spans {
+		if len(merged) == 0 {
+			merged = append(merged, s)
+			continue
+		}
+
+		var last = &merged[len(merged)-1]
+		var next, overflow = successor(last.last)
+		if overflow || bytes.Compare(s.first[:], next[:]) <= 0 {
+			if bytes.Compare(s.last[:], last.last[:]) > 0 {
+				last.last = s.last
+			}
+			continue
+		}
+
+		merged = append(merged, s)
+	}
+
+	return merged
+}
+
+// successor returns the address right after `addr`, and whether there is none because `addr` is the last one.
+func successor(addr [net.IPv6len]byte) ([net.IPv6len]byte, bool) {
+	for i := len(addr) - 1; i >= 0; i-- {
+		addr[i]++
+		if addr[i] != 0 {
+			return addr, false
+		}
+	}
+
+	return addr, true
+}
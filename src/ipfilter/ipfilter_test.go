@@ -0,0 +1,98 @@
+package ipfilter
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	/*
+		test cases:
+		1. addresses within the ranges are blocked, the ones around them aren't
+		2. overlapping and adjacent ranges are merged
+		3. IPv4 and IPv6 ranges are blocked alike
+		4. a nil filter blocks nothing
+		5. reloading reads the blocklist again and keeps the ranges if it is malformed
+	*/
+
+	var ipRange = func(first, last string) Range {
+		return Range{First: net.ParseIP(first), Last: net.ParseIP(last)}
+	}
+
+	t.Run("addresses within the ranges are blocked, the ones around them aren't", func(t *testing.T) {
+		var filter = New([]Range{ipRange("10.0.0.0", "10.255.255.255"), ipRange("192.0.2.7", "192.0.2.7")})
+
+		assert.True(t, filter.Blocked(net.ParseIP("10.0.0.0")))
+		assert.True(t, filter.Blocked(net.ParseIP("10.42.1.2")))
+		assert.True(t, filter.Blocked(net.IP{10, 255, 255, 255}))
+		assert.True(t, filter.Blocked(net.ParseIP("192.0.2.7")))
+
+		assert.False(t, filter.Blocked(net.ParseIP("9.255.255.255")))
+		assert.False(t, filter.Blocked(net.ParseIP("11.0.0.0")))
+		assert.False(t, filter.Blocked(net.ParseIP("192.0.2.6")))
+		assert.False(t, filter.Blocked(net.ParseIP("192.0.2.8")))
+		assert.False(t, filter.Blocked(nil))
+	})
+
+	t.Run("overlapping and adjacent ranges are merged", func(t *testing.T) {
+		var filter = New([]Range{
+			ipRange("10.0.0.10", "10.0.0.20"),
+			ipRange("10.0.0.0", "10.0.0.15"),
+			ipRange("10.0.0.21", "10.0.0.30"),
+			ipRange("10.0.0.12", "10.0.0.13"),
+			ipRange("10.0.0.32", "10.0.0.40"),
+		})
+
+		assert.Equal(t, 2, filter.NumRanges())
+		assert.True(t, filter.Blocked(net.ParseIP("10.0.0.25")))
+		assert.False(t, filter.Blocked(net.ParseIP("10.0.0.31")))
+		assert.True(t, filter.Blocked(net.ParseIP("10.0.0.32")))
+
+		// the last address there is has no successor
+		filter = New([]Range{ipRange("ffff::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"), ipRange("ffff::1", "ffff::2")})
+		assert.Equal(t, 1, filter.NumRanges())
+	})
+
+	t.Run("IPv4 and IPv6 ranges are blocked alike", func(t *testing.T) {
+		var filter = New([]Range{ipRange("2001:db8::", "2001:db8::ffff"), ipRange("203.0.113.0", "203.0.113.255")})
+
+		assert.True(t, filter.Blocked(net.ParseIP("2001:db8::1234")))
+		assert.False(t, filter.Blocked(net.ParseIP("2001:db8::1:0")))
+		assert.True(t, filter.Blocked(net.ParseIP("::ffff:203.0.113.9")))
+		assert.False(t, filter.Blocked(net.ParseIP("::203.0.113.9")))
+	})
+
+	t.Run("a nil filter blocks nothing", func(t *testing.T) {
+		var filter *Filter
+
+		assert.False(t, filter.Blocked(net.ParseIP("10.0.0.1")))
+		assert.Zero(t, filter.NumRanges())
+	})
+
+	t.Run("reloading reads the blocklist again and keeps the ranges if it is malformed", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "blocklist.p2p")
+		require.Nil(t, os.WriteFile(path, []byte("Bad network:10.0.0.0-10.0.0.255\n"), 0o644))
+
+		var filter, err = Load(path)
+		require.Nil(t, err)
+		assert.True(t, filter.Blocked(net.ParseIP("10.0.0.1")))
+
+		require.Nil(t, os.WriteFile(path, []byte("192.168.0.0/16\n"), 0o644))
+		require.Nil(t, filter.Reload())
+		assert.False(t, filter.Blocked(net.ParseIP("10.0.0.1")))
+		assert.True(t, filter.Blocked(net.ParseIP("192.168.4.2")))
+
+		require.Nil(t, os.WriteFile(path, []byte("not an address\n"), 0o644))
+		assert.NotNil(t, filter.Reload())
+		assert.True(t, filter.Blocked(net.ParseIP("192.168.4.2")))
+
+		_, err = Load(filepath.Join(t.TempDir(), "missing"))
+		assert.NotNil(t, err)
+		assert.NotNil(t, New(nil).Reload())
+	})
+}
@@ -0,0 +1,152 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// eMuleMaxBlockedLevel is the highest access level of an eMule ipfilter.dat range that is blocked. Ranges
+// with higher levels are allowed.
+const eMuleMaxBlockedLevel = 127
+
+// Parse reads a blocklist with one range of addresses per line, in any of the following formats, which may
+// be mixed:
+//
+//	# CIDR lists, of IPv4 or IPv6 networks or single addresses
+//	10.0.0.0/8
+//	fc00::/7
+//	192.0.2.1
+//	# plain ranges
+//	198.51.100.0 - 198.51.100.255
+//	# PeerGuardian P2P text format, a description followed by a range of IPv4 addresses
+//	Some bad network:203.0.113.0-203.0.113.255
+//	# eMule ipfilter.dat format, a range, an access level and a description
+//	001.002.003.000 - 001.002.003.255 , 000 , Some bad network
+//
+// The eMule ranges whose access level is above 127 are allowed, and left out. Lines starting with "#" or
+// "//" are comments.
+// Returns an error naming the line of the first malformed range.
+func Parse(r io.Reader) ([]Range, error) {
+	var ranges []Range
+	var scanner = bufio.NewScanner(r)
+	var number int
+	for scanner.Scan() {
+		number++
+
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		var parsed, blocked, err = parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+
+		if blocked {
+			ranges = append(ranges, parsed)
+		}
+	}
+
+	return ranges, scanner.Err()
+}
+
+// parseLine parses a line of a blocklist, trying every format in turn.
+// It returns the range and whether it is blocked, which only the eMule access level can tell otherwise.
+func parseLine(line string) (Range, bool, error) {
+	if _, network, err := net.ParseCIDR(line); err == nil {
+		return networkRange(network), true, nil
+	}
+
+	if parsed, err := parseRange(line); err == nil {
+		return parsed, true, nil
+	}
+
+	// P2P: the description may hold colons itself, but the range of IPv4 addresses can't
+	if i := strings.LastIndexByte(line, ':'); i >= 0 {
+		if parsed, err := parseRange(line[i+1:]); err == nil {
+			return parsed, true, nil
+		}
+	}
+
+	// eMule: the description may hold commas itself, but the range and access level can't
+	var fields = strings.SplitN(line, ",", 3)
+	if len(fields) >= 2 {
+		var parsed, err = parseRange(fields[0])
+		if err != nil {
+			return Range{}, false, err
+		}
+
+		var level int
+		level, err = strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return Range{}, false, fmt.Errorf("invalid access level %q", strings.TrimSpace(fields[1]))
+		}
+
+		return parsed, level <= eMuleMaxBlockedLevel, nil
+	}
+
+	return Range{}, false, fmt.Errorf("expected a CIDR network, a range of addresses, a P2P or an eMule range, got %q", line)
+}
+
+// parseRange parses a range of addresses written as "first-last", or a single address.
+func parseRange(s string) (Range, error) {
+	var first, last, found = strings.Cut(s, "-")
+	if !found {
+		last = first
+	}
+
+	var r = Range{First: parseIP(first), Last: parseIP(last)}
+	if r.First == nil || r.Last == nil {
+		return Range{}, fmt.Errorf("invalid range of addresses %q", strings.TrimSpace(s))
+	}
+
+	// a range can't span both families of addresses
+	if (r.First.To4() == nil) != (r.Last.To4() == nil) || bytes.Compare(r.First.To16(), r.Last.To16()) > 0 {
+		return Range{}, fmt.Errorf("invalid range of addresses %q", strings.TrimSpace(s))
+	}
+
+	return r, nil
+}
+
+// parseIP parses an IPv4 or IPv6 address, allowing the zero-padded IPv4 addresses of eMule blocklists like
+// "001.002.003.004".
+// It returns nil if `s` isn't an address.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s)
+	}
+
+	var parts = strings.Split(s, ".")
+	if len(parts) != net.IPv4len {
+		return nil
+	}
+
+	var ip = make(net.IP, net.IPv4len)
+	for i, part := range parts {
+		var octet, err = strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil
+		}
+
+		ip[i] = byte(octet)
+	}
+
+	return ip.To16()
+}
+
+// networkRange returns the range of addresses of a network.
+func networkRange(network *net.IPNet) Range {
+	var last = make(net.IP, len(network.IP))
+	for i := range network.IP {
+		last[i] = network.IP[i] | ^network.Mask[i]
+	}
+
+	return Range{First: network.IP, Last: last}
+}
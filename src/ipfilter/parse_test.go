@@ -0,0 +1,89 @@
+package ipfilter
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	/*
+		test cases:
+		1. CIDR networks and single addresses are parsed
+		2. PeerGuardian P2P ranges are parsed
+		3. eMule ranges are parsed, and the allowed ones are left out
+		4. malformed lines are reported with their number
+	*/
+
+	// parse returns the ranges of the blocklist as strings
+	var parse = func(t *testing.T, blocklist string) []string {
+		var ranges, err = Parse(strings.NewReader(blocklist))
+		assert.Nil(t, err)
+
+		var result []string
+		for _, r := range ranges {
+			result = append(result, r.String())
+		}
+
+		return result
+	}
+
+	t.Run("CIDR networks and single addresses are parsed", func(t *testing.T) {
+		var ranges = parse(t, `
+# private networks
+10.0.0.0/8
+192.168.1.17/30
+fc00::/7
+192.0.2.1
+// a plain range
+198.51.100.0 - 198.51.100.255
+`)
+
+		assert.Equal(t, []string{
+			"10.0.0.0-10.255.255.255",
+			"192.168.1.16-192.168.1.19",
+			"fc00::-fdff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+			"192.0.2.1-192.0.2.1",
+			"198.51.100.0-198.51.100.255",
+		}, ranges)
+	})
+
+	t.Run("PeerGuardian P2P ranges are parsed", func(t *testing.T) {
+		var ranges = parse(t, `
+Some bad network:203.0.113.0-203.0.113.255
+Bad, Inc. - offices: the 2nd floor:1.2.3.4-1.2.3.8
+`)
+
+		assert.Equal(t, []string{"203.0.113.0-203.0.113.255", "1.2.3.4-1.2.3.8"}, ranges)
+	})
+
+	t.Run("eMule ranges are parsed, and the allowed ones are left out", func(t *testing.T) {
+		var ranges = parse(t, `
+001.002.003.000 - 001.002.003.255 , 000 , Some bad network
+004.005.006.000 - 004.005.006.255 , 200 , Allowed network
+007.008.009.000 - 007.008.009.010 ,127, Bad, Inc.
+`)
+
+		assert.Equal(t, []string{"1.2.3.0-1.2.3.255", "7.8.9.0-7.8.9.10"}, ranges)
+	})
+
+	t.Run("malformed lines are reported with their number", func(t *testing.T) {
+		for _, blocklist := range []string{
+			"10.0.0.0/8\nnot an address",
+			"10.0.0.0/8\n10.0.0.9-10.0.0.1",
+			"10.0.0.0/8\n10.0.0.1-::1",
+			"10.0.0.0/8\n1.2.3.256 - 1.2.3.4 , 000 , Bad",
+			"10.0.0.0/8\n1.2.3.0 - 1.2.3.4 , high , Bad",
+		} {
+			var _, err = Parse(strings.NewReader(blocklist))
+			if assert.NotNil(t, err, blocklist) {
+				assert.Contains(t, err.Error(), "line 2:")
+			}
+		}
+
+		var ip = parseIP("001.002.003.004")
+		assert.Equal(t, net.IP{1, 2, 3, 4}.To16(), ip)
+	})
+}
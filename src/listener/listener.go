@@ -0,0 +1,269 @@
+// Package listener accepts the connections peers open to us and hands them to the torrents they are for.
+package listener
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/winterrdog/lean-bit-torrent-client/client"
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/ipfilter"
+	"github.com/winterrdog/lean-bit-torrent-client/mse"
+)
+
+// ServeFunc keeps a connection a peer opened to us going until it ends or `ctx` is cancelled, and closes it.
+// It returns the error that ended the connection, if any.
+type ServeFunc func(ctx context.Context, conn *client.Client) error
+
+// FailFunc is called with the address of a peer whose connection was closed because its handshake failed, and
+// the reason.
+type FailFunc func(addr net.Addr, err error)
+
+// torrent is a torrent the listener accepts connections for.
+type torrent struct {
+	peerId  common.Sha1Hash    // peer ID we use for the torrent
+	serve   ServeFunc          // serves the torrent's connections
+	ctx     context.Context    // cancelled once the torrent is removed
+	cancel  context.CancelFunc // ends the torrent's connections
+	running sync.WaitGroup     // connections of the torrent that haven't ended yet
+}
+
+// Listener accepts peer connections on a TCP port and completes their handshakes for the torrents that were
+// added to it, handing each connection to its torrent. Connections for other torrents are closed, and so are
+// the ones from the addresses its filter blocks and the ones its encryption policy refuses.
+// It is safe for concurrent use.
+type Listener struct {
+	Filter     *ipfilter.Filter // Addresses whose connections are closed before their handshake. May be nil. Set before calling Serve.
+	Encryption mse.Policy       // Whether encrypted connections are accepted, and plaintext ones refused. Set before calling Serve.
+	Failed     FailFunc         // Called when a handshake fails, but not for connections to unknown torrents. May be nil. Set before calling Serve.
+
+	listeners []net.Listener // one per address listened on, all on the same port
+	mu        sync.Mutex
+	torrents  map[common.Sha1Hash]*torrent // keyed by info hash
+	running   sync.WaitGroup               // connections that haven't ended yet
+}
+
+// Listen starts listening for peer connections on the given addresses, e.g. ":6881", or "192.0.2.7:6881" and
+// "[2001:db8::7]:6881" to only accept them on an IPv4 and an IPv6 address. The addresses are listened on on
+// the same port: if the first one's port is 0, the others are listened on on the port picked for it.
+// Connections are only accepted once Serve is called.
+// Returns an error if no address is given or any of them can't be listened on.
+func Listen(addrs ...string) (*Listener, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+
+	var listener = &Listener{torrents: make(map[common.Sha1Hash]*torrent)}
+	for i, addr := range addrs {
+		if i > 0 {
+			var host, _, err = net.SplitHostPort(addr)
+			if err != nil {
+				listener.Close()
+				return nil, err
+			}
+
+			addr = net.JoinHostPort(host, strconv.Itoa(int(listener.Port())))
+		}
+
+		var ln, err = net.Listen("tcp", addr)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+
+		listener.listeners = append(listener.listeners, ln)
+	}
+
+	return listener, nil
+}
+
+// Addr returns the first address the listener listens on.
+func (listener *Listener) Addr() net.Addr {
+	return listener.listeners[0].Addr()
+}
+
+// Port returns the TCP port the listener listens on, which is the one to announce to trackers.
+func (listener *Listener) Port() uint16 {
+	var addr, ok = listener.listeners[0].Addr().(*net.TCPAddr)
+	if !ok {
+		return 0
+	}
+
+	return uint16(addr.Port)
+}
+
+// Add makes the listener accept the connections for the torrent with the given info hash, answering their
+// handshakes with `peerId` and handing them to `serve`. A torrent that was added already is replaced.
+func (listener *Listener) Add(infoHash, peerId common.Sha1Hash, serve ServeFunc) {
+	var ctx, cancel = context.WithCancel(context.Background())
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+
+	if old := listener.torrents[infoHash]; old != nil {
+		old.cancel()
+	}
+
+	listener.torrents[infoHash] = &torrent{peerId: peerId, serve: serve, ctx: ctx, cancel: cancel}
+}
+
+// Remove stops the listener from accepting connections for the torrent with the given info hash, and ends
+// the connections it accepted for it. It only returns once they have ended.
+func (listener *Listener) Remove(infoHash common.Sha1Hash) {
+	listener.mu.Lock()
+	var old = listener.torrents[infoHash]
+	delete(listener.torrents, infoHash)
+	listener.mu.Unlock()
+
+	if old != nil {
+		old.cancel()
+		old.running.Wait()
+	}
+}
+
+// lookup returns the torrent with the given info hash and counts a connection for it, or returns nil if the
+// listener doesn't accept connections for it.
+func (listener *Listener) lookup(infoHash common.Sha1Hash) *torrent {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+
+	var found = listener.torrents[infoHash]
+	if found != nil {
+		found.running.Add(1)
+	}
+
+	return found
+}
+
+// infoHashes returns the info hashes of the torrents added to the listener.
+func (listener *Listener) infoHashes() []common.Sha1Hash {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+
+	var infoHashes = make([]common.Sha1Hash, 0, len(listener.torrents))
+	for infoHash := range listener.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes
+}
+
+// Serve accepts connections until `ctx` is cancelled or the listener is closed, handling each of them on a
+// goroutine of its own. Cancelling `ctx` also ends the connections that are up, and closes the listener.
+// Serve only returns once all of them have ended.
+// Returns ctx.Err() once `ctx` is cancelled, or the error that stopped the listener from accepting connections.
+func (listener *Listener) Serve(ctx context.Context) error {
+	defer listener.running.Wait()
+
+	var stopClosing = context.AfterFunc(ctx, func() { listener.Close() })
+	defer stopClosing()
+
+	// the first address to fail stops the others
+	var errs = make(chan error, len(listener.listeners))
+	for _, ln := range listener.listeners {
+		go func() { errs <- listener.accept(ctx, ln) }()
+	}
+
+	var err = <-errs
+	listener.Close()
+	for range listener.listeners[1:] {
+		<-errs
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// accept accepts connections on one of the addresses of the listener until it is closed, handling each of
+// them on a goroutine of its own.
+// Returns the error that stopped it from accepting connections.
+func (listener *Listener) accept(ctx context.Context, ln net.Listener) error {
+	for {
+		var conn, err = ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			conn.Close()
+			return ctx.Err()
+		}
+
+		listener.running.Add(1)
+		go listener.handle(ctx, conn)
+	}
+}
+
+// handle completes the handshake of a connection and hands it to the torrent it is for.
+func (listener *Listener) handle(ctx context.Context, conn net.Conn) {
+	defer listener.running.Done()
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && listener.Filter.Blocked(addr.IP) {
+		conn.Close()
+		return
+	}
+
+	// encrypted connections are decrypted before their handshake is read
+	var peerConn, err = mse.Accept(ctx, conn, listener.Encryption, listener.infoHashes)
+	if err != nil {
+		conn.Close()
+		if !errors.Is(err, mse.ErrUnknownTorrent) {
+			listener.fail(ctx, conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	var found *torrent
+	var torrentClient *client.Client
+	torrentClient, err = client.Accept(ctx, peerConn, func(infoHash common.Sha1Hash) (common.Sha1Hash, bool) {
+		found = listener.lookup(infoHash)
+		if found == nil {
+			return common.Sha1Hash{}, false
+		}
+
+		return found.peerId, true
+	})
+	if found != nil {
+		defer found.running.Done()
+	}
+
+	if err != nil {
+		if !errors.Is(err, client.ErrUnknownTorrent) {
+			listener.fail(ctx, conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	// the connection ends with the listener or once its torrent is removed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var stop = context.AfterFunc(found.ctx, cancel)
+	defer stop()
+
+	found.serve(ctx, torrentClient)
+}
+
+// fail reports the handshake of the peer at `addr` failed with `err`, unless it was cut short by `ctx` ending.
+func (listener *Listener) fail(ctx context.Context, addr net.Addr, err error) {
+	if listener.Failed != nil && ctx.Err() == nil {
+		listener.Failed(addr, err)
+	}
+}
+
+// Close stops the listener from accepting connections. The connections that are up are left alone.
+// Returns an error if any of its addresses could not be closed.
+func (listener *Listener) Close() error {
+	var errs []error
+	for _, ln := range listener.listeners {
+		errs = append(errs, ln.Close())
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,251 @@
+package listener
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/client"
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/handshake"
+	"github.com/winterrdog/lean-bit-torrent-client/ipfilter"
+	"github.com/winterrdog/lean-bit-torrent-client/mse"
+)
+
+// dial opens a connection to the listener and sends a handshake for the torrent with the given info hash.
+func dial(t *testing.T, listener *Listener, infoHash common.Sha1Hash) net.Conn {
+	var conn, err = net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Write(handshake.New(&infoHash, &common.Sha1Hash{0x09}).Serialize())
+	require.Nil(t, err)
+
+	return conn
+}
+
+func TestListener(t *testing.T) {
+	/*
+		test cases:
+		1. connections are handed to the torrent they are for
+		2. connections for unknown torrents are closed
+		3. removing a torrent ends its connections
+		4. cancelling the context stops the listener and ends its connections
+		5. connections from the addresses the filter blocks are closed before their handshake
+		6. several addresses are listened on on the same port
+		7. encrypted connections are accepted, and plaintext ones refused and reported when encryption is required
+	*/
+
+	var infoHash = common.Sha1Hash{0x01}
+	var peerId = common.Sha1Hash{0x02}
+
+	// start returns a listener serving until the test ends
+	var start = func(t *testing.T) (*Listener, context.CancelFunc, chan error) {
+		var listener, err = Listen("127.0.0.1:0")
+		require.Nil(t, err)
+		assert.NotZero(t, listener.Port())
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		var done = make(chan error, 1)
+		go func() { done <- listener.Serve(ctx) }()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		return listener, cancel, done
+	}
+
+	// serveUntilDone returns a ServeFunc that sends the connections it gets on `conns` and keeps them up
+	// until they end
+	var serveUntilDone = func(conns chan *client.Client) ServeFunc {
+		return func(ctx context.Context, conn *client.Client) error {
+			defer conn.Conn.Close()
+			conns <- conn
+			<-ctx.Done()
+			return ctx.Err()
+		}
+	}
+
+	t.Run("connections are handed to the torrent they are for", func(t *testing.T) {
+		var listener, _, _ = start(t)
+		var conns = make(chan *client.Client, 1)
+		listener.Add(infoHash, peerId, serveUntilDone(conns))
+
+		var conn = dial(t, listener, infoHash)
+		var reply, err = handshake.Read(conn)
+		assert.Nil(t, err)
+		assert.Equal(t, peerId, reply.PeerId)
+
+		var served = <-conns
+		assert.Equal(t, infoHash, served.InfoHash)
+		assert.Equal(t, peerId, served.PeerId)
+	})
+
+	t.Run("connections for unknown torrents are closed", func(t *testing.T) {
+		var listener, _, _ = start(t)
+		listener.Add(infoHash, peerId, serveUntilDone(make(chan *client.Client, 1)))
+
+		var conn = dial(t, listener, common.Sha1Hash{0xff})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var _, err = conn.Read(make([]byte, 1))
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("removing a torrent ends its connections", func(t *testing.T) {
+		var listener, _, _ = start(t)
+		var conns = make(chan *client.Client, 1)
+		listener.Add(infoHash, peerId, serveUntilDone(conns))
+
+		var conn = dial(t, listener, infoHash)
+		<-conns
+
+		listener.Remove(infoHash)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var _, err = handshake.Read(conn)
+		assert.Nil(t, err)
+		_, err = conn.Read(make([]byte, 1))
+		assert.NotNil(t, err)
+
+		// new connections for it are turned away
+		conn = dial(t, listener, infoHash)
+		_, err = handshake.Read(conn)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("cancelling the context stops the listener and ends its connections", func(t *testing.T) {
+		var listener, cancel, done = start(t)
+		var conns = make(chan *client.Client, 1)
+		listener.Add(infoHash, peerId, serveUntilDone(conns))
+
+		dial(t, listener, infoHash)
+		<-conns
+
+		cancel()
+		select {
+		case err := <-done:
+			assert.ErrorIs(t, err, context.Canceled)
+			done <- err
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "the listener didn't stop")
+		}
+
+		var _, err = net.Dial("tcp", listener.Addr().String())
+		assert.NotNil(t, err)
+	})
+
+	t.Run("connections from the addresses the filter blocks are closed before their handshake", func(t *testing.T) {
+		var listener, err = Listen("127.0.0.1:0")
+		require.Nil(t, err)
+		listener.Filter = ipfilter.New([]ipfilter.Range{{First: net.IP{127, 0, 0, 1}, Last: net.IP{127, 0, 0, 1}}})
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		var done = make(chan error, 1)
+		go func() { done <- listener.Serve(ctx) }()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		var conns = make(chan *client.Client, 1)
+		listener.Add(infoHash, peerId, serveUntilDone(conns))
+
+		var conn = dial(t, listener, infoHash)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = handshake.Read(conn)
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.Empty(t, conns)
+	})
+
+	t.Run("several addresses are listened on on the same port", func(t *testing.T) {
+		var listener, err = Listen("127.0.0.1:0", "127.0.0.2:0")
+		require.Nil(t, err)
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		var done = make(chan error, 1)
+		go func() { done <- listener.Serve(ctx) }()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		var conns = make(chan *client.Client, 2)
+		listener.Add(infoHash, peerId, serveUntilDone(conns))
+
+		for _, host := range []string{"127.0.0.1", "127.0.0.2"} {
+			var conn net.Conn
+			conn, err = net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(listener.Port()))))
+			require.Nil(t, err)
+			t.Cleanup(func() { conn.Close() })
+
+			_, err = conn.Write(handshake.New(&infoHash, &common.Sha1Hash{0x09}).Serialize())
+			require.Nil(t, err)
+
+			select {
+			case <-conns:
+			case <-time.After(5 * time.Second):
+				assert.Fail(t, "the connection wasn't handed to the torrent", host)
+			}
+		}
+
+		_, err = Listen()
+		assert.NotNil(t, err)
+	})
+
+	t.Run("encrypted connections are accepted, and plaintext ones refused and reported when encryption is required", func(t *testing.T) {
+		var listener, err = Listen("127.0.0.1:0")
+		require.Nil(t, err)
+		listener.Encryption = mse.Required
+		var failures = make(chan error, 1)
+		listener.Failed = func(addr net.Addr, err error) { failures <- err }
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		var done = make(chan error, 1)
+		go func() { done <- listener.Serve(ctx) }()
+		t.Cleanup(func() {
+			cancel()
+			<-done
+		})
+
+		var conns = make(chan *client.Client, 1)
+		listener.Add(infoHash, peerId, serveUntilDone(conns))
+
+		var conn net.Conn
+		conn, err = net.Dial("tcp", listener.Addr().String())
+		require.Nil(t, err)
+		t.Cleanup(func() { conn.Close() })
+
+		conn, err = mse.Initiate(context.Background(), conn, infoHash, mse.Required)
+		require.Nil(t, err)
+		_, err = conn.Write(handshake.New(&infoHash, &common.Sha1Hash{0x09}).Serialize())
+		require.Nil(t, err)
+
+		var reply *handshake.Handshake
+		reply, err = handshake.Read(conn)
+		require.Nil(t, err)
+		assert.Equal(t, peerId, reply.PeerId)
+
+		select {
+		case accepted := <-conns:
+			assert.IsType(t, &mse.Conn{}, accepted.Conn)
+			assert.True(t, accepted.Encrypted)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "the encrypted connection wasn't handed to the torrent")
+		}
+
+		conn = dial(t, listener, infoHash)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = handshake.Read(conn)
+		assert.NotNil(t, err)
+		assert.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+		assert.Empty(t, conns)
+		assert.ErrorIs(t, <-failures, mse.ErrPlaintextRefused)
+	})
+}
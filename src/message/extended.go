@@ -0,0 +1,62 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// MsgExtended carries the messages of the extension protocol (BEP 10).
+// Its payload starts with the ID of the extended message followed by a bencoded dictionary.
+const MsgExtended MessageId = 20
+
+// ExtendedHandshakeId is the extended message ID of the extension protocol handshake.
+const ExtendedHandshakeId byte = 0
+
+// ExtendedHandshake is the bencoded dictionary sent in an extension protocol handshake.
+type ExtendedHandshake struct {
+	M    map[string]int `bencode:"m"`              // extended message IDs supported by the sender
+	V    string         `bencode:"v,omitempty"`    // name and version of the sender's client
+	Reqq int            `bencode:"reqq,omitempty"` // number of outstanding requests the sender accepts
+}
+
+// FormatExtendedHandshake formats an extension protocol handshake carrying the given dictionary.
+// It returns an error if the dictionary cannot be bencoded.
+func FormatExtendedHandshake(hs *ExtendedHandshake) (*Message, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(ExtendedHandshakeId)
+
+	var dict = *hs
+	if dict.M == nil {
+		dict.M = map[string]int{}
+	}
+
+	var err = bencode.Marshal(&buf, dict)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{Id: MsgExtended, Payload: buf.Bytes()}, nil
+}
+
+// ParseExtendedHandshake parses an extension protocol handshake.
+// It verifies that the message is an extended message carrying a handshake and decodes its dictionary.
+// Keys we don't know about are ignored.
+func ParseExtendedHandshake(msg *Message) (*ExtendedHandshake, error) {
+	if msg.Id != MsgExtended {
+		return nil, fmt.Errorf("expected 'extended' message, got %s with ID as %d", msg.Name(), msg.Id)
+	}
+
+	if len(msg.Payload) < 1 || msg.Payload[0] != ExtendedHandshakeId {
+		return nil, fmt.Errorf("expected an extended handshake")
+	}
+
+	var hs ExtendedHandshake
+	var err = bencode.Unmarshal(bytes.NewReader(msg.Payload[1:]), &hs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hs, nil
+}
@@ -0,0 +1,45 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatExtendedHandshake(t *testing.T) {
+	msg, err := FormatExtendedHandshake(&ExtendedHandshake{V: "leechy", Reqq: 250})
+	require.NoError(t, err)
+
+	assert.Equal(t, MsgExtended, msg.Id)
+	assert.Equal(t, "\x00d1:mde4:reqqi250e1:v6:leechye", string(msg.Payload))
+}
+
+func TestParseExtendedHandshake(t *testing.T) {
+	t.Run("Invalid Message ID", func(t *testing.T) {
+		msg := &Message{Id: MsgHave}
+		_, err := ParseExtendedHandshake(msg)
+		assert.EqualError(t, err, "expected 'extended' message, got have with ID as 4")
+	})
+
+	t.Run("Not A Handshake", func(t *testing.T) {
+		msg := &Message{Id: MsgExtended, Payload: []byte("\x01de")}
+		_, err := ParseExtendedHandshake(msg)
+		assert.EqualError(t, err, "expected an extended handshake")
+	})
+
+	t.Run("Malformed Dictionary", func(t *testing.T) {
+		msg := &Message{Id: MsgExtended, Payload: []byte("\x00d4:reqq")}
+		_, err := ParseExtendedHandshake(msg)
+		assert.Error(t, err)
+	})
+
+	t.Run("Valid Message", func(t *testing.T) {
+		msg := &Message{Id: MsgExtended, Payload: []byte("\x00d1:md6:ut_pexi1ee4:reqqi500e1:v13:qBittorrent 41:pi6881ee")}
+		hs, err := ParseExtendedHandshake(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, 500, hs.Reqq)
+		assert.Equal(t, "qBittorrent 4", hs.V)
+		assert.Equal(t, map[string]int{"ut_pex": 1}, hs.M)
+	})
+}
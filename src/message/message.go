@@ -20,6 +20,15 @@ const (
 	MsgCancel                         // cancels a request sent to the peer. useful when a piece is no longer needed
 )
 
+// messages of the Fast Extension (BEP 6)
+const (
+	MsgSuggest       MessageId = 0x0d // suggests a piece the peer would like us to download
+	MsgHaveAll       MessageId = 0x0e // announces that the peer has every piece, in place of a bitfield
+	MsgHaveNone      MessageId = 0x0f // announces that the peer has no pieces, in place of a bitfield
+	MsgRejectRequest MessageId = 0x10 // tells the peer that one of its requests will not be served
+	MsgAllowedFast   MessageId = 0x11 // tells the peer that a piece may be requested even while it is choked
+)
+
 // Message represents a message that can be sent to or received from a peer in the BitTorrent protocol.
 type Message struct {
 	Id      MessageId // message ID (1 byte)
@@ -86,6 +95,18 @@ func (msg *Message) Name() string {
 		return "piece"
 	case MsgCancel:
 		return "cancel"
+	case MsgSuggest:
+		return "suggest"
+	case MsgHaveAll:
+		return "have-all"
+	case MsgHaveNone:
+		return "have-none"
+	case MsgRejectRequest:
+		return "reject-request"
+	case MsgAllowedFast:
+		return "allowed-fast"
+	case MsgExtended:
+		return "extended"
 	default:
 		return fmt.Sprintf("unknown id: %d", msg.Id)
 	}
@@ -108,6 +129,16 @@ func FormatRequestMsg(index, begin, length int) *Message {
 	}
 }
 
+// FormatCancel formats a cancel message for the request with the given index, begin, and length.
+// It returns a pointer to a Message struct containing the formatted message.
+// The payload has the same layout as the payload of a request message.
+func FormatCancel(index, begin, length int) *Message {
+	var msg = FormatRequestMsg(index, begin, length)
+	msg.Id = MsgCancel
+
+	return msg
+}
+
 // FormatHave formats a "have" message with the given index.
 // It returns a pointer to a Message struct containing the formatted message.
 // The payload of the message is a 4-byte buffer containing the index to be sent to the peer.
@@ -118,6 +149,29 @@ func FormatHave(index int) *Message {
 	return &Message{Id: MsgHave, Payload: payload[:]}
 }
 
+// FormatRejectRequest formats a 'reject-request' message for the request with the given index, begin, and length.
+// It returns a pointer to a Message struct containing the formatted message.
+// The payload has the same layout as the payload of a request message.
+func FormatRejectRequest(index, begin, length int) *Message {
+	var msg = FormatRequestMsg(index, begin, length)
+	msg.Id = MsgRejectRequest
+
+	return msg
+}
+
+// FormatPiece formats a 'piece' message carrying the block of data at offset `begin` of the piece at `index`.
+// It returns a pointer to a Message struct containing the formatted message.
+// The payload of the message is the index and begin offset, 4 bytes each, followed by the data.
+func FormatPiece(index, begin int, data []byte) *Message {
+	var payload = make([]byte, 8+len(data))
+
+	binary.BigEndian.PutUint32(payload[:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+
+	return &Message{Id: MsgPiece, Payload: payload}
+}
+
 // ParsePiece parses a 'piece' message and extracts the piece index, begin offset, and data from the message payload.
 // It verifies that the message ID is 'piece' and checks the payload length.
 // If the parsed index does not match the expected index, or if the begin offset is beyond the buffer size,
@@ -158,6 +212,44 @@ func ParsePiece(index int, dataBuf []byte, msg *Message) (int, error) {
 	return dataLen, nil
 }
 
+// ParseBlock parses a 'piece' message without knowing in advance which piece it belongs to.
+// It verifies that the message ID is 'piece' and that the payload holds at least the index and begin offset.
+// It returns the piece index, the begin offset and the block data. The returned data aliases the message payload.
+func ParseBlock(msg *Message) (index int, begin int, data []byte, err error) {
+	if msg.Id != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("expected 'piece' message, got %s with ID as %d", msg.Name(), msg.Id)
+	}
+
+	if !(len(msg.Payload) >= 8) {
+		return 0, 0, nil, fmt.Errorf("expected payload length of at least 8, got %d", len(msg.Payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.Payload[:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	data = msg.Payload[8:]
+
+	return index, begin, data, nil
+}
+
+// ParseRequest parses a 'request', 'cancel' or 'reject-request' message, which all share the same payload.
+// It returns the piece index, the begin offset and the length of the block the message refers to.
+// If the message ID or payload length is not as expected, it returns an error.
+func ParseRequest(msg *Message) (index int, begin int, length int, err error) {
+	if msg.Id != MsgRequest && msg.Id != MsgCancel && msg.Id != MsgRejectRequest {
+		return 0, 0, 0, fmt.Errorf("expected 'request', 'cancel' or 'reject-request' message, got %s with ID as %d", msg.Name(), msg.Id)
+	}
+
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length of 12, got %d", len(msg.Payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(msg.Payload[:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+
+	return index, begin, length, nil
+}
+
 // ParseHave parses a 'have' message and returns the index of the piece that the sender has.
 // It expects the message ID to be MsgHave and the payload length to be 4.
 // If the message ID or payload length is not as expected, it returns an error.
@@ -21,6 +21,20 @@ func TestFormatRequestMsg(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatCancel(t *testing.T) {
+	msg := FormatCancel(4, 567, 4321)
+	expected := &Message{
+		Id: MsgCancel,
+		Payload: []byte{
+			0x0, 0x0, 0x0, 0x4, // index
+			0x0, 0x0, 0x02, 0x37, // begin
+			0x0, 0x0, 0x10, 0xe1, // length
+		},
+	}
+
+	assert.Equal(t, expected, msg)
+}
+
 func TestFormatHave(t *testing.T) {
 	msg := FormatHave(123)
 	expected := &Message{
@@ -31,6 +45,40 @@ func TestFormatHave(t *testing.T) {
 	assert.Equal(t, expected, msg)
 }
 
+func TestFormatRejectRequest(t *testing.T) {
+	msg := FormatRejectRequest(4, 567, 4321)
+	expected := &Message{
+		Id: MsgRejectRequest,
+		Payload: []byte{
+			0x0, 0x0, 0x0, 0x4, // index
+			0x0, 0x0, 0x02, 0x37, // begin
+			0x0, 0x0, 0x10, 0xe1, // length
+		},
+	}
+
+	assert.Equal(t, expected, msg)
+}
+
+func TestFormatPiece(t *testing.T) {
+	msg := FormatPiece(4, 567, []byte("abc"))
+	expected := &Message{
+		Id: MsgPiece,
+		Payload: []byte{
+			0x0, 0x0, 0x0, 0x4, // index
+			0x0, 0x0, 0x02, 0x37, // begin
+			'a', 'b', 'c', // data
+		},
+	}
+
+	assert.Equal(t, expected, msg)
+
+	index, begin, data, err := ParseBlock(msg)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, index)
+	assert.Equal(t, 567, begin)
+	assert.Equal(t, []byte("abc"), data)
+}
+
 func TestParsePiece(t *testing.T) {
 	t.Run("Invalid Message ID", func(t *testing.T) {
 		msg := &Message{Id: MsgChoke}
@@ -108,6 +156,36 @@ func TestParsePiece(t *testing.T) {
 	})
 }
 
+func TestParseBlock(t *testing.T) {
+	t.Run("Invalid Message ID", func(t *testing.T) {
+		msg := &Message{Id: MsgHave}
+		_, _, _, err := ParseBlock(msg)
+		assert.EqualError(t, err, "expected 'piece' message, got have with ID as 4")
+	})
+
+	t.Run("Payload Too Short", func(t *testing.T) {
+		msg := &Message{Id: MsgPiece, Payload: []byte{0x0, 0x0, 0x0, 0x0}}
+		_, _, _, err := ParseBlock(msg)
+		assert.EqualError(t, err, "expected payload length of at least 8, got 4")
+	})
+
+	t.Run("Valid Message", func(t *testing.T) {
+		msg := &Message{
+			Id: MsgPiece,
+			Payload: []byte{
+				0x0, 0x0, 0x0, 0x7, // index
+				0x0, 0x0, 0x40, 0x0, // begin
+				0xaa, 0xbb, 0xcc, // data
+			},
+		}
+		index, begin, data, err := ParseBlock(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, 7, index)
+		assert.Equal(t, 16384, begin)
+		assert.Equal(t, []byte{0xaa, 0xbb, 0xcc}, data)
+	})
+}
+
 func TestString(t *testing.T) {
 	/*
 		for each message type, test that the string representation and payload length are as expected
@@ -153,9 +231,21 @@ func TestString(t *testing.T) {
 			msg:      &Message{Id: MsgCancel, Payload: []byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x3}},
 			expected: "cancel [12]",
 		},
+		{
+			msg:      &Message{Id: MsgHaveAll, Payload: nil},
+			expected: "have-all [0]",
+		},
+		{
+			msg:      &Message{Id: MsgRejectRequest, Payload: []byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x3}},
+			expected: "reject-request [12]",
+		},
 		{
 			msg:      &Message{Id: 0x0f, Payload: []byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x3}},
-			expected: "unknown id: 15 [12]",
+			expected: "have-none [12]",
+		},
+		{
+			msg:      &Message{Id: 0x1f, Payload: []byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x3}},
+			expected: "unknown id: 31 [12]",
 		},
 		{
 			msg:      nil,
@@ -236,6 +326,33 @@ func TestRead(t *testing.T) {
 	})
 }
 
+func TestParseRequest(t *testing.T) {
+	t.Run("Invalid Message ID", func(t *testing.T) {
+		msg := &Message{Id: MsgPiece}
+		_, _, _, err := ParseRequest(msg)
+		assert.EqualError(t, err, "expected 'request', 'cancel' or 'reject-request' message, got piece with ID as 7")
+	})
+
+	t.Run("Invalid Payload Length", func(t *testing.T) {
+		msg := &Message{Id: MsgRequest, Payload: []byte{0x0, 0x0, 0x0, 0x1}}
+		_, _, _, err := ParseRequest(msg)
+		assert.EqualError(t, err, "expected payload length of 12, got 4")
+	})
+
+	t.Run("Valid Messages", func(t *testing.T) {
+		for _, id := range []MessageId{MsgRequest, MsgCancel, MsgRejectRequest} {
+			msg := FormatRequestMsg(4, 567, 4321)
+			msg.Id = id
+
+			index, begin, length, err := ParseRequest(msg)
+			assert.NoError(t, err)
+			assert.Equal(t, 4, index)
+			assert.Equal(t, 567, begin)
+			assert.Equal(t, 4321, length)
+		}
+	})
+}
+
 func TestParseHave(t *testing.T) {
 	t.Run("Invalid Message ID", func(t *testing.T) {
 		msg := &Message{Id: MsgChoke}
@@ -0,0 +1,67 @@
+package mse
+
+import (
+	"bufio"
+	"crypto/rc4"
+	"net"
+	"sync"
+)
+
+// Conn is a connection past the MSE key exchange, which decrypts what is read from it and encrypts what is
+// written to it. If plaintext was selected, it passes the Bittorrent stream through as it is.
+type Conn struct {
+	net.Conn
+
+	reader  *bufio.Reader // reads the connection, with what was read past the key exchange buffered
+	pending []byte        // decrypted initial payload of the peer, read before the rest of the stream
+
+	readMu   sync.Mutex
+	decrypt  *rc4.Cipher // nil if plaintext was selected
+	writeMu  sync.Mutex
+	encrypt  *rc4.Cipher // nil if plaintext was selected
+	writeBuf []byte      // encrypted copy of the data being written, reused between writes
+}
+
+// Encrypted reports whether the Bittorrent stream is encrypted, rather than only its handshake.
+func (conn *Conn) Encrypted() bool {
+	return conn.encrypt != nil
+}
+
+// Read reads and decrypts data from the connection.
+func (conn *Conn) Read(b []byte) (int, error) {
+	conn.readMu.Lock()
+	defer conn.readMu.Unlock()
+
+	if len(conn.pending) > 0 {
+		var n = copy(b, conn.pending)
+		conn.pending = conn.pending[n:]
+		return n, nil
+	}
+
+	var n, err = conn.reader.Read(b)
+	if conn.decrypt != nil {
+		conn.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+// Write encrypts data and writes it to the connection. The keystream goes on in the order of the writes, so
+// concurrent writes are done one after the other.
+func (conn *Conn) Write(b []byte) (int, error) {
+	if conn.encrypt == nil {
+		return conn.Conn.Write(b)
+	}
+
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+
+	if cap(conn.writeBuf) < len(b) {
+		conn.writeBuf = make([]byte, len(b))
+	}
+	var encrypted = conn.writeBuf[:len(b)]
+	conn.encrypt.XORKeyStream(encrypted, b)
+
+	// a short write leaves the stream out of sync with the peer, which is then beyond repair anyway
+	return conn.Conn.Write(encrypted)
+}
@@ -0,0 +1,106 @@
+package mse
+
+import (
+	"bufio"
+	"crypto/rc4"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConn(t *testing.T) {
+	/*
+		test cases:
+		1. what is written is encrypted on the wire and decrypted on the other end
+		2. concurrent writes keep the keystream in step with the peer
+		3. the pending initial payload is read first
+	*/
+
+	// newPair returns both ends of a connection encrypting what goes each way with the same keys
+	var newPair = func(t *testing.T) (*Conn, *Conn, net.Conn) {
+		var client, server = connPair(t)
+		var cipher = func(key string) *rc4.Cipher {
+			var c, err = rc4.NewCipher([]byte(key))
+			require.Nil(t, err)
+			return c
+		}
+
+		var a = &Conn{Conn: client, reader: bufio.NewReader(client), encrypt: cipher("a"), decrypt: cipher("b")}
+		var b = &Conn{Conn: server, reader: bufio.NewReader(server), encrypt: cipher("b"), decrypt: cipher("a")}
+		return a, b, server
+	}
+
+	t.Run("what is written is encrypted on the wire and decrypted on the other end", func(t *testing.T) {
+		var a, b, raw = newPair(t)
+		var plaintext = []byte("\x13BitTorrent protocol")
+
+		var _, err = a.Write(plaintext)
+		require.Nil(t, err)
+		assert.Equal(t, "\x13BitTorrent protocol", string(plaintext), "the written data is left alone")
+
+		var wire = make([]byte, len(plaintext))
+		_, err = io.ReadFull(raw, wire)
+		require.Nil(t, err)
+		assert.NotEqual(t, plaintext, wire)
+
+		// decrypted by a cipher with the same key
+		var decrypt, _ = rc4.NewCipher([]byte("a"))
+		decrypt.XORKeyStream(wire, wire)
+		assert.Equal(t, plaintext, wire)
+
+		_, err = b.Write([]byte("pong"))
+		require.Nil(t, err)
+		var buf = make([]byte, 4)
+		_, err = io.ReadFull(a, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "pong", string(buf))
+	})
+
+	t.Run("concurrent writes keep the keystream in step with the peer", func(t *testing.T) {
+		var a, b, _ = newPair(t)
+		const writers, size = 8, 4096
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var block = make([]byte, size)
+				for j := range block {
+					block[j] = byte(i)
+				}
+				a.Write(block)
+			}()
+		}
+
+		var buf = make([]byte, writers*size)
+		var _, err = io.ReadFull(b, buf)
+		wg.Wait()
+		require.Nil(t, err)
+
+		// every block arrives whole, in whatever order they were written
+		for i := 0; i < writers; i++ {
+			var block = buf[i*size : (i+1)*size]
+			for _, c := range block {
+				require.Equal(t, block[0], c)
+			}
+		}
+	})
+
+	t.Run("the pending initial payload is read first", func(t *testing.T) {
+		var a, b, _ = newPair(t)
+		b.pending = []byte("hello")
+
+		var _, err = a.Write([]byte(" world"))
+		require.Nil(t, err)
+
+		var buf = make([]byte, 11)
+		_, err = io.ReadFull(b, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello world", string(buf))
+	})
+}
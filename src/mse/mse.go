@@ -0,0 +1,466 @@
+// Package mse implements Message Stream Encryption, also known as Protocol Encryption: a Diffie-Hellman key
+// exchange between two peers, after which the Bittorrent connection between them is obfuscated with RC4.
+// It keeps networks that throttle or block Bittorrent from recognizing its handshake, and lets us talk to the
+// peers refusing plaintext connections. It is not meant to keep the data secret, since anyone knowing the
+// info hash can read it.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+)
+
+// Policy tells whether the connections to and from peers are encrypted.
+type Policy int
+
+const (
+	Disabled  Policy = iota // connections are plaintext, and encrypted ones from peers are refused
+	Preferred               // connections are encrypted, falling back to plaintext with the peers that don't support it
+	Required                // connections are encrypted, and plaintext ones are refused
+)
+
+// ParsePolicy returns the policy with the given name, "disabled", "preferred" or "required".
+// Returns an error if there is no such policy.
+func ParsePolicy(name string) (Policy, error) {
+	switch name {
+	case "disabled":
+		return Disabled, nil
+	case "preferred":
+		return Preferred, nil
+	case "required":
+		return Required, nil
+	default:
+		return 0, fmt.Errorf("unknown encryption policy %q, expected \"disabled\", \"preferred\" or \"required\"", name)
+	}
+}
+
+// String returns the name of the policy.
+func (policy Policy) String() string {
+	switch policy {
+	case Disabled:
+		return "disabled"
+	case Preferred:
+		return "preferred"
+	case Required:
+		return "required"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	// ErrPlaintextRefused is returned by Accept when a peer opens a plaintext connection while encryption is
+	// required.
+	ErrPlaintextRefused = errors.New("plaintext connections are refused")
+	// ErrUnknownTorrent is returned by Accept when a peer asks for a torrent we don't serve.
+	ErrUnknownTorrent = errors.New("encrypted connection for an unknown torrent")
+	// ErrNoCryptoMethod is returned when the peers have no method of obfuscating the connection in common,
+	// e.g. when one of them requires encryption and the other one only offers plaintext.
+	ErrNoCryptoMethod = errors.New("no crypto method in common with the peer")
+)
+
+const (
+	keySize          = 96              // bytes of the public keys and the shared secret
+	maxPadding       = 512             // bytes of padding at most in each step of the handshake
+	discarded        = 1024            // bytes of the RC4 keystreams dropped before use, as its first bytes are weak
+	handshakeTimeout = 5 * time.Second // how long the key exchange may take
+)
+
+// methods of obfuscating the connection a peer provides or selects, as a bit field
+const (
+	cryptoPlaintext uint32 = 0x01 // only the handshake is encrypted, the Bittorrent stream is plaintext
+	cryptoRC4       uint32 = 0x02 // the Bittorrent stream is encrypted with RC4
+)
+
+var (
+	// prime is the modulus of the Diffie-Hellman key exchange, whose generator is 2.
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	// verificationConstant is sent encrypted by both sides to show they derived the same keys.
+	verificationConstant = make([]byte, 8)
+
+	// plaintextProtocol is the start of a plaintext Bittorrent handshake, which tells it from an encrypted one.
+	plaintextProtocol = []byte("\x13BitTorrent protocol")
+)
+
+// Initiate encrypts a connection we opened to a peer for the torrent with the given info hash, and returns the
+// connection to speak Bittorrent on. The handshake is obfuscated whatever the policy, and so is the rest of the
+// stream, unless the policy is Preferred and the peer only offers plaintext.
+// The policy must not be Disabled, under which connections are left alone.
+// Cancelling `ctx` aborts the key exchange.
+// Returns an error if the peer doesn't speak MSE, which it may show by dropping the connection, or if it has no
+// crypto method in common with us. The connection is left to the caller to close.
+func Initiate(ctx context.Context, conn net.Conn, infoHash common.Sha1Hash, policy Policy) (net.Conn, error) {
+	var stopClosing = context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClosing()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// plaintext is only offered if we can do without encryption
+	var provide = cryptoRC4
+	if policy == Preferred {
+		provide |= cryptoPlaintext
+	}
+
+	var encrypted, err = initiate(conn, infoHash, provide, nil)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return encrypted, err
+}
+
+// initiate runs the key exchange of Initiate, offering the crypto methods in `provide` and sending `initial`
+// as the initial payload, which the Bittorrent handshake may be sent in.
+func initiate(conn net.Conn, infoHash common.Sha1Hash, provide uint32, initial []byte) (net.Conn, error) {
+	var private, public, err = newKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. send our public key and some padding
+	var padding []byte
+	padding, err = randomPadding()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(public, padding...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. get the peer's public key, from which the shared secret follows
+	var reader = bufio.NewReader(conn)
+	var peerPublic = make([]byte, keySize)
+	_, err = io.ReadFull(reader, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret = sharedSecret(private, peerPublic)
+
+	// 3. tell the peer which torrent we are after and which crypto methods we provide
+	var encrypt = newCipher("keyA", secret, infoHash)
+	var decrypt = newCipher("keyB", secret, infoHash)
+
+	var req2, req3 = hash([]byte("req2"), infoHash[:]), hash([]byte("req3"), secret)
+	var msg = hash([]byte("req1"), secret)
+	for i := range req2 {
+		msg = append(msg, req2[i]^req3[i])
+	}
+
+	var offer = binary.BigEndian.AppendUint32(append([]byte(nil), verificationConstant...), provide)
+	offer = binary.BigEndian.AppendUint16(offer, 0) // no padding
+	offer = binary.BigEndian.AppendUint16(offer, uint16(len(initial)))
+	offer = append(offer, initial...)
+	encrypt.XORKeyStream(offer, offer)
+
+	_, err = conn.Write(append(msg, offer...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. find the peer's answer behind its padding, starting with the verification constant
+	var answerStart = make([]byte, len(verificationConstant))
+	decrypt.XORKeyStream(answerStart, verificationConstant)
+
+	err = skipTo(reader, answerStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var answer = make([]byte, 6)
+	_, err = io.ReadFull(reader, answer)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(answer, answer)
+
+	var selected = binary.BigEndian.Uint32(answer)
+	if selected&provide == 0 || selected&(selected-1) != 0 {
+		return nil, fmt.Errorf("%w: the peer selected %#x", ErrNoCryptoMethod, selected)
+	}
+
+	err = skipPadding(reader, binary.BigEndian.Uint16(answer[4:]), decrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	if selected == cryptoPlaintext {
+		return &Conn{Conn: conn, reader: reader}, nil
+	}
+
+	return &Conn{Conn: conn, reader: reader, encrypt: encrypt, decrypt: decrypt}, nil
+}
+
+// Accept tells a plaintext connection a peer opened to us from an encrypted one, and returns the connection
+// to speak Bittorrent on. Plaintext connections are refused if the policy is Required, and encrypted ones if it
+// is Disabled, which reads nothing from the connection and returns it as it is.
+// `infoHashes` returns the info hashes of the torrents we serve, one of which an encrypted connection must be
+// for. The initial payload the peer may send along with its key exchange, e.g. its Bittorrent handshake, is
+// the first thing read from the returned connection.
+// Cancelling `ctx` aborts the key exchange.
+// Returns ErrPlaintextRefused, ErrUnknownTorrent or ErrNoCryptoMethod if the connection can't be accepted, or an
+// error if the key exchange fails. The connection is left to the caller to close.
+func Accept(ctx context.Context, conn net.Conn, policy Policy, infoHashes func() []common.Sha1Hash) (net.Conn, error) {
+	if policy == Disabled {
+		return conn, nil
+	}
+
+	var stopClosing = context.AfterFunc(ctx, func() { conn.Close() })
+	defer stopClosing()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var encrypted, err = accept(conn, policy, infoHashes)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return encrypted, err
+}
+
+// accept runs the key exchange of Accept.
+func accept(conn net.Conn, policy Policy, infoHashes func() []common.Sha1Hash) (net.Conn, error) {
+	var reader = bufio.NewReaderSize(conn, keySize+maxPadding)
+	var start, err = reader.Peek(len(plaintextProtocol))
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, plaintextProtocol) {
+		if policy == Required {
+			return nil, ErrPlaintextRefused
+		}
+
+		return &Conn{Conn: conn, reader: reader}, nil
+	}
+
+	// 1. get the peer's public key, from which the shared secret follows
+	var peerPublic = make([]byte, keySize)
+	_, err = io.ReadFull(reader, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	var private, public []byte
+	private, public, err = newKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var secret = sharedSecret(private, peerPublic)
+
+	// 2. send our public key and some padding
+	var padding []byte
+	padding, err = randomPadding()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(public, padding...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. find the torrent the peer is after behind its padding, then the crypto methods it provides
+	err = skipTo(reader, hash([]byte("req1"), secret))
+	if err != nil {
+		return nil, err
+	}
+
+	var obfuscatedHash = make([]byte, sha1.Size)
+	_, err = io.ReadFull(reader, obfuscatedHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var infoHash, found = findTorrent(obfuscatedHash, secret, infoHashes())
+	if !found {
+		return nil, ErrUnknownTorrent
+	}
+
+	var decrypt = newCipher("keyA", secret, infoHash)
+	var encrypt = newCipher("keyB", secret, infoHash)
+
+	var offer = make([]byte, len(verificationConstant)+6)
+	_, err = io.ReadFull(reader, offer)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(offer, offer)
+
+	if !bytes.Equal(offer[:len(verificationConstant)], verificationConstant) {
+		return nil, errors.New("wrong verification constant in the encrypted handshake")
+	}
+
+	var provide = binary.BigEndian.Uint32(offer[len(verificationConstant):])
+	err = skipPadding(reader, binary.BigEndian.Uint16(offer[len(verificationConstant)+4:]), decrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	var initialLength = make([]byte, 2)
+	_, err = io.ReadFull(reader, initialLength)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(initialLength, initialLength)
+
+	var initial = make([]byte, binary.BigEndian.Uint16(initialLength))
+	_, err = io.ReadFull(reader, initial)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(initial, initial)
+
+	// 4. select RC4 whenever the peer provides it, and plaintext only if we don't insist on encryption
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy == Preferred:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("%w: the peer provides %#x", ErrNoCryptoMethod, provide)
+	}
+
+	var answer = binary.BigEndian.AppendUint32(append([]byte(nil), verificationConstant...), selected)
+	answer = binary.BigEndian.AppendUint16(answer, 0) // no padding
+	encrypt.XORKeyStream(answer, answer)
+
+	_, err = conn.Write(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	// the initial payload was encrypted with RC4 whatever the selected method, so it is handed over decrypted
+	if selected == cryptoPlaintext {
+		return &Conn{Conn: conn, reader: reader, pending: initial}, nil
+	}
+
+	return &Conn{Conn: conn, reader: reader, pending: initial, encrypt: encrypt, decrypt: decrypt}, nil
+}
+
+// newKeys returns a random private key of the Diffie-Hellman key exchange and the public key that goes with it.
+// Returns an error if no random key could be generated.
+func newKeys() ([]byte, []byte, error) {
+	var private = make([]byte, 20)
+	var _, err = rand.Read(private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var public = new(big.Int).Exp(generator, new(big.Int).SetBytes(private), prime)
+	return private, public.FillBytes(make([]byte, keySize)), nil
+}
+
+// sharedSecret returns the secret both sides of the key exchange end up with, from our private key and the
+// peer's public key.
+func sharedSecret(private, peerPublic []byte) []byte {
+	var secret = new(big.Int).Exp(new(big.Int).SetBytes(peerPublic), new(big.Int).SetBytes(private), prime)
+	return secret.FillBytes(make([]byte, keySize))
+}
+
+// randomPadding returns up to maxPadding random bytes, which keep the length of the handshake from giving it away.
+// Returns an error if no random bytes could be generated.
+func randomPadding() ([]byte, error) {
+	var length = make([]byte, 2)
+	var _, err = rand.Read(length)
+	if err != nil {
+		return nil, err
+	}
+
+	var padding = make([]byte, int(binary.BigEndian.Uint16(length))%(maxPadding+1))
+	_, err = rand.Read(padding)
+	return padding, err
+}
+
+// hash returns the SHA-1 hash of the given parts put together.
+func hash(parts ...[]byte) []byte {
+	var hasher = sha1.New()
+	for _, part := range parts {
+		hasher.Write(part)
+	}
+
+	return hasher.Sum(nil)
+}
+
+// newCipher returns the RC4 cipher keyed with the shared secret and the info hash for the side named `name`,
+// "keyA" for the side that opened the connection and "keyB" for the other one, past its discarded bytes.
+func newCipher(name string, secret []byte, infoHash common.Sha1Hash) *rc4.Cipher {
+	var cipher, _ = rc4.NewCipher(hash([]byte(name), secret, infoHash[:])) // never fails with a 20-byte key
+	var discard = make([]byte, discarded)
+	cipher.XORKeyStream(discard, discard)
+
+	return cipher
+}
+
+// findTorrent returns the info hash among `infoHashes` the peer obfuscated as `obfuscated` with the shared
+// secret, and false if it is none of them.
+func findTorrent(obfuscated, secret []byte, infoHashes []common.Sha1Hash) (common.Sha1Hash, bool) {
+	var req3 = hash([]byte("req3"), secret)
+	for _, infoHash := range infoHashes {
+		var req2 = hash([]byte("req2"), infoHash[:])
+		for i := range req2 {
+			req2[i] ^= req3[i]
+		}
+
+		if bytes.Equal(req2, obfuscated) {
+			return infoHash, true
+		}
+	}
+
+	return common.Sha1Hash{}, false
+}
+
+// skipTo reads past the padding of the peer up to and including `marker`, which must come within maxPadding
+// bytes.
+// Returns an error if it doesn't.
+func skipTo(reader *bufio.Reader, marker []byte) error {
+	var seen = make([]byte, 0, maxPadding+len(marker))
+	for len(seen) < cap(seen) {
+		var b, err = reader.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		seen = append(seen, b)
+		if bytes.HasSuffix(seen, marker) {
+			return nil
+		}
+	}
+
+	return errors.New("the encrypted handshake of the peer is malformed")
+}
+
+// skipPadding reads past `length` bytes of encrypted padding, which must be at most maxPadding bytes.
+// Returns an error if it is longer or can't be read.
+func skipPadding(reader *bufio.Reader, length uint16, decrypt *rc4.Cipher) error {
+	if length > maxPadding {
+		return fmt.Errorf("the padding of the peer is %d bytes long, expected at most %d", length, maxPadding)
+	}
+
+	var padding = make([]byte, length)
+	var _, err = io.ReadFull(reader, padding)
+	decrypt.XORKeyStream(padding, padding)
+
+	return err
+}
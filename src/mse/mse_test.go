@@ -0,0 +1,195 @@
+package mse
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+)
+
+// connPair returns both ends of a TCP connection, closed when the test ends.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	var ln, err = net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	var accepted = make(chan net.Conn, 1)
+	go func() {
+		var conn, _ = ln.Accept()
+		accepted <- conn
+	}()
+
+	var client net.Conn
+	client, err = net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+
+	var server = <-accepted
+	require.NotNil(t, server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+// result is what a side of the key exchange ended up with.
+type result struct {
+	conn net.Conn
+	err  error
+}
+
+// acceptAsync accepts the encrypted connection on `server` on a goroutine of its own.
+func acceptAsync(server net.Conn, policy Policy, infoHashes ...common.Sha1Hash) chan result {
+	var done = make(chan result, 1)
+	go func() {
+		var conn, err = Accept(context.Background(), server, policy, func() []common.Sha1Hash { return infoHashes })
+		done <- result{conn, err}
+	}()
+
+	return done
+}
+
+// assertTalks checks that what is written on either connection is read as it is on the other.
+func assertTalks(t *testing.T, a, b net.Conn) {
+	for _, pair := range [][2]net.Conn{{a, b}, {b, a}} {
+		var _, err = pair[0].Write([]byte("\x13BitTorrent protocol"))
+		require.Nil(t, err)
+
+		var buf = make([]byte, 20)
+		_, err = io.ReadFull(pair[1], buf)
+		require.Nil(t, err)
+		assert.Equal(t, "\x13BitTorrent protocol", string(buf))
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{Disabled, Preferred, Required} {
+		var parsed, err = ParsePolicy(policy.String())
+		assert.Nil(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+
+	var _, err = ParsePolicy("sometimes")
+	assert.NotNil(t, err)
+}
+
+func TestHandshake(t *testing.T) {
+	/*
+		test cases:
+		1. the connection is encrypted when both sides can encrypt it
+		2. plaintext is selected for peers only offering plaintext, unless encryption is required
+		3. plaintext handshakes are passed through unless encryption is required
+		4. encrypted connections for unknown torrents are refused
+		5. peers that don't speak MSE fail the key exchange
+		6. cancelling the context aborts the key exchange
+	*/
+
+	var infoHash = common.Sha1Hash{0x01}
+	var otherInfoHash = common.Sha1Hash{0x02}
+
+	t.Run("the connection is encrypted when both sides can encrypt it", func(t *testing.T) {
+		for _, policies := range [][2]Policy{{Preferred, Preferred}, {Preferred, Required}, {Required, Preferred}} {
+			var client, server = connPair(t)
+			var accepted = acceptAsync(server, policies[1], otherInfoHash, infoHash)
+
+			var conn, err = Initiate(context.Background(), client, infoHash, policies[0])
+			require.Nil(t, err, policies)
+
+			var other = <-accepted
+			require.Nil(t, other.err, policies)
+			assert.True(t, conn.(*Conn).Encrypted())
+			assert.True(t, other.conn.(*Conn).Encrypted())
+			assertTalks(t, conn, other.conn)
+		}
+	})
+
+	t.Run("plaintext is selected for peers only offering plaintext, unless encryption is required", func(t *testing.T) {
+		var client, server = connPair(t)
+		var accepted = acceptAsync(server, Preferred, infoHash)
+
+		var conn, err = initiate(client, infoHash, cryptoPlaintext, []byte("hello"))
+		require.Nil(t, err)
+
+		var other = <-accepted
+		require.Nil(t, other.err)
+		assert.False(t, conn.(*Conn).Encrypted())
+		assert.False(t, other.conn.(*Conn).Encrypted())
+
+		// the initial payload comes first
+		var buf = make([]byte, 5)
+		_, err = io.ReadFull(other.conn, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(buf))
+		assertTalks(t, conn, other.conn)
+
+		client, server = connPair(t)
+		accepted = acceptAsync(server, Required, infoHash)
+		var initiated = make(chan error, 1)
+		go func() {
+			var _, err = initiate(client, infoHash, cryptoPlaintext, nil)
+			initiated <- err
+		}()
+
+		assert.ErrorIs(t, (<-accepted).err, ErrNoCryptoMethod)
+		server.Close()
+		assert.NotNil(t, <-initiated)
+	})
+
+	t.Run("plaintext handshakes are passed through unless encryption is required", func(t *testing.T) {
+		for _, policy := range []Policy{Disabled, Preferred} {
+			var client, server = connPair(t)
+			var accepted = acceptAsync(server, policy, infoHash)
+
+			var _, err = client.Write([]byte("\x13BitTorrent protocol"))
+			require.Nil(t, err)
+
+			var other = <-accepted
+			require.Nil(t, other.err, policy)
+
+			var buf = make([]byte, 20)
+			_, err = io.ReadFull(other.conn, buf)
+			assert.Nil(t, err)
+			assert.Equal(t, "\x13BitTorrent protocol", string(buf))
+		}
+
+		var client, server = connPair(t)
+		var accepted = acceptAsync(server, Required, infoHash)
+		client.Write([]byte("\x13BitTorrent protocol"))
+		assert.ErrorIs(t, (<-accepted).err, ErrPlaintextRefused)
+	})
+
+	t.Run("encrypted connections for unknown torrents are refused", func(t *testing.T) {
+		var client, server = connPair(t)
+		var accepted = acceptAsync(server, Preferred, otherInfoHash)
+
+		go Initiate(context.Background(), client, infoHash, Preferred)
+		assert.ErrorIs(t, (<-accepted).err, ErrUnknownTorrent)
+	})
+
+	t.Run("peers that don't speak MSE fail the key exchange", func(t *testing.T) {
+		var client, server = connPair(t)
+		go func() {
+			// a plaintext peer reading what it takes for a handshake and giving up on it
+			io.ReadFull(server, make([]byte, 68))
+			server.Close()
+		}()
+
+		var _, err = Initiate(context.Background(), client, infoHash, Preferred)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("cancelling the context aborts the key exchange", func(t *testing.T) {
+		var client, _ = connPair(t)
+		var ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		var _, err = Initiate(ctx, client, infoHash, Required)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
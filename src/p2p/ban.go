@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"github.com/winterrdog/lean-bit-torrent-client/ipfilter"
+	"github.com/winterrdog/lean-bit-torrent-client/peerban"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+// Bans returns the list of the peers banned for sending corrupt data: GlobalBans if set, otherwise a list of
+// the torrent's own created on first use, which bans the peers blamed for MaxHashFailures corrupt pieces.
+func (torrent *Torrent) Bans() *peerban.List {
+	torrent.bansOnce.Do(torrent.initBans)
+
+	return torrent.bans
+}
+
+// smartBan returns what finds the culprits among the peers that sent the blocks of a corrupt piece.
+func (torrent *Torrent) smartBan() *peerban.SmartBan {
+	torrent.bansOnce.Do(torrent.initBans)
+
+	return torrent.suspects
+}
+
+// initBans creates the ban list, unless it is shared with other torrents, and the smart ban of the torrent.
+func (torrent *Torrent) initBans() {
+	torrent.bans = torrent.GlobalBans
+	if torrent.bans == nil {
+		torrent.bans = peerban.NewList(torrent.MaxHashFailures)
+	}
+
+	torrent.suspects = peerban.NewSmartBan(MaxBlockSize)
+}
+
+// refused returns why connections to and from the peer aren't allowed: ipfilter.ErrBlocked if the IP filter
+// blocks its address, or peerban.ErrBanned if it is banned for sending corrupt data.
+// It returns nil if they are allowed.
+func (torrent *Torrent) refused(peer peers.Peer) error {
+	if torrent.Filter.Blocked(peer.IP) {
+		return ipfilter.ErrBlocked
+	}
+
+	if torrent.Bans().Banned(peer.IP) {
+		return peerban.ErrBanned
+	}
+
+	return nil
+}
+
+// blameCorrupt blames the peers that sent the blocks of the piece at `index`, which failed its integrity
+// check, where `data` is the piece and `senders` the peer each of its blocks came from.
+// A peer that sent every block gets a strike right away, and is banned once it has too many. When several
+// peers sent blocks, the culprits are found once the piece is downloaded again, see blameValid.
+func (torrent *Torrent) blameCorrupt(index int, data []byte, senders []peers.Peer) {
+	for _, peer := range torrent.smartBan().Failed(index, data, senders) {
+		if torrent.Bans().Strike(peer.IP) {
+			torrent.peerBanned(peer, index)
+		}
+	}
+}
+
+// blameValid bans the peers that sent blocks of earlier downloads of the piece at `index` that differ from
+// the blocks of `data`, the piece once it passed its integrity check. Their blocks made the piece corrupt.
+func (torrent *Torrent) blameValid(index int, data []byte) {
+	for _, peer := range torrent.smartBan().Passed(index, data) {
+		if torrent.Bans().Ban(peer.IP) {
+			torrent.peerBanned(peer, index)
+		}
+	}
+}
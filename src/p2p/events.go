@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+// EventType tells what happened in a download.
+type EventType int
+
+const (
+	EventPieceCompleted   EventType = iota // a piece was verified and handed over to be written
+	EventHashFailed                        // a piece failed its integrity check and will be downloaded again
+	EventPeerConnected                     // the handshake with a peer completed
+	EventPeerDisconnected                  // the connection to a peer ended
+	EventTrackerAnnounce                   // the tracker, or another peer source, was asked for peers
+	EventStateChanged                      // the download moved to another state
+	EventPeerBanned                        // a peer was banned for sending corrupt data
+)
+
+// String returns the name of the event type.
+func (eventType EventType) String() string {
+	switch eventType {
+	case EventPieceCompleted:
+		return "piece-completed"
+	case EventHashFailed:
+		return "hash-failed"
+	case EventPeerConnected:
+		return "peer-connected"
+	case EventPeerDisconnected:
+		return "peer-disconnected"
+	case EventTrackerAnnounce:
+		return "tracker-announce"
+	case EventStateChanged:
+		return "state-changed"
+	case EventPeerBanned:
+		return "peer-banned"
+	default:
+		return "unknown"
+	}
+}
+
+// State is the stage a download is in.
+type State int
+
+const (
+	StateIdle        State = iota // the download hasn't started yet
+	StateChecking                 // the data already in the storage is being verified
+	StateDownloading              // pieces are being downloaded
+	StateCompleted                // every piece has been downloaded and written
+	StateStopped                  // the download was cancelled before it completed
+	StatePaused                   // the download stopped because the disk is full, and can be resumed once there is room
+	StateFailed                   // the download gave up because of an error
+	StateSeeding                  // the download completed and its content is uploaded to peers until a seed limit is reached
+)
+
+// String returns the name of the state.
+func (state State) String() string {
+	switch state {
+	case StateIdle:
+		return "idle"
+	case StateChecking:
+		return "checking"
+	case StateDownloading:
+		return "downloading"
+	case StateCompleted:
+		return "completed"
+	case StateStopped:
+		return "stopped"
+	case StatePaused:
+		return "paused"
+	case StateFailed:
+		return "failed"
+	case StateSeeding:
+		return "seeding"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes something that happened in a download.
+// Only the fields relevant to the event's type are set.
+type Event struct {
+	Type      EventType    // what happened
+	Time      time.Time    // when it happened
+	Piece     int          // index of the piece, for EventPieceCompleted, EventHashFailed and EventPeerBanned
+	Peer      peers.Peer   // peer involved, for EventHashFailed, EventPeerConnected, EventPeerDisconnected and EventPeerBanned
+	Peers     []peers.Peer // peers that sent blocks of the piece, for EventHashFailed
+	Encrypted bool         // whether the connection to the peer is encrypted with MSE, for EventPeerConnected
+	NumPeers  int          // number of peers the tracker or peer source returned, for EventTrackerAnnounce
+	State     State        // state the download moved to, for EventStateChanged
+	Err       error        // why a peer disconnected, the tracker announce failed or the download paused or failed
+}
+
+// EventHandler is called with every event of a download and the torrent it happened in, so that a
+// single handler can follow several downloads and look up their Stats.
+// It is called from the goroutines doing the download, so it must be safe for concurrent use and return quickly.
+type EventHandler func(torrent *Torrent, event Event)
+
+// Emit passes the event to the torrent's event handler, if it has one.
+// The event's time is set to the current time unless it is already set.
+// It is also used by the code feeding the download, like its tracker, to report through the same handler.
+func (torrent *Torrent) Emit(event Event) {
+	if torrent.Events == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	torrent.Events(torrent, event)
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmit(t *testing.T) {
+	/*
+		test cases:
+		1. events are passed to the handler along with their torrent
+		2. a torrent without a handler drops its events
+	*/
+
+	t.Run("events are passed to the handler along with their torrent", func(t *testing.T) {
+		var got []Event
+		var torrent = &Torrent{}
+		torrent.Events = func(from *Torrent, event Event) {
+			assert.Same(t, torrent, from)
+			got = append(got, event)
+		}
+
+		var at = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		var err = errors.New("tracker is down")
+		torrent.Emit(Event{Type: EventTrackerAnnounce, Err: err})
+		torrent.Emit(Event{Type: EventPieceCompleted, Piece: 3, Time: at})
+
+		assert.Len(t, got, 2)
+		assert.Equal(t, EventTrackerAnnounce, got[0].Type)
+		assert.Equal(t, err, got[0].Err)
+		assert.WithinDuration(t, time.Now(), got[0].Time, time.Second)
+		assert.Equal(t, 3, got[1].Piece)
+		assert.Equal(t, at, got[1].Time)
+	})
+
+	t.Run("a torrent without a handler drops its events", func(t *testing.T) {
+		var torrent = &Torrent{}
+		assert.NotPanics(t, func() { torrent.Emit(Event{Type: EventHashFailed}) })
+	})
+}
+
+func TestEventNames(t *testing.T) {
+	assert.Equal(t, "piece-completed", EventPieceCompleted.String())
+	assert.Equal(t, "state-changed", EventStateChanged.String())
+	assert.Equal(t, "unknown", EventType(42).String())
+	assert.Equal(t, "downloading", StateDownloading.String())
+	assert.Equal(t, "unknown", State(42).String())
+}
@@ -1,34 +1,95 @@
 package p2p
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"runtime"
+	"sync"
 	"time"
 
+	"github.com/winterrdog/lean-bit-torrent-client/bitfield"
+	"github.com/winterrdog/lean-bit-torrent-client/bufpool"
+	"github.com/winterrdog/lean-bit-torrent-client/choker"
 	"github.com/winterrdog/lean-bit-torrent-client/client"
 	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/connmgr"
+	"github.com/winterrdog/lean-bit-torrent-client/diskio"
+	"github.com/winterrdog/lean-bit-torrent-client/ipfilter"
 	"github.com/winterrdog/lean-bit-torrent-client/message"
+	"github.com/winterrdog/lean-bit-torrent-client/mse"
+	"github.com/winterrdog/lean-bit-torrent-client/peerban"
 	"github.com/winterrdog/lean-bit-torrent-client/peers"
+	"github.com/winterrdog/lean-bit-torrent-client/proxy"
+	"github.com/winterrdog/lean-bit-torrent-client/ratelimit"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+	"github.com/winterrdog/lean-bit-torrent-client/verify"
 )
 
 const (
+	DefaultStallTimeout = 2 * time.Minute // how long a download may go without receiving any data before giving up
+	DefaultReadAhead    = 16              // pieces past the first missing piece that are fetched in order in sequential mode
+
 	MaxBlockSize = 16384 // largest number of bytes a request can ask for
-	MaxBacklog   = 8     // number of unfulfilled requests a client can have in its pipeline
+	MaxBacklog   = 8     // number of unfulfilled requests in a peer's pipeline before its throughput is known
 )
 
+// ErrStalled is returned by Download when no data arrived from any peer for longer than the stall timeout.
+var ErrStalled = errors.New("download stalled")
+
 // Torrent represents a BitTorrent file.
 type Torrent struct {
-	Name         string            // Name of the torrent file.
-	Length       int               // Length of the torrent file in bytes.
-	Peers        []peers.Peer      // List of peers connected to the torrent.
-	PeerId       common.Sha1Hash   // Peer ID of the client.
-	InfoHash     common.Sha1Hash   // Info hash of the torrent file.
-	PieceLength  int               // Length of each piece in bytes.
-	PiecesHashes []common.Sha1Hash // List of SHA-1 hashes for each piece.
+	Name         string                // Name of the torrent file.
+	Length       int                   // Length of the torrent file in bytes.
+	Peers        []peers.Peer          // List of peers to connect to first.
+	PeerSources  []connmgr.PeerSource  // Sources asked for fresh peers when too few peers are connected.
+	Connections  connmgr.Config        // How peers are kept connected. Zero values use connmgr.DefaultConfig.
+	StallTimeout time.Duration         // How long the download may go without receiving data. Defaults to DefaultStallTimeout.
+	Disk         diskio.Config         // How pieces are written to the storage. Zero values use diskio.DefaultConfig.
+	HashWorkers  int                   // Goroutines verifying pieces. Defaults to one per CPU.
+	Recheck      bool                  // Whether to check the data already in the storage and only download what is missing.
+	Preallocate  storage.Preallocation // How the disk space of storages keeping the content in files is reserved.
+	Sequential   bool                  // Whether to fetch pieces roughly in order, so the content is usable before it is complete.
+	ReadAhead    int                   // Pieces past the first missing one fetched in order in sequential mode. Defaults to DefaultReadAhead.
+	Buffers      *bufpool.Pool         // Pool the buffers of in-flight pieces come from, which torrents may share. Defaults to a pool of its own.
+	SeedRatio    float64               // Ratio of uploaded bytes to the content's length at which Seed stops. No limit if zero.
+	SeedTime     time.Duration         // Longest time Seed keeps seeding for. No limit if zero.
+	UploadSlots  int                   // Peers uploaded to at a time. Defaults to choker.DefaultSlots.
+	GlobalLimits *ratelimit.Limits     // Rate limits shared with other torrents, e.g. of the whole client. May be nil.
+	PeerId       common.Sha1Hash       // Peer ID of the client.
+	InfoHash     common.Sha1Hash       // Info hash of the torrent file.
+	PieceLength  int                   // Length of each piece in bytes.
+	PiecesHashes []common.Sha1Hash     // List of SHA-1 hashes for each piece.
+	Events       EventHandler          // Called with every event of the download, if set.
+
+	MaxDownloadRate     ratelimit.Rate // Bytes per second downloaded from all peers together. Unlimited by default.
+	MaxUploadRate       ratelimit.Rate // Bytes per second uploaded to all peers together. Unlimited by default.
+	MaxPeerDownloadRate ratelimit.Rate // Bytes per second downloaded from each peer. Unlimited by default.
+	MaxPeerUploadRate   ratelimit.Rate // Bytes per second uploaded to each peer. Unlimited by default.
+
+	GlobalBans      *peerban.List // Peers banned for sending corrupt data, shared with other torrents. Defaults to a list of the torrent's own.
+	MaxHashFailures int           // Corrupt pieces a peer is blamed for before the torrent's own list bans it. Defaults to peerban.DefaultMaxStrikes.
+
+	Filter     *ipfilter.Filter // Addresses of the peers never to connect to or accept connections from, e.g. of the whole client. May be nil.
+	Dialer     proxy.Dialer     // Opens the connections to peers, e.g. through a proxy. Connects directly if nil.
+	Encryption mse.Policy       // Whether the connections opened to peers are encrypted. Plaintext by default.
+
+	statsMu sync.Mutex    // guards `stats`
+	stats   downloadStats // progress of the download, see Stats
+
+	contentOnce sync.Once
+	content     *content // pieces the torrent's readers can read, see NewReader
+
+	chokerOnce sync.Once
+	choker     *choker.Choker // decides which peers we upload to, see Choker
+
+	limitsOnce sync.Once
+	limits     *ratelimit.Limits // rate limits of the torrent's connections, see Limits
+
+	bansOnce sync.Once
+	bans     *peerban.List     // peers banned for sending corrupt data, see Bans
+	suspects *peerban.SmartBan // blocks of the corrupt pieces several peers sent blocks of
 }
 
 // PieceWork represents a piece of work in the BitTorrent client.
@@ -44,39 +105,68 @@ type PieceResult struct {
 	Buf   []byte // Buf is the byte buffer containing the downloaded piece data.
 }
 
-// PieceProgress represents the progress of a piece in the BitTorrent client.
-type PieceProgress struct {
-	Index      int            // Index of the piece
-	Client     *client.Client // Client associated with the piece
-	Buf        []byte         // Buffer for storing the piece data
-	Downloaded int            // Number of bytes downloaded for the piece
-	Requested  int            // Number of bytes requested for the piece
-	Backlog    int            // Number of bytes in the backlog for the piece
+// PendingRequest represents a block request that has been sent to a peer and hasn't been answered yet.
+type PendingRequest struct {
+	BlockRequest
+	SentAt time.Time // when the request was sent to the peer
+}
+
+// PeerProgress represents the progress of the download from a single peer.
+type PeerProgress struct {
+	Client     *client.Client   // Client associated with the peer
+	Picker     *Picker          // Picker handing out the blocks to request
+	Pipeline   *Pipeline        // Pipeline deciding how many requests to keep outstanding
+	Requests   []PendingRequest // Blocks requested from the peer that haven't arrived yet
+	Downloaded int              // Bytes of block data received from the peer
+
+	upload *upload // side of the connection uploading to the peer, if any
 }
 
 // ReadMessage reads a message from the client and updates the state accordingly.
 // It blocks until a message is received or an error occurs.
-// If the message is a keep-alive message, it returns nil.
-// If the message is a choke message, it sets the client's Choked flag to true.
+// If the message is a keep-alive message, it does nothing.
+// If the message is a choke message, it sets the client's Choked flag to true. A peer that chokes us drops our requests,
+// so the outstanding requests are handed back to the picker, unless the peer speaks the Fast Extension and rejects them explicitly.
 // If the message is an unchoke message, it sets the client's Choked flag to false.
-// If the message is a have message, it parses the index from the message and sets the corresponding piece in the client's Bitfield.
-// If the message is a piece message, it parses the piece size from the message, updates the downloaded count and backlog count in the state.
+// If the message is a reject request message, the rejected block is handed back to the picker.
+// If the message is a have message, it parses the index from the message, sets the corresponding piece in the client's Bitfield
+// and tells the picker, which makes the piece less rare.
+// If the message is a piece message, it counts the block's bytes, hands the block over to the picker, removes it from
+// the outstanding requests and feeds its round-trip time to the pipeline.
+// If the message is an extended handshake, it caps the pipeline at the number of requests the peer accepts.
+// Interested, not interested and request messages are handed to the upload side of the connection, if any.
+// It returns the index of the piece the block completed, or -1 if no piece was completed.
 // Returns an error if any error occurs during reading or parsing the message.
-func (state *PieceProgress) ReadMessage() error {
+func (state *PeerProgress) ReadMessage() (int, error) {
 	var msg, err = state.Client.Read() // call blocks
 	if err != nil {
-		return err
+		return -1, err
 	}
 
 	// send keep-alive
 	if msg == nil {
-		return nil
+		return -1, nil
 	}
 
 	// handle message
 	switch msg.Id {
 	case message.MsgChoke:
 		state.Client.Choked = true
+		if !state.Client.Fast {
+			state.cancelRequests()
+		}
+	case message.MsgRejectRequest:
+		var index, begin int
+
+		index, begin, _, err = message.ParseRequest(msg)
+		if err != nil {
+			return -1, err
+		}
+
+		var req, ok = state.removeRequest(index, begin)
+		if ok {
+			state.Picker.CancelBlock(req.BlockRequest)
+		}
 	case message.MsgUnchoke:
 		state.Client.Choked = false
 	case message.MsgHave:
@@ -84,36 +174,142 @@ func (state *PieceProgress) ReadMessage() error {
 
 		index, err = message.ParseHave(msg)
 		if err != nil {
-			return err
+			return -1, err
 		}
 
-		state.Client.Bitfield.SetPiece(index)
+		if !state.Client.Bitfield.HasPiece(index) {
+			state.Client.Bitfield.SetPiece(index)
+			state.Picker.PeerHas(index)
+		}
 	case message.MsgPiece:
-		var pieceSize int
+		var index, begin int
+		var data []byte
+
+		index, begin, data, err = message.ParseBlock(msg)
+		if err != nil {
+			return -1, err
+		}
+		state.Downloaded += len(data)
+
+		var req, ok = state.removeRequest(index, begin)
+		if ok {
+			var now = time.Now()
+			state.Pipeline.Received(len(data), now.Sub(req.SentAt), now)
+		}
+
+		var complete bool
+		complete, err = state.Picker.ReceiveBlock(state.Client.Peer, index, begin, data)
+		if err != nil {
+			return -1, err
+		}
+
+		if complete {
+			return index, nil
+		}
+	case message.MsgExtended:
+		if len(msg.Payload) == 0 || msg.Payload[0] != message.ExtendedHandshakeId {
+			break
+		}
+
+		err = state.Client.HandleExtendedHandshake(msg)
+		if err != nil {
+			return -1, err
+		}
+
+		state.Pipeline.SetLimit(state.Client.MaxRequests)
+	case message.MsgInterested, message.MsgNotInterested, message.MsgRequest:
+		if state.upload != nil {
+			err = state.upload.handle(msg)
+			if err != nil {
+				return -1, err
+			}
+		}
+	}
+
+	return -1, nil
+}
+
+// removeRequest removes the block at the given piece index and offset from the outstanding requests.
+// It returns the removed request and false if no such request was outstanding.
+func (state *PeerProgress) removeRequest(index, begin int) (PendingRequest, bool) {
+	for i, req := range state.Requests {
+		if req.Index == index && req.Begin == begin {
+			state.Requests = append(state.Requests[:i], state.Requests[i+1:]...)
+			return req, true
+		}
+	}
+
+	return PendingRequest{}, false
+}
+
+// fillPipeline sends requests to the peer until the pipeline is as deep as the peer's measured
+// throughput calls for, or the picker has nothing left that the peer can give us.
+// Nothing is requested while the peer is choking us.
+func (state *PeerProgress) fillPipeline() error {
+	if state.Client.Choked {
+		return nil
+	}
+
+	var depth = state.Pipeline.Depth()
+	for len(state.Requests) < depth {
+		var req, ok = state.Picker.PickBlock(state.Client.Peer, state.Client.Bitfield)
+		if !ok {
+			return nil
+		}
 
-		// parse piece size
-		pieceSize, err = message.ParsePiece(state.Index, state.Buf, msg)
+		var err = state.Client.SendRequest(req.Index, req.Begin, req.Length)
 		if err != nil {
+			state.Picker.CancelBlock(req)
 			return err
 		}
 
-		// update state with downloaded piece size
-		state.Downloaded += pieceSize
-		state.Backlog--
+		state.Requests = append(state.Requests, PendingRequest{BlockRequest: req, SentAt: time.Now()})
 	}
 
 	return nil
 }
 
-// checkIntegrity checks the integrity of a piece of data by comparing its hash with the expected hash.
-// It returns an error if the integrity check fails.
-func checkIntegrity(pw *PieceWork, buf []byte) error {
-	var hash = sha1.Sum(buf)
-	if !bytes.Equal(hash[:], pw.Hash[:]) {
-		return fmt.Errorf("index %d failed integrity check. it could be corrupt somehow", pw.Index)
+// expireRequests gives up on the requests that have been outstanding for longer than the pipeline's request timeout.
+// The peer is told to drop them and their blocks are handed back to the picker so that other peers can fetch them.
+// Should a timed out block arrive after all, it is still accepted if nobody else delivered it first.
+func (state *PeerProgress) expireRequests(now time.Time) error {
+	var timeout = state.Pipeline.RequestTimeout()
+	var remaining = state.Requests[:0]
+
+	var err error
+	for _, req := range state.Requests {
+		if now.Sub(req.SentAt) < timeout {
+			remaining = append(remaining, req)
+			continue
+		}
+
+		state.Picker.CancelBlock(req.BlockRequest)
+		if err == nil {
+			err = state.Client.SendCancel(req.Index, req.Begin, req.Length)
+		}
 	}
+	state.Requests = remaining
 
-	return nil
+	return err
+}
+
+// cancelRequests hands all outstanding requests back to the picker so that other peers can fetch them.
+func (state *PeerProgress) cancelRequests() {
+	for _, req := range state.Requests {
+		state.Picker.CancelBlock(req.BlockRequest)
+	}
+
+	state.Requests = nil
+}
+
+// isIdleTimeout reports whether `err` is a read timeout on a peer that had no reason to send us anything.
+// That is the case when nothing is requested from the peer, or when it choked us and our requests are parked.
+func (state *PeerProgress) isIdleTimeout(err error) bool {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+
+	return len(state.Requests) == 0 || state.Client.Choked
 }
 
 // calculateBoundsForPiece calculates the start and end bounds for a given piece index.
@@ -139,168 +335,459 @@ func (torrent *Torrent) calculatePieceSize(index int) int {
 	return end - start
 }
 
-// attemptDownloadPiece attempts to download a piece of the torrent file.
-// It returns the downloaded piece as a byte slice and an error if any.
-// The function sets a deadline to get unresponsive peers unstuck and disables the deadline afterwards.
-// It sends requests to unchoked peers until enough requests are in the pipeline.
-// The function reads messages from the peers and continues until the entire piece is downloaded.
-func attemptDownloadPiece(torrentClient *client.Client, pw *PieceWork) ([]byte, error) {
-	var state = PieceProgress{
-		Index:  pw.Index,
-		Client: torrentClient,
-		Buf:    make([]byte, pw.Length),
+// pieceWork returns the description of the piece at the given index.
+func (torrent *Torrent) pieceWork(index int) *PieceWork {
+	return &PieceWork{
+		Index:  index,
+		Hash:   torrent.PiecesHashes[index],
+		Length: torrent.calculatePieceSize(index),
 	}
+}
 
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	torrentClient.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer torrentClient.Conn.SetDeadline(time.Time{}) // disable deadline
+// startDownloadWorker starts a download worker for a given peer in the BitTorrent client.
+// It performs the handshake with the peer and downloads blocks from it until every piece has been downloaded,
+// reporting the peer as connected and disconnected around the download. Completed pieces are verified by the pool.
+// It returns nil once every piece has been downloaded. If an error occurs during the download
+// process, the function hands its outstanding requests back to the picker and returns the error.
+// Cancelling `ctx` closes the connection to the peer, which ends the worker with ctx.Err().
+func (torrent *Torrent) startDownloadWorker(ctx context.Context, peer *peers.Peer, established func(peerId common.Sha1Hash) error, picker *Picker, pool *verify.Pool, results chan *PieceResult) error {
+	var torrentClient, err = client.New(ctx, torrent.Dialer, torrent.Encryption, peer, &torrent.PeerId, &torrent.InfoHash)
+	if err != nil {
+		return fmt.Errorf("failed to handshake: %w", err)
+	}
+	torrentClient.LimitRate(torrent.Limits(), torrent.GlobalLimits)
+	defer torrentClient.Conn.Close()
 
-	// actually download the piece
-	var err error
-	var blockSize, remainingBytes int
-	for state.Downloaded < pw.Length {
-		// if unchoked, send requests until we've enough requests in our pipeline
-		if !state.Client.Choked {
-			for state.Backlog != MaxBacklog && state.Requested < pw.Length {
-				blockSize = MaxBlockSize
-
-				// last block might be shorter than the typical block
-				remainingBytes = pw.Length - state.Requested
-				if remainingBytes < blockSize {
-					blockSize = remainingBytes
-				}
-
-				err = torrentClient.SendRequest(pw.Index, state.Requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-
-				state.Backlog++
-				state.Requested += blockSize
+	// connections to ourselves and second connections to a peer are dropped
+	err = established(torrentClient.RemoteId)
+	if err != nil {
+		return err
+	}
+
+	// unblock reads and writes on the connection as soon as we're told to stop
+	var stopClosing = context.AfterFunc(ctx, func() { torrentClient.Conn.Close() })
+	defer stopClosing()
+
+	torrent.peerConnected(*peer, torrentClient.Encrypted)
+	err = torrent.downloadFromPeer(ctx, torrentClient, picker, pool, results)
+	torrent.peerDisconnected(*peer, err)
+
+	return err
+}
+
+// downloadFromPeer sends the necessary messages to a peer we completed the handshake with, and requests
+// the blocks handed out by the picker until every piece has been downloaded. The peer is uploaded the pieces
+// we have as well, whenever the torrent's choker unchokes it.
+// Whenever a block completes a piece, the piece is handed to the pool for verification, so that hashing doesn't
+// hold up reading from the peer.
+// It returns nil once every piece has been downloaded, ctx.Err() once `ctx` is cancelled, or the error
+// that ended the connection.
+func (torrent *Torrent) downloadFromPeer(ctx context.Context, torrentClient *client.Client, picker *Picker, pool *verify.Pool, results chan *PieceResult) error {
+	// peers announcing their pieces with 'have all' or 'have none' don't send a bitfield
+	var numPieces = len(torrent.PiecesHashes)
+	if torrentClient.HaveAll {
+		torrentClient.Bitfield = bitfield.NewFull(numPieces)
+	} else if len(torrentClient.Bitfield) == 0 {
+		torrentClient.Bitfield = bitfield.New(numPieces)
+	}
+
+	// the peer's pieces count towards their availability as long as it is connected
+	picker.AddPeer(torrentClient.Bitfield)
+	defer func() { picker.RemovePeer(torrentClient.Bitfield) }()
+
+	// the peer is uploaded the pieces we have as well, as far as the choker lets it
+	var upload, err = torrent.newUpload(torrentClient)
+	if err != nil {
+		return err
+	}
+	defer torrent.Choker().Remove(upload)
+
+	torrentClient.SendInterested()
+
+	var state = PeerProgress{
+		Client:   torrentClient,
+		Picker:   picker,
+		Pipeline: NewPipeline(torrentClient.MaxRequests),
+		upload:   upload,
+	}
+	defer state.cancelRequests()
+
+	var index, received int
+	for {
+		select {
+		case <-picker.Done():
+			return nil
+		default:
+		}
+
+		// the peer may have been banned for its part in a corrupt piece, or blocked by a reloaded IP filter
+		err = torrent.refused(torrentClient.Peer)
+		if err != nil {
+			return err
+		}
+
+		err = upload.announce()
+		if err != nil {
+			return err
+		}
+
+		err = state.fillPipeline()
+		if err != nil {
+			return err
+		}
+
+		// rather than waiting for messages the peer has no reason to send, wait for room to start a new piece
+		if len(state.Requests) == 0 && !torrentClient.Choked {
+			var waited bool
+			waited, err = picker.WaitBuffer(ctx, torrentClient.Bitfield)
+			if err != nil {
+				return err
+			}
+
+			if waited {
+				continue
 			}
 		}
 
-		err = state.ReadMessage()
+		received = state.Downloaded
+		index, err = state.ReadMessage()
+		torrent.blockReceived(state.Downloaded - received)
+		upload.downloaded.Store(int64(state.Downloaded))
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil && !state.isIdleTimeout(err) {
+			return err
+		}
+
+		err = state.expireRequests(time.Now())
 		if err != nil {
-			return nil, err
+			return err
 		}
-	}
 
-	return state.Buf, nil
+		if index < 0 {
+			continue
+		}
+
+		var pw = torrent.pieceWork(index)
+		var buf = picker.PieceBuffer(index)
+		pool.Submit(buf, pw.Hash, func(valid bool) {
+			torrent.finishPiece(ctx, torrentClient, picker, pw, buf, valid, results)
+		})
+	}
 }
 
-// startDownloadWorker starts a download worker for a given peer in the BitTorrent client.
-// It performs the handshake with the peer, sends necessary messages, and downloads the requested pieces.
-// The downloaded pieces are sent to the results channel.
-// If an error occurs during the download process, the function logs the error and returns.
-func (torrent *Torrent) startDownloadWorker(peer *peers.Peer, workQueue chan *PieceWork, results chan *PieceResult) {
-	var torrentClient, err = client.New(peer, &torrent.PeerId, &torrent.InfoHash)
-	if err != nil {
-		log.Printf("failed to handshake with %s: %s\n", peer.IP, err)
+// finishPiece records the outcome of verifying a piece completed by the client's peer.
+// A piece that failed verification is blamed on the peers that sent its blocks and downloaded again. A valid
+// one is compared with the earlier corrupt downloads of the piece to find their culprits, sent to the results
+// channel, and announced to the peers once it is readable. If `ctx` is cancelled first, its buffer is given
+// back right away.
+func (torrent *Torrent) finishPiece(ctx context.Context, torrentClient *client.Client, picker *Picker, pw *PieceWork, buf []byte, valid bool, results chan *PieceResult) {
+	if !valid {
+		var senders = picker.Senders(pw.Index)
+		torrent.hashFailed(pw.Index, pw.Length, torrentClient.Peer, peerban.Distinct(senders))
+		torrent.blameCorrupt(pw.Index, buf, senders)
+		picker.FinishPiece(pw.Index, false)
 		return
 	}
-	defer torrentClient.Conn.Close()
-	log.Printf("completed handshake with %s\n", peer.IP)
+	torrent.blameValid(pw.Index, buf)
+	picker.FinishPiece(pw.Index, true)
 
-	torrentClient.SendUnchoke()
-	torrentClient.SendInterested()
+	select {
+	case results <- &PieceResult{Index: pw.Index, Buf: buf}:
+	case <-ctx.Done():
+		picker.ReleaseBuffer(buf)
+	}
+}
 
-	var buf []byte
-	for pw := range workQueue {
-		// check if peer has the piece we want
-		if !torrentClient.Bitfield.HasPiece(pw.Index) {
-			workQueue <- pw // put piece back on queue
-			continue
-		}
+// recheck checks the pieces already in the storage and marks the valid ones as downloaded,
+// both in the picker and in the storage.
+// Returns ctx.Err() if `ctx` is cancelled, or the error that occurred while reading the storage.
+func (torrent *Torrent) recheck(ctx context.Context, store storage.Storage, picker *Picker) error {
+	var pieces = make([]verify.Piece, len(torrent.PiecesHashes))
+	for index := range torrent.PiecesHashes {
+		var pw = torrent.pieceWork(index)
+		pieces[index] = verify.Piece{Index: pw.Index, Length: pw.Length, Hash: pw.Hash}
+	}
 
-		// download the piece
-		buf, err = attemptDownloadPiece(torrentClient, pw)
-		if err != nil {
-			log.Println("exiting...", err)
-			workQueue <- pw
+	var mu sync.Mutex
+	var markErr error
+	var err = verify.CheckStorage(ctx, store, pieces, torrent.HashWorkers, func(index int, valid bool) {
+		if !valid {
 			return
 		}
 
-		err = checkIntegrity(pw, buf)
+		var err = store.MarkComplete(index)
 		if err != nil {
-			log.Printf("piece #%d failed an integrity check\n", pw.Index)
-			workQueue <- pw
-			continue
+			mu.Lock()
+			markErr = err
+			mu.Unlock()
+			return
 		}
 
-		// send "have" message to all peers and send piece to results channel
-		torrentClient.SendHave(pw.Index)
-		results <- &PieceResult{Index: pw.Index, Buf: buf}
+		picker.SetHave(index)
+		torrent.pieceRestored(pieces[index].Length)
+		torrent.content.setReadable(index)
+	})
+	if err != nil {
+		return err
 	}
+
+	return markErr
 }
 
-// Download downloads the torrent file and returns the downloaded data as a byte slice.
-// It initializes workers to send work to consumers and starts downloading pieces from peers.
-// The downloaded pieces are collected into a buffer until the download is complete.
-// It logs the progress of the download, including the percentage completed and the number of peers involved.
-// Returns the downloaded data as a byte slice and any error encountered during the download process.
-func (torrent *Torrent) Download(path string) error {
-	log.Println("starting download for", torrent.Name+"...")
+// Download downloads the torrent's content into the given storage.
+// It initializes a picker that schedules blocks across the workers, rarest pieces first or roughly in order if the
+// torrent is sequential, and a connection manager which keeps workers downloading blocks from peers, reconnecting
+// to them and asking the peer sources for more as needed.
+// The verified pieces are collected and handed over to a disk, which writes them into the storage and marks them
+// as complete in the background, until the download is complete.
+// Pieces are assembled in buffers from the torrent's buffer pool, which caps the memory of the pieces being
+// downloaded, verified and written: while its budget is used up, workers wait before starting new pieces.
+// If no data arrives for longer than the stall timeout, it gives up and returns an error wrapping ErrStalled.
+// The time the download is paused by its rate limits doesn't count.
+// Cancelling `ctx` stops the download: the connections to the peers are closed, the pieces written so far are
+// flushed and ctx.Err() is returned. Download only returns once every worker has stopped.
+// The storage is left open for the caller to close.
+// If the storage keeps the content in files, the download only starts if the disk has room for the content,
+// which is preallocated as the torrent asks. Should the disk run full anyway, the download is paused: the
+// pieces written so far are kept and an error wrapping storage.ErrNoSpace is returned. Once there is room
+// again, downloading with Recheck set resumes it.
+// If the torrent is to be rechecked, the data already in the storage is verified first and only the pieces
+// that are missing or corrupt are downloaded.
+// The progress of the download is reported to the torrent's event handler and can be looked up with Stats.
+// The torrent's readers can read the pieces as soon as they have been handed over to the disk.
+// Returns any error encountered during the download process.
+func (torrent *Torrent) Download(ctx context.Context, store storage.Storage) error {
+	torrent.resetStats()
+
+	var err = torrent.download(ctx, store)
+	torrent.contentOf().end(err)
+
+	switch {
+	case err == nil:
+		torrent.setState(StateCompleted, nil)
+	case ctx.Err() != nil:
+		torrent.setState(StateStopped, nil)
+	case errors.Is(err, storage.ErrNoSpace):
+		torrent.setState(StatePaused, err)
+	default:
+		torrent.setState(StateFailed, err)
+	}
+
+	return err
+}
 
-	// init workers. generally setup the producers to send work to consumers
+// download does the work of Download, without tracking the state of the download.
+func (torrent *Torrent) download(ctx context.Context, store storage.Storage) error {
+	// workers stop when the download ends, whatever the reason
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// init the picker which hands out blocks to the workers
 	var (
-		length    int
-		workQueue = make(chan *PieceWork, len(torrent.PiecesHashes))
-		results   = make(chan *PieceResult)
+		pieces  = make([]*PieceWork, len(torrent.PiecesHashes))
+		buffers = torrent.Buffers
+		picker  *Picker
+		results = make(chan *PieceResult)
 	)
-	for index, hash := range torrent.PiecesHashes {
-		length = torrent.calculatePieceSize(index)
-		workQueue <- &PieceWork{Index: index, Hash: hash, Length: length}
+	for index := range torrent.PiecesHashes {
+		pieces[index] = torrent.pieceWork(index)
 	}
-	defer close(workQueue)
-	defer close(results)
 
-	// start workers which will download pieces from peers
-	for _, peer := range torrent.Peers {
-		go torrent.startDownloadWorker(&peer, workQueue, results)
+	if buffers == nil {
+		buffers = bufpool.New(0)
 	}
+	torrent.setBuffers(buffers)
+
+	// the buffers of the pieces left unfinished go back to the pool once nothing uses them anymore
+	picker = NewPicker(pieces, buffers)
+	defer picker.Close()
+
+	// readers read the pieces from the storage until the disk takes over
+	torrent.contentOf().begin(len(pieces), picker, store)
+
+	if torrent.Sequential {
+		var readAhead = torrent.ReadAhead
+		if readAhead <= 0 {
+			readAhead = DefaultReadAhead
+		}
+
+		picker.SetSequential(readAhead)
+	}
+
+	// pieces are verified on a pool of their own, which outlives the workers submitting to it
+	var pool = verify.NewPool(torrent.HashWorkers)
+	defer pool.Close()
+
+	// make sure the content fits on the disk before downloading any of it
+	var allocator, ok = store.(storage.Allocator)
+	if ok {
+		var err = allocator.CheckSpace()
+		if err != nil {
+			return err
+		}
+
+		err = allocator.Preallocate(torrent.Preallocate)
+		if err != nil {
+			return err
+		}
+	}
+
+	if torrent.Recheck {
+		torrent.setState(StateChecking, nil)
+
+		var err = torrent.recheck(ctx, store, picker)
+		if err != nil {
+			return err
+		}
+	}
+	torrent.setState(StateDownloading, nil)
+
+	// start the connection manager which keeps workers downloading blocks from peers
+	var connect = func(ctx context.Context, peer peers.Peer, established func(peerId common.Sha1Hash) error) error {
+		select {
+		case <-picker.Done():
+			return nil
+		default:
+		}
+
+		var err = torrent.startDownloadWorker(ctx, &peer, established, picker, pool, results)
+		if ctx.Err() != nil {
+			return nil
+		}
 
-	// write results into a file until end
-	var outputFile, err = os.Create(path)
-	if err != nil {
 		return err
 	}
-	defer outputFile.Close()
+	var connections = torrent.Connections
+	connections.PeerId = torrent.PeerId
+	connections.Blocked = func(peer peers.Peer) bool { return torrent.refused(peer) != nil }
+	connections.Refreshed = func(source connmgr.PeerSource, newPeers []peers.Peer, err error) {
+		if torrent.Connections.Refreshed != nil {
+			torrent.Connections.Refreshed(source, newPeers, err)
+		}
 
-	/*
-		todo: implement a buffering
-			algorithm to determine when to write to file:
-			- create a buffer as big as 4 blocks of size MaxBlockSize
-			- write to buffer until it's full.
-			- write buffer to file
-	*/
+		torrent.Emit(Event{Type: EventTrackerAnnounce, NumPeers: len(newPeers), Err: err})
+	}
+	var manager = connmgr.New(connections, connect, torrent.PeerSources...)
+	manager.AddPeers(torrent.Peers)
+	torrent.setManager(manager)
+
+	var managerDone = make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(managerDone)
+	}()
+
+	// peers are unchoked by how fast they upload to us
+	var chokerDone = make(chan struct{})
+	go func() {
+		torrent.Choker().Run(ctx, false)
+		close(chokerDone)
+	}()
+
+	// wait for the workers before returning so that no connection outlives the download
+	defer func() {
+		cancel()
+		<-managerDone
+		<-chokerDone
+	}()
+
+	// write results into the storage in the background until end, giving their buffers back once written
+	var diskConfig = torrent.Disk
+	diskConfig.Release = picker.ReleaseBuffer
+
+	var disk = diskio.New(store, torrent.PieceLength, diskConfig)
+	defer disk.Close()
+	torrent.content.setSource(disk)
+
+	var stallTimeout = torrent.StallTimeout
+	if stallTimeout <= 0 {
+		stallTimeout = DefaultStallTimeout
+	}
+
+	var stallCheck = time.NewTicker(min(stallTimeout, time.Second))
+	defer stallCheck.Stop()
 
 	var (
-		downloadedPiece   *PieceResult
-		start, numWorkers int
-		percent           float64
-		donePieces        = 0
-		totalPieces       = len(torrent.PiecesHashes)
+		downloadedPiece *PieceResult
+		err             error
+		donePieces      = picker.NumHave()
+		totalPieces     = len(torrent.PiecesHashes)
 	)
 	for donePieces != totalPieces {
-		// collect results
-		downloadedPiece = <-results
-		start, _ = torrent.calculateBoundsForPiece(downloadedPiece.Index)
+		// collect results, giving up if no peer can make progress
+		select {
+		case downloadedPiece = <-results:
+		case <-ctx.Done():
+			// keep what has been downloaded so far
+			var err = disk.Close()
+			if err != nil {
+				log.Printf("failed to write the downloaded pieces: %s\n", err)
+			}
+			return ctx.Err()
+		case <-stallCheck.C:
+			// no data arrives while the download is paused, which isn't the peers' fault
+			if torrent.downloadPaused() {
+				continue
+			}
 
-		// write piece into file
-		_, err = outputFile.WriteAt(downloadedPiece.Buf, int64(start))
+			var idle = time.Since(latest(picker.LastProgress(), torrent.downloadResumed()))
+			if idle > stallTimeout {
+				return fmt.Errorf("%w: no data received for %s with %d peer(s) connected", ErrStalled, idle.Round(time.Second), manager.NumActive())
+			}
+			continue
+		}
+
+		// hand the piece over to the disk, which only blocks while its write cache is full
+		err = disk.WritePiece(downloadedPiece.Index, downloadedPiece.Buf)
 		if err != nil {
+			picker.ReleaseBuffer(downloadedPiece.Buf)
 			return err
 		}
 
 		donePieces++
+		torrent.content.setReadable(downloadedPiece.Index)
+		torrent.pieceCompleted(downloadedPiece.Index, len(downloadedPiece.Buf))
+	}
+
+	return disk.Close()
+}
+
+// downloadPaused reports whether the torrent's rate limits, or the global ones, pause downloading.
+func (torrent *Torrent) downloadPaused() bool {
+	return torrent.Limits().Download.Paused() || (torrent.GlobalLimits != nil && torrent.GlobalLimits.Download.Paused())
+}
 
-		// log progress
-		percent = (float64(donePieces) / float64(totalPieces)) * 100
-		numWorkers = runtime.NumGoroutine() - 1 // remove the main thread
-		log.Printf("(%0.2f%%) downloaded piece number %d from %d peer(s)\n", percent, downloadedPiece.Index, numWorkers)
+// downloadResumed returns when the torrent's rate limits, or the global ones, last resumed downloading after
+// a pause, the zero time if they never did.
+func (torrent *Torrent) downloadResumed() time.Time {
+	var resumed = torrent.Limits().Download.Resumed()
+	if torrent.GlobalLimits != nil {
+		resumed = latest(resumed, torrent.GlobalLimits.Download.Resumed())
 	}
 
-	return nil
+	return resumed
+}
+
+// latest returns the later of two times.
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+// Limits returns the rate limits of the torrent's connections, creating them on first use from MaxDownloadRate,
+// MaxUploadRate, MaxPeerDownloadRate and MaxPeerUploadRate. Their rates can be changed while the torrent runs.
+func (torrent *Torrent) Limits() *ratelimit.Limits {
+	torrent.limitsOnce.Do(func() {
+		torrent.limits = ratelimit.NewLimits(torrent.MaxDownloadRate, torrent.MaxUploadRate)
+		torrent.limits.SetPeerRates(torrent.MaxPeerDownloadRate, torrent.MaxPeerUploadRate)
+	})
+
+	return torrent.limits
 }
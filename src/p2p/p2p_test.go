@@ -0,0 +1,858 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/bitfield"
+	"github.com/winterrdog/lean-bit-torrent-client/bufpool"
+	"github.com/winterrdog/lean-bit-torrent-client/client"
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/connmgr"
+	"github.com/winterrdog/lean-bit-torrent-client/handshake"
+	"github.com/winterrdog/lean-bit-torrent-client/ipfilter"
+	"github.com/winterrdog/lean-bit-torrent-client/message"
+	"github.com/winterrdog/lean-bit-torrent-client/p2p/p2ptest"
+	"github.com/winterrdog/lean-bit-torrent-client/peerban"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+	"github.com/winterrdog/lean-bit-torrent-client/proxy"
+	"github.com/winterrdog/lean-bit-torrent-client/ratelimit"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+// fakeSeeder is a peer that has every piece of `data` and serves requests for it.
+type fakeSeeder struct {
+	torrent    *Torrent
+	data       []byte
+	maxBlocks  int           // hang up after serving this many blocks, never if 0
+	chokeAfter int           // choke for a moment and drop requests after serving this many blocks, never if 0
+	silent     bool          // never answer requests
+	corrupt    bool          // serve blocks with every byte flipped
+	ip         net.IP        // address to listen on, 127.0.0.1 if nil
+	hungUp     chan struct{} // closed when the connection to the seeder ends, if set
+	listener   net.Listener
+}
+
+// dialerFunc is a dialer calling a function.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (dial dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dial(ctx, network, addr)
+}
+
+// newTestTorrent creates a torrent with random content of the given size.
+func newTestTorrent(t *testing.T, length, pieceLength int) (*Torrent, []byte) {
+	var data, hashes = p2ptest.Content(length, pieceLength)
+
+	var torrent = &Torrent{
+		Name:         "test",
+		Length:       length,
+		PieceLength:  pieceLength,
+		InfoHash:     common.Sha1Hash{0x01, 0x02, 0x03},
+		PeerId:       common.Sha1Hash{0x04, 0x05, 0x06},
+		PiecesHashes: hashes,
+	}
+
+	return torrent, data
+}
+
+// startFakeSeeder starts the seeder and returns the peer to connect to it.
+func startFakeSeeder(t *testing.T, seeder *fakeSeeder) peers.Peer {
+	if seeder.ip == nil {
+		seeder.ip = net.IP{127, 0, 0, 1}
+	}
+
+	var listener, err = net.Listen("tcp", net.JoinHostPort(seeder.ip.String(), "0"))
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	seeder.listener = listener
+	go seeder.serve()
+
+	return peers.Peer{IP: seeder.ip, Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+}
+
+func (seeder *fakeSeeder) serve() {
+	for {
+		var conn, err = seeder.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go seeder.handle(conn)
+	}
+}
+
+func (seeder *fakeSeeder) handle(conn net.Conn) {
+	defer conn.Close()
+	if seeder.hungUp != nil {
+		defer close(seeder.hungUp)
+	}
+
+	var _, err = handshake.Read(conn)
+	if err != nil {
+		return
+	}
+
+	// every seeder is a peer of its own
+	var port = seeder.listener.Addr().(*net.TCPAddr).Port
+	var peerId = common.Sha1Hash{0xff, seeder.ip[len(seeder.ip)-1], byte(port >> 8), byte(port)}
+	conn.Write(handshake.New(&seeder.torrent.InfoHash, &peerId).Serialize())
+
+	var numPieces = len(seeder.torrent.PiecesHashes)
+	var bf = make([]byte, (numPieces+7)/8)
+	for i := 0; i != numPieces; i++ {
+		bf[i/8] |= 1 << (7 - i%8)
+	}
+	conn.Write((&message.Message{Id: message.MsgBitfield, Payload: bf}).Serialize())
+	conn.Write((&message.Message{Id: message.MsgUnchoke}).Serialize())
+
+	var served int
+	var choked atomic.Bool
+	for {
+		var msg, err = message.Read(conn)
+		if err != nil {
+			return
+		}
+
+		// a choking peer drops the requests it gets
+		if msg == nil || msg.Id != message.MsgRequest || choked.Load() || seeder.silent {
+			continue
+		}
+
+		var index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		var begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		var length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+		var offset = index*seeder.torrent.PieceLength + begin
+
+		var payload = make([]byte, 8+length)
+		copy(payload, msg.Payload[:8])
+		copy(payload[8:], seeder.data[offset:offset+length])
+		if seeder.corrupt {
+			for i := 8; i < len(payload); i++ {
+				payload[i] = ^payload[i]
+			}
+		}
+
+		_, err = conn.Write((&message.Message{Id: message.MsgPiece, Payload: payload}).Serialize())
+		if err != nil {
+			return
+		}
+
+		served++
+		if seeder.maxBlocks != 0 && served == seeder.maxBlocks {
+			return
+		}
+
+		if seeder.chokeAfter != 0 && served == seeder.chokeAfter {
+			choked.Store(true)
+			conn.Write((&message.Message{Id: message.MsgChoke}).Serialize())
+
+			time.AfterFunc(100*time.Millisecond, func() {
+				choked.Store(false)
+				conn.Write((&message.Message{Id: message.MsgUnchoke}).Serialize())
+			})
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	/*
+		test cases:
+		1. download a torrent from a single peer
+		2. pieces started by a peer that disconnects are finished by other peers
+		3. requests dropped by a peer that chokes us are requested again
+		4. a peer that keeps hanging up is reconnected to until the download completes
+		5. fresh peers are fetched from the peer sources when the known peers are gone
+		6. the download gives up when no peer can make progress
+		7. cancelling the context closes the connections and stops the download
+		8. the progress of the download is reported as events and stats
+		9. pieces already in the storage are checked and not downloaded again
+		10. the pieces in flight stay within the memory budget
+		11. the download doesn't start when the disk has no room for it
+		12. the download is paused when the disk runs full
+		13. a sequential download completes the pieces in order
+		14. the peers we download from are uploaded the pieces we have
+		15. the download stays within the rate limits
+		16. a download paused by its rate limits doesn't stall
+		17. a peer sending corrupt pieces on its own is banned once it sent too many
+		18. the peers that sent the corrupt blocks of a piece several peers contributed to are banned
+		19. peers whose addresses the IP filter blocks are never connected to, whatever their source
+		20. the connections to peers are opened with the torrent's dialer
+	*/
+
+	t.Run("download a torrent from a single peer", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 5*MaxBlockSize+123, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+
+		var path = filepath.Join(t.TempDir(), "out")
+		var store, err = storage.NewFile(path, torrent.PieceLength, int64(torrent.Length))
+		require.Nil(t, err)
+
+		err = torrent.Download(context.Background(), store)
+		require.Nil(t, err)
+		require.Nil(t, store.Close())
+
+		var got []byte
+		got, err = os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("pieces started by a peer that disconnects are finished by other peers", func(t *testing.T) {
+		// one piece of 8 blocks. the flaky peer hangs up after serving 3 blocks
+		var torrent, data = newTestTorrent(t, 8*MaxBlockSize, 8*MaxBlockSize)
+		torrent.Peers = []peers.Peer{
+			startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data, maxBlocks: 3}),
+			startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data}),
+		}
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		var err = torrent.Download(context.Background(), store)
+		require.Nil(t, err)
+		assert.Equal(t, data, store.Bytes())
+	})
+
+	t.Run("requests dropped by a peer that chokes us are requested again", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 6*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{
+			startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data, chokeAfter: 2}),
+		}
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		var err = torrent.Download(context.Background(), store)
+		require.Nil(t, err)
+		assert.Equal(t, data, store.Bytes())
+	})
+
+	t.Run("a peer that keeps hanging up is reconnected to until the download completes", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 12*MaxBlockSize, 4*MaxBlockSize)
+		torrent.Connections = fastConnections
+		torrent.Peers = []peers.Peer{
+			startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data, maxBlocks: 3}),
+		}
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		var err = torrent.Download(context.Background(), store)
+		require.Nil(t, err)
+		assert.Equal(t, data, store.Bytes())
+	})
+
+	t.Run("fresh peers are fetched from the peer sources when the known peers are gone", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Connections = fastConnections
+		torrent.Peers = []peers.Peer{deadPeer(t)}
+		torrent.PeerSources = []connmgr.PeerSource{
+			fakePeerSource{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})},
+		}
+
+		// what the sources return is reported as events
+		var announces = make(chan Event, 10)
+		torrent.Events = func(from *Torrent, event Event) {
+			if event.Type != EventTrackerAnnounce {
+				return
+			}
+
+			select {
+			case announces <- event:
+			default:
+			}
+		}
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		var err = torrent.Download(context.Background(), store)
+		require.Nil(t, err)
+		assert.Equal(t, data, store.Bytes())
+
+		require.NotEmpty(t, announces)
+		var announce = <-announces
+		assert.Equal(t, 1, announce.NumPeers)
+		assert.Nil(t, announce.Err)
+	})
+
+	t.Run("the download gives up when no peer can make progress", func(t *testing.T) {
+		var torrent, _ = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Connections = fastConnections
+		torrent.StallTimeout = 200 * time.Millisecond
+		torrent.Peers = []peers.Peer{deadPeer(t)}
+
+		var err = torrent.Download(context.Background(), storage.NewMemory(torrent.PieceLength, int64(torrent.Length)))
+		assert.ErrorIs(t, err, ErrStalled)
+	})
+
+	t.Run("cancelling the context closes the connections and stops the download", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		var seeder = &fakeSeeder{torrent: torrent, data: data, silent: true, hungUp: make(chan struct{})}
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, seeder)}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		var err = torrent.Download(ctx, store)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// the connection was closed by the time Download returned
+		select {
+		case <-seeder.hungUp:
+		case <-time.After(time.Second):
+			assert.Fail(t, "the connection to the peer is still up")
+		}
+
+		assert.Equal(t, StateStopped, torrent.Stats().State)
+	})
+
+	t.Run("the progress of the download is reported as events and stats", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 5*MaxBlockSize+123, 2*MaxBlockSize)
+		var peer = startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})
+		torrent.Peers = []peers.Peer{peer}
+
+		var mu sync.Mutex
+		var events []Event
+		torrent.Events = func(from *Torrent, event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, event)
+		}
+
+		var err = torrent.Download(context.Background(), storage.NewMemory(torrent.PieceLength, int64(torrent.Length)))
+		require.Nil(t, err)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		var completed []int
+		var types []EventType
+		for _, event := range events {
+			if event.Type == EventPieceCompleted {
+				completed = append(completed, event.Piece)
+				continue
+			}
+			types = append(types, event.Type)
+		}
+		assert.ElementsMatch(t, []int{0, 1, 2}, completed)
+		assert.Equal(t, []EventType{EventStateChanged, EventPeerConnected, EventPeerDisconnected, EventStateChanged}, types)
+		assert.Equal(t, StateDownloading, events[0].State)
+		assert.Equal(t, peer, events[1].Peer)
+		assert.Equal(t, StateCompleted, events[len(events)-1].State)
+
+		var stats = torrent.Stats()
+		assert.Equal(t, StateCompleted, stats.State)
+		assert.Equal(t, int64(len(data)), stats.Downloaded)
+		assert.Equal(t, int64(len(data)), stats.Received)
+		assert.Equal(t, 3, stats.PiecesDone)
+		assert.Equal(t, 0, stats.ConnectedPeers)
+		assert.Equal(t, time.Duration(0), stats.ETA)
+	})
+
+	t.Run("pieces already in the storage are checked and not downloaded again", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 6*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+		torrent.Recheck = true
+
+		// the first piece is intact, the second one is corrupt and the third one is missing
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		require.Nil(t, store.WriteBlock(0, 0, data[:torrent.PieceLength]))
+		require.Nil(t, store.WriteBlock(1, 0, make([]byte, torrent.PieceLength)))
+
+		var mu sync.Mutex
+		var states []State
+		var completed []int
+		torrent.Events = func(from *Torrent, event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch event.Type {
+			case EventStateChanged:
+				states = append(states, event.State)
+			case EventPieceCompleted:
+				completed = append(completed, event.Piece)
+			}
+		}
+
+		var err = torrent.Download(context.Background(), store)
+		require.Nil(t, err)
+		assert.Equal(t, data, store.Bytes())
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []State{StateChecking, StateDownloading, StateCompleted}, states)
+		assert.ElementsMatch(t, []int{1, 2}, completed)
+
+		var stats = torrent.Stats()
+		assert.Equal(t, 3, stats.PiecesDone)
+		assert.Equal(t, int64(len(data)), stats.Downloaded)
+		assert.Equal(t, int64(4*MaxBlockSize), stats.Received)
+	})
+
+	t.Run("the pieces in flight stay within the memory budget", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 12*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{
+			startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data}),
+			startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data}),
+			startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data}),
+		}
+		torrent.Buffers = bufpool.New(int64(2 * torrent.PieceLength))
+
+		var mu sync.Mutex
+		var peak int64
+		torrent.Events = func(from *Torrent, event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			peak = max(peak, from.Stats().MemoryInUse)
+		}
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		var err = torrent.Download(context.Background(), store)
+		require.Nil(t, err)
+		assert.Equal(t, data, store.Bytes())
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.LessOrEqual(t, peak, torrent.Buffers.Budget())
+
+		var stats = torrent.Stats()
+		assert.Equal(t, int64(0), stats.MemoryInUse)
+		assert.Equal(t, torrent.Buffers.Budget(), stats.MemoryBudget)
+	})
+
+	t.Run("the download doesn't start when the disk has no room for it", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+		torrent.Preallocate = storage.PreallocateFull
+
+		var store = &fullStorage{Memory: storage.NewMemory(torrent.PieceLength, int64(torrent.Length))}
+		var err = torrent.Download(context.Background(), store)
+		assert.ErrorIs(t, err, storage.ErrNoSpace)
+		assert.Equal(t, StatePaused, torrent.Stats().State)
+		assert.Equal(t, int64(0), torrent.Stats().Received)
+		assert.Equal(t, storage.Preallocation(-1), store.preallocated)
+	})
+
+	t.Run("the download is paused when the disk runs full", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+		torrent.Preallocate = storage.PreallocateFull
+
+		var states []State
+		torrent.Events = func(from *Torrent, event Event) {
+			if event.Type == EventStateChanged {
+				states = append(states, event.State)
+			}
+		}
+
+		var store = &fullStorage{Memory: storage.NewMemory(torrent.PieceLength, int64(torrent.Length)), room: true}
+		var err = torrent.Download(context.Background(), store)
+		assert.ErrorIs(t, err, storage.ErrNoSpace)
+		assert.ErrorIs(t, err, syscall.ENOSPC)
+		assert.Equal(t, []State{StateDownloading, StatePaused}, states)
+		assert.Equal(t, storage.PreallocateFull, store.preallocated)
+	})
+
+	t.Run("a sequential download completes the pieces in order", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 6*MaxBlockSize, MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+		torrent.Sequential = true
+		torrent.HashWorkers = 1
+
+		var mu sync.Mutex
+		var completed []int
+		torrent.Events = func(from *Torrent, event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if event.Type == EventPieceCompleted {
+				completed = append(completed, event.Piece)
+			}
+		}
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		var err = torrent.Download(context.Background(), store)
+		require.Nil(t, err)
+		assert.Equal(t, data, store.Bytes())
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []int{0, 1, 2, 3, 4, 5}, completed)
+	})
+
+	t.Run("the peers we download from are uploaded the pieces we have", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		torrent.Recheck = true
+
+		var store = storage.NewMemory(MaxBlockSize, int64(len(data)))
+		require.Nil(t, store.WriteBlock(0, 0, data[:MaxBlockSize]))
+
+		var listener, err = net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		defer listener.Close()
+		torrent.Peers = []peers.Peer{{IP: net.IP{127, 0, 0, 1}, Port: uint16(listener.Addr().(*net.TCPAddr).Port)}}
+
+		// the peer has the piece we lack and only gives it to us once we gave it the piece it lacks
+		var uploaded = make(chan []byte, 1)
+		go func() {
+			var conn, err = listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, err = handshake.Read(conn)
+			if err != nil {
+				return
+			}
+			conn.Write(handshake.New(&torrent.InfoHash, &common.Sha1Hash{0xff}).Serialize())
+			conn.Write((&message.Message{Id: message.MsgBitfield, Payload: []byte{0x40}}).Serialize())
+			conn.Write((&message.Message{Id: message.MsgInterested}).Serialize())
+
+			for {
+				var msg, err = message.Read(conn)
+				if err != nil {
+					return
+				}
+
+				switch {
+				case msg == nil:
+				case msg.Id == message.MsgUnchoke:
+					conn.Write(message.FormatRequestMsg(0, 0, MaxBlockSize).Serialize())
+				case msg.Id == message.MsgPiece:
+					var _, _, block, _ = message.ParseBlock(msg)
+					uploaded <- block
+					conn.Write((&message.Message{Id: message.MsgUnchoke}).Serialize())
+				case msg.Id == message.MsgRequest:
+					conn.Write(message.FormatPiece(1, 0, data[MaxBlockSize:]).Serialize())
+				}
+			}
+		}()
+
+		require.Nil(t, torrent.Download(context.Background(), store))
+		assert.Equal(t, data[:MaxBlockSize], <-uploaded)
+		assert.Equal(t, int64(MaxBlockSize), torrent.Stats().Uploaded)
+	})
+
+	t.Run("the download stays within the rate limits", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 8*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+		torrent.GlobalLimits = ratelimit.NewLimits(4*MaxBlockSize, ratelimit.Unlimited)
+
+		// a second worth of data arrives at once, the rest at the global rate
+		var start = time.Now()
+		require.Nil(t, torrent.Download(context.Background(), storage.NewMemory(torrent.PieceLength, int64(torrent.Length))))
+		assert.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+	})
+
+	t.Run("a download paused by its rate limits doesn't stall", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+		torrent.StallTimeout = time.Second
+		torrent.GlobalLimits = ratelimit.NewLimits(ratelimit.Unlimited, ratelimit.Unlimited)
+		torrent.GlobalLimits.SetPaused(true)
+
+		// the pause outlasts the stall timeout, and the peers get all of it again once it is over, however the
+		// stall checks line up with the resume
+		time.AfterFunc(1500*time.Millisecond, func() { torrent.GlobalLimits.SetPaused(false) })
+		require.Nil(t, torrent.Download(context.Background(), storage.NewMemory(torrent.PieceLength, int64(torrent.Length))))
+		assert.False(t, torrent.GlobalLimits.Download.Resumed().IsZero())
+	})
+
+	t.Run("a peer sending corrupt pieces on its own is banned once it sent too many", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 8*MaxBlockSize, 2*MaxBlockSize)
+		var poisoner = startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data, corrupt: true, ip: net.IP{127, 0, 0, 2}})
+		torrent.Peers = []peers.Peer{poisoner}
+		torrent.MaxHashFailures = 2
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+
+		var mu sync.Mutex
+		var failures []Event
+		var disconnected = make(chan error, 10)
+		torrent.Events = func(from *Torrent, event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch event.Type {
+			case EventHashFailed:
+				failures = append(failures, event)
+			case EventPeerBanned:
+				assert.Equal(t, poisoner, event.Peer)
+			case EventPeerDisconnected:
+				disconnected <- event.Err
+			}
+		}
+
+		var done = make(chan error)
+		go func() { done <- torrent.Download(ctx, storage.NewMemory(torrent.PieceLength, int64(torrent.Length))) }()
+
+		// the peer is dropped once banned, and never connected to again
+		assert.ErrorIs(t, <-disconnected, peerban.ErrBanned)
+		assert.True(t, torrent.Bans().Banned(poisoner.IP))
+		time.Sleep(50 * time.Millisecond)
+		assert.Empty(t, disconnected)
+
+		cancel()
+		<-done
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.GreaterOrEqual(t, len(failures), 2)
+		assert.Equal(t, poisoner, failures[0].Peer)
+		assert.Equal(t, []peers.Peer{poisoner}, failures[0].Peers)
+
+		var stats = torrent.Stats()
+		assert.Equal(t, len(failures), stats.HashFailures)
+		assert.Equal(t, 1, stats.BannedPeers)
+	})
+
+	t.Run("the peers that sent the corrupt blocks of a piece several peers contributed to are banned", func(t *testing.T) {
+		// one large piece, which both peers send blocks of
+		var torrent, data = newTestTorrent(t, 32*MaxBlockSize, 32*MaxBlockSize)
+		var poisoner = startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data, corrupt: true, ip: net.IP{127, 0, 0, 2}})
+		var honest = startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data, ip: net.IP{127, 0, 0, 3}})
+		torrent.Peers = []peers.Peer{poisoner, honest}
+
+		// strikes alone never ban anybody here
+		torrent.GlobalBans = peerban.NewList(1000)
+
+		var banned = make(chan peers.Peer, 10)
+		torrent.Events = func(from *Torrent, event Event) {
+			if event.Type == EventPeerBanned {
+				banned <- event.Peer
+			}
+		}
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		require.Nil(t, torrent.Download(context.Background(), store))
+		assert.Equal(t, data, store.Bytes())
+
+		assert.Equal(t, poisoner, <-banned)
+		assert.Empty(t, banned)
+		assert.True(t, torrent.Bans().Banned(poisoner.IP))
+		assert.False(t, torrent.Bans().Banned(honest.IP))
+		assert.Equal(t, 0, torrent.Stats().SuspectPieces)
+	})
+
+	t.Run("peers whose addresses the IP filter blocks are never connected to, whatever their source", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		var blocked = startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data, ip: net.IP{127, 0, 0, 2}})
+		var fromSource = startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data, ip: net.IP{127, 0, 0, 2}})
+		var allowed = startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data, ip: net.IP{127, 0, 0, 3}})
+		torrent.Connections = fastConnections
+		torrent.Peers = []peers.Peer{blocked, allowed}
+		torrent.PeerSources = []connmgr.PeerSource{fakePeerSource{fromSource}}
+		torrent.Filter = ipfilter.New([]ipfilter.Range{{First: net.IP{127, 0, 0, 2}, Last: net.IP{127, 0, 0, 2}}})
+
+		var mu sync.Mutex
+		var connected []peers.Peer
+		torrent.Events = func(from *Torrent, event Event) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if event.Type == EventPeerConnected {
+				connected = append(connected, event.Peer)
+			}
+		}
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		require.Nil(t, torrent.Download(context.Background(), store))
+		assert.Equal(t, data, store.Bytes())
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []peers.Peer{allowed}, connected)
+	})
+
+	t.Run("the connections to peers are opened with the torrent's dialer", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		var seeder = startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})
+		torrent.Peers = []peers.Peer{seeder}
+
+		var dialed = make(chan string, 10)
+		torrent.Dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed <- addr
+			return proxy.Direct.DialContext(ctx, network, addr)
+		})
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		require.Nil(t, torrent.Download(context.Background(), store))
+		assert.Equal(t, data, store.Bytes())
+		assert.Equal(t, seeder.String(), <-dialed)
+	})
+}
+
+// fullStorage is an in-memory storage on a disk that is full by the time anything is written.
+type fullStorage struct {
+	*storage.Memory
+	room         bool                  // whether the disk seems to have room for the content to begin with
+	preallocated storage.Preallocation // mode the storage was preallocated with, -1 if it wasn't
+}
+
+func (store *fullStorage) CheckSpace() error {
+	store.preallocated = -1
+	if !store.room {
+		return fmt.Errorf("%w: no room for the test", storage.ErrNoSpace)
+	}
+
+	return nil
+}
+
+func (store *fullStorage) Preallocate(mode storage.Preallocation) error {
+	store.preallocated = mode
+	return nil
+}
+
+func (store *fullStorage) WriteBlock(index, begin int, data []byte) error {
+	return fmt.Errorf("%w: %w", storage.ErrNoSpace, syscall.ENOSPC)
+}
+
+func (store *fullStorage) WriteAt(data []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("%w: %w", storage.ErrNoSpace, syscall.ENOSPC)
+}
+
+// fakePeerSource is a peer source handing out a fixed list of peers.
+type fakePeerSource []peers.Peer
+
+func (source fakePeerSource) Peers(ctx context.Context) ([]peers.Peer, error) {
+	return source, nil
+}
+
+// deadPeer returns a peer nobody is listening on.
+func deadPeer(t *testing.T) peers.Peer {
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	listener.Close()
+
+	return peers.Peer{IP: net.IP{127, 0, 0, 1}, Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+}
+
+// fastConnections is a connection manager config that retries peers quickly.
+var fastConnections = connmgr.Config{
+	MinBackoff:      10 * time.Millisecond,
+	MaxBackoff:      50 * time.Millisecond,
+	RefreshInterval: 50 * time.Millisecond,
+	TickInterval:    10 * time.Millisecond,
+}
+
+// newTestPeerProgress creates the download state of a peer whose end of the connection is returned.
+func newTestPeerProgress(t *testing.T, picker *Picker) (*PeerProgress, net.Conn) {
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+
+	var clientConn net.Conn
+	clientConn, err = net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+
+	var serverConn net.Conn
+	serverConn, err = listener.Accept()
+	require.Nil(t, err)
+
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	var state = &PeerProgress{
+		Client:   &client.Client{Conn: clientConn, Bitfield: bitfield.Bitfield{0xff}},
+		Picker:   picker,
+		Pipeline: NewPipeline(client.DefaultRequestQueue),
+	}
+
+	return state, serverConn
+}
+
+func TestReadMessageChoke(t *testing.T) {
+	/*
+		test cases:
+		1. a choke hands the outstanding requests back to the picker
+		2. a choke from a peer speaking the Fast Extension keeps the requests until they're rejected
+	*/
+
+	t.Run("a choke hands the outstanding requests back to the picker", func(t *testing.T) {
+		var picker = newTestPicker(1, 2*MaxBlockSize)
+		var state, peerConn = newTestPeerProgress(t, picker)
+
+		require.Nil(t, state.fillPipeline())
+		require.Len(t, state.Requests, 2)
+
+		peerConn.Write((&message.Message{Id: message.MsgChoke}).Serialize())
+		var _, err = state.ReadMessage()
+		assert.Nil(t, err)
+		assert.True(t, state.Client.Choked)
+		assert.Empty(t, state.Requests)
+
+		// the blocks are up for grabs again
+		var _, ok = picker.PickBlock(peers.Peer{}, bitfield.Bitfield{0xff})
+		assert.True(t, ok)
+	})
+
+	t.Run("a choke from a peer speaking the Fast Extension keeps the requests until they're rejected", func(t *testing.T) {
+		var picker = newTestPicker(1, 2*MaxBlockSize)
+		var state, peerConn = newTestPeerProgress(t, picker)
+		state.Client.Fast = true
+
+		require.Nil(t, state.fillPipeline())
+		require.Len(t, state.Requests, 2)
+
+		peerConn.Write((&message.Message{Id: message.MsgChoke}).Serialize())
+		var _, err = state.ReadMessage()
+		assert.Nil(t, err)
+		assert.Len(t, state.Requests, 2)
+
+		var reject = message.FormatRequestMsg(0, MaxBlockSize, MaxBlockSize)
+		reject.Id = message.MsgRejectRequest
+		peerConn.Write(reject.Serialize())
+		_, err = state.ReadMessage()
+		assert.Nil(t, err)
+		assert.Len(t, state.Requests, 1)
+
+		var req, ok = picker.PickBlock(peers.Peer{}, bitfield.Bitfield{0xff})
+		assert.True(t, ok)
+		assert.Equal(t, BlockRequest{Index: 0, Begin: MaxBlockSize, Length: MaxBlockSize}, req)
+	})
+}
+
+func TestExpireRequests(t *testing.T) {
+	var picker = newTestPicker(1, 2*MaxBlockSize)
+	var state, peerConn = newTestPeerProgress(t, picker)
+
+	require.Nil(t, state.fillPipeline())
+	require.Len(t, state.Requests, 2)
+
+	// drain the two requests
+	for i := 0; i != 2; i++ {
+		var _, err = message.Read(peerConn)
+		require.Nil(t, err)
+	}
+
+	// only the first request is overdue
+	var now = time.Now()
+	state.Requests[0].SentAt = now.Add(-state.Pipeline.RequestTimeout())
+
+	var err = state.expireRequests(now)
+	assert.Nil(t, err)
+	assert.Len(t, state.Requests, 1)
+	assert.Equal(t, MaxBlockSize, state.Requests[0].Begin)
+
+	// the peer is told to drop the request
+	var msg *message.Message
+	msg, err = message.Read(peerConn)
+	require.Nil(t, err)
+	assert.Equal(t, message.FormatCancel(0, 0, MaxBlockSize), msg)
+
+	// and its block is up for grabs again
+	var req, ok = picker.PickBlock(peers.Peer{}, bitfield.Bitfield{0xff})
+	assert.True(t, ok)
+	assert.Equal(t, BlockRequest{Index: 0, Begin: 0, Length: MaxBlockSize}, req)
+}
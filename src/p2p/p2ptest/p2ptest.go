@@ -0,0 +1,38 @@
+// Package p2ptest provides the content of the torrents used by the tests of p2p and of the packages built on it.
+// It doesn't depend on p2p, so that the tests of p2p itself can use it too.
+package p2ptest
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+// Content returns `length` bytes of random content, the same for the same length, and the SHA-1 hashes of its
+// pieces of `pieceLength` bytes.
+func Content(length, pieceLength int) ([]byte, []common.Sha1Hash) {
+	var data = make([]byte, length)
+	rand.New(rand.NewSource(int64(length))).Read(data)
+
+	var hashes []common.Sha1Hash
+	for start := 0; start < length; start += pieceLength {
+		var end = min(start+pieceLength, length)
+		hashes = append(hashes, sha1.Sum(data[start:end]))
+	}
+
+	return data, hashes
+}
+
+// NewStore returns an in-memory storage of pieces of `pieceLength` bytes holding `data`, none of them marked as
+// complete yet.
+func NewStore(t testing.TB, pieceLength int, data []byte) *storage.Memory {
+	var store = storage.NewMemory(pieceLength, int64(len(data)))
+	var _, err = store.WriteAt(data, 0)
+	require.Nil(t, err)
+
+	return store
+}
@@ -0,0 +1,599 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/bitfield"
+	"github.com/winterrdog/lean-bit-torrent-client/bufpool"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+// BlockRequest identifies a single block within a piece.
+type BlockRequest struct {
+	Index  int // index of the piece the block belongs to
+	Begin  int // offset of the block within the piece
+	Length int // length of the block in bytes
+}
+
+type blockState uint8
+
+const (
+	blockMissing   blockState = iota // nobody has been asked for the block yet
+	blockRequested                   // the block has been requested from a peer and is in flight
+	blockReceived                    // the block's data has been copied into the piece buffer
+)
+
+// partialPiece is a piece that has at least one of its blocks requested or received.
+// It lives in the picker rather than in a peer worker so that it survives peer disconnects.
+type partialPiece struct {
+	work      *PieceWork   // piece being assembled
+	buf       []byte       // buffer the blocks are copied into
+	blocks    []blockState // state of every block in the piece
+	senders   []peers.Peer // peer each received block came from
+	received  int          // number of blocks in `blocks` marked as received
+	exclusive bool         // whether the piece is downloaded from a single peer, since it was corrupt when several sent it
+	owner     string       // address of the peer an exclusive piece is downloaded from, empty if none yet
+}
+
+// claim reports whether blocks of the piece can be requested from the peer at `addr`. An exclusive piece
+// becomes the peer's if nobody has it yet.
+func (piece *partialPiece) claim(addr string) bool {
+	if !piece.exclusive {
+		return true
+	}
+
+	if piece.owner == "" {
+		piece.owner = addr
+	}
+
+	return piece.owner == addr
+}
+
+// Picker hands out blocks to peer workers and assembles the received blocks into pieces.
+// Blocks are the unit of scheduling, so several peers can contribute to the same piece and
+// the progress on a piece is kept when one of them goes away.
+// New pieces are started rarest first, i.e. the pieces the fewest connected peers have go first, which
+// spreads them through the swarm. In sequential mode, the pieces within a read-ahead window starting at
+// the first missing piece are started in order first, so the content is usable before it is complete.
+// Pieces that have been given a deadline, e.g. because a reader waits for them, go before any other piece,
+// earliest deadline first.
+// The buffers pieces are assembled in come from a buffer pool, so no new piece is started while
+// the pool's budget is used up.
+// It is safe for concurrent use.
+type Picker struct {
+	mu       sync.Mutex
+	pieces   []*PieceWork          // every piece in the torrent
+	buffers  *bufpool.Pool         // pool the piece buffers come from, nil to allocate them without a limit
+	have     bitfield.Bitfield     // pieces that have been downloaded and verified
+	peers    []int                 // number of connected peers that have each piece
+	window   int                   // pieces started in order from `first` on, 0 if not in sequential mode
+	first    int                   // index of the first piece that isn't in `have`
+	urgent   map[int]time.Time     // deadlines of the pieces someone waits for, keyed by piece index
+	partial  map[int]*partialPiece // pieces being assembled, keyed by piece index
+	active   []int                 // indices of the pieces in `partial`, oldest first
+	numHave  int                   // number of pieces set in `have`
+	progress time.Time             // when a block was last received
+	done     chan struct{}         // closed once every piece has been verified
+	doneOnce sync.Once
+}
+
+// NewPicker creates a picker for the given pieces, which assembles them in buffers from the given pool.
+// If `buffers` is nil, the buffers are allocated without a limit.
+// Pieces are expected to be ordered by index.
+func NewPicker(pieces []*PieceWork, buffers *bufpool.Pool) *Picker {
+	var picker = &Picker{
+		pieces:   pieces,
+		buffers:  buffers,
+		have:     make(bitfield.Bitfield, (len(pieces)+7)/8),
+		peers:    make([]int, len(pieces)),
+		partial:  make(map[int]*partialPiece),
+		urgent:   make(map[int]time.Time),
+		progress: time.Now(),
+		done:     make(chan struct{}),
+	}
+
+	if len(pieces) == 0 {
+		picker.doneOnce.Do(func() { close(picker.done) })
+	}
+
+	return picker
+}
+
+// numBlocks returns the number of blocks a piece of the given length is split into.
+func numBlocks(pieceLength int) int {
+	return (pieceLength + MaxBlockSize - 1) / MaxBlockSize
+}
+
+// blockLength returns the length of the block starting at `begin` in a piece of the given length.
+// The last block of a piece might be shorter than MaxBlockSize.
+func blockLength(pieceLength, begin int) int {
+	var length = pieceLength - begin
+	if length > MaxBlockSize {
+		length = MaxBlockSize
+	}
+
+	return length
+}
+
+// Done returns a channel that is closed once every piece has been downloaded and verified.
+func (picker *Picker) Done() <-chan struct{} {
+	return picker.done
+}
+
+// HasPiece reports whether the piece at the given index has been downloaded and verified.
+func (picker *Picker) HasPiece(index int) bool {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	return picker.have.HasPiece(index)
+}
+
+// NumHave returns the number of pieces that have been downloaded and verified.
+func (picker *Picker) NumHave() int {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	return picker.numHave
+}
+
+// LastProgress returns when a block was last received, or when the picker was created if no block was received yet.
+func (picker *Picker) LastProgress() time.Time {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	return picker.progress
+}
+
+// PickBlock picks the next block to request from `peer`, which has the pieces in `peerBitfield`.
+// Blocks of pieces with a deadline come first. Then blocks of pieces that are already partially downloaded
+// are preferred so that pieces get completed, and therefore verified and written, as early as possible.
+// A piece that was corrupt when several peers sent its blocks is downloaded again from a single peer, so
+// that the culprits can be told apart from the download that passes.
+// It returns false if the peer has nothing we still need, or if only new pieces are left to
+// start and the buffer pool's budget is used up, see WaitBuffer.
+func (picker *Picker) PickBlock(peer peers.Peer, peerBitfield bitfield.Bitfield) (BlockRequest, bool) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	var addr = peer.String()
+
+	// what someone waits for comes first
+	for _, index := range picker.byDeadline() {
+		if !peerBitfield.HasPiece(index) {
+			continue
+		}
+
+		var piece = picker.partial[index]
+		if piece == nil {
+			var buf, ok = picker.buffer(picker.pieces[index])
+			if !ok {
+				continue
+			}
+			piece = picker.start(picker.pieces[index], buf)
+		}
+
+		var req, ok = picker.pending(piece, addr)
+		if ok {
+			return req, true
+		}
+	}
+
+	// finish what has been started
+	for _, index := range picker.active {
+		if !peerBitfield.HasPiece(index) {
+			continue
+		}
+
+		var req, ok = picker.pending(picker.partial[index], addr)
+		if ok {
+			return req, true
+		}
+	}
+
+	// start a new piece
+	var pw = picker.next(peerBitfield)
+	if pw == nil {
+		return BlockRequest{}, false
+	}
+
+	var buf, ok = picker.buffer(pw)
+	if !ok {
+		return BlockRequest{}, false
+	}
+
+	var piece = picker.start(pw, buf)
+	var req, _ = picker.pending(piece, addr)
+	return req, true
+}
+
+// buffer returns a buffer to assemble the given piece in, or false if the buffer pool's budget is used up.
+func (picker *Picker) buffer(pw *PieceWork) ([]byte, bool) {
+	if picker.buffers == nil {
+		return make([]byte, pw.Length), true
+	}
+
+	return picker.buffers.TryGet(pw.Length)
+}
+
+// byDeadline returns the indices of the pieces with a deadline, earliest deadline first and lowest index
+// first among pieces with the same deadline.
+// The caller must hold the picker's lock.
+func (picker *Picker) byDeadline() []int {
+	if len(picker.urgent) == 0 {
+		return nil
+	}
+
+	var indices = make([]int, 0, len(picker.urgent))
+	for index := range picker.urgent {
+		indices = append(indices, index)
+	}
+
+	sort.Slice(indices, func(i, j int) bool {
+		var a, b = picker.urgent[indices[i]], picker.urgent[indices[j]]
+		if a.Equal(b) {
+			return indices[i] < indices[j]
+		}
+
+		return a.Before(b)
+	})
+
+	return indices
+}
+
+// SetDeadline asks for the piece at the given index to be downloaded by `deadline`, which puts it before
+// every piece without a deadline or with a later one. A piece keeps the earliest deadline it is given
+// until it is downloaded. Pieces that are downloaded already are left alone.
+func (picker *Picker) SetDeadline(index int, deadline time.Time) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	if index < 0 || index >= len(picker.pieces) || picker.have.HasPiece(index) {
+		return
+	}
+
+	var current, ok = picker.urgent[index]
+	if !ok || deadline.Before(current) {
+		picker.urgent[index] = deadline
+	}
+}
+
+// SetDeadlines replaces the deadlines of all pieces with `deadlines`, keyed by piece index, e.g. when the
+// pieces someone waits for change. Pieces that are downloaded already are left out.
+func (picker *Picker) SetDeadlines(deadlines map[int]time.Time) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	picker.urgent = make(map[int]time.Time, len(deadlines))
+	for index, deadline := range deadlines {
+		if index >= 0 && index < len(picker.pieces) && !picker.have.HasPiece(index) {
+			picker.urgent[index] = deadline
+		}
+	}
+}
+
+// next returns the next piece to start that the peer with the pieces in `peerBitfield` has,
+// or nil if there is none. In sequential mode that is the first such piece within the read-ahead window;
+// otherwise, and if there is none in the window, it is the rarest such piece, the one with the lowest
+// index among equally rare ones.
+// The caller must hold the picker's lock.
+func (picker *Picker) next(peerBitfield bitfield.Bitfield) *PieceWork {
+	var startable = func(index int) bool {
+		return !picker.have.HasPiece(index) && picker.partial[index] == nil && peerBitfield.HasPiece(index)
+	}
+
+	var end = min(picker.first+picker.window, len(picker.pieces))
+	for index := picker.first; index < end; index++ {
+		if startable(index) {
+			return picker.pieces[index]
+		}
+	}
+
+	var rarest *PieceWork
+	for _, pw := range picker.pieces {
+		if !startable(pw.Index) {
+			continue
+		}
+
+		if rarest == nil || picker.peers[pw.Index] < picker.peers[rarest.Index] {
+			rarest = pw
+		}
+	}
+
+	return rarest
+}
+
+// SetSequential switches the picker to sequential mode, in which the pieces within `window` pieces of the
+// first missing piece are started in order before any other piece. A window that is not positive switches
+// back to rarest first.
+func (picker *Picker) SetSequential(window int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	picker.window = max(window, 0)
+}
+
+// AddPeer records that a peer with the pieces in `peerBitfield` connected, which makes those pieces less rare.
+func (picker *Picker) AddPeer(peerBitfield bitfield.Bitfield) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	for index := range picker.peers {
+		if peerBitfield.HasPiece(index) {
+			picker.peers[index]++
+		}
+	}
+}
+
+// RemovePeer records that a peer with the pieces in `peerBitfield` disconnected.
+// `peerBitfield` must include the pieces the peer was added with and announced with PeerHas since.
+func (picker *Picker) RemovePeer(peerBitfield bitfield.Bitfield) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	for index := range picker.peers {
+		if peerBitfield.HasPiece(index) && picker.peers[index] > 0 {
+			picker.peers[index]--
+		}
+	}
+}
+
+// PeerHas records that a connected peer announced that it got the piece at the given index.
+func (picker *Picker) PeerHas(index int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	if index >= 0 && index < len(picker.peers) {
+		picker.peers[index]++
+	}
+}
+
+// WaitBuffer blocks while the next piece the peer with the pieces in `peerBitfield` could start doesn't
+// fit in the buffer pool's budget. It is meant for workers that PickBlock had nothing for.
+// It returns true once the piece fits, in which case PickBlock is worth calling again, and false
+// right away if the peer has no piece left to start.
+// Returns ctx.Err() if `ctx` is cancelled while waiting.
+func (picker *Picker) WaitBuffer(ctx context.Context, peerBitfield bitfield.Bitfield) (bool, error) {
+	if picker.buffers == nil {
+		return false, nil
+	}
+
+	picker.mu.Lock()
+	var pw = picker.next(peerBitfield)
+	picker.mu.Unlock()
+
+	if pw == nil {
+		return false, nil
+	}
+
+	return true, picker.buffers.Wait(ctx, pw.Length)
+}
+
+// start creates a partial piece for the given piece, assembled in `buf`, and makes it active.
+// The caller must hold the picker's lock.
+func (picker *Picker) start(pw *PieceWork, buf []byte) *partialPiece {
+	var piece = &partialPiece{
+		work:    pw,
+		buf:     buf,
+		blocks:  make([]blockState, numBlocks(pw.Length)),
+		senders: make([]peers.Peer, numBlocks(pw.Length)),
+	}
+
+	picker.partial[pw.Index] = piece
+	picker.active = append(picker.active, pw.Index)
+
+	return piece
+}
+
+// pending marks the first missing block of the piece as requested from the peer at `addr` and returns it.
+// It returns false if every block of the piece is either in flight or received, or if the piece is
+// exclusive to another peer.
+// The caller must hold the picker's lock.
+func (picker *Picker) pending(piece *partialPiece, addr string) (BlockRequest, bool) {
+	for i, state := range piece.blocks {
+		if state != blockMissing {
+			continue
+		}
+
+		if !piece.claim(addr) {
+			break
+		}
+
+		piece.blocks[i] = blockRequested
+
+		var begin = i * MaxBlockSize
+		return BlockRequest{
+			Index:  piece.work.Index,
+			Begin:  begin,
+			Length: blockLength(piece.work.Length, begin),
+		}, true
+	}
+
+	return BlockRequest{}, false
+}
+
+// CancelBlock puts a block that was handed out by PickBlock back up for grabs.
+// It is used when the peer the block was requested from goes away or stops serving it.
+// Blocks that have already been received are left alone. An exclusive piece none of whose blocks are in
+// flight anymore is up for grabs by another peer.
+func (picker *Picker) CancelBlock(req BlockRequest) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	var piece = picker.partial[req.Index]
+	if piece == nil {
+		return
+	}
+
+	var block = req.Begin / MaxBlockSize
+	if block < len(piece.blocks) && piece.blocks[block] == blockRequested {
+		piece.blocks[block] = blockMissing
+	}
+
+	for _, state := range piece.blocks {
+		if state == blockRequested {
+			return
+		}
+	}
+	piece.owner = ""
+}
+
+// ReceiveBlock copies the data of a block received from `peer` into its piece, and remembers who sent it
+// in case the piece turns out to be corrupt.
+// It returns true if the block completed the piece, in which case the piece is ready for
+// verification and the caller is responsible for calling FinishPiece.
+// Blocks of pieces we are not assembling and duplicate blocks are ignored.
+// An error is returned if the block does not line up with the piece's blocks.
+func (picker *Picker) ReceiveBlock(peer peers.Peer, index, begin int, data []byte) (bool, error) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	var piece = picker.partial[index]
+	if piece == nil {
+		return false, nil
+	}
+
+	if begin%MaxBlockSize != 0 || begin >= piece.work.Length {
+		return false, fmt.Errorf("block at offset %d does not belong to piece #%d", begin, index)
+	}
+
+	var expected = blockLength(piece.work.Length, begin)
+	if len(data) != expected {
+		return false, fmt.Errorf("expected block of length %d at offset %d of piece #%d, got %d", expected, begin, index, len(data))
+	}
+
+	var block = begin / MaxBlockSize
+	if piece.blocks[block] == blockReceived {
+		return false, nil
+	}
+
+	copy(piece.buf[begin:], data)
+	piece.blocks[block] = blockReceived
+	piece.senders[block] = peer
+	piece.received++
+	picker.progress = time.Now()
+
+	return piece.received == len(piece.blocks), nil
+}
+
+// PieceBuffer returns the assembled data of a piece that has been completed by ReceiveBlock.
+// Once the piece is verified and finished, the caller owns the buffer and gives it back to the
+// picker's buffer pool when done with it.
+// It returns nil if the piece is not being assembled.
+func (picker *Picker) PieceBuffer(index int) []byte {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	var piece = picker.partial[index]
+	if piece == nil {
+		return nil
+	}
+
+	return piece.buf
+}
+
+// Senders returns the peer each block of a piece completed by ReceiveBlock came from, in the order of the
+// blocks, or nil if the piece is not being assembled.
+func (picker *Picker) Senders(index int) []peers.Peer {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	var piece = picker.partial[index]
+	if piece == nil {
+		return nil
+	}
+
+	return append([]peers.Peer(nil), piece.senders...)
+}
+
+// SetHave marks the piece at the given index as downloaded without downloading it, e.g. because it
+// was found in the storage already. Pieces that are being assembled are left alone.
+func (picker *Picker) SetHave(index int) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	if index < 0 || index >= len(picker.pieces) || picker.have.HasPiece(index) || picker.partial[index] != nil {
+		return
+	}
+
+	picker.markHave(index)
+}
+
+// markHave marks the piece at the given index as downloaded and closes the done channel once every piece is.
+// The caller must hold the picker's lock.
+func (picker *Picker) markHave(index int) {
+	picker.have.SetPiece(index)
+	picker.numHave++
+	delete(picker.urgent, index)
+
+	for picker.first < len(picker.pieces) && picker.have.HasPiece(picker.first) {
+		picker.first++
+	}
+
+	if picker.numHave == len(picker.pieces) {
+		picker.doneOnce.Do(func() { close(picker.done) })
+	}
+}
+
+// FinishPiece records the outcome of verifying a completed piece.
+// If the piece is valid it is marked as downloaded, otherwise all of its blocks are reset
+// so that the piece is downloaded again, from a single peer if several peers sent its blocks.
+func (picker *Picker) FinishPiece(index int, valid bool) {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	var piece = picker.partial[index]
+	if piece == nil {
+		return
+	}
+
+	if !valid {
+		// peers are told apart by IP address, like the ban list does
+		for i := range piece.blocks {
+			if !piece.senders[i].IP.Equal(piece.senders[0].IP) {
+				piece.exclusive = true
+			}
+		}
+
+		for i := range piece.blocks {
+			piece.blocks[i] = blockMissing
+			piece.senders[i] = peers.Peer{}
+		}
+		piece.received = 0
+		piece.owner = ""
+		return
+	}
+
+	delete(picker.partial, index)
+	for i, activeIndex := range picker.active {
+		if activeIndex == index {
+			picker.active = append(picker.active[:i], picker.active[i+1:]...)
+			break
+		}
+	}
+
+	picker.markHave(index)
+}
+
+// ReleaseBuffer gives a buffer returned by PieceBuffer back to the buffer pool once its owner is done with it.
+func (picker *Picker) ReleaseBuffer(buf []byte) {
+	if picker.buffers != nil {
+		picker.buffers.Put(buf)
+	}
+}
+
+// Close gives the buffers of the pieces being assembled back to the buffer pool and drops the pieces.
+// It is used once the download ends and no worker uses the picker anymore.
+func (picker *Picker) Close() {
+	picker.mu.Lock()
+	defer picker.mu.Unlock()
+
+	for index, piece := range picker.partial {
+		picker.ReleaseBuffer(piece.buf)
+		delete(picker.partial, index)
+	}
+	picker.active = nil
+}
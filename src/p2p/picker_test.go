@@ -0,0 +1,424 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/bitfield"
+	"github.com/winterrdog/lean-bit-torrent-client/bufpool"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+// newTestPicker creates a picker for `numPieces` pieces of `pieceLength` bytes each.
+func newTestPicker(numPieces, pieceLength int) *Picker {
+	var pieces = make([]*PieceWork, numPieces)
+	for i := range pieces {
+		pieces[i] = &PieceWork{Index: i, Length: pieceLength}
+	}
+
+	return NewPicker(pieces, nil)
+}
+
+func TestPickBlock(t *testing.T) {
+	/*
+		test cases:
+		1. blocks of a piece are handed out in order and the last block is shorter
+		2. partially downloaded pieces are preferred over new ones
+		3. pieces the peer doesn't have are skipped
+		4. nothing is handed out when the peer has nothing we need
+		5. no new piece is started while the memory budget is used up
+		6. the rarest pieces are started first
+		7. pieces within the read-ahead window are started in order in sequential mode
+		8. pieces with a deadline come first, earliest deadline first
+	*/
+
+	var everything = bitfield.Bitfield{0xff}
+
+	t.Run("blocks of a piece are handed out in order and the last block is shorter", func(t *testing.T) {
+		var picker = newTestPicker(1, 2*MaxBlockSize+100)
+
+		var expected = []BlockRequest{
+			{Index: 0, Begin: 0, Length: MaxBlockSize},
+			{Index: 0, Begin: MaxBlockSize, Length: MaxBlockSize},
+			{Index: 0, Begin: 2 * MaxBlockSize, Length: 100},
+		}
+		for _, want := range expected {
+			var req, ok = picker.PickBlock(peers.Peer{}, everything)
+			assert.True(t, ok)
+			assert.Equal(t, want, req)
+		}
+
+		var _, ok = picker.PickBlock(peers.Peer{}, everything)
+		assert.False(t, ok)
+	})
+
+	t.Run("partially downloaded pieces are preferred over new ones", func(t *testing.T) {
+		var picker = newTestPicker(2, 2*MaxBlockSize)
+
+		// a peer with only piece 1 starts it
+		var req, ok = picker.PickBlock(peers.Peer{}, bitfield.Bitfield{0b01000000})
+		require.True(t, ok)
+		assert.Equal(t, 1, req.Index)
+
+		// a peer with everything should help finish piece 1 before starting piece 0
+		req, ok = picker.PickBlock(peers.Peer{}, everything)
+		require.True(t, ok)
+		assert.Equal(t, BlockRequest{Index: 1, Begin: MaxBlockSize, Length: MaxBlockSize}, req)
+
+		req, ok = picker.PickBlock(peers.Peer{}, everything)
+		require.True(t, ok)
+		assert.Equal(t, 0, req.Index)
+	})
+
+	t.Run("pieces the peer doesn't have are skipped", func(t *testing.T) {
+		var picker = newTestPicker(3, MaxBlockSize)
+
+		var req, ok = picker.PickBlock(peers.Peer{}, bitfield.Bitfield{0b00100000})
+		assert.True(t, ok)
+		assert.Equal(t, 2, req.Index)
+	})
+
+	t.Run("nothing is handed out when the peer has nothing we need", func(t *testing.T) {
+		var picker = newTestPicker(3, MaxBlockSize)
+
+		var _, ok = picker.PickBlock(peers.Peer{}, bitfield.Bitfield{0b00011111})
+		assert.False(t, ok)
+	})
+
+	t.Run("no new piece is started while the memory budget is used up", func(t *testing.T) {
+		var buffers = bufpool.New(2 * MaxBlockSize)
+		var picker = NewPicker([]*PieceWork{{Index: 0, Length: 2 * MaxBlockSize}, {Index: 1, Length: MaxBlockSize}}, buffers)
+
+		var first, _ = picker.PickBlock(peers.Peer{}, everything)
+		var second, _ = picker.PickBlock(peers.Peer{}, everything)
+		assert.Equal(t, 0, second.Index)
+		assert.Equal(t, int64(2*MaxBlockSize), buffers.InUse())
+
+		var _, ok = picker.PickBlock(peers.Peer{}, everything)
+		assert.False(t, ok)
+
+		// the worker waits until the finished piece's buffer is given back
+		var waited = make(chan bool)
+		go func() {
+			var ok, _ = picker.WaitBuffer(context.Background(), everything)
+			waited <- ok
+		}()
+
+		select {
+		case <-waited:
+			assert.Fail(t, "WaitBuffer didn't wait for room in the budget")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		picker.ReceiveBlock(peers.Peer{}, first.Index, first.Begin, make([]byte, first.Length))
+		picker.ReceiveBlock(peers.Peer{}, second.Index, second.Begin, make([]byte, second.Length))
+		var buf = picker.PieceBuffer(0)
+		picker.FinishPiece(0, true)
+		picker.ReleaseBuffer(buf)
+		assert.True(t, <-waited)
+
+		var req, _ = picker.PickBlock(peers.Peer{}, everything)
+		assert.Equal(t, 1, req.Index)
+
+		// the buffers of unfinished pieces are given back when the picker is closed
+		picker.Close()
+		assert.Equal(t, int64(0), buffers.InUse())
+
+		// there's nothing to wait for when the peer has no piece left to start
+		ok, _ = picker.WaitBuffer(context.Background(), bitfield.Bitfield{0b10000000})
+		assert.False(t, ok)
+	})
+
+	t.Run("the rarest pieces are started first", func(t *testing.T) {
+		var picker = newTestPicker(4, MaxBlockSize)
+		picker.AddPeer(bitfield.Bitfield{0b11110000})
+		picker.AddPeer(bitfield.Bitfield{0b11010000})
+		picker.AddPeer(bitfield.Bitfield{0b01000000})
+
+		// piece 2 is on a single peer, piece 0 and 3 on two and piece 1 on three
+		var order []int
+		for i := 0; i != 4; i++ {
+			var req, ok = picker.PickBlock(peers.Peer{}, everything)
+			require.True(t, ok)
+			order = append(order, req.Index)
+		}
+		assert.Equal(t, []int{2, 0, 3, 1}, order)
+
+		// pieces the peers announce and the pieces of the peers that leave count too
+		picker = newTestPicker(3, MaxBlockSize)
+		picker.AddPeer(bitfield.Bitfield{0b11100000})
+		picker.PeerHas(0)
+		picker.PeerHas(1)
+		picker.RemovePeer(bitfield.Bitfield{0b01000000})
+
+		order = nil
+		for i := 0; i != 3; i++ {
+			var req, _ = picker.PickBlock(peers.Peer{}, everything)
+			order = append(order, req.Index)
+		}
+		assert.Equal(t, []int{1, 2, 0}, order)
+	})
+
+	t.Run("pieces within the read-ahead window are started in order in sequential mode", func(t *testing.T) {
+		var picker = newTestPicker(6, MaxBlockSize)
+		picker.SetSequential(2)
+
+		// pieces 3 and 5 are the rarest, but only get their turn once the window is taken care of
+		picker.AddPeer(bitfield.Bitfield{0b11101000})
+		picker.AddPeer(bitfield.Bitfield{0b11111100})
+
+		var pick = func() int {
+			var req, ok = picker.PickBlock(peers.Peer{}, everything)
+			require.True(t, ok)
+			return req.Index
+		}
+		assert.Equal(t, 0, pick())
+		assert.Equal(t, 1, pick())
+		assert.Equal(t, 3, pick())
+
+		// the window moves along as the first pieces complete
+		for index := 0; index != 2; index++ {
+			var complete, _ = picker.ReceiveBlock(peers.Peer{}, index, 0, make([]byte, MaxBlockSize))
+			require.True(t, complete)
+			picker.FinishPiece(index, true)
+		}
+		assert.Equal(t, 2, pick())
+		assert.Equal(t, 5, pick())
+		assert.Equal(t, 4, pick())
+	})
+
+	t.Run("pieces with a deadline come first, earliest deadline first", func(t *testing.T) {
+		var picker = newTestPicker(4, 2*MaxBlockSize)
+		var now = time.Now()
+
+		// piece 0 is under way, but pieces someone waits for go first
+		var first, _ = picker.PickBlock(peers.Peer{}, everything)
+		require.Equal(t, 0, first.Index)
+
+		picker.SetDeadline(3, now.Add(time.Second))
+		picker.SetDeadline(2, now.Add(2*time.Second))
+		picker.SetDeadline(2, now.Add(3*time.Second))
+
+		var order []int
+		for i := 0; i != 4; i++ {
+			var req, ok = picker.PickBlock(peers.Peer{}, everything)
+			require.True(t, ok)
+			order = append(order, req.Index)
+		}
+		assert.Equal(t, []int{3, 3, 2, 2}, order)
+
+		// the deadline goes away with the piece
+		for begin := 0; begin != 2*MaxBlockSize; begin += MaxBlockSize {
+			picker.ReceiveBlock(peers.Peer{}, 3, begin, make([]byte, MaxBlockSize))
+		}
+		picker.FinishPiece(3, true)
+		assert.NotContains(t, picker.urgent, 3)
+
+		picker.SetDeadline(3, now)
+		assert.NotContains(t, picker.urgent, 3)
+	})
+}
+
+func TestReceiveBlock(t *testing.T) {
+	/*
+		test cases:
+		1. blocks from different peers are assembled into one piece
+		2. cancelled blocks survive a disconnect and are handed out again
+		3. blocks that don't line up are rejected
+		4. a piece that fails verification is downloaded again
+		5. verified pieces complete the download
+		6. pieces found in the storage are not handed out
+		7. the peer every block came from is remembered until the piece is downloaded again
+		8. a piece that fails verification after several peers sent its blocks is downloaded again from a single peer
+		9. a piece whose blocks came from a single IP address on several ports is downloaded again as usual
+	*/
+
+	var everything = bitfield.Bitfield{0xff}
+
+	t.Run("blocks from different peers are assembled into one piece", func(t *testing.T) {
+		var picker = newTestPicker(1, MaxBlockSize+2)
+
+		var first, _ = picker.PickBlock(peers.Peer{}, everything)
+		var second, _ = picker.PickBlock(peers.Peer{}, everything)
+
+		var firstData = make([]byte, first.Length)
+		firstData[0] = 0xaa
+
+		// blocks can arrive out of order
+		var complete, err = picker.ReceiveBlock(peers.Peer{}, second.Index, second.Begin, []byte{0xbb, 0xcc})
+		assert.Nil(t, err)
+		assert.False(t, complete)
+
+		complete, err = picker.ReceiveBlock(peers.Peer{}, first.Index, first.Begin, firstData)
+		assert.Nil(t, err)
+		assert.True(t, complete)
+
+		var buf = picker.PieceBuffer(0)
+		assert.Equal(t, byte(0xaa), buf[0])
+		assert.Equal(t, []byte{0xbb, 0xcc}, buf[MaxBlockSize:])
+	})
+
+	t.Run("cancelled blocks survive a disconnect and are handed out again", func(t *testing.T) {
+		var picker = newTestPicker(1, 2*MaxBlockSize)
+
+		var first, _ = picker.PickBlock(peers.Peer{}, everything)
+		var second, _ = picker.PickBlock(peers.Peer{}, everything)
+
+		var complete, err = picker.ReceiveBlock(peers.Peer{}, first.Index, first.Begin, make([]byte, first.Length))
+		require.Nil(t, err)
+		require.False(t, complete)
+
+		// the peer serving the second block goes away
+		picker.CancelBlock(second)
+
+		var req, ok = picker.PickBlock(peers.Peer{}, everything)
+		assert.True(t, ok)
+		assert.Equal(t, second, req)
+
+		complete, err = picker.ReceiveBlock(peers.Peer{}, req.Index, req.Begin, make([]byte, req.Length))
+		assert.Nil(t, err)
+		assert.True(t, complete)
+	})
+
+	t.Run("blocks that don't line up are rejected", func(t *testing.T) {
+		var picker = newTestPicker(1, 2*MaxBlockSize)
+		picker.PickBlock(peers.Peer{}, everything)
+
+		var _, err = picker.ReceiveBlock(peers.Peer{}, 0, 3, make([]byte, MaxBlockSize))
+		assert.NotNil(t, err)
+
+		_, err = picker.ReceiveBlock(peers.Peer{}, 0, 0, make([]byte, 10))
+		assert.NotNil(t, err)
+	})
+
+	t.Run("a piece that fails verification is downloaded again", func(t *testing.T) {
+		var picker = newTestPicker(1, MaxBlockSize)
+
+		var req, _ = picker.PickBlock(peers.Peer{}, everything)
+		var complete, _ = picker.ReceiveBlock(peers.Peer{}, req.Index, req.Begin, make([]byte, req.Length))
+		require.True(t, complete)
+
+		picker.FinishPiece(0, false)
+		assert.False(t, picker.HasPiece(0))
+
+		var again, ok = picker.PickBlock(peers.Peer{}, everything)
+		assert.True(t, ok)
+		assert.Equal(t, req, again)
+	})
+
+	t.Run("verified pieces complete the download", func(t *testing.T) {
+		var picker = newTestPicker(2, MaxBlockSize)
+
+		for i := 0; i != 2; i++ {
+			var req, ok = picker.PickBlock(peers.Peer{}, everything)
+			require.True(t, ok)
+
+			var complete, _ = picker.ReceiveBlock(peers.Peer{}, req.Index, req.Begin, make([]byte, req.Length))
+			require.True(t, complete)
+			picker.FinishPiece(req.Index, true)
+		}
+
+		assert.True(t, picker.HasPiece(0))
+		assert.True(t, picker.HasPiece(1))
+		assert.Equal(t, 2, picker.NumHave())
+
+		select {
+		case <-picker.Done():
+		default:
+			t.Fatal("expected picker to be done")
+		}
+
+		// blocks of pieces that are already done are ignored
+		var complete, err = picker.ReceiveBlock(peers.Peer{}, 0, 0, make([]byte, MaxBlockSize))
+		assert.Nil(t, err)
+		assert.False(t, complete)
+	})
+
+	t.Run("pieces found in the storage are not handed out", func(t *testing.T) {
+		var picker = newTestPicker(2, MaxBlockSize)
+
+		picker.SetHave(0)
+		picker.SetHave(0)
+		assert.Equal(t, 1, picker.NumHave())
+
+		var req, ok = picker.PickBlock(peers.Peer{}, everything)
+		require.True(t, ok)
+		assert.Equal(t, 1, req.Index)
+
+		// a piece that is being assembled is left to its download
+		picker.SetHave(1)
+		assert.False(t, picker.HasPiece(1))
+	})
+	t.Run("the peer every block came from is remembered until the piece is downloaded again", func(t *testing.T) {
+		var picker = newTestPicker(1, 2*MaxBlockSize)
+		var alice = peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+		var bob = peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881}
+		assert.Nil(t, picker.Senders(0))
+
+		var first, _ = picker.PickBlock(alice, everything)
+		var second, _ = picker.PickBlock(bob, everything)
+		picker.ReceiveBlock(bob, second.Index, second.Begin, make([]byte, second.Length))
+		picker.ReceiveBlock(alice, first.Index, first.Begin, make([]byte, first.Length))
+		assert.Equal(t, []peers.Peer{alice, bob}, picker.Senders(0))
+
+		picker.FinishPiece(0, false)
+		assert.Equal(t, []peers.Peer{{}, {}}, picker.Senders(0))
+	})
+
+	t.Run("a piece that fails verification after several peers sent its blocks is downloaded again from a single peer", func(t *testing.T) {
+		var picker = newTestPicker(1, 3*MaxBlockSize)
+		var alice = peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+		var bob = peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881}
+
+		for i := 0; i != 3; i++ {
+			var peer = []peers.Peer{alice, bob}[i%2]
+			var req, _ = picker.PickBlock(peer, everything)
+			picker.ReceiveBlock(peer, req.Index, req.Begin, make([]byte, req.Length))
+		}
+		picker.FinishPiece(0, false)
+
+		// the first peer to ask gets the whole piece
+		var first, ok = picker.PickBlock(bob, everything)
+		require.True(t, ok)
+		assert.Equal(t, 0, first.Begin)
+		_, ok = picker.PickBlock(alice, everything)
+		assert.False(t, ok)
+
+		var second BlockRequest
+		second, ok = picker.PickBlock(bob, everything)
+		require.True(t, ok)
+		assert.Equal(t, MaxBlockSize, second.Begin)
+
+		// once the peer gave up on its blocks, another peer can take over
+		picker.CancelBlock(first)
+		picker.CancelBlock(second)
+		var third BlockRequest
+		third, ok = picker.PickBlock(alice, everything)
+		require.True(t, ok)
+		assert.Equal(t, 0, third.Begin)
+		_, ok = picker.PickBlock(bob, everything)
+		assert.False(t, ok)
+	})
+
+	t.Run("a piece whose blocks came from a single IP address on several ports is downloaded again as usual", func(t *testing.T) {
+		var picker = newTestPicker(1, 2*MaxBlockSize)
+		var first = peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+		var second = peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6882}
+
+		for _, peer := range []peers.Peer{first, second} {
+			var req, _ = picker.PickBlock(peer, everything)
+			picker.ReceiveBlock(peer, req.Index, req.Begin, make([]byte, req.Length))
+		}
+		picker.FinishPiece(0, false)
+
+		// the piece isn't held for a single peer, so both get blocks of it
+		var _, ok = picker.PickBlock(first, everything)
+		assert.True(t, ok)
+		_, ok = picker.PickBlock(second, everything)
+		assert.True(t, ok)
+	})
+}
@@ -0,0 +1,111 @@
+package p2p
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	MinBacklog      = 2   // fewest unfulfilled requests kept in a peer's pipeline once it has been measured
+	MaxRequestQueue = 250 // most unfulfilled requests kept in a peer's pipeline, whatever the peer accepts
+
+	MinRequestTimeout = 4 * time.Second  // shortest time a request may stay unanswered before its block is reassigned
+	MaxRequestTimeout = 30 * time.Second // longest time a request may stay unanswered before its block is reassigned
+
+	pipelineGain  = 2.0              // how many bandwidth-delay products worth of requests to keep in flight
+	timeoutFactor = 3.0              // how many times the expected wait for a block to tolerate before giving up on it
+	rateInterval  = time.Second      // how long to accumulate received bytes for before sampling the download rate
+	rateSmoothing = 0.5              // weight given to a new rate sample over the running average
+	rttWindow     = 10 * time.Second // how long the lowest round-trip time seen is trusted for
+)
+
+// Pipeline sizes the queue of outstanding requests to a single peer.
+// Like libtorrent, it aims to keep a bandwidth-delay product worth of requests in flight: enough to
+// cover the data the peer can send us during one round trip. The download rate is a smoothed average
+// of what the peer actually delivered, and the round-trip time is the lowest request-to-block latency
+// seen recently, which leaves out the time requests spend queued behind each other at the peer.
+// The pipeline keeps pipelineGain times the product in flight so that a peer whose rate is only
+// limited by our queue depth sees the queue grow until the link itself becomes the limit.
+type Pipeline struct {
+	rate        float64       // smoothed download rate from the peer in bytes per second
+	minRtt      time.Duration // lowest round-trip time seen in the current window
+	minRttAt    time.Time     // when `minRtt` was seen
+	sampleStart time.Time     // when the current rate sample started
+	sampleBytes int           // bytes received during the current rate sample
+	limit       int           // most requests the peer accepts
+}
+
+// NewPipeline creates a pipeline for a peer that accepts at most `limit` outstanding requests.
+// Until the peer has been measured, the pipeline holds MaxBacklog requests.
+func NewPipeline(limit int) *Pipeline {
+	var pipeline = &Pipeline{limit: MaxRequestQueue}
+	pipeline.SetLimit(limit)
+
+	return pipeline
+}
+
+// SetLimit sets the number of outstanding requests the peer accepts, e.g. after it advertised `reqq`.
+// Limits above MaxRequestQueue are capped and non-positive limits are ignored.
+func (pipeline *Pipeline) SetLimit(limit int) {
+	if limit <= 0 {
+		return
+	}
+
+	pipeline.limit = min(limit, MaxRequestQueue)
+}
+
+// Received records the arrival of a block of `n` bytes that took `rtt` to arrive after it was requested.
+func (pipeline *Pipeline) Received(n int, rtt time.Duration, now time.Time) {
+	// a window of round-trip times lets the estimate recover after the route or the peer slows down
+	if rtt > 0 && (pipeline.minRtt == 0 || rtt < pipeline.minRtt || now.Sub(pipeline.minRttAt) > rttWindow) {
+		pipeline.minRtt = rtt
+		pipeline.minRttAt = now
+	}
+
+	if pipeline.sampleStart.IsZero() {
+		pipeline.sampleStart = now
+	}
+	pipeline.sampleBytes += n
+
+	var elapsed = now.Sub(pipeline.sampleStart)
+	if elapsed < rateInterval {
+		return
+	}
+
+	var sample = float64(pipeline.sampleBytes) / elapsed.Seconds()
+	if pipeline.rate == 0 {
+		pipeline.rate = sample
+	} else {
+		pipeline.rate = rateSmoothing*sample + (1-rateSmoothing)*pipeline.rate
+	}
+
+	pipeline.sampleStart = now
+	pipeline.sampleBytes = 0
+}
+
+// Depth returns the number of outstanding requests to keep in the peer's pipeline.
+// It is never more than the peer accepts.
+func (pipeline *Pipeline) Depth() int {
+	var depth = MaxBacklog
+	if pipeline.rate > 0 && pipeline.minRtt > 0 {
+		var bdp = pipeline.rate * pipeline.minRtt.Seconds() / MaxBlockSize
+		depth = max(int(math.Ceil(pipelineGain*bdp)), MinBacklog)
+	}
+
+	return min(depth, pipeline.limit)
+}
+
+// RequestTimeout returns how long a request to the peer may stay unanswered before its block is given to someone else.
+// It allows a few times the expected wait for a block at the back of a full pipeline, which is one round trip plus the
+// time the peer needs to send the blocks queued ahead of it. Peers that haven't been measured get MaxRequestTimeout.
+func (pipeline *Pipeline) RequestTimeout() time.Duration {
+	if pipeline.rate == 0 {
+		return MaxRequestTimeout
+	}
+
+	var queued = float64(pipeline.Depth()*MaxBlockSize) / pipeline.rate
+	var expected = pipeline.minRtt + time.Duration(queued*float64(time.Second))
+	var timeout = time.Duration(timeoutFactor * float64(expected))
+
+	return min(max(timeout, MinRequestTimeout), MaxRequestTimeout)
+}
@@ -0,0 +1,115 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// feedPipeline simulates a peer delivering `rate` bytes per second in full blocks for `duration`,
+// with every block arriving `rtt` after it was requested. It returns the time the feed ended.
+func feedPipeline(pipeline *Pipeline, start time.Time, rate int, rtt, duration time.Duration) time.Time {
+	var interval = time.Duration(float64(time.Second) * MaxBlockSize / float64(rate))
+	var now = start
+	for end := start.Add(duration); !now.After(end); now = now.Add(interval) {
+		pipeline.Received(MaxBlockSize, rtt, now)
+	}
+
+	return now
+}
+
+func TestPipelineDepth(t *testing.T) {
+	/*
+		test cases:
+		1. an unmeasured peer gets the default backlog
+		2. the depth follows the bandwidth-delay product
+		3. the depth is capped by what the peer accepts
+		4. slow peers still get a minimal pipeline
+		5. the round-trip time recovers after the window expires
+	*/
+
+	var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("an unmeasured peer gets the default backlog", func(t *testing.T) {
+		var pipeline = NewPipeline(0)
+		assert.Equal(t, MaxBacklog, pipeline.Depth())
+
+		// a single block isn't enough to know the rate
+		pipeline.Received(MaxBlockSize, 50*time.Millisecond, start)
+		assert.Equal(t, MaxBacklog, pipeline.Depth())
+	})
+
+	t.Run("the depth follows the bandwidth-delay product", func(t *testing.T) {
+		var pipeline = NewPipeline(0)
+
+		// 100 blocks a second over a 100ms link is 10 blocks in flight
+		feedPipeline(pipeline, start, 100*MaxBlockSize, 100*time.Millisecond, 3*time.Second)
+		assert.InDelta(t, 100*MaxBlockSize, pipeline.rate, 2*MaxBlockSize)
+		assert.Equal(t, 100*time.Millisecond, pipeline.minRtt)
+		assert.InDelta(t, 20, pipeline.Depth(), 1)
+
+		// the same peer on a long-haul link needs a much deeper pipeline
+		pipeline = NewPipeline(0)
+		feedPipeline(pipeline, start, 100*MaxBlockSize, 600*time.Millisecond, 3*time.Second)
+		assert.InDelta(t, 120, pipeline.Depth(), 3)
+	})
+
+	t.Run("the depth is capped by what the peer accepts", func(t *testing.T) {
+		var pipeline = NewPipeline(0)
+		feedPipeline(pipeline, start, 1000*MaxBlockSize, time.Second, 3*time.Second)
+		assert.Equal(t, MaxRequestQueue, pipeline.Depth())
+
+		pipeline.SetLimit(64)
+		assert.Equal(t, 64, pipeline.Depth())
+
+		pipeline = NewPipeline(5)
+		assert.Equal(t, 5, pipeline.Depth())
+	})
+
+	t.Run("slow peers still get a minimal pipeline", func(t *testing.T) {
+		var pipeline = NewPipeline(0)
+		feedPipeline(pipeline, start, 2*MaxBlockSize, 10*time.Millisecond, 5*time.Second)
+		assert.Equal(t, MinBacklog, pipeline.Depth())
+	})
+
+	t.Run("the round-trip time recovers after the window expires", func(t *testing.T) {
+		var pipeline = NewPipeline(0)
+		var now = feedPipeline(pipeline, start, 100*MaxBlockSize, 10*time.Millisecond, time.Second)
+		assert.Equal(t, 10*time.Millisecond, pipeline.minRtt)
+
+		// the route got longer
+		feedPipeline(pipeline, now, 100*MaxBlockSize, 200*time.Millisecond, 2*rttWindow)
+		assert.Equal(t, 200*time.Millisecond, pipeline.minRtt)
+	})
+}
+
+func TestPipelineRequestTimeout(t *testing.T) {
+	/*
+		test cases:
+		1. an unmeasured peer gets the longest timeout
+		2. fast peers get the shortest timeout
+		3. the timeout grows with the time it takes to drain the pipeline
+	*/
+
+	var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("an unmeasured peer gets the longest timeout", func(t *testing.T) {
+		assert.Equal(t, MaxRequestTimeout, NewPipeline(0).RequestTimeout())
+	})
+
+	t.Run("fast peers get the shortest timeout", func(t *testing.T) {
+		var pipeline = NewPipeline(0)
+		feedPipeline(pipeline, start, 1000*MaxBlockSize, 5*time.Millisecond, 3*time.Second)
+		assert.Equal(t, MinRequestTimeout, pipeline.RequestTimeout())
+	})
+
+	t.Run("the timeout grows with the time it takes to drain the pipeline", func(t *testing.T) {
+		// 10 blocks a second over a 500ms link keeps 10 blocks in flight,
+		// so the last one is expected about 1.5s after it was requested
+		var pipeline = NewPipeline(0)
+		feedPipeline(pipeline, start, 10*MaxBlockSize, 500*time.Millisecond, 5*time.Second)
+		assert.InDelta(t, 10, pipeline.Depth(), 1)
+		assert.InDelta(t, 4.5, pipeline.RequestTimeout().Seconds(), 0.5)
+	})
+}
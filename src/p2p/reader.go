@@ -0,0 +1,388 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/bitfield"
+)
+
+// readAheadLag is how much later than the pieces a read waits for the pieces it reads ahead are due,
+// so that they don't hold up the reads of other readers.
+const readAheadLag = time.Second
+
+// ErrNotDownloaded is returned by reads of data that the download ended without.
+var ErrNotDownloaded = errors.New("the download ended before the data was downloaded")
+
+// blockReader reads blocks of the content, like a storage or the disk writing to it.
+type blockReader interface {
+	ReadBlock(index, begin int, buf []byte) error
+}
+
+// want is a range of pieces a read waits for, followed by the pieces it reads ahead.
+type want struct {
+	first, last int       // indices of the first and last piece the read waits for
+	ahead       int       // index of the last piece read ahead, `last` if none is
+	deadline    time.Time // when the read started
+}
+
+// content keeps track of which pieces of a torrent can be read, for its readers.
+type content struct {
+	mu       sync.Mutex
+	readable bitfield.Bitfield  // pieces that are in the storage or on their way to it
+	picker   *Picker            // picker of the running download, nil before the first download starts
+	source   blockReader        // where the pieces are read from, nil before the first download starts
+	ended    error              // why the download ended, nil while it is running
+	changed  chan struct{}      // closed and replaced whenever any of the above changes
+	wants    map[*want]struct{} // pieces the readers wait for or read ahead, which come first in the picker
+}
+
+// contentOf returns the content of the torrent, creating it on first use.
+func (torrent *Torrent) contentOf() *content {
+	torrent.contentOnce.Do(func() {
+		torrent.content = &content{changed: make(chan struct{}), wants: make(map[*want]struct{})}
+	})
+
+	return torrent.content
+}
+
+// notify wakes up the readers waiting for the content to change.
+// The caller must hold the content's lock.
+func (c *content) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// begin starts tracking the content of a new download, whose pieces are read from `source`.
+func (c *content) begin(numPieces int, picker *Picker, source blockReader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readable = bitfield.New(numPieces)
+	c.picker = picker
+	c.source = source
+	c.ended = nil
+	c.notify()
+	c.prioritize()
+}
+
+// setSource makes the pieces be read from `source` from now on.
+func (c *content) setSource(source blockReader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.source = source
+}
+
+// setReadable records that the piece at the given index can be read.
+func (c *content) setReadable(index int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readable.SetPiece(index)
+	c.notify()
+}
+
+// started reports whether a download of the torrent started, so that its pieces can be read.
+func (c *content) started() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.picker != nil
+}
+
+// snapshot returns a copy of the pieces that can be read and how many there are.
+func (c *content) snapshot() (bitfield.Bitfield, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var count int
+	for index := 0; index != len(c.readable)*8; index++ {
+		if c.readable.HasPiece(index) {
+			count++
+		}
+	}
+
+	return append(bitfield.Bitfield{}, c.readable...), count
+}
+
+// newPieces returns the indices of the pieces that can be read but aren't set in `known`, in ascending order.
+func (c *content) newPieces(known bitfield.Bitfield) []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var pieces []int
+	for i := range c.readable {
+		if i < len(known) && c.readable[i] == known[i] {
+			continue
+		}
+
+		for index := i * 8; index != (i+1)*8; index++ {
+			if c.readable.HasPiece(index) && !known.HasPiece(index) {
+				pieces = append(pieces, index)
+			}
+		}
+	}
+
+	return pieces
+}
+
+// readableSource returns where to read the piece at the given index from, and false if it can't be read yet.
+func (c *content) readableSource(index int) (blockReader, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.readable.HasPiece(index) {
+		return nil, false
+	}
+
+	return c.source, true
+}
+
+// end records that the download ended because of `err`, which is nil if it completed.
+// The pieces that can be read stay readable.
+func (c *content) end(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		err = ErrNotDownloaded
+	}
+
+	c.ended = err
+	c.notify()
+}
+
+// prioritize gives the pieces the readers want that can't be read yet a deadline in the picker of the running
+// download, if there is one, replacing the deadlines given before. The pieces a read waits for are due when
+// the read started, the pieces it reads ahead a little later. A piece wanted by several reads is due by the
+// earliest of their deadlines.
+// The caller must hold the content's lock.
+func (c *content) prioritize() {
+	if c.picker == nil || c.ended != nil {
+		return
+	}
+
+	var deadlines = make(map[int]time.Time)
+	for w := range c.wants {
+		for index := w.first; index <= w.ahead; index++ {
+			if c.readable.HasPiece(index) {
+				continue
+			}
+
+			var deadline = w.deadline
+			if index > w.last {
+				deadline = deadline.Add(readAheadLag)
+			}
+
+			var current, ok = deadlines[index]
+			if !ok || deadline.Before(current) {
+				deadlines[index] = deadline
+			}
+		}
+	}
+
+	c.picker.SetDeadlines(deadlines)
+}
+
+// addWant makes the pieces of `w` come first in the picker.
+func (c *content) addWant(w *want) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.wants[w] = struct{}{}
+	c.prioritize()
+}
+
+// settle keeps the pieces `w` of a finished read of `reader` reads ahead first in the picker, until the
+// reader's next read or until it is closed. The pieces of a read that started before the reader's last
+// finished one are dropped instead.
+func (c *content) settle(reader *Reader, w *want) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case reader.closed || (reader.last != nil && reader.last.deadline.After(w.deadline)):
+		delete(c.wants, w)
+	default:
+		if reader.last != nil {
+			delete(c.wants, reader.last)
+		}
+		reader.last = w
+	}
+
+	c.prioritize()
+}
+
+// close drops the pieces `reader` reads ahead from the picker, and those of its reads that finish later.
+func (c *content) close(reader *Reader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reader.closed = true
+	if reader.last != nil {
+		delete(c.wants, reader.last)
+		reader.last = nil
+	}
+
+	c.prioritize()
+}
+
+// wait blocks until the piece at the given index can be read and returns where to read it from.
+// Returns ctx.Err() if `ctx` is cancelled first, or an error wrapping ErrNotDownloaded if the download
+// ended without the piece.
+func (c *content) wait(ctx context.Context, index int) (blockReader, error) {
+	for {
+		c.mu.Lock()
+		var readable = c.readable.HasPiece(index)
+		var source, ended, changed = c.source, c.ended, c.changed
+		c.mu.Unlock()
+
+		if readable {
+			return source, nil
+		}
+
+		if ended != nil {
+			if errors.Is(ended, ErrNotDownloaded) {
+				return nil, fmt.Errorf("piece #%d: %w", index, ended)
+			}
+
+			return nil, fmt.Errorf("piece #%d: %w: %w", index, ErrNotDownloaded, ended)
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Reader reads the content of a torrent while it downloads. A read blocks until the pieces it covers
+// have been downloaded and verified, and asks for them to be downloaded before any other piece.
+// Reads started before the download wait for it to start.
+// The pieces the last read reads ahead keep coming first until the next read or until the reader is closed,
+// so the priorities of the download follow the open readers.
+// ReadAt is safe for concurrent use; Read and Seek are not, like with an os.File.
+type Reader struct {
+	ReadAhead int // Pieces past the data of each read that are fetched ahead of the next reads. None by default.
+
+	torrent *Torrent
+	ctx     context.Context
+	offset  int64 // where Read continues from
+	last    *want // pieces the last finished read reads ahead, guarded by the content's lock
+	closed  bool  // whether the reader was closed, guarded by the content's lock
+}
+
+// NewReader creates a reader of the torrent's content, starting at the beginning.
+// Its reads give up with ctx.Err() once `ctx` is cancelled. Once the download ended, the pieces it
+// downloaded are read from its storage, which must still be open.
+// The reader should be closed once it is no longer used, so that its pieces stop coming first.
+func (torrent *Torrent) NewReader(ctx context.Context) *Reader {
+	torrent.contentOf()
+	return &Reader{torrent: torrent, ctx: ctx}
+}
+
+// ReadAt reads len(buf) bytes at offset `off` of the content into `buf`, waiting for the pieces they
+// lie in to be downloaded. The pieces are given a deadline of when the read started, so the pieces of
+// earlier reads come first, and the reader's read-ahead pieces past them are due a little later.
+// It returns the number of bytes read, and io.EOF if the content ends before `buf` is full.
+// Returns ctx.Err() if the reader's context is cancelled first, an error wrapping ErrNotDownloaded
+// if the download ends without the data, or the error that occurred while reading the storage.
+func (reader *Reader) ReadAt(buf []byte, off int64) (int, error) {
+	var torrent = reader.torrent
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+
+	var length = int64(torrent.Length)
+	if off >= length {
+		return 0, io.EOF
+	}
+
+	var n = int(min(int64(len(buf)), length-off))
+	var pieceLength = int64(torrent.PieceLength)
+	var w = &want{first: int(off / pieceLength), last: int((off + int64(n) - 1) / pieceLength), deadline: time.Now()}
+	w.ahead = min(w.last+max(reader.ReadAhead, 0), len(torrent.PiecesHashes)-1)
+	torrent.content.addWant(w)
+	defer torrent.content.settle(reader, w)
+
+	var done int
+	for done < n {
+		var pos = off + int64(done)
+		var index = int(pos / pieceLength)
+		var start, end = torrent.calculateBoundsForPiece(index)
+		var begin = int(pos - int64(start))
+		var size = min(n-done, end-start-begin)
+
+		var source, err = torrent.content.wait(reader.ctx, index)
+		if err != nil {
+			return done, err
+		}
+
+		err = source.ReadBlock(index, begin, buf[done:done+size])
+		if err != nil {
+			return done, err
+		}
+
+		done += size
+	}
+
+	if n < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Read reads up to len(buf) bytes from where the last read or seek left off into `buf`, waiting for the
+// pieces they lie in to be downloaded, see ReadAt.
+// It returns the number of bytes read, or io.EOF once the end of the content is reached.
+func (reader *Reader) Read(buf []byte) (int, error) {
+	var n, err = reader.ReadAt(buf, reader.offset)
+	reader.offset += int64(n)
+
+	// a short read isn't the end as long as something was read
+	if errors.Is(err, io.EOF) && n != 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Seek sets where the next Read starts to `offset`, relative to the start of the content, the current
+// position or the end of the content depending on `whence`, as explained in io.Seeker.
+// Nothing is downloaded until the next read.
+// It returns the new position. Returns an error if the position would be negative.
+func (reader *Reader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = reader.offset + offset
+	case io.SeekEnd:
+		pos = int64(reader.torrent.Length) + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+
+	reader.offset = pos
+	return pos, nil
+}
+
+// Close stops the pieces the reader reads ahead from coming first. The reader can still be read afterwards,
+// without reading ahead.
+// It always returns nil.
+func (reader *Reader) Close() error {
+	reader.torrent.content.close(reader)
+	return nil
+}
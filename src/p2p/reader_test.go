@@ -0,0 +1,171 @@
+package p2p
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/bitfield"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+func TestReader(t *testing.T) {
+	/*
+		test cases:
+		1. reads wait for the download to start and for their pieces to be downloaded
+		2. reads at any offset are served, and the content ends with io.EOF
+		3. reads give up when the context is cancelled
+		4. reads of data the download ended without fail
+		5. seeking moves where the next read starts
+		6. the pieces of open readers come first in the picker until the readers are closed
+	*/
+
+	t.Run("reads wait for the download to start and for their pieces to be downloaded", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 7*MaxBlockSize+123, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+
+		var reader = torrent.NewReader(context.Background())
+		var got = make(chan []byte)
+		go func() {
+			var all, _ = io.ReadAll(reader)
+			got <- all
+		}()
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		require.Nil(t, torrent.Download(context.Background(), store))
+		assert.Equal(t, data, <-got)
+	})
+
+	t.Run("reads at any offset are served, and the content ends with io.EOF", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 5*MaxBlockSize+123, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		require.Nil(t, torrent.Download(context.Background(), store))
+
+		var reader = torrent.NewReader(context.Background())
+		var buf = make([]byte, 3*MaxBlockSize)
+		var n, err = reader.ReadAt(buf, MaxBlockSize+7)
+		assert.Nil(t, err)
+		assert.Equal(t, len(buf), n)
+		assert.Equal(t, data[MaxBlockSize+7:4*MaxBlockSize+7], buf)
+
+		n, err = reader.ReadAt(buf, int64(len(data)-10))
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Equal(t, 10, n)
+		assert.Equal(t, data[len(data)-10:], buf[:n])
+
+		_, err = reader.ReadAt(buf, int64(len(data)))
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("reads give up when the context is cancelled", func(t *testing.T) {
+		var torrent, _ = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		var _, err = torrent.NewReader(ctx).Read(make([]byte, 10))
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("reads of data the download ended without fail", func(t *testing.T) {
+		var torrent, _ = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Connections = fastConnections
+		torrent.StallTimeout = 200 * time.Millisecond
+		torrent.Peers = []peers.Peer{deadPeer(t)}
+
+		var reader = torrent.NewReader(context.Background())
+		var failed = make(chan error)
+		go func() {
+			var _, err = reader.ReadAt(make([]byte, 10), 3*MaxBlockSize)
+			failed <- err
+		}()
+
+		var err = torrent.Download(context.Background(), storage.NewMemory(torrent.PieceLength, int64(torrent.Length)))
+		assert.ErrorIs(t, err, ErrStalled)
+
+		err = <-failed
+		assert.ErrorIs(t, err, ErrNotDownloaded)
+		assert.ErrorIs(t, err, ErrStalled)
+	})
+
+	t.Run("seeking moves where the next read starts", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, 2*MaxBlockSize)
+		torrent.Peers = []peers.Peer{startFakeSeeder(t, &fakeSeeder{torrent: torrent, data: data})}
+		require.Nil(t, torrent.Download(context.Background(), storage.NewMemory(torrent.PieceLength, int64(torrent.Length))))
+
+		var reader = torrent.NewReader(context.Background())
+		var pos, err = reader.Seek(-5, io.SeekEnd)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)-5), pos)
+
+		var buf = make([]byte, 10)
+		var n int
+		n, err = reader.Read(buf)
+		assert.Nil(t, err)
+		assert.Equal(t, data[len(data)-5:], buf[:n])
+
+		_, err = reader.Read(buf)
+		assert.ErrorIs(t, err, io.EOF)
+
+		pos, err = reader.Seek(-int64(len(data)), io.SeekCurrent)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), pos)
+
+		_, err = reader.Seek(-1, io.SeekStart)
+		assert.NotNil(t, err)
+	})
+	t.Run("the pieces of open readers come first in the picker until the readers are closed", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 6*MaxBlockSize, MaxBlockSize)
+		var store = storage.NewMemory(torrent.PieceLength, int64(torrent.Length))
+		require.Nil(t, store.WriteBlock(0, 0, data[:MaxBlockSize]))
+
+		var picker = newTestPicker(6, MaxBlockSize)
+		var content = torrent.contentOf()
+		content.begin(6, picker, store)
+		content.setReadable(0)
+
+		var reader = torrent.NewReader(context.Background())
+		reader.ReadAhead = 2
+		var _, err = reader.ReadAt(make([]byte, 10), 0)
+		require.Nil(t, err)
+
+		// the read is done, but the pieces it reads ahead stay wanted
+		picker.mu.Lock()
+		assert.Len(t, picker.urgent, 2)
+		assert.Contains(t, picker.urgent, 1)
+		assert.Contains(t, picker.urgent, 2)
+		picker.mu.Unlock()
+
+		// a read waiting for its piece comes before the pieces read ahead
+		var ctx, cancel = context.WithCancel(context.Background())
+		var other = torrent.NewReader(ctx)
+		var failed = make(chan error)
+		go func() {
+			var _, err = other.ReadAt(make([]byte, 10), 5*MaxBlockSize)
+			failed <- err
+		}()
+
+		assert.Eventually(t, func() bool {
+			var req, ok = picker.PickBlock(peers.Peer{}, bitfield.NewFull(6))
+			if ok {
+				picker.CancelBlock(req)
+			}
+			return ok && req.Index == 5
+		}, time.Second, time.Millisecond)
+
+		cancel()
+		assert.ErrorIs(t, <-failed, context.Canceled)
+		other.Close()
+
+		reader.Close()
+		picker.mu.Lock()
+		assert.Empty(t, picker.urgent)
+		picker.mu.Unlock()
+	})
+}
@@ -0,0 +1,425 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/bitfield"
+	"github.com/winterrdog/lean-bit-torrent-client/choker"
+	"github.com/winterrdog/lean-bit-torrent-client/client"
+	"github.com/winterrdog/lean-bit-torrent-client/connmgr"
+	"github.com/winterrdog/lean-bit-torrent-client/message"
+)
+
+const (
+	keepAliveInterval = time.Minute // longest time we go without sending anything to a peer we upload to
+	seedCheckInterval = time.Second // how often seeding checks whether the seed ratio is reached
+)
+
+// ErrNotServing is returned by ServePeer while the torrent's content can't be uploaded, i.e. before its
+// first download started.
+var ErrNotServing = errors.New("the torrent isn't being downloaded or seeded")
+
+// upload is the side of a connection that sends the torrent's content to the peer.
+// It is a choker.Peer: the torrent's choker decides whether the peer's requests are answered.
+type upload struct {
+	torrent     *Torrent
+	client      *client.Client
+	announced   bitfield.Bitfield // pieces the peer was told we have
+	numPieces   int               // number of pieces in the torrent
+	ourPieces   int               // number of pieces set in `announced`
+	peerPieces  int               // number of pieces set in the peer's bitfield
+	lastSent    time.Time         // when we last sent the peer anything, apart from chokes and unchokes
+	blockBuffer []byte            // buffer the blocks sent to the peer are read into
+
+	interested atomic.Bool  // whether the peer wants pieces from us
+	choking    atomic.Bool  // whether we refuse to answer the peer's requests
+	downloaded atomic.Int64 // bytes of block data received from the peer
+	uploaded   atomic.Int64 // bytes of block data sent to the peer
+}
+
+// newUpload starts uploading to the peer of the connection: the peer is told which pieces we have and handed
+// to the torrent's choker, which it must be removed from once the connection ends.
+// Returns an error if the pieces we have could not be sent.
+func (torrent *Torrent) newUpload(torrentClient *client.Client) (*upload, error) {
+	var state = &upload{
+		torrent:   torrent,
+		client:    torrentClient,
+		numPieces: len(torrent.PiecesHashes),
+		lastSent:  time.Now(),
+	}
+	state.choking.Store(true)
+
+	state.announced, state.ourPieces = torrent.content.snapshot()
+	var err = torrentClient.SendBitfield(state.announced, state.numPieces)
+	if err != nil {
+		return nil, err
+	}
+
+	torrent.Choker().Add(state)
+	return state, nil
+}
+
+// Interested reports whether the peer wants pieces from us.
+func (state *upload) Interested() bool {
+	return state.interested.Load()
+}
+
+// Transferred returns the bytes of block data received from the peer and sent to it so far.
+func (state *upload) Transferred() (int64, int64) {
+	return state.downloaded.Load(), state.uploaded.Load()
+}
+
+// SetChoked chokes or unchokes the peer and tells it so. Should that fail, the connection's own reads and
+// writes run into the same error.
+func (state *upload) SetChoked(choked bool) {
+	state.choking.Store(choked)
+
+	if choked {
+		state.client.SendChoke()
+	} else {
+		state.client.SendUnchoke()
+	}
+}
+
+// ServePeer uploads the torrent's content to the peer of a connection it opened to us, whose handshake was
+// completed by client.Accept, until the connection ends or `ctx` is cancelled. The connection is closed
+// before it returns.
+// The peer is told which pieces we have, and about every other piece as soon as it can be read. Interested
+// peers are unchoked when the torrent's choker gives them a slot, where they rank last while we download since
+// nothing is downloaded on these connections, and their requests for the pieces we have are answered from the
+// storage. The requests
+// we can't answer are rejected if the peer speaks the Fast Extension and ignored otherwise. The connection
+// ends once both sides have every piece, since neither has anything left to give the other.
+// It works as soon as a download of the torrent started and keeps working once it ended, for as long as its
+// storage is open.
+// The connection counts towards the connection limits of the download, or only towards the global ones once
+// the download ended.
+// Returns nil if the connection ended because both sides have every piece, ErrNotServing if no download
+// started yet, ipfilter.ErrBlocked, peerban.ErrBanned, connmgr.ErrSelf, connmgr.ErrDuplicate or
+// connmgr.ErrTooMany if the connection isn't kept, ctx.Err() once `ctx` is cancelled, or the error that ended
+// the connection.
+func (torrent *Torrent) ServePeer(ctx context.Context, torrentClient *client.Client) error {
+	torrentClient.LimitRate(torrent.Limits(), torrent.GlobalLimits)
+	defer torrentClient.Conn.Close()
+
+	var content = torrent.contentOf()
+	if !content.started() {
+		return ErrNotServing
+	}
+
+	var release, err = torrent.admit(torrentClient)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// unblock reads and writes on the connection as soon as we're told to stop
+	var stopClosing = context.AfterFunc(ctx, func() { torrentClient.Conn.Close() })
+	defer stopClosing()
+
+	torrent.peerConnected(torrentClient.Peer, torrentClient.Encrypted)
+	err = torrent.uploadToPeer(ctx, torrentClient)
+	torrent.peerDisconnected(torrentClient.Peer, err)
+
+	return err
+}
+
+// admit counts a connection a peer opened to us towards the connection limits of the download while it runs,
+// and towards the global ones otherwise.
+// It returns the function to call once the connection ended.
+// Returns ipfilter.ErrBlocked if the IP filter blocks the peer, peerban.ErrBanned if the peer is banned,
+// connmgr.ErrSelf if the peer is ourselves, connmgr.ErrDuplicate if we are connected to it already, or
+// connmgr.ErrTooMany if the connection goes over the limits.
+func (torrent *Torrent) admit(torrentClient *client.Client) (func(), error) {
+	var err = torrent.refused(torrentClient.Peer)
+	if err != nil {
+		return nil, err
+	}
+
+	torrent.statsMu.Lock()
+	var manager = torrent.stats.manager
+	torrent.statsMu.Unlock()
+
+	if manager != nil {
+		return manager.Accept(torrentClient.RemoteId)
+	}
+
+	if torrentClient.RemoteId == torrent.PeerId {
+		return nil, connmgr.ErrSelf
+	}
+
+	var release, ok = torrent.Connections.Global.Accept()
+	if !ok {
+		return nil, connmgr.ErrTooMany
+	}
+
+	return release, nil
+}
+
+// uploadToPeer does the work of ServePeer once the connection is up.
+func (torrent *Torrent) uploadToPeer(ctx context.Context, torrentClient *client.Client) error {
+	var numPieces = len(torrent.PiecesHashes)
+	torrentClient.Bitfield = bitfield.New(numPieces)
+
+	var state, err = torrent.newUpload(torrentClient)
+	if err != nil {
+		return err
+	}
+	defer torrent.Choker().Remove(state)
+
+	for {
+		err = state.announce()
+		if err != nil {
+			return err
+		}
+
+		if state.ourPieces == numPieces && state.peerPieces == numPieces {
+			return nil
+		}
+
+		var msg *message.Message
+		msg, err = torrentClient.Read()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// a peer that has nothing to ask for may go quiet for a while
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = state.keepAlive(time.Now())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = state.track(msg)
+		if err != nil {
+			return err
+		}
+
+		err = state.handle(msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// announce tells the peer about the pieces that became readable since it was last told.
+func (state *upload) announce() error {
+	var pieces = state.torrent.content.newPieces(state.announced)
+	for _, index := range pieces {
+		var err = state.client.SendHave(index)
+		if err != nil {
+			return err
+		}
+
+		state.announced.SetPiece(index)
+		state.ourPieces++
+		state.lastSent = time.Now()
+	}
+
+	return nil
+}
+
+// keepAlive sends the peer a keep-alive message if we haven't sent it anything for a while.
+func (state *upload) keepAlive(now time.Time) error {
+	if now.Sub(state.lastSent) < keepAliveInterval {
+		return nil
+	}
+
+	state.lastSent = now
+	return state.client.SendKeepAlive()
+}
+
+// handle handles the messages from the peer about what it wants from us: interested and not interested
+// messages, which the choker is told about, and requests. Other messages are ignored.
+// It returns an error if the message is malformed, asks for data outside of the content, or if the answer
+// could not be sent.
+func (state *upload) handle(msg *message.Message) error {
+	if msg == nil {
+		return nil
+	}
+
+	switch msg.Id {
+	case message.MsgInterested:
+		state.interested.Store(true)
+		state.torrent.Choker().PeerInterested(state)
+	case message.MsgNotInterested:
+		state.interested.Store(false)
+	case message.MsgRequest:
+		var index, begin, length, err = message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+
+		return state.answer(index, begin, length)
+	}
+
+	return nil
+}
+
+// track keeps track of the pieces the peer has from its messages, on connections we only upload on.
+// It also handles the peer's extended handshake. Other messages are ignored.
+// It returns an error if the message is malformed.
+func (state *upload) track(msg *message.Message) error {
+	if msg == nil {
+		return nil
+	}
+
+	switch msg.Id {
+	case message.MsgHave:
+		var index, err = message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+
+		state.peerHas(index)
+	case message.MsgBitfield:
+		var bf = bitfield.Bitfield(msg.Payload)
+		for index := 0; index != state.numPieces; index++ {
+			if bf.HasPiece(index) {
+				state.peerHas(index)
+			}
+		}
+	case message.MsgHaveAll:
+		for index := 0; index != state.numPieces; index++ {
+			state.peerHas(index)
+		}
+	case message.MsgExtended:
+		if len(msg.Payload) == 0 || msg.Payload[0] != message.ExtendedHandshakeId {
+			break
+		}
+
+		return state.client.HandleExtendedHandshake(msg)
+	}
+
+	return nil
+}
+
+// peerHas records that the peer has the piece at the given index.
+func (state *upload) peerHas(index int) {
+	if index < 0 || index >= state.numPieces || state.client.Bitfield.HasPiece(index) {
+		return
+	}
+
+	state.client.Bitfield.SetPiece(index)
+	state.peerPieces++
+}
+
+// answer sends the peer the block it requested if it is unchoked and we have the block's piece.
+// Otherwise the request is rejected if the peer speaks the Fast Extension, and ignored if it doesn't.
+// Returns an error if the block lies outside of the content or could not be read or sent.
+func (state *upload) answer(index, begin, length int) error {
+	var torrent = state.torrent
+	if index < 0 || index >= state.numPieces || begin < 0 || length <= 0 || length > MaxBlockSize ||
+		begin+length > torrent.calculatePieceSize(index) {
+		return fmt.Errorf("invalid request for %d bytes at offset %d of piece #%d", length, begin, index)
+	}
+
+	var source, ok = torrent.content.readableSource(index)
+	if state.choking.Load() || !ok {
+		if !state.client.Fast {
+			return nil
+		}
+
+		state.lastSent = time.Now()
+		return state.client.SendRejectRequest(index, begin, length)
+	}
+
+	if state.blockBuffer == nil {
+		state.blockBuffer = make([]byte, MaxBlockSize)
+	}
+
+	var block = state.blockBuffer[:length]
+	var err = source.ReadBlock(index, begin, block)
+	if err != nil {
+		return fmt.Errorf("failed to read block at offset %d of piece #%d: %w", begin, index, err)
+	}
+
+	err = state.client.SendPiece(index, begin, block)
+	if err != nil {
+		return err
+	}
+
+	state.lastSent = time.Now()
+	state.uploaded.Add(int64(length))
+	torrent.blockUploaded(length)
+	return nil
+}
+
+// Seed keeps the torrent's content available to the peers connecting to us once the download completed,
+// until the bytes uploaded since it started reach SeedRatio times the length of the content or SeedTime
+// went by, whichever comes first. Without either limit, it returns right away.
+// The download is in StateSeeding while it seeds, and back in StateCompleted afterwards. The peers are
+// uploaded to through ServePeer, whose connections the caller should end once Seed returns.
+// Returns nil once a limit is reached, ctx.Err() if `ctx` is cancelled first, or an error if the download
+// hasn't completed.
+func (torrent *Torrent) Seed(ctx context.Context) error {
+	if torrent.SeedRatio <= 0 && torrent.SeedTime <= 0 {
+		return nil
+	}
+
+	if torrent.Stats().State != StateCompleted {
+		return errors.New("only completed downloads can be seeded")
+	}
+
+	torrent.setState(StateSeeding, nil)
+	defer torrent.setState(StateCompleted, nil)
+
+	// peers are unchoked by how fast they download from us
+	var chokerCtx, stopChoker = context.WithCancel(ctx)
+	var chokerDone = make(chan struct{})
+	go func() {
+		torrent.Choker().Run(chokerCtx, true)
+		close(chokerDone)
+	}()
+	defer func() {
+		stopChoker()
+		<-chokerDone
+	}()
+
+	var timeLimit <-chan time.Time
+	if torrent.SeedTime > 0 {
+		var timer = time.NewTimer(torrent.SeedTime)
+		defer timer.Stop()
+
+		timeLimit = timer.C
+	}
+
+	var check = time.NewTicker(seedCheckInterval)
+	defer check.Stop()
+
+	for {
+		var stats = torrent.Stats()
+		if torrent.SeedRatio > 0 && float64(stats.Uploaded) >= torrent.SeedRatio*float64(stats.Length) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeLimit:
+			return nil
+		case <-check.C:
+		}
+	}
+}
+
+// Choker returns the choker deciding which peers the torrent uploads to, creating it on first use with
+// UploadSlots slots. Its number of slots can be changed while the torrent runs.
+func (torrent *Torrent) Choker() *choker.Choker {
+	torrent.chokerOnce.Do(func() {
+		torrent.choker = choker.New(torrent.UploadSlots)
+	})
+
+	return torrent.choker
+}
@@ -0,0 +1,302 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/client"
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/connmgr"
+	"github.com/winterrdog/lean-bit-torrent-client/handshake"
+	"github.com/winterrdog/lean-bit-torrent-client/ipfilter"
+	"github.com/winterrdog/lean-bit-torrent-client/message"
+	"github.com/winterrdog/lean-bit-torrent-client/p2p/p2ptest"
+	"github.com/winterrdog/lean-bit-torrent-client/peerban"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+// newSeedTorrent returns a torrent whose download completed from the data already in its storage, and its content.
+func newSeedTorrent(t *testing.T, length, pieceLength int) (*Torrent, []byte) {
+	var torrent, data = newTestTorrent(t, length, pieceLength)
+	torrent.Recheck = true
+
+	require.Nil(t, torrent.Download(context.Background(), p2ptest.NewStore(t, pieceLength, data)))
+
+	return torrent, data
+}
+
+// connectLeecher opens a connection to the torrent as a peer speaking the Fast Extension or not, and serves it
+// on the torrent. It returns our end of the connection, past the handshake, and the channel ServePeer's
+// result is sent to.
+func connectLeecher(t *testing.T, ctx context.Context, torrent *Torrent, fast bool) (net.Conn, chan error) {
+	var ln, err = net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	var served = make(chan error, 1)
+	go func() {
+		var conn, err = ln.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+
+		var torrentClient *client.Client
+		torrentClient, err = client.Accept(ctx, conn, func(common.Sha1Hash) (common.Sha1Hash, bool) {
+			return torrent.PeerId, true
+		})
+		if err != nil {
+			served <- err
+			return
+		}
+
+		served <- torrent.ServePeer(ctx, torrentClient)
+	}()
+
+	var conn net.Conn
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	var hs = handshake.New(&torrent.InfoHash, &common.Sha1Hash{0x09})
+	if fast {
+		hs.EnableFastExtension()
+	}
+	_, err = conn.Write(hs.Serialize())
+	require.Nil(t, err)
+
+	_, err = handshake.Read(conn)
+	require.Nil(t, err)
+
+	return conn, served
+}
+
+// readMessage reads the next message that isn't a keep-alive from the connection.
+func readMessage(t *testing.T, conn net.Conn) *message.Message {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		var msg, err = message.Read(conn)
+		require.Nil(t, err)
+
+		if msg != nil {
+			return msg
+		}
+	}
+}
+
+func TestServePeer(t *testing.T) {
+	/*
+		test cases:
+		1. peers are told which pieces we have and have their requests answered once interested
+		2. requests of choked peers and for missing pieces are rejected
+		3. peers are told about the pieces that become readable
+		4. invalid requests end the connection
+		5. the connection ends once both sides have every piece
+		6. peers can't be served before the download started
+		7. interested peers beyond the upload slots stay choked
+		8. connections from ourselves and beyond the connection limits are refused
+		9. connections from the peers the IP filter blocks or that are banned are refused
+	*/
+
+	t.Run("peers are told which pieces we have and have their requests answered once interested", func(t *testing.T) {
+		var torrent, data = newSeedTorrent(t, 3*MaxBlockSize+100, 2*MaxBlockSize)
+		var conn, _ = connectLeecher(t, context.Background(), torrent, false)
+
+		var msg = readMessage(t, conn)
+		assert.Equal(t, message.MsgBitfield, msg.Id)
+		assert.Equal(t, []byte{0xc0}, msg.Payload)
+
+		conn.Write((&message.Message{Id: message.MsgInterested}).Serialize())
+		assert.Equal(t, message.MsgUnchoke, readMessage(t, conn).Id)
+
+		conn.Write(message.FormatRequestMsg(1, MaxBlockSize, 100).Serialize())
+		var index, begin, block, err = message.ParseBlock(readMessage(t, conn))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, index)
+		assert.Equal(t, MaxBlockSize, begin)
+		assert.Equal(t, data[3*MaxBlockSize:], block)
+
+		assert.Eventually(t, func() bool { return torrent.Stats().Uploaded == 100 }, time.Second, time.Millisecond)
+	})
+
+	t.Run("requests of choked peers and for missing pieces are rejected", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, MaxBlockSize)
+		var store = storage.NewMemory(MaxBlockSize, int64(len(data)))
+		require.Nil(t, store.WriteBlock(0, 0, data[:MaxBlockSize]))
+
+		var content = torrent.contentOf()
+		content.begin(4, newTestPicker(4, MaxBlockSize), store)
+		content.setReadable(0)
+
+		var conn, _ = connectLeecher(t, context.Background(), torrent, true)
+		assert.Equal(t, message.MsgBitfield, readMessage(t, conn).Id)
+
+		conn.Write(message.FormatRequestMsg(0, 0, MaxBlockSize).Serialize())
+		assert.Equal(t, message.FormatRejectRequest(0, 0, MaxBlockSize), readMessage(t, conn))
+
+		conn.Write((&message.Message{Id: message.MsgInterested}).Serialize())
+		assert.Equal(t, message.MsgUnchoke, readMessage(t, conn).Id)
+
+		conn.Write(message.FormatRequestMsg(2, 0, MaxBlockSize).Serialize())
+		assert.Equal(t, message.FormatRejectRequest(2, 0, MaxBlockSize), readMessage(t, conn))
+	})
+
+	t.Run("peers are told about the pieces that become readable", func(t *testing.T) {
+		var torrent, data = newTestTorrent(t, 4*MaxBlockSize, MaxBlockSize)
+		var store = storage.NewMemory(MaxBlockSize, int64(len(data)))
+
+		var content = torrent.contentOf()
+		content.begin(4, newTestPicker(4, MaxBlockSize), store)
+
+		var conn, _ = connectLeecher(t, context.Background(), torrent, true)
+		assert.Equal(t, message.MsgHaveNone, readMessage(t, conn).Id)
+
+		require.Nil(t, store.WriteBlock(2, 0, data[2*MaxBlockSize:3*MaxBlockSize]))
+		content.setReadable(2)
+		assert.Equal(t, message.FormatHave(2), readMessage(t, conn))
+	})
+
+	t.Run("invalid requests end the connection", func(t *testing.T) {
+		var torrent, _ = newSeedTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		var conn, served = connectLeecher(t, context.Background(), torrent, false)
+		readMessage(t, conn)
+
+		conn.Write(message.FormatRequestMsg(1, MaxBlockSize-10, 20).Serialize())
+		assert.ErrorContains(t, <-served, "invalid request")
+	})
+
+	t.Run("the connection ends once both sides have every piece", func(t *testing.T) {
+		var torrent, _ = newSeedTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		var conn, served = connectLeecher(t, context.Background(), torrent, true)
+		assert.Equal(t, message.MsgHaveAll, readMessage(t, conn).Id)
+
+		conn.Write((&message.Message{Id: message.MsgHaveAll}).Serialize())
+		assert.Nil(t, <-served)
+	})
+
+	t.Run("peers can't be served before the download started", func(t *testing.T) {
+		var torrent, _ = newTestTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		var _, served = connectLeecher(t, context.Background(), torrent, true)
+		assert.ErrorIs(t, <-served, ErrNotServing)
+	})
+
+	t.Run("interested peers beyond the upload slots stay choked", func(t *testing.T) {
+		var torrent, _ = newSeedTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		torrent.Choker().SetSlots(1)
+
+		var first, _ = connectLeecher(t, context.Background(), torrent, true)
+		assert.Equal(t, message.MsgHaveAll, readMessage(t, first).Id)
+		first.Write((&message.Message{Id: message.MsgInterested}).Serialize())
+		assert.Equal(t, message.MsgUnchoke, readMessage(t, first).Id)
+
+		var second, _ = connectLeecher(t, context.Background(), torrent, true)
+		assert.Equal(t, message.MsgHaveAll, readMessage(t, second).Id)
+		second.Write((&message.Message{Id: message.MsgInterested}).Serialize())
+		second.Write(message.FormatRequestMsg(0, 0, MaxBlockSize).Serialize())
+		assert.Equal(t, message.FormatRejectRequest(0, 0, MaxBlockSize), readMessage(t, second))
+	})
+
+	t.Run("connections from ourselves and beyond the connection limits are refused", func(t *testing.T) {
+		var torrent, _ = newSeedTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		torrent.Connections.Global = connmgr.NewLimits(1, 1)
+
+		var ours, _ = net.Pipe()
+		var self = &client.Client{Conn: ours, RemoteId: torrent.PeerId}
+		assert.ErrorIs(t, torrent.ServePeer(context.Background(), self), connmgr.ErrSelf)
+
+		var conn, _ = connectLeecher(t, context.Background(), torrent, true)
+		assert.Equal(t, message.MsgHaveAll, readMessage(t, conn).Id)
+
+		var _, served = connectLeecher(t, context.Background(), torrent, true)
+		assert.ErrorIs(t, <-served, connmgr.ErrTooMany)
+	})
+
+	t.Run("connections from the peers the IP filter blocks or that are banned are refused", func(t *testing.T) {
+		var torrent, _ = newSeedTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		torrent.Filter = ipfilter.New([]ipfilter.Range{{First: net.IP{10, 0, 0, 0}, Last: net.IP{10, 0, 0, 255}}})
+		torrent.Bans().Ban(net.IP{192, 0, 2, 1})
+
+		var ours, _ = net.Pipe()
+		var blocked = &client.Client{Conn: ours, Peer: peers.Peer{IP: net.IP{10, 0, 0, 7}, Port: 6881}}
+		assert.ErrorIs(t, torrent.ServePeer(context.Background(), blocked), ipfilter.ErrBlocked)
+
+		ours, _ = net.Pipe()
+		var banned = &client.Client{Conn: ours, Peer: peers.Peer{IP: net.IP{192, 0, 2, 1}, Port: 6881}}
+		assert.ErrorIs(t, torrent.ServePeer(context.Background(), banned), peerban.ErrBanned)
+
+		// the filter can be changed while seeding
+		torrent.Filter.Set(nil)
+		var conn, _ = connectLeecher(t, context.Background(), torrent, true)
+		assert.Equal(t, message.MsgHaveAll, readMessage(t, conn).Id)
+	})
+}
+
+func TestSeed(t *testing.T) {
+	/*
+		test cases:
+		1. seeding stops once the seed ratio is reached
+		2. seeding stops once the seed time went by
+		3. without limits there is no seeding
+		4. downloads that haven't completed can't be seeded
+	*/
+
+	t.Run("seeding stops once the seed ratio is reached", func(t *testing.T) {
+		var torrent, _ = newSeedTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		torrent.SeedRatio = 0.5
+
+		var seeded = make(chan error)
+		go func() { seeded <- torrent.Seed(context.Background()) }()
+
+		assert.Eventually(t, func() bool { return torrent.Stats().State == StateSeeding }, time.Second, time.Millisecond)
+
+		var conn, _ = connectLeecher(t, context.Background(), torrent, false)
+		readMessage(t, conn)
+		conn.Write((&message.Message{Id: message.MsgInterested}).Serialize())
+		readMessage(t, conn)
+		conn.Write(message.FormatRequestMsg(0, 0, MaxBlockSize).Serialize())
+		readMessage(t, conn)
+
+		select {
+		case err := <-seeded:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, "seeding didn't stop at the seed ratio")
+		}
+		assert.Equal(t, StateCompleted, torrent.Stats().State)
+	})
+
+	t.Run("seeding stops once the seed time went by", func(t *testing.T) {
+		var torrent, _ = newSeedTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		torrent.SeedTime = 50 * time.Millisecond
+
+		var start = time.Now()
+		assert.Nil(t, torrent.Seed(context.Background()))
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+		// seeding doesn't count as time spent downloading
+		assert.Less(t, torrent.Stats().Elapsed, 50*time.Millisecond)
+	})
+
+	t.Run("without limits there is no seeding", func(t *testing.T) {
+		var torrent, _ = newSeedTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		var events []Event
+		torrent.Events = func(torrent *Torrent, event Event) { events = append(events, event) }
+
+		assert.Nil(t, torrent.Seed(context.Background()))
+		assert.Empty(t, events)
+	})
+
+	t.Run("downloads that haven't completed can't be seeded", func(t *testing.T) {
+		var torrent, _ = newTestTorrent(t, 2*MaxBlockSize, MaxBlockSize)
+		torrent.SeedTime = time.Hour
+
+		assert.NotNil(t, torrent.Seed(context.Background()))
+	})
+}
@@ -0,0 +1,283 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/bufpool"
+	"github.com/winterrdog/lean-bit-torrent-client/connmgr"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+const rateWindow = 5 // number of seconds the download rate is averaged over
+
+// Stats is a snapshot of the progress of a download.
+type Stats struct {
+	State          State         // stage the download is in
+	Length         int64         // size of the torrent's content in bytes
+	Downloaded     int64         // bytes of the pieces that have been verified and written
+	Received       int64         // bytes of block data received from peers, including the data that was wasted
+	Wasted         int64         // bytes of the pieces that failed their integrity check
+	HashFailures   int           // number of pieces that failed their integrity check
+	BannedPeers    int           // number of peers banned for sending corrupt data, counting every torrent sharing the ban list
+	SuspectPieces  int           // number of corrupt pieces several peers sent blocks of, waiting to be downloaded again to find the culprits
+	PiecesDone     int           // number of pieces that have been verified and written
+	PiecesTotal    int           // number of pieces in the torrent
+	DownloadRate   float64       // bytes received per second over the last few seconds
+	Uploaded       int64         // bytes of block data sent to peers
+	UploadRate     float64       // bytes sent per second over the last few seconds
+	ETA            time.Duration // estimated time left at the current rate, or -1 if it can't be estimated
+	ConnectedPeers int           // number of peers a connection is up to
+	KnownPeers     int           // number of peers we know about, connected or not
+	HalfOpenPeers  int           // number of connections to peers being opened
+	Elapsed        time.Duration // time the download has been running for, or ran for once it ended
+	MemoryInUse    int64         // bytes of in-flight piece buffers in the torrent's buffer pool, counting every torrent sharing it
+	MemoryBudget   int64         // most bytes the buffers in the torrent's buffer pool add up to
+}
+
+// rateMeter measures a rate over a sliding window of rateWindow one-second buckets.
+type rateMeter struct {
+	start   time.Time         // when the meter started measuring
+	buckets [rateWindow]int64 // amounts added during each second of the window
+	last    int64             // unix time of the newest bucket
+}
+
+// newRateMeter creates a meter that starts measuring at `now`.
+func newRateMeter(now time.Time) rateMeter {
+	return rateMeter{start: now, last: now.Unix()}
+}
+
+// advance empties the buckets of the seconds that went by since the meter was last used.
+func (meter *rateMeter) advance(now time.Time) {
+	var second = now.Unix()
+	if second-meter.last >= rateWindow {
+		meter.buckets = [rateWindow]int64{}
+	} else {
+		for s := meter.last + 1; s <= second; s++ {
+			meter.buckets[s%rateWindow] = 0
+		}
+	}
+
+	meter.last = max(meter.last, second)
+}
+
+// add records `n` units at `now`.
+func (meter *rateMeter) add(n int64, now time.Time) {
+	meter.advance(now)
+	meter.buckets[meter.last%rateWindow] += n
+}
+
+// rate returns the units per second over the window ending at `now`.
+// The window is shorter while the meter has been measuring for less than rateWindow seconds.
+func (meter *rateMeter) rate(now time.Time) float64 {
+	meter.advance(now)
+
+	var total int64
+	for _, amount := range meter.buckets {
+		total += amount
+	}
+
+	// the current second has only partially gone by
+	var span = (rateWindow-1)*time.Second + now.Sub(now.Truncate(time.Second))
+	span = min(span, now.Sub(meter.start))
+	if span <= 0 {
+		return 0
+	}
+
+	return float64(total) / span.Seconds()
+}
+
+// downloadStats is what a torrent keeps track of to produce its Stats.
+type downloadStats struct {
+	state      State
+	started    time.Time        // when the download started
+	ended      time.Time        // when the download ended, zero if it is running
+	downloaded int64            // bytes of verified pieces
+	received   int64            // bytes of block data received
+	wasted     int64            // bytes of pieces that failed their integrity check
+	failures   int              // number of pieces that failed their integrity check
+	piecesDone int              // number of verified pieces
+	connected  int              // number of peers a connection is up to
+	manager    *connmgr.Manager // manager of the connections, set while the download runs
+	buffers    *bufpool.Pool    // pool the piece buffers come from, set once the download started
+	rate       rateMeter        // bytes received per second
+	uploaded   int64            // bytes of block data sent
+	upRate     rateMeter        // bytes sent per second
+}
+
+// Stats returns a snapshot of the progress of the download.
+// It is safe to call while the download is running.
+func (torrent *Torrent) Stats() Stats {
+	torrent.statsMu.Lock()
+	defer torrent.statsMu.Unlock()
+
+	var stats = &torrent.stats
+	var now = time.Now()
+	var snapshot = Stats{
+		State:          stats.state,
+		Length:         int64(torrent.Length),
+		Downloaded:     stats.downloaded,
+		Received:       stats.received,
+		Wasted:         stats.wasted,
+		HashFailures:   stats.failures,
+		BannedPeers:    torrent.Bans().NumBanned(),
+		SuspectPieces:  torrent.smartBan().NumSuspect(),
+		Uploaded:       stats.uploaded,
+		PiecesDone:     stats.piecesDone,
+		PiecesTotal:    len(torrent.PiecesHashes),
+		ConnectedPeers: stats.connected,
+		ETA:            -1,
+	}
+
+	if stats.manager != nil {
+		snapshot.KnownPeers = stats.manager.NumKnown()
+		snapshot.HalfOpenPeers = stats.manager.NumHalfOpen()
+	}
+
+	if stats.buffers != nil {
+		snapshot.MemoryInUse = stats.buffers.InUse()
+		snapshot.MemoryBudget = stats.buffers.Budget()
+	}
+
+	if stats.state == StateDownloading || stats.state == StateSeeding {
+		snapshot.UploadRate = stats.upRate.rate(now)
+	}
+
+	if stats.state == StateChecking || stats.state == StateDownloading {
+		snapshot.DownloadRate = stats.rate.rate(now)
+		snapshot.Elapsed = now.Sub(stats.started)
+	} else if !stats.started.IsZero() {
+		snapshot.Elapsed = stats.ended.Sub(stats.started)
+	}
+
+	var left = snapshot.Length - snapshot.Downloaded
+	if left <= 0 {
+		snapshot.ETA = 0
+	} else if snapshot.DownloadRate > 0 {
+		snapshot.ETA = time.Duration(float64(left) / snapshot.DownloadRate * float64(time.Second))
+	}
+
+	return snapshot
+}
+
+// resetStats starts the stats of a new download from scratch.
+func (torrent *Torrent) resetStats() {
+	torrent.statsMu.Lock()
+	defer torrent.statsMu.Unlock()
+
+	var now = time.Now()
+	torrent.stats = downloadStats{started: now, rate: newRateMeter(now), upRate: newRateMeter(now)}
+}
+
+// setState moves the download to the given state and emits the change.
+// `err` is what made the download fail, if it did.
+func (torrent *Torrent) setState(state State, err error) {
+	torrent.statsMu.Lock()
+	var now = time.Now()
+	switch state {
+	case StateDownloading:
+		// the rate covers the download only, not the time spent checking
+		torrent.stats.rate = newRateMeter(now)
+	case StateCompleted, StateStopped, StatePaused, StateFailed:
+		// seeding doesn't count towards the time the download took
+		if torrent.stats.state != StateSeeding {
+			torrent.stats.ended = now
+		}
+		torrent.stats.manager = nil
+	}
+	torrent.stats.state = state
+	torrent.statsMu.Unlock()
+
+	torrent.Emit(Event{Type: EventStateChanged, Time: now, State: state, Err: err})
+}
+
+// setManager records the manager of the download's connections, which knows how many peers there are.
+func (torrent *Torrent) setManager(manager *connmgr.Manager) {
+	torrent.statsMu.Lock()
+	defer torrent.statsMu.Unlock()
+
+	torrent.stats.manager = manager
+}
+
+// setBuffers records the pool the download's piece buffers come from, which knows how much memory they use.
+func (torrent *Torrent) setBuffers(buffers *bufpool.Pool) {
+	torrent.statsMu.Lock()
+	defer torrent.statsMu.Unlock()
+
+	torrent.stats.buffers = buffers
+}
+
+// blockReceived records the arrival of `n` bytes of block data.
+func (torrent *Torrent) blockReceived(n int) {
+	if n == 0 {
+		return
+	}
+
+	torrent.statsMu.Lock()
+	defer torrent.statsMu.Unlock()
+
+	torrent.stats.received += int64(n)
+	torrent.stats.rate.add(int64(n), time.Now())
+}
+
+// blockUploaded records that `n` bytes of block data were sent to a peer.
+func (torrent *Torrent) blockUploaded(n int) {
+	torrent.statsMu.Lock()
+	defer torrent.statsMu.Unlock()
+
+	torrent.stats.uploaded += int64(n)
+	torrent.stats.upRate.add(int64(n), time.Now())
+}
+
+// pieceCompleted records that the piece at the given index was verified and written, and emits it.
+func (torrent *Torrent) pieceCompleted(index, length int) {
+	torrent.statsMu.Lock()
+	torrent.stats.downloaded += int64(length)
+	torrent.stats.piecesDone++
+	torrent.statsMu.Unlock()
+
+	torrent.Emit(Event{Type: EventPieceCompleted, Piece: index})
+}
+
+// pieceRestored records that a piece of `length` bytes was found intact in the storage.
+func (torrent *Torrent) pieceRestored(length int) {
+	torrent.statsMu.Lock()
+	defer torrent.statsMu.Unlock()
+
+	torrent.stats.downloaded += int64(length)
+	torrent.stats.piecesDone++
+}
+
+// hashFailed records that the piece at the given index, completed by `peer` with blocks sent by `contributors`,
+// failed its integrity check, and emits it.
+func (torrent *Torrent) hashFailed(index, length int, peer peers.Peer, contributors []peers.Peer) {
+	torrent.statsMu.Lock()
+	torrent.stats.wasted += int64(length)
+	torrent.stats.failures++
+	torrent.statsMu.Unlock()
+
+	torrent.Emit(Event{Type: EventHashFailed, Piece: index, Peer: peer, Peers: contributors})
+}
+
+// peerBanned emits that `peer` was banned for its part in the corrupt piece at the given index.
+func (torrent *Torrent) peerBanned(peer peers.Peer, index int) {
+	torrent.Emit(Event{Type: EventPeerBanned, Piece: index, Peer: peer})
+}
+
+// peerConnected records that the handshake with `peer` completed, over an encrypted connection if `encrypted`
+// is set, and emits it.
+func (torrent *Torrent) peerConnected(peer peers.Peer, encrypted bool) {
+	torrent.statsMu.Lock()
+	torrent.stats.connected++
+	torrent.statsMu.Unlock()
+
+	torrent.Emit(Event{Type: EventPeerConnected, Peer: peer, Encrypted: encrypted})
+}
+
+// peerDisconnected records that the connection to `peer` ended because of `err`, and emits it.
+func (torrent *Torrent) peerDisconnected(peer peers.Peer, err error) {
+	torrent.statsMu.Lock()
+	torrent.stats.connected--
+	torrent.statsMu.Unlock()
+
+	torrent.Emit(Event{Type: EventPeerDisconnected, Peer: peer, Err: err})
+}
@@ -0,0 +1,120 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+func TestRateMeter(t *testing.T) {
+	/*
+		test cases:
+		1. a new meter measures nothing
+		2. the rate is averaged over the time measured so far
+		3. the rate is averaged over the window once it is full
+		4. old amounts drop out of the window
+	*/
+
+	var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("a new meter measures nothing", func(t *testing.T) {
+		var meter = newRateMeter(start)
+		assert.Equal(t, 0.0, meter.rate(start))
+		assert.Equal(t, 0.0, meter.rate(start.Add(time.Second)))
+	})
+
+	t.Run("the rate is averaged over the time measured so far", func(t *testing.T) {
+		var meter = newRateMeter(start)
+		meter.add(1000, start.Add(500*time.Millisecond))
+		meter.add(1000, start.Add(1500*time.Millisecond))
+
+		assert.InDelta(t, 1000, meter.rate(start.Add(2*time.Second)), 1)
+	})
+
+	t.Run("the rate is averaged over the window once it is full", func(t *testing.T) {
+		var meter = newRateMeter(start)
+		for i := 0; i != 20; i++ {
+			meter.add(500, start.Add(time.Duration(i)*500*time.Millisecond))
+		}
+
+		assert.InDelta(t, 1000, meter.rate(start.Add(10*time.Second)), 1)
+	})
+
+	t.Run("old amounts drop out of the window", func(t *testing.T) {
+		var meter = newRateMeter(start)
+		meter.add(100000, start)
+		meter.add(1000, start.Add(8*time.Second))
+
+		// the window ending on a whole second spans the 4 seconds before it
+		assert.InDelta(t, 250, meter.rate(start.Add(9*time.Second)), 1)
+		assert.Equal(t, 0.0, meter.rate(start.Add(time.Minute)))
+	})
+}
+
+func TestStats(t *testing.T) {
+	/*
+		test cases:
+		1. an idle torrent has nothing to show
+		2. the stats follow the download
+		3. the elapsed time stops when the download ends
+	*/
+
+	var newTorrent = func() *Torrent {
+		return &Torrent{Length: 4 * MaxBlockSize, PieceLength: 2 * MaxBlockSize, PiecesHashes: make([][20]byte, 2)}
+	}
+
+	t.Run("an idle torrent has nothing to show", func(t *testing.T) {
+		var stats = newTorrent().Stats()
+		assert.Equal(t, StateIdle, stats.State)
+		assert.Equal(t, int64(4*MaxBlockSize), stats.Length)
+		assert.Equal(t, 2, stats.PiecesTotal)
+		assert.Equal(t, time.Duration(-1), stats.ETA)
+		assert.Zero(t, stats.Elapsed)
+	})
+
+	t.Run("the stats follow the download", func(t *testing.T) {
+		var torrent = newTorrent()
+		var peer = peers.Peer{IP: net.IP{192, 168, 1, 1}, Port: 6881}
+
+		torrent.resetStats()
+		torrent.setState(StateDownloading, nil)
+		torrent.peerConnected(peer, false)
+		torrent.blockReceived(2 * MaxBlockSize)
+		torrent.hashFailed(0, 2*MaxBlockSize, peer, []peers.Peer{peer})
+		torrent.blockReceived(2 * MaxBlockSize)
+		torrent.pieceCompleted(0, 2*MaxBlockSize)
+
+		var stats = torrent.Stats()
+		assert.Equal(t, StateDownloading, stats.State)
+		assert.Equal(t, int64(2*MaxBlockSize), stats.Downloaded)
+		assert.Equal(t, int64(4*MaxBlockSize), stats.Received)
+		assert.Equal(t, int64(2*MaxBlockSize), stats.Wasted)
+		assert.Equal(t, 1, stats.HashFailures)
+		assert.Equal(t, 1, stats.PiecesDone)
+		assert.Equal(t, 1, stats.ConnectedPeers)
+		assert.Greater(t, stats.DownloadRate, 0.0)
+		assert.Greater(t, stats.ETA, time.Duration(0))
+
+		torrent.peerDisconnected(peer, nil)
+		assert.Equal(t, 0, torrent.Stats().ConnectedPeers)
+	})
+
+	t.Run("the elapsed time stops when the download ends", func(t *testing.T) {
+		var torrent = newTorrent()
+		torrent.resetStats()
+		torrent.setState(StateDownloading, nil)
+		torrent.pieceCompleted(0, 2*MaxBlockSize)
+		torrent.pieceCompleted(1, 2*MaxBlockSize)
+		torrent.setState(StateCompleted, nil)
+
+		var stats = torrent.Stats()
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, stats.Elapsed, torrent.Stats().Elapsed)
+		assert.Equal(t, StateCompleted, stats.State)
+		assert.Equal(t, time.Duration(0), stats.ETA)
+		assert.Zero(t, stats.DownloadRate)
+	})
+}
@@ -0,0 +1,93 @@
+// Package peerban finds the peers that send corrupt data and bans them for the rest of the session.
+// Peers are told apart by IP address, since a peer sending garbage may well come back on another port.
+package peerban
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// DefaultMaxStrikes is the number of corrupt pieces a peer is blamed for before it is banned.
+const DefaultMaxStrikes = 2
+
+// ErrBanned is returned for connections to and from banned peers.
+var ErrBanned = errors.New("peer is banned for sending corrupt data")
+
+// List keeps count of the corrupt pieces each peer is blamed for, and bans the peers blamed for too many.
+// Bans last as long as the list, which torrents may share so that a peer banned by one of them is banned
+// by every one.
+// It is safe for concurrent use.
+type List struct {
+	mu         sync.Mutex
+	maxStrikes int
+	strikes    map[string]int      // corrupt pieces each peer was blamed for, keyed by IP address
+	banned     map[string]struct{} // banned peers, keyed by IP address
+}
+
+// NewList creates a list banning the peers blamed for `maxStrikes` corrupt pieces.
+// A limit that isn't positive uses DefaultMaxStrikes.
+func NewList(maxStrikes int) *List {
+	if maxStrikes <= 0 {
+		maxStrikes = DefaultMaxStrikes
+	}
+
+	return &List{
+		maxStrikes: maxStrikes,
+		strikes:    make(map[string]int),
+		banned:     make(map[string]struct{}),
+	}
+}
+
+// Strike blames the peer at `ip` for a corrupt piece, and bans it once it was blamed for the list's
+// maximum number of them.
+// It reports whether the peer got banned by this strike.
+func (list *List) Strike(ip net.IP) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	var key = ip.String()
+	if _, banned := list.banned[key]; banned {
+		return false
+	}
+
+	list.strikes[key]++
+	if list.strikes[key] < list.maxStrikes {
+		return false
+	}
+
+	list.banned[key] = struct{}{}
+	return true
+}
+
+// Ban bans the peer at `ip` right away, e.g. because it was caught sending a corrupt block.
+// It reports whether the peer wasn't banned already.
+func (list *List) Ban(ip net.IP) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	var key = ip.String()
+	if _, banned := list.banned[key]; banned {
+		return false
+	}
+
+	list.banned[key] = struct{}{}
+	return true
+}
+
+// Banned reports whether the peer at `ip` is banned.
+func (list *List) Banned(ip net.IP) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	var _, banned = list.banned[ip.String()]
+	return banned
+}
+
+// NumBanned returns the number of banned peers.
+func (list *List) NumBanned() int {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	return len(list.banned)
+}
@@ -0,0 +1,58 @@
+package peerban
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestList(t *testing.T) {
+	/*
+		test cases:
+		1. peers are banned once they were blamed for too many corrupt pieces
+		2. peers can be banned right away
+		3. peers are told apart by IP address alone
+	*/
+
+	t.Run("peers are banned once they were blamed for too many corrupt pieces", func(t *testing.T) {
+		var list = NewList(3)
+		var ip = net.IP{10, 0, 0, 1}
+
+		assert.False(t, list.Strike(ip))
+		assert.False(t, list.Strike(ip))
+		assert.False(t, list.Banned(ip))
+		assert.Equal(t, 2, list.strikes[ip.String()])
+
+		assert.True(t, list.Strike(ip))
+		assert.True(t, list.Banned(ip))
+		assert.Equal(t, 1, list.NumBanned())
+
+		// strikes against a banned peer don't ban it again
+		assert.False(t, list.Strike(ip))
+		assert.False(t, list.Banned(net.IP{10, 0, 0, 2}))
+
+		assert.Equal(t, DefaultMaxStrikes, NewList(0).maxStrikes)
+	})
+
+	t.Run("peers can be banned right away", func(t *testing.T) {
+		var list = NewList(DefaultMaxStrikes)
+		var ip = net.IP{10, 0, 0, 1}
+
+		assert.True(t, list.Ban(ip))
+		assert.False(t, list.Ban(ip))
+		assert.True(t, list.Banned(ip))
+		assert.Equal(t, 0, list.strikes[ip.String()])
+	})
+
+	t.Run("peers are told apart by IP address alone", func(t *testing.T) {
+		var list = NewList(1)
+
+		list.Strike(net.ParseIP("10.0.0.1"))
+		assert.True(t, list.Banned(net.IP{10, 0, 0, 1}.To16()))
+
+		list.Ban(net.ParseIP("2001:db8::1"))
+		assert.True(t, list.Banned(net.ParseIP("2001:db8:0::1")))
+		assert.Equal(t, 2, list.NumBanned())
+	})
+}
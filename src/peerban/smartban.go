@@ -0,0 +1,115 @@
+package peerban
+
+import (
+	"crypto/sha1"
+	"sync"
+
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+// block is a block of a corrupt piece, by the peer that sent it.
+type block struct {
+	peer peers.Peer
+	hash common.Sha1Hash
+}
+
+// SmartBan finds out which of the peers that sent the blocks of a corrupt piece sent the corrupt ones.
+// The hash of every block of a corrupt piece several peers contributed to is kept until the piece is
+// downloaded again and found valid; the peers whose blocks differ from the valid ones are the culprits.
+// It is safe for concurrent use.
+type SmartBan struct {
+	mu        sync.Mutex
+	blockSize int
+	suspects  map[int][][]block // blocks of each corrupt download of a piece, keyed by piece index
+}
+
+// NewSmartBan creates a smart ban for pieces split in blocks of `blockSize` bytes, the last one of a piece
+// being shorter if need be.
+func NewSmartBan(blockSize int) *SmartBan {
+	return &SmartBan{blockSize: blockSize, suspects: make(map[int][][]block)}
+}
+
+// Failed records that the piece at `index` failed its integrity check, where `data` is the piece and
+// `senders` the peer that sent each of its blocks.
+// It returns the peers to blame right away: the one that sent every block if there is only one. If several
+// peers sent blocks of the piece, the blocks are kept for Passed to compare with and nil is returned.
+func (smartBan *SmartBan) Failed(index int, data []byte, senders []peers.Peer) []peers.Peer {
+	var contributors = Distinct(senders)
+	if len(contributors) <= 1 {
+		return contributors
+	}
+
+	var hashes = hashBlocks(data, smartBan.blockSize)
+	var blocks = make([]block, len(senders))
+	for i := range senders {
+		blocks[i] = block{peer: senders[i], hash: hashes[i]}
+	}
+
+	smartBan.mu.Lock()
+	defer smartBan.mu.Unlock()
+
+	smartBan.suspects[index] = append(smartBan.suspects[index], blocks)
+	return nil
+}
+
+// Passed records that the piece at `index` is valid, where `data` is the piece, and forgets about it.
+// It returns the peers that sent blocks differing from the valid ones in the corrupt downloads of the piece
+// recorded by Failed, nil if there are none.
+func (smartBan *SmartBan) Passed(index int, data []byte) []peers.Peer {
+	smartBan.mu.Lock()
+	var downloads = smartBan.suspects[index]
+	delete(smartBan.suspects, index)
+	smartBan.mu.Unlock()
+
+	if len(downloads) == 0 {
+		return nil
+	}
+
+	var hashes = hashBlocks(data, smartBan.blockSize)
+	var culprits []peers.Peer
+	for _, blocks := range downloads {
+		for i, block := range blocks {
+			if i < len(hashes) && block.hash != hashes[i] {
+				culprits = append(culprits, block.peer)
+			}
+		}
+	}
+
+	return Distinct(culprits)
+}
+
+// NumSuspect returns the number of corrupt pieces waiting to be compared with their valid download.
+func (smartBan *SmartBan) NumSuspect() int {
+	smartBan.mu.Lock()
+	defer smartBan.mu.Unlock()
+
+	return len(smartBan.suspects)
+}
+
+// hashBlocks returns the SHA-1 hash of every block of `data`.
+func hashBlocks(data []byte, blockSize int) []common.Sha1Hash {
+	var hashes = make([]common.Sha1Hash, 0, (len(data)+blockSize-1)/blockSize)
+	for begin := 0; begin < len(data); begin += blockSize {
+		hashes = append(hashes, sha1.Sum(data[begin:min(begin+blockSize, len(data))]))
+	}
+
+	return hashes
+}
+
+// Distinct returns the peers of `list` with distinct IP addresses, in the order they first appear in.
+func Distinct(list []peers.Peer) []peers.Peer {
+	var seen = make(map[string]struct{}, len(list))
+	var result []peers.Peer
+	for _, peer := range list {
+		var key = peer.IP.String()
+		if _, ok := seen[key]; ok {
+			continue
+		}
+
+		seen[key] = struct{}{}
+		result = append(result, peer)
+	}
+
+	return result
+}
@@ -0,0 +1,67 @@
+package peerban
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/winterrdog/lean-bit-torrent-client/peers"
+)
+
+const testBlockSize = 4
+
+var (
+	alice = peers.Peer{IP: net.IP{10, 0, 0, 1}, Port: 6881}
+	bob   = peers.Peer{IP: net.IP{10, 0, 0, 2}, Port: 6881}
+	carol = peers.Peer{IP: net.IP{10, 0, 0, 3}, Port: 6881}
+)
+
+func TestSmartBan(t *testing.T) {
+	/*
+		test cases:
+		1. a corrupt piece sent by a single peer is blamed on it right away
+		2. the peers whose blocks differ from the valid piece are the culprits
+		3. every corrupt download of a piece is compared with the valid one
+		4. valid pieces that were never corrupt blame nobody
+	*/
+
+	var valid = []byte("aaaabbbbccccdd")
+
+	t.Run("a corrupt piece sent by a single peer is blamed on it right away", func(t *testing.T) {
+		var smartBan = NewSmartBan(testBlockSize)
+
+		// the same peer on another port is still the same peer
+		var other = alice
+		other.Port = 6882
+
+		var blamed = smartBan.Failed(0, []byte("xxxxbbbbccccdd"), []peers.Peer{alice, other, alice, alice})
+		assert.Equal(t, []peers.Peer{alice}, blamed)
+		assert.Equal(t, 0, smartBan.NumSuspect())
+	})
+
+	t.Run("the peers whose blocks differ from the valid piece are the culprits", func(t *testing.T) {
+		var smartBan = NewSmartBan(testBlockSize)
+
+		var blamed = smartBan.Failed(0, []byte("aaaaxxxxccccdx"), []peers.Peer{alice, bob, alice, carol})
+		assert.Nil(t, blamed)
+		assert.Equal(t, 1, smartBan.NumSuspect())
+
+		assert.Equal(t, []peers.Peer{bob, carol}, smartBan.Passed(0, valid))
+		assert.Equal(t, 0, smartBan.NumSuspect())
+	})
+
+	t.Run("every corrupt download of a piece is compared with the valid one", func(t *testing.T) {
+		var smartBan = NewSmartBan(testBlockSize)
+
+		smartBan.Failed(3, []byte("aaaaxxxxccccdd"), []peers.Peer{alice, bob, alice, alice})
+		smartBan.Failed(3, []byte("aaaabbbbxxxxdd"), []peers.Peer{alice, alice, carol, bob})
+		assert.Nil(t, smartBan.Passed(2, valid))
+
+		assert.Equal(t, []peers.Peer{bob, carol}, smartBan.Passed(3, valid))
+	})
+
+	t.Run("valid pieces that were never corrupt blame nobody", func(t *testing.T) {
+		var smartBan = NewSmartBan(testBlockSize)
+		assert.Nil(t, smartBan.Passed(0, valid))
+	})
+}
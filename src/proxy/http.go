@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// HTTP is a dialer connecting through an HTTP proxy, which tunnels each connection with a CONNECT request.
+// The proxy is authenticated with using basic authentication if a user name is set.
+type HTTP struct {
+	Addr     string // Address of the proxy, e.g. "proxy:3128".
+	Username string // User to authenticate as, if the proxy requires it.
+	Password string // Password of the user.
+	Forward  Dialer // Opens the connections to the proxy. Defaults to Direct.
+}
+
+// DialContext connects to `addr` on a TCP network through the proxy.
+// Returns ErrAuthFailed if the proxy requires credentials we don't have or refuses ours, or an error if the
+// proxy can't be reached or can't connect to `addr`.
+func (proxy *HTTP) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("the HTTP proxy can't dial %s networks", network)
+	}
+
+	var buffered *bufio.Reader
+	var conn, err = dialProxy(ctx, proxy.Forward, proxy.Addr, func(conn net.Conn) error {
+		var request, err = http.NewRequest(http.MethodConnect, "http://"+addr, nil)
+		if err != nil {
+			return err
+		}
+
+		request.Host = addr
+		if proxy.Username != "" {
+			var credentials = base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+			request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+		}
+
+		err = request.Write(conn)
+		if err != nil {
+			return err
+		}
+
+		buffered = bufio.NewReader(conn)
+		var response *http.Response
+		response, err = http.ReadResponse(buffered, request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+
+		switch response.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusProxyAuthRequired:
+			return ErrAuthFailed
+		default:
+			return fmt.Errorf("the HTTP proxy failed the request for %s: %s", addr, response.Status)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the proxy may have sent data from the destination right after its response
+	if buffered.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: buffered}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into a buffer already.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
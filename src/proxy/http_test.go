@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHTTPProxy is a stand-in HTTP proxy tunnelling the connections of its clients with CONNECT.
+type fakeHTTPProxy struct {
+	username, password string // credentials required from the clients, none if empty
+	greeting           string // sent by the proxy right after its response, as if from the destination
+
+	mu       sync.Mutex
+	requests []string // addresses the clients asked to connect to
+}
+
+// start starts the proxy until the test ends, and returns its address.
+func (proxy *fakeHTTPProxy) start(t *testing.T) string {
+	var ln, err = net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			var conn, err = ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go proxy.serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// serve handles a connection from a client.
+func (proxy *fakeHTTPProxy) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var reader = bufio.NewReader(conn)
+	var request, err = http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+
+	if request.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+
+	if proxy.username != "" {
+		var credentials = base64.StdEncoding.EncodeToString([]byte(proxy.username + ":" + proxy.password))
+		if request.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+	}
+
+	proxy.mu.Lock()
+	proxy.requests = append(proxy.requests, request.Host)
+	proxy.mu.Unlock()
+
+	var target net.Conn
+	target, err = net.Dial("tcp", request.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+
+	io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"+proxy.greeting)
+	go io.Copy(target, reader)
+	io.Copy(conn, target)
+}
+
+// requested returns the addresses the clients asked to connect to.
+func (proxy *fakeHTTPProxy) requested() []string {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	return append([]string(nil), proxy.requests...)
+}
+
+func TestHTTP(t *testing.T) {
+	/*
+		test cases:
+		1. connections are tunnelled through the proxy
+		2. the proxy is authenticated with basic authentication
+		3. wrong or missing credentials are refused
+		4. connections the proxy can't make fail
+		5. data sent right after the proxy's response isn't lost
+	*/
+
+	t.Run("connections are tunnelled through the proxy", func(t *testing.T) {
+		var proxy = &fakeHTTPProxy{}
+		var echo = startEchoServer(t)
+		var dialer = &HTTP{Addr: proxy.start(t)}
+
+		var conn, err = dialer.DialContext(context.Background(), "tcp", echo)
+		require.Nil(t, err)
+		defer conn.Close()
+
+		assertEchoes(t, conn)
+		assert.Equal(t, []string{echo}, proxy.requested())
+
+		_, err = dialer.DialContext(context.Background(), "udp", echo)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("the proxy is authenticated with basic authentication", func(t *testing.T) {
+		var proxy = &fakeHTTPProxy{username: "bob", password: "pa:ss"}
+		var dialer = &HTTP{Addr: proxy.start(t), Username: "bob", Password: "pa:ss"}
+
+		var conn, err = dialer.DialContext(context.Background(), "tcp", startEchoServer(t))
+		require.Nil(t, err)
+		defer conn.Close()
+
+		assertEchoes(t, conn)
+	})
+
+	t.Run("wrong or missing credentials are refused", func(t *testing.T) {
+		var proxy = &fakeHTTPProxy{username: "bob", password: "pa:ss"}
+		var addr = proxy.start(t)
+		var echo = startEchoServer(t)
+
+		var _, err = (&HTTP{Addr: addr, Username: "bob", Password: "wrong"}).DialContext(context.Background(), "tcp", echo)
+		assert.ErrorIs(t, err, ErrAuthFailed)
+
+		_, err = (&HTTP{Addr: addr}).DialContext(context.Background(), "tcp", echo)
+		assert.ErrorIs(t, err, ErrAuthFailed)
+		assert.Empty(t, proxy.requested())
+	})
+
+	t.Run("connections the proxy can't make fail", func(t *testing.T) {
+		var dialer = &HTTP{Addr: (&fakeHTTPProxy{}).start(t)}
+
+		var ln, err = net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		var closed = ln.Addr().String()
+		ln.Close()
+
+		_, err = dialer.DialContext(context.Background(), "tcp", closed)
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "502 Bad Gateway")
+		}
+	})
+
+	t.Run("data sent right after the proxy's response isn't lost", func(t *testing.T) {
+		var dialer = &HTTP{Addr: (&fakeHTTPProxy{greeting: "hello"}).start(t)}
+
+		var conn, err = dialer.DialContext(context.Background(), "tcp", startEchoServer(t))
+		require.Nil(t, err)
+		defer conn.Close()
+
+		var greeting = make([]byte, 5)
+		_, err = io.ReadFull(conn, greeting)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(greeting))
+		assertEchoes(t, conn)
+	})
+}
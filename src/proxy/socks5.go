@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socksVersion        = 0x05
+	socksAuthNone       = 0x00
+	socksAuthPassword   = 0x02
+	socksPasswordVer    = 0x01
+	socksCmdConnect     = 0x01
+	socksAddrIPv4       = 0x01
+	socksAddrDomain     = 0x03
+	socksAddrIPv6       = 0x04
+	socksReplySucceeded = 0x00
+)
+
+// socksReplies are the meanings of the reply codes of a SOCKS5 proxy other than success.
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// ErrAuthFailed is returned when a proxy refuses our credentials, or accepts none of the ways we can
+// authenticate with.
+var ErrAuthFailed = errors.New("proxy authentication failed")
+
+// SOCKS5 is a dialer connecting through a SOCKS5 proxy, authenticating with a user name and password if
+// one is set. Host names are resolved by the proxy.
+type SOCKS5 struct {
+	Addr     string // Address of the proxy, e.g. "proxy:1080".
+	Username string // User to authenticate as, if the proxy requires it.
+	Password string // Password of the user.
+	Forward  Dialer // Opens the connections to the proxy. Defaults to Direct.
+}
+
+// DialContext connects to `addr` on a TCP network through the proxy.
+// Returns an error if the proxy can't be reached, refuses our credentials or can't connect to `addr`.
+func (proxy *SOCKS5) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("the SOCKS5 proxy can't dial %s networks", network)
+	}
+
+	return dialProxy(ctx, proxy.Forward, proxy.Addr, func(conn net.Conn) error {
+		var err = proxy.authenticate(conn)
+		if err != nil {
+			return err
+		}
+
+		return socksRequest(conn, socksCmdConnect, addr)
+	})
+}
+
+// authenticate greets the proxy and authenticates with it, with our password if we have one.
+// Returns ErrAuthFailed if the proxy accepts none of the ways we can authenticate with or refuses our
+// credentials, or an error if it can't be talked to.
+func (proxy *SOCKS5) authenticate(conn net.Conn) error {
+	var methods = []byte{socksAuthNone}
+	if proxy.Username != "" {
+		methods = []byte{socksAuthNone, socksAuthPassword}
+	}
+
+	var _, err = conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+
+	var reply = make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+
+	if reply[0] != socksVersion {
+		return fmt.Errorf("expected SOCKS version %d, got %d", socksVersion, reply[0])
+	}
+
+	switch reply[1] {
+	case socksAuthNone:
+		return nil
+	case socksAuthPassword:
+		if proxy.Username == "" {
+			return ErrAuthFailed
+		}
+	default:
+		return ErrAuthFailed
+	}
+
+	if len(proxy.Username) > 255 || len(proxy.Password) > 255 {
+		return errors.New("the proxy user name and password must be at most 255 bytes long")
+	}
+
+	var request = []byte{socksPasswordVer, byte(len(proxy.Username))}
+	request = append(request, proxy.Username...)
+	request = append(request, byte(len(proxy.Password)))
+	request = append(request, proxy.Password...)
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+
+	if reply[1] != socksReplySucceeded {
+		return ErrAuthFailed
+	}
+
+	return nil
+}
+
+// socksRequest sends a request with the given command for `addr` to the proxy and reads its reply.
+// Returns an error if the proxy fails the request.
+func socksRequest(conn net.Conn, command byte, addr string) error {
+	var encoded, err = appendSocksAddr([]byte{socksVersion, command, 0x00}, addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(encoded)
+	if err != nil {
+		return err
+	}
+
+	var header = make([]byte, 3)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+
+	if header[0] != socksVersion {
+		return fmt.Errorf("expected SOCKS version %d, got %d", socksVersion, header[0])
+	}
+
+	// the address the proxy bound for the connection is of no use to us, but must be read past
+	_, err = readSocksAddr(conn)
+	if err != nil {
+		return err
+	}
+
+	if header[1] != socksReplySucceeded {
+		var reason, ok = socksReplies[header[1]]
+		if !ok {
+			reason = fmt.Sprintf("unknown reply code %d", header[1])
+		}
+
+		return fmt.Errorf("the SOCKS5 proxy failed the request for %s: %s", addr, reason)
+	}
+
+	return nil
+}
+
+// appendSocksAddr appends `addr`, a host and port, to `b` as a SOCKS5 address: an IP address if the host is
+// one, its name otherwise.
+// Returns an error if `addr` isn't a host and port.
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	var host, portString, err = net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var port int
+	port, err = strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+
+	var ip = net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		b = append(append(b, socksAddrIPv4), ip.To4()...)
+	case ip != nil:
+		b = append(append(b, socksAddrIPv6), ip.To16()...)
+	case len(host) <= 255:
+		b = append(append(b, socksAddrDomain, byte(len(host))), host...)
+	default:
+		return nil, fmt.Errorf("host name too long in %q", addr)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocksAddr reads a SOCKS5 address and returns it as a host and port.
+func readSocksAddr(r io.Reader) (string, error) {
+	var kind = make([]byte, 1)
+	var _, err = io.ReadFull(r, kind)
+	if err != nil {
+		return "", err
+	}
+
+	var host []byte
+	switch kind[0] {
+	case socksAddrIPv4:
+		host = make([]byte, net.IPv4len)
+	case socksAddrIPv6:
+		host = make([]byte, net.IPv6len)
+	case socksAddrDomain:
+		var length = make([]byte, 1)
+		_, err = io.ReadFull(r, length)
+		if err != nil {
+			return "", err
+		}
+		host = make([]byte, length[0])
+	default:
+		return "", fmt.Errorf("unknown SOCKS5 address type %d", kind[0])
+	}
+
+	var port = make([]byte, 2)
+	_, err = io.ReadFull(r, host)
+	if err == nil {
+		_, err = io.ReadFull(r, port)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var hostString = string(host)
+	if kind[0] != socksAddrDomain {
+		hostString = net.IP(host).String()
+	}
+
+	return net.JoinHostPort(hostString, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
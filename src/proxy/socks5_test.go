@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSOCKS5 is a stand-in SOCKS5 proxy connecting its clients.
+type fakeSOCKS5 struct {
+	username, password string // credentials required from the clients, none if empty
+
+	mu       sync.Mutex
+	requests []string // addresses the clients asked to connect to
+}
+
+// start starts the proxy until the test ends, and returns its address.
+func (proxy *fakeSOCKS5) start(t *testing.T) string {
+	var ln, err = net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			var conn, err = ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go proxy.serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// serve handles a connection from a client.
+func (proxy *fakeSOCKS5) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var header = make([]byte, 2)
+	var _, err = io.ReadFull(conn, header)
+	if err != nil {
+		return
+	}
+
+	var methods = make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return
+	}
+
+	var method byte = socksAuthNone
+	if proxy.username != "" {
+		method = socksAuthPassword
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{socksVersion, 0xff})
+		return
+	}
+	conn.Write([]byte{socksVersion, method})
+
+	if method == socksAuthPassword && !proxy.checkPassword(conn) {
+		return
+	}
+
+	var request = make([]byte, 3)
+	_, err = io.ReadFull(conn, request)
+	if err != nil {
+		return
+	}
+
+	var addr string
+	addr, err = readSocksAddr(conn)
+	if err != nil {
+		return
+	}
+
+	switch request[1] {
+	case socksCmdConnect:
+		proxy.connect(conn, addr)
+	default:
+		conn.Write([]byte{socksVersion, 0x07, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// checkPassword reads the credentials of a client and tells it whether they are the right ones.
+func (proxy *fakeSOCKS5) checkPassword(conn net.Conn) bool {
+	var read = func() string {
+		var length = make([]byte, 1)
+		io.ReadFull(conn, length)
+		var value = make([]byte, length[0])
+		io.ReadFull(conn, value)
+		return string(value)
+	}
+
+	var version = make([]byte, 1)
+	io.ReadFull(conn, version)
+	var username, password = read(), read()
+
+	if username != proxy.username || password != proxy.password {
+		conn.Write([]byte{socksPasswordVer, 0x01})
+		return false
+	}
+
+	conn.Write([]byte{socksPasswordVer, socksReplySucceeded})
+	return true
+}
+
+// connect connects the client to `addr` and pipes the two connections together until either ends.
+func (proxy *fakeSOCKS5) connect(conn net.Conn, addr string) {
+	proxy.mu.Lock()
+	proxy.requests = append(proxy.requests, addr)
+	proxy.mu.Unlock()
+
+	var target, err = net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{socksVersion, 0x05, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+
+	var reply, _ = appendSocksAddr([]byte{socksVersion, socksReplySucceeded, 0x00}, target.LocalAddr().String())
+	conn.Write(reply)
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+// requested returns the addresses the clients asked to connect to.
+func (proxy *fakeSOCKS5) requested() []string {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+
+	return append([]string(nil), proxy.requests...)
+}
+
+func TestSOCKS5(t *testing.T) {
+	/*
+		test cases:
+		1. connections are made through the proxy
+		2. the proxy is authenticated with a user name and password
+		3. wrong or missing credentials are refused
+		4. connections the proxy can't make fail
+		5. cancelling the context aborts the dial
+	*/
+
+	t.Run("connections are made through the proxy", func(t *testing.T) {
+		var proxy = &fakeSOCKS5{}
+		var echo = startEchoServer(t)
+		var dialer = &SOCKS5{Addr: proxy.start(t)}
+
+		var conn, err = dialer.DialContext(context.Background(), "tcp", echo)
+		require.Nil(t, err)
+		defer conn.Close()
+
+		assertEchoes(t, conn)
+		assert.Equal(t, []string{echo}, proxy.requested())
+
+		// host names are left for the proxy to resolve
+		_, err = dialer.DialContext(context.Background(), "tcp", "localhost:1")
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{echo, "localhost:1"}, proxy.requested())
+
+		_, err = dialer.DialContext(context.Background(), "udp", echo)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("the proxy is authenticated with a user name and password", func(t *testing.T) {
+		var proxy = &fakeSOCKS5{username: "alice", password: "secret"}
+		var dialer = &SOCKS5{Addr: proxy.start(t), Username: "alice", Password: "secret"}
+
+		var conn, err = dialer.DialContext(context.Background(), "tcp", startEchoServer(t))
+		require.Nil(t, err)
+		defer conn.Close()
+
+		assertEchoes(t, conn)
+	})
+
+	t.Run("wrong or missing credentials are refused", func(t *testing.T) {
+		var proxy = &fakeSOCKS5{username: "alice", password: "secret"}
+		var addr = proxy.start(t)
+		var echo = startEchoServer(t)
+
+		var _, err = (&SOCKS5{Addr: addr, Username: "alice", Password: "wrong"}).DialContext(context.Background(), "tcp", echo)
+		assert.ErrorIs(t, err, ErrAuthFailed)
+
+		_, err = (&SOCKS5{Addr: addr}).DialContext(context.Background(), "tcp", echo)
+		assert.ErrorIs(t, err, ErrAuthFailed)
+		assert.Empty(t, proxy.requested())
+	})
+
+	t.Run("connections the proxy can't make fail", func(t *testing.T) {
+		var dialer = &SOCKS5{Addr: (&fakeSOCKS5{}).start(t)}
+
+		var ln, err = net.Listen("tcp", "127.0.0.1:0")
+		require.Nil(t, err)
+		var closed = ln.Addr().String()
+		ln.Close()
+
+		_, err = dialer.DialContext(context.Background(), "tcp", closed)
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "connection refused")
+		}
+	})
+
+	t.Run("cancelling the context aborts the dial", func(t *testing.T) {
+		var dialer = &SOCKS5{Addr: startStalledServer(t)}
+
+		var ctx, cancel = context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		var start = time.Now()
+		var _, err = dialer.DialContext(ctx, "tcp", startEchoServer(t))
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conn is a connection whose reads and writes go no faster than its limiters allow. A read or write first
+// waits until none of the limiters of its direction is in debt, then takes the bytes it moved from all of
+// them. The time spent waiting doesn't count towards the connection's deadlines, so that throttling doesn't
+// make a busy connection look idle. Waits end with net.ErrClosed once the connection is closed.
+type Conn struct {
+	net.Conn
+
+	limits       *Limits    // limits whose peer rates the connection's own limiters follow
+	peerDownload *Limiter   // the connection's own download limiter
+	peerUpload   *Limiter   // the connection's own upload limiter
+	download     []*Limiter // limiters reads wait for and take from
+	upload       []*Limiter // limiters writes wait for and take from
+
+	ctx    context.Context // cancelled once the connection is closed
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	readDeadline  time.Time     // deadline of the reads, zero if none
+	writeDeadline time.Time     // deadline of the writes, zero if none
+	readWaited    time.Duration // time reads spent waiting since the read deadline was set
+	writeWaited   time.Duration // time writes spent waiting since the write deadline was set
+}
+
+// Wrap returns the connection limited by the limits: its reads and writes wait for the shared limiters of the
+// limits and of `parents`, e.g. the limits of the whole client, and for limiters of its own following the peer
+// rates of the limits. Nil parents are skipped.
+// The connection stops following the peer rates once it is closed.
+func (limits *Limits) Wrap(conn net.Conn, parents ...*Limits) *Conn {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	var limited = &Conn{
+		Conn:         conn,
+		limits:       limits,
+		peerDownload: NewLimiter(limits.peerDownload),
+		peerUpload:   NewLimiter(limits.peerUpload),
+	}
+	limited.ctx, limited.cancel = context.WithCancel(context.Background())
+
+	limited.download = []*Limiter{limited.peerDownload, limits.Download}
+	limited.upload = []*Limiter{limited.peerUpload, limits.Upload}
+	for _, parent := range parents {
+		if parent != nil {
+			limited.download = append(limited.download, parent.Download)
+			limited.upload = append(limited.upload, parent.Upload)
+		}
+	}
+
+	limits.conns[limited] = struct{}{}
+	return limited
+}
+
+// wait waits until none of the limiters is in debt. The time spent waiting pushes back the deadline,
+// if there is one, by way of `setDeadline`.
+// Returns net.ErrClosed if the connection is closed first.
+func (conn *Conn) wait(limiters []*Limiter, deadline *time.Time, waited *time.Duration, setDeadline func(time.Time) error) error {
+	var start = time.Now()
+	for _, limiter := range limiters {
+		var err = limiter.Wait(conn.ctx)
+		if err != nil {
+			return net.ErrClosed
+		}
+	}
+
+	var elapsed = time.Since(start)
+	if elapsed < time.Millisecond {
+		return nil
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	*waited += elapsed
+	if deadline.IsZero() {
+		return nil
+	}
+
+	return setDeadline(deadline.Add(*waited))
+}
+
+// Read waits for the download limiters, then reads from the connection into `buf` and takes the bytes read
+// from the limiters.
+func (conn *Conn) Read(buf []byte) (int, error) {
+	var err = conn.wait(conn.download, &conn.readDeadline, &conn.readWaited, conn.Conn.SetReadDeadline)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	n, err = conn.Conn.Read(buf)
+	for _, limiter := range conn.download {
+		limiter.Take(n)
+	}
+
+	return n, err
+}
+
+// Write waits for the upload limiters, then writes `buf` to the connection and takes the bytes written
+// from the limiters.
+func (conn *Conn) Write(buf []byte) (int, error) {
+	var err = conn.wait(conn.upload, &conn.writeDeadline, &conn.writeWaited, conn.Conn.SetWriteDeadline)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	n, err = conn.Conn.Write(buf)
+	for _, limiter := range conn.upload {
+		limiter.Take(n)
+	}
+
+	return n, err
+}
+
+// SetDeadline sets the read and write deadlines, see net.Conn. Time spent waiting for the limiters
+// from now on pushes them back.
+func (conn *Conn) SetDeadline(t time.Time) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.readDeadline, conn.readWaited = t, 0
+	conn.writeDeadline, conn.writeWaited = t, 0
+	return conn.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, see net.Conn. Time spent waiting for the download limiters
+// from now on pushes it back.
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.readDeadline, conn.readWaited = t, 0
+	return conn.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline, see net.Conn. Time spent waiting for the upload limiters
+// from now on pushes it back.
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.writeDeadline, conn.writeWaited = t, 0
+	return conn.Conn.SetWriteDeadline(t)
+}
+
+// Close closes the connection, ending the waits in progress.
+func (conn *Conn) Close() error {
+	conn.cancel()
+	conn.limits.remove(conn)
+
+	return conn.Conn.Close()
+}
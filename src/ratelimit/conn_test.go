@@ -0,0 +1,153 @@
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConns returns both ends of a TCP connection.
+func newTestConns(t *testing.T) (net.Conn, net.Conn) {
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+
+	var clientConn net.Conn
+	clientConn, err = net.Dial("tcp", listener.Addr().String())
+	require.Nil(t, err)
+
+	var serverConn net.Conn
+	serverConn, err = listener.Accept()
+	require.Nil(t, err)
+
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	return clientConn, serverConn
+}
+
+// timeTransfer returns how long it takes to write `n` bytes to `writer` and read them from `reader`.
+func timeTransfer(t *testing.T, writer io.Writer, reader io.Reader, n int) time.Duration {
+	var start = time.Now()
+	var written = make(chan error, 1)
+	go func() {
+		var _, err = writer.Write(make([]byte, n))
+		written <- err
+	}()
+
+	var _, err = io.ReadFull(reader, make([]byte, n))
+	require.Nil(t, err)
+	require.Nil(t, <-written)
+
+	return time.Since(start)
+}
+
+func TestConn(t *testing.T) {
+	/*
+		test cases:
+		1. reads go no faster than the download limiters allow
+		2. writes go no faster than the upload limiters allow
+		3. connections follow changes to the peer rates until they are closed
+		4. time spent waiting for the limiters doesn't count towards the deadlines
+		5. closing the connection ends its waits
+	*/
+
+	t.Run("reads go no faster than the download limiters allow", func(t *testing.T) {
+		var ours, theirs = newTestConns(t)
+		var global = NewLimits(Unlimited, Unlimited)
+		var limits = NewLimits(20_000, Unlimited)
+		var conn = limits.Wrap(ours, global, nil)
+
+		// the first read goes through at once and leaves the limiter 4000 bytes in debt for the next one
+		timeTransfer(t, theirs, conn, 24_000)
+		assert.GreaterOrEqual(t, timeTransfer(t, theirs, conn, 10), 150*time.Millisecond)
+
+		// so does the global limit
+		limits.Download.SetRate(Unlimited)
+		global.Download.SetRate(20_000)
+		timeTransfer(t, theirs, conn, 24_000)
+		assert.GreaterOrEqual(t, timeTransfer(t, theirs, conn, 10), 150*time.Millisecond)
+	})
+
+	t.Run("writes go no faster than the upload limiters allow", func(t *testing.T) {
+		var ours, theirs = newTestConns(t)
+		var limits = NewLimits(Unlimited, 20_000)
+		var conn = limits.Wrap(ours)
+
+		// the first write goes through at once and leaves the limiter in debt for the second one
+		assert.Less(t, timeTransfer(t, conn, theirs, 24_000), 100*time.Millisecond)
+		assert.GreaterOrEqual(t, timeTransfer(t, conn, theirs, 10), 150*time.Millisecond)
+	})
+
+	t.Run("connections follow changes to the peer rates until they are closed", func(t *testing.T) {
+		var ours, theirs = newTestConns(t)
+		var limits = NewLimits(Unlimited, Unlimited)
+		limits.SetPeerRates(1000, 2000)
+
+		var conn = limits.Wrap(ours)
+		assert.Equal(t, Rate(1000), conn.peerDownload.Rate())
+		assert.Equal(t, Rate(2000), conn.peerUpload.Rate())
+
+		limits.SetPeerRates(20_000, Unlimited)
+		assert.Equal(t, Rate(20_000), conn.peerDownload.Rate())
+		assert.Equal(t, Unlimited, conn.peerUpload.Rate())
+		timeTransfer(t, theirs, conn, 24_000)
+		assert.GreaterOrEqual(t, timeTransfer(t, theirs, conn, 10), 150*time.Millisecond)
+
+		conn.Close()
+		limits.SetPeerRates(5, 5)
+		assert.Equal(t, Rate(20_000), conn.peerDownload.Rate())
+		assert.Empty(t, limits.conns)
+	})
+
+	t.Run("time spent waiting for the limiters doesn't count towards the deadlines", func(t *testing.T) {
+		var ours, theirs = newTestConns(t)
+		var limits = NewLimits(10_000, Unlimited)
+		var conn = limits.Wrap(ours)
+		limits.Download.Take(10_000 + 2_000)
+
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+		theirs.Write([]byte("hello"))
+
+		// the read waits for 200ms, past the deadline, and still gets the data
+		var buf = make([]byte, 5)
+		var _, err = io.ReadFull(conn, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, "hello", string(buf))
+
+		// the deadline is pushed back by the wait rather than lifted
+		_, err = conn.Read(buf)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	})
+
+	t.Run("closing the connection ends its waits", func(t *testing.T) {
+		var ours, _ = newTestConns(t)
+		var limits = NewLimits(1, Unlimited)
+		var conn = limits.Wrap(ours)
+		limits.Download.Take(1000)
+
+		var read = make(chan error)
+		go func() {
+			var _, err = conn.Read(make([]byte, 10))
+			read <- err
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+
+		select {
+		case err := <-read:
+			assert.True(t, errors.Is(err, net.ErrClosed))
+		case <-time.After(time.Second):
+			assert.Fail(t, "the read didn't end once the connection was closed")
+		}
+	})
+}
@@ -0,0 +1,340 @@
+// Package ratelimit caps how fast data goes over connections, with token buckets shared by the connections
+// of a torrent or of the whole client, and token buckets of each connection.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Unlimited is the rate of a limiter that doesn't hold anything up.
+const Unlimited Rate = 0
+
+// units are the suffixes a rate can be given with, and the bytes they stand for.
+var units = []struct {
+	suffix string
+	bytes  float64
+}{
+	// longer suffixes first, so that "KIB" isn't taken for "B"
+	{"KIB", 1 << 10},
+	{"MIB", 1 << 20},
+	{"GIB", 1 << 30},
+	{"KB", 1e3},
+	{"MB", 1e6},
+	{"GB", 1e9},
+	{"K", 1e3},
+	{"M", 1e6},
+	{"G", 1e9},
+	{"B", 1},
+}
+
+// Rate is a number of bytes per second. Zero means unlimited.
+// It implements flag.Value, so rates can be given on the command line like "5MB/s".
+type Rate int64
+
+// ParseRate parses a rate given as a number of bytes per second, optionally followed by a unit and "/s",
+// e.g. "5MB/s", "512KiB/s" or "1.5M". Decimal units are powers of 1000 and binary ones powers of 1024.
+// "0" and "unlimited" are the unlimited rate.
+// Returns an error if the rate is malformed or negative.
+func ParseRate(s string) (Rate, error) {
+	var text = strings.ToUpper(strings.TrimSpace(s))
+	if text == "UNLIMITED" {
+		return Unlimited, nil
+	}
+
+	text = strings.TrimSuffix(text, "/S")
+	var multiplier = 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(text, unit.suffix) {
+			text = strings.TrimSpace(strings.TrimSuffix(text, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+
+	var value, err = strconv.ParseFloat(text, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected e.g. 5MB/s or 512KiB/s", s)
+	}
+
+	return Rate(value * multiplier), nil
+}
+
+// String formats the rate in the largest decimal unit it has at least one of, e.g. "5MB/s".
+func (rate Rate) String() string {
+	switch {
+	case rate == Unlimited:
+		return "unlimited"
+	case rate >= 1e9:
+		return strconv.FormatFloat(float64(rate)/1e9, 'f', -1, 64) + "GB/s"
+	case rate >= 1e6:
+		return strconv.FormatFloat(float64(rate)/1e6, 'f', -1, 64) + "MB/s"
+	case rate >= 1e3:
+		return strconv.FormatFloat(float64(rate)/1e3, 'f', -1, 64) + "KB/s"
+	default:
+		return strconv.FormatInt(int64(rate), 10) + "B/s"
+	}
+}
+
+// Set parses the rate from a command line flag, see ParseRate.
+func (rate *Rate) Set(s string) error {
+	var parsed, err = ParseRate(s)
+	if err != nil {
+		return err
+	}
+
+	*rate = parsed
+	return nil
+}
+
+// Limiter is a token bucket handing out a number of bytes per second. It holds up to a second worth of
+// bytes, so that a connection that was idle can catch up a little. Bytes can be taken beyond what it holds,
+// e.g. for a read whose size is only known once it is done, which makes the next waits longer.
+// A paused limiter hands out nothing at all until it is resumed.
+// The zero value and a nil limiter are unlimited. It is safe for concurrent use.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    Rate
+	paused  bool
+	resumed time.Time        // when the limiter was last resumed after a pause, zero if it never was
+	tokens  float64          // bytes that can be taken without waiting, negative when in debt
+	updated time.Time        // when `tokens` was last brought up to date
+	changed chan struct{}    // closed and replaced whenever the rate changes or the limiter is paused or resumed
+	now     func() time.Time // clock of the limiter, time.Now outside of tests
+}
+
+// NewLimiter creates a limiter handing out `rate` bytes per second, starting full.
+func NewLimiter(rate Rate) *Limiter {
+	var limiter = &Limiter{}
+	limiter.SetRate(rate)
+
+	return limiter
+}
+
+// clock returns the current time of the limiter.
+// The caller must hold the limiter's lock.
+func (limiter *Limiter) clock() time.Time {
+	if limiter.now == nil {
+		return time.Now()
+	}
+
+	return limiter.now()
+}
+
+// refill adds the bytes handed out since the last refill, up to a second worth of them.
+// The caller must hold the limiter's lock.
+func (limiter *Limiter) refill(now time.Time) {
+	var elapsed = now.Sub(limiter.updated).Seconds()
+	limiter.updated = now
+
+	if elapsed > 0 {
+		limiter.tokens = min(limiter.tokens+elapsed*float64(limiter.rate), float64(limiter.rate))
+	}
+}
+
+// Rate returns the bytes per second the limiter hands out, Unlimited if it doesn't limit anything.
+func (limiter *Limiter) Rate() Rate {
+	if limiter == nil {
+		return Unlimited
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return limiter.rate
+}
+
+// SetRate changes the bytes per second the limiter hands out, which applies to the waits in progress too.
+// A limiter that was unlimited starts full.
+func (limiter *Limiter) SetRate(rate Rate) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	var now = limiter.clock()
+	if limiter.rate == Unlimited {
+		limiter.tokens = float64(rate)
+	} else {
+		limiter.refill(now)
+		limiter.tokens = min(limiter.tokens, float64(rate))
+	}
+
+	limiter.rate = max(rate, Unlimited)
+	limiter.updated = now
+	limiter.notify()
+}
+
+// notify wakes up the waits in progress, so that they see the limiter's new settings.
+// The caller must hold the limiter's lock.
+func (limiter *Limiter) notify() {
+	if limiter.changed != nil {
+		close(limiter.changed)
+	}
+	limiter.changed = make(chan struct{})
+}
+
+// Paused reports whether the limiter is paused.
+func (limiter *Limiter) Paused() bool {
+	if limiter == nil {
+		return false
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return limiter.paused
+}
+
+// Resumed returns when the limiter was last resumed after a pause, the zero time if it never was. Nothing
+// could be handed out before then, which e.g. a stall check must not blame on the peers.
+func (limiter *Limiter) Resumed() time.Time {
+	if limiter == nil {
+		return time.Time{}
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	return limiter.resumed
+}
+
+// SetPaused pauses the limiter, which holds up every wait until it is resumed, or resumes it.
+func (limiter *Limiter) SetPaused(paused bool) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.rate != Unlimited {
+		limiter.refill(limiter.clock())
+	}
+
+	if limiter.paused && !paused {
+		limiter.resumed = limiter.clock()
+	}
+
+	limiter.paused = paused
+	limiter.notify()
+}
+
+// Wait blocks until the limiter isn't paused nor in debt, so that bytes can be taken from it.
+// Returns ctx.Err() if `ctx` is cancelled first.
+func (limiter *Limiter) Wait(ctx context.Context) error {
+	if limiter == nil {
+		return nil
+	}
+
+	for {
+		limiter.mu.Lock()
+		var changed = limiter.changed
+		if limiter.paused {
+			limiter.mu.Unlock()
+
+			select {
+			case <-changed:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if limiter.rate == Unlimited {
+			limiter.mu.Unlock()
+			return nil
+		}
+
+		limiter.refill(limiter.clock())
+		if limiter.tokens >= 0 {
+			limiter.mu.Unlock()
+			return nil
+		}
+
+		var delay = time.Duration(-limiter.tokens / float64(limiter.rate) * float64(time.Second))
+		limiter.mu.Unlock()
+
+		var timer = time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Take takes `n` bytes from the limiter, going into debt if it holds fewer. Unlimited limiters keep no count.
+func (limiter *Limiter) Take(n int) {
+	if limiter == nil || n <= 0 {
+		return
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if limiter.rate == Unlimited {
+		return
+	}
+
+	limiter.refill(limiter.clock())
+	limiter.tokens -= float64(n)
+}
+
+// Limits are the rate limits of one level, e.g. the whole client or a single torrent: a limiter for each
+// direction shared by all of the level's connections, and rates each of its connections is held to on its
+// own. Every rate can be changed while the connections run.
+// It is safe for concurrent use.
+type Limits struct {
+	Download *Limiter // Bytes per second read from all of the connections together.
+	Upload   *Limiter // Bytes per second written to all of the connections together.
+
+	mu           sync.Mutex
+	peerDownload Rate               // bytes per second read from each connection
+	peerUpload   Rate               // bytes per second written to each connection
+	conns        map[*Conn]struct{} // open connections, whose own limiters follow the peer rates
+}
+
+// NewLimits creates the limits of a level, whose connections together download at most `download` and upload
+// at most `upload` bytes per second. Connections aren't limited on their own until SetPeerRates is called.
+func NewLimits(download, upload Rate) *Limits {
+	return &Limits{
+		Download: NewLimiter(download),
+		Upload:   NewLimiter(upload),
+		conns:    make(map[*Conn]struct{}),
+	}
+}
+
+// Paused reports whether the limits are paused, in either direction.
+func (limits *Limits) Paused() bool {
+	return limits.Download.Paused() || limits.Upload.Paused()
+}
+
+// SetPaused pauses or resumes both directions, see Limiter.SetPaused.
+func (limits *Limits) SetPaused(paused bool) {
+	limits.Download.SetPaused(paused)
+	limits.Upload.SetPaused(paused)
+}
+
+// SetPeerRates changes the bytes per second each connection downloads and uploads at most, for the open
+// connections as well as for the ones to come.
+func (limits *Limits) SetPeerRates(download, upload Rate) {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	limits.peerDownload = download
+	limits.peerUpload = upload
+	for conn := range limits.conns {
+		conn.peerDownload.SetRate(download)
+		conn.peerUpload.SetRate(upload)
+	}
+}
+
+// remove stops the limiters of a closed connection from following the peer rates.
+func (limits *Limits) remove(conn *Conn) {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+
+	delete(limits.conns, conn)
+}
@@ -0,0 +1,224 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+// newTestLimiter creates a limiter running on a fake clock.
+func newTestLimiter(rate Rate) (*Limiter, *fakeClock) {
+	var clock = &fakeClock{now: time.Unix(1000, 0)}
+	var limiter = &Limiter{now: clock.Now}
+	limiter.SetRate(rate)
+
+	return limiter, clock
+}
+
+func TestParseRate(t *testing.T) {
+	/*
+		test cases:
+		1. rates with decimal and binary units are parsed
+		2. unlimited rates are parsed
+		3. malformed and negative rates are rejected
+		4. rates are formatted in the largest decimal unit
+	*/
+
+	t.Run("rates with decimal and binary units are parsed", func(t *testing.T) {
+		var cases = map[string]Rate{
+			"5MB/s":     5_000_000,
+			"512KiB/s":  512 * 1024,
+			"1.5M":      1_500_000,
+			"2 GB/s":    2_000_000_000,
+			"100":       100,
+			"100B/s":    100,
+			"3kb/s":     3000,
+			"1MiB":      1 << 20,
+			" 20 KB/s ": 20_000,
+		}
+
+		for text, want := range cases {
+			var rate, err = ParseRate(text)
+			assert.Nil(t, err, text)
+			assert.Equal(t, want, rate, text)
+		}
+	})
+
+	t.Run("unlimited rates are parsed", func(t *testing.T) {
+		for _, text := range []string{"0", "unlimited", "0MB/s"} {
+			var rate, err = ParseRate(text)
+			assert.Nil(t, err, text)
+			assert.Equal(t, Unlimited, rate, text)
+		}
+	})
+
+	t.Run("malformed and negative rates are rejected", func(t *testing.T) {
+		for _, text := range []string{"", "fast", "5XB/s", "-1MB/s", "MB/s"} {
+			var _, err = ParseRate(text)
+			assert.NotNil(t, err, text)
+		}
+	})
+
+	t.Run("rates are formatted in the largest decimal unit", func(t *testing.T) {
+		assert.Equal(t, "5MB/s", Rate(5_000_000).String())
+		assert.Equal(t, "1.5KB/s", Rate(1500).String())
+		assert.Equal(t, "2GB/s", Rate(2_000_000_000).String())
+		assert.Equal(t, "10B/s", Rate(10).String())
+		assert.Equal(t, "unlimited", Unlimited.String())
+
+		var rate Rate
+		assert.Nil(t, rate.Set("250KB/s"))
+		assert.Equal(t, Rate(250_000), rate)
+	})
+}
+
+func TestLimiter(t *testing.T) {
+	/*
+		test cases:
+		1. bytes can be taken right away up to a second worth of them
+		2. the limiter refills at its rate, up to a second worth of bytes
+		3. waits last until the debt is paid off
+		4. changing the rate applies to the waits in progress
+		5. unlimited limiters never wait
+		6. waits give up when the context is cancelled
+		7. waits last as long as the limiter is paused
+		8. the time the limiter was resumed is recorded
+	*/
+
+	t.Run("bytes can be taken right away up to a second worth of them", func(t *testing.T) {
+		var limiter, _ = newTestLimiter(1000)
+
+		limiter.Take(600)
+		limiter.Take(400)
+		assert.InDelta(t, 0, limiter.tokens, 0.001)
+
+		limiter.Take(500)
+		assert.InDelta(t, -500, limiter.tokens, 0.001)
+	})
+
+	t.Run("the limiter refills at its rate, up to a second worth of bytes", func(t *testing.T) {
+		var limiter, clock = newTestLimiter(1000)
+		limiter.Take(1500)
+
+		clock.now = clock.now.Add(time.Second)
+		limiter.mu.Lock()
+		limiter.refill(clock.now)
+		assert.InDelta(t, 500, limiter.tokens, 0.001)
+		limiter.mu.Unlock()
+
+		clock.now = clock.now.Add(10 * time.Second)
+		limiter.mu.Lock()
+		limiter.refill(clock.now)
+		assert.InDelta(t, 1000, limiter.tokens, 0.001)
+		limiter.mu.Unlock()
+	})
+
+	t.Run("waits last until the debt is paid off", func(t *testing.T) {
+		var limiter = NewLimiter(10_000)
+		limiter.Take(10_000 + 1_000)
+
+		var start = time.Now()
+		assert.Nil(t, limiter.Wait(context.Background()))
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+
+		// the debt is paid, so the next wait returns at once
+		start = time.Now()
+		assert.Nil(t, limiter.Wait(context.Background()))
+		assert.Less(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("changing the rate applies to the waits in progress", func(t *testing.T) {
+		var limiter = NewLimiter(100)
+		limiter.Take(100 + 1_000)
+
+		var waited = make(chan error)
+		go func() { waited <- limiter.Wait(context.Background()) }()
+
+		time.Sleep(20 * time.Millisecond)
+		limiter.SetRate(Unlimited)
+
+		select {
+		case err := <-waited:
+			assert.Nil(t, err)
+		case <-time.After(time.Second):
+			assert.Fail(t, "the wait didn't end once the limiter became unlimited")
+		}
+		assert.Equal(t, Unlimited, limiter.Rate())
+	})
+
+	t.Run("unlimited limiters never wait", func(t *testing.T) {
+		var limiter = NewLimiter(Unlimited)
+		limiter.Take(1 << 30)
+		assert.Nil(t, limiter.Wait(context.Background()))
+
+		var none *Limiter
+		none.Take(1 << 30)
+		assert.Nil(t, none.Wait(context.Background()))
+		assert.Equal(t, Unlimited, none.Rate())
+	})
+
+	t.Run("waits give up when the context is cancelled", func(t *testing.T) {
+		var limiter = NewLimiter(1)
+		limiter.Take(1000)
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		assert.ErrorIs(t, limiter.Wait(ctx), context.DeadlineExceeded)
+	})
+
+	t.Run("waits last as long as the limiter is paused", func(t *testing.T) {
+		var limits = NewLimits(Unlimited, 1000)
+		limits.SetPaused(true)
+		assert.True(t, limits.Paused())
+
+		var waited = make(chan error)
+		go func() { waited <- limits.Download.Wait(context.Background()) }()
+
+		select {
+		case <-waited:
+			assert.Fail(t, "the wait ended while the limiter was paused")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		limits.SetPaused(false)
+		assert.False(t, limits.Paused())
+
+		select {
+		case err := <-waited:
+			assert.Nil(t, err)
+		case <-time.After(time.Second):
+			assert.Fail(t, "the wait didn't end once the limiter was resumed")
+		}
+	})
+
+	t.Run("the time the limiter was resumed is recorded", func(t *testing.T) {
+		var limiter, clock = newTestLimiter(1000)
+		assert.True(t, limiter.Resumed().IsZero())
+		assert.True(t, (*Limiter)(nil).Resumed().IsZero())
+
+		limiter.SetPaused(true)
+		clock.now = clock.now.Add(time.Minute)
+		assert.True(t, limiter.Resumed().IsZero(), "pausing isn't resuming")
+
+		limiter.SetPaused(false)
+		assert.Equal(t, clock.now, limiter.Resumed())
+
+		// resuming a limiter that isn't paused changes nothing
+		var resumed = clock.now
+		clock.now = clock.now.Add(time.Minute)
+		limiter.SetPaused(false)
+		assert.Equal(t, resumed, limiter.Resumed())
+	})
+}
@@ -0,0 +1,365 @@
+// Package schedule changes the rate limits with the time of the week, e.g. to throttle the downloads during
+// working hours and let them run at full speed overnight.
+package schedule
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/winterrdog/lean-bit-torrent-client/ratelimit"
+)
+
+const day = 24 * time.Hour
+
+// dayNames are the names days can be given by in a schedule.
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// Rule gives the rate limits for a range of time on some days of the week.
+type Rule struct {
+	Days     [7]bool        // Days the range of time starts on, indexed by time.Weekday.
+	Start    time.Duration  // Time of day the range starts at.
+	End      time.Duration  // Time of day the range ends at, on the next day if it isn't after Start. 24h is midnight.
+	Download ratelimit.Rate // Bytes per second downloaded during the range.
+	Upload   ratelimit.Rate // Bytes per second uploaded during the range.
+	Pause    bool           // Whether nothing is downloaded or uploaded at all during the range, whatever the rates.
+}
+
+// timeOfDay returns how long after midnight `t` is.
+func timeOfDay(t time.Time) time.Duration {
+	var hour, minute, second = t.Clock()
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second +
+		time.Duration(t.Nanosecond())
+}
+
+// Matches reports whether `t` lies in the rule's range of time, in the location of `t`.
+func (rule *Rule) Matches(t time.Time) bool {
+	var weekday, now = t.Weekday(), timeOfDay(t)
+	if rule.Start < rule.End {
+		return rule.Days[weekday] && now >= rule.Start && now < rule.End
+	}
+
+	// the range goes past midnight into the next day
+	var yesterday = (weekday + 6) % 7
+	return (rule.Days[weekday] && now >= rule.Start) || (rule.Days[yesterday] && now < rule.End)
+}
+
+// String formats the rule the way it is written in a schedule, e.g. "mon,tue 09:00-18:00 1MB/s 200KB/s".
+func (rule *Rule) String() string {
+	var days []string
+	for weekday, set := range rule.Days {
+		if set {
+			days = append(days, time.Weekday(weekday).String()[:3])
+		}
+	}
+
+	var text strings.Builder
+	if len(days) == 7 {
+		text.WriteString("*")
+	} else {
+		text.WriteString(strings.ToLower(strings.Join(days, ",")))
+	}
+
+	if rule.Start == 0 && rule.End == day {
+		text.WriteString(" *")
+	} else {
+		fmt.Fprintf(&text, " %02d:%02d-%02d:%02d",
+			int(rule.Start.Hours()), int(rule.Start.Minutes())%60, int(rule.End.Hours()), int(rule.End.Minutes())%60)
+	}
+
+	if rule.Pause {
+		text.WriteString(" pause")
+	} else {
+		fmt.Fprintf(&text, " %s %s", rule.Download, rule.Upload)
+	}
+
+	return text.String()
+}
+
+// Schedule is a list of rules giving the rate limits by the time of the week. The first rule matching a time
+// applies; at the times no rule matches, the limits aren't changed from what they were set to otherwise.
+type Schedule struct {
+	Rules []Rule
+}
+
+// Rule returns the rule applying at `t`, nil if no rule matches it.
+func (schedule *Schedule) Rule(t time.Time) *Rule {
+	for i := range schedule.Rules {
+		if schedule.Rules[i].Matches(t) {
+			return &schedule.Rules[i]
+		}
+	}
+
+	return nil
+}
+
+// Load reads a schedule from the file at `path`, see Parse.
+// Returns an error if the file can't be read or the schedule is malformed.
+func Load(path string) (*Schedule, error) {
+	var file, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var schedule *Schedule
+	schedule, err = Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return schedule, nil
+}
+
+// Parse reads a schedule with one rule per line, in the order they are checked in. A rule is made of the days
+// of the week it applies on, its range of time and either the download and upload rates or "pause":
+//
+//	# days    time          download   upload
+//	mon-fri   12:00-13:00   pause
+//	mon-fri   09:00-18:00   1MB/s      200KB/s
+//	fri       22:00-06:00   unlimited  unlimited
+//	sat,sun   *             5MB/s      1MB/s
+//
+// Days are given by name, as comma separated lists and ranges, or as "*" for every day. Times are given in
+// the local time of day; a range whose end isn't after its start goes on until the next day, and "*" is the
+// whole day. Rates are written like "5MB/s" or "512KiB/s", see ratelimit.ParseRate. Everything after a "#"
+// is a comment.
+// Returns an error naming the line of the first malformed rule.
+func Parse(r io.Reader) (*Schedule, error) {
+	var schedule = &Schedule{}
+	var scanner = bufio.NewScanner(r)
+	var number int
+	for scanner.Scan() {
+		number++
+
+		var line, _, _ = strings.Cut(scanner.Text(), "#")
+		var fields = strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var rule, err = parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number, err)
+		}
+
+		schedule.Rules = append(schedule.Rules, rule)
+	}
+
+	return schedule, scanner.Err()
+}
+
+// parseRule parses the fields of a line of a schedule.
+func parseRule(fields []string) (Rule, error) {
+	var rule Rule
+	if len(fields) != 3 && len(fields) != 4 {
+		return rule, fmt.Errorf("expected days, a time range and either two rates or \"pause\", got %q", strings.Join(fields, " "))
+	}
+
+	var err error
+	rule.Days, err = parseDays(fields[0])
+	if err != nil {
+		return rule, err
+	}
+
+	rule.Start, rule.End, err = parseTimeRange(fields[1])
+	if err != nil {
+		return rule, err
+	}
+
+	if len(fields) == 3 {
+		if !strings.EqualFold(fields[2], "pause") {
+			return rule, fmt.Errorf("expected two rates or \"pause\", got %q", fields[2])
+		}
+
+		rule.Pause = true
+		return rule, nil
+	}
+
+	rule.Download, err = ratelimit.ParseRate(fields[2])
+	if err != nil {
+		return rule, err
+	}
+
+	rule.Upload, err = ratelimit.ParseRate(fields[3])
+	return rule, err
+}
+
+// parseDays parses a list of days like "mon-fri,sun", or "*" for every day.
+func parseDays(text string) ([7]bool, error) {
+	var days [7]bool
+	if text == "*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+
+	for _, item := range strings.Split(strings.ToLower(text), ",") {
+		var first, last, isRange = strings.Cut(item, "-")
+		var from, ok = dayNames[first]
+		if !ok {
+			return days, fmt.Errorf("unknown day %q", first)
+		}
+
+		var to = from
+		if isRange {
+			to, ok = dayNames[last]
+			if !ok {
+				return days, fmt.Errorf("unknown day %q", last)
+			}
+		}
+
+		// ranges like "fri-mon" go on past the end of the week
+		for weekday := from; ; weekday = (weekday + 1) % 7 {
+			days[weekday] = true
+			if weekday == to {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseTimeRange parses a range of time of day like "09:00-18:00", or "*" for the whole day.
+func parseTimeRange(text string) (time.Duration, time.Duration, error) {
+	if text == "*" {
+		return 0, day, nil
+	}
+
+	var first, last, ok = strings.Cut(text, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected e.g. 09:00-18:00", text)
+	}
+
+	var start, err = parseTimeOfDay(first)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var end time.Duration
+	end, err = parseTimeOfDay(last)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if start == day {
+		return 0, 0, fmt.Errorf("invalid time range %q, it can't start at 24:00", text)
+	}
+
+	if start == end {
+		return 0, 0, fmt.Errorf("empty time range %q", text)
+	}
+
+	return start, end, nil
+}
+
+// parseTimeOfDay parses a time of day like "09:30", from 00:00 to 24:00.
+func parseTimeOfDay(text string) (time.Duration, error) {
+	var hour, minute int
+	var _, err = fmt.Sscanf(text, "%d:%d", &hour, &minute)
+	if err != nil || len(text) != 5 || hour < 0 || hour > 24 || minute < 0 || minute > 59 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time of day %q, expected e.g. 09:30", text)
+	}
+
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+// Clock tells the time to a scheduler.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel the time is sent to once `d` went by.
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the clock of the system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SystemClock is the clock of the system, which schedulers run on outside of tests.
+var SystemClock Clock = systemClock{}
+
+// Scheduler applies a schedule to rate limits. Whenever another rule of the schedule starts to apply, the
+// limits get the rule's rates, or are paused if the rule says so; whenever no rule applies anymore, the limits
+// go back to the rates they had when the scheduler was created.
+type Scheduler struct {
+	OnChange func(rule *Rule) // Called with the rule that starts to apply, nil once none does. May be nil.
+
+	schedule *Schedule
+	limits   *ratelimit.Limits
+	download ratelimit.Rate // download rate of the limits outside of the rules
+	upload   ratelimit.Rate // upload rate of the limits outside of the rules
+	current  *Rule          // rule applied last, nil if none
+	started  bool           // whether anything was applied yet
+}
+
+// New creates a scheduler applying the schedule to the limits, whose current rates apply outside of the rules.
+// Nothing is applied until Update or Run is called.
+func New(schedule *Schedule, limits *ratelimit.Limits) *Scheduler {
+	return &Scheduler{
+		schedule: schedule,
+		limits:   limits,
+		download: limits.Download.Rate(),
+		upload:   limits.Upload.Rate(),
+	}
+}
+
+// Update applies the rule of the schedule applying at `now` to the limits, if it isn't the rule applied last,
+// so that changes made to the limits in between stay until the next rule starts.
+// It returns the rule applying at `now`, nil if none does.
+func (scheduler *Scheduler) Update(now time.Time) *Rule {
+	var rule = scheduler.schedule.Rule(now)
+	if scheduler.started && rule == scheduler.current {
+		return rule
+	}
+
+	scheduler.started = true
+	scheduler.current = rule
+
+	switch {
+	case rule == nil:
+		scheduler.limits.Download.SetRate(scheduler.download)
+		scheduler.limits.Upload.SetRate(scheduler.upload)
+		scheduler.limits.SetPaused(false)
+	case rule.Pause:
+		scheduler.limits.SetPaused(true)
+	default:
+		scheduler.limits.Download.SetRate(rule.Download)
+		scheduler.limits.Upload.SetRate(rule.Upload)
+		scheduler.limits.SetPaused(false)
+	}
+
+	if scheduler.OnChange != nil {
+		scheduler.OnChange(rule)
+	}
+
+	return rule
+}
+
+// Run applies the schedule right away, then at the start of every minute of the clock, until `ctx` is cancelled.
+func (scheduler *Scheduler) Run(ctx context.Context, clock Clock) {
+	for {
+		var now = clock.Now()
+		scheduler.Update(now)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-clock.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		}
+	}
+}
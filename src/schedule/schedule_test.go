@@ -0,0 +1,237 @@
+package schedule
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/winterrdog/lean-bit-torrent-client/ratelimit"
+)
+
+// testSchedule is a schedule throttling working hours, pausing at lunch and opening up on Friday nights.
+const testSchedule = `
+# days    time          download   upload
+mon-fri   12:00-13:00   pause
+mon-fri   09:00-18:00   1MB/s      200KB/s   # working hours
+fri       22:00-06:00   unlimited  unlimited
+sat,sun   *             5MB/s      1MB/s
+`
+
+// at returns the given time of the week of 2024-01-01, which was a Monday.
+func at(weekday time.Weekday, hour, minute int) time.Time {
+	return time.Date(2024, time.January, int(weekday+6)%7+1, hour, minute, 0, 0, time.Local)
+}
+
+// fakeClock is a clock that moves only when told to, waking up the timers it went past.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	return clock.now
+}
+
+func (clock *fakeClock) After(d time.Duration) <-chan time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	var ch = make(chan time.Time, 1)
+	clock.timers = append(clock.timers, fakeTimer{at: clock.now.Add(d), ch: ch})
+	return ch
+}
+
+// waiting reports whether anything waits for the clock.
+func (clock *fakeClock) waiting() bool {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	return len(clock.timers) != 0
+}
+
+// set moves the clock to `now`.
+func (clock *fakeClock) set(now time.Time) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	clock.now = now
+	var pending []fakeTimer
+	for _, timer := range clock.timers {
+		if timer.at.After(now) {
+			pending = append(pending, timer)
+			continue
+		}
+
+		timer.ch <- now
+	}
+	clock.timers = pending
+}
+
+func TestParse(t *testing.T) {
+	/*
+		test cases:
+		1. rules are parsed with their days, times and limits
+		2. malformed rules are rejected with their line number
+	*/
+
+	t.Run("rules are parsed with their days, times and limits", func(t *testing.T) {
+		var schedule, err = Parse(strings.NewReader(testSchedule))
+		require.Nil(t, err)
+		require.Len(t, schedule.Rules, 4)
+
+		var workdays = [7]bool{false, true, true, true, true, true, false}
+		assert.Equal(t, Rule{Days: workdays, Start: 12 * time.Hour, End: 13 * time.Hour, Pause: true}, schedule.Rules[0])
+		assert.Equal(t, Rule{Days: workdays, Start: 9 * time.Hour, End: 18 * time.Hour, Download: 1_000_000, Upload: 200_000}, schedule.Rules[1])
+		assert.Equal(t, "fri 22:00-06:00 unlimited unlimited", schedule.Rules[2].String())
+		assert.Equal(t, "sun,sat * 5MB/s 1MB/s", schedule.Rules[3].String())
+
+		schedule, err = Parse(strings.NewReader("fri-mon 00:00-24:00 1KB/s 1KB/s\n* 18:30-08:00 pause"))
+		require.Nil(t, err)
+		assert.Equal(t, [7]bool{true, true, false, false, false, true, true}, schedule.Rules[0].Days)
+		assert.Equal(t, "* 18:30-08:00 pause", schedule.Rules[1].String())
+	})
+
+	t.Run("malformed rules are rejected with their line number", func(t *testing.T) {
+		var lines = []string{
+			"mon-fri 09:00-18:00",
+			"mon-fri 09:00-18:00 1MB/s",
+			"mon-fri 09:00-18:00 fast slow",
+			"someday 09:00-18:00 pause",
+			"mon-fri 9-18 pause",
+			"mon-fri 09:00-25:00 pause",
+			"mon-fri 09:00-09:00 pause",
+			"mon-fri 24:00-09:00 pause",
+		}
+
+		for _, line := range lines {
+			var _, err = Parse(strings.NewReader("# comment\n\n" + line))
+			assert.ErrorContains(t, err, "line 3", line)
+		}
+	})
+}
+
+func TestRule(t *testing.T) {
+	/*
+		test cases:
+		1. the first rule matching a time applies
+		2. ranges going past midnight apply until the next day
+	*/
+
+	var schedule, err = Parse(strings.NewReader(testSchedule))
+	require.Nil(t, err)
+
+	t.Run("the first rule matching a time applies", func(t *testing.T) {
+		assert.Nil(t, schedule.Rule(at(time.Monday, 8, 59)))
+		assert.Equal(t, &schedule.Rules[1], schedule.Rule(at(time.Monday, 9, 0)))
+		assert.Equal(t, &schedule.Rules[0], schedule.Rule(at(time.Wednesday, 12, 30)))
+		assert.Equal(t, &schedule.Rules[1], schedule.Rule(at(time.Friday, 17, 59)))
+		assert.Nil(t, schedule.Rule(at(time.Friday, 18, 0)))
+		assert.Equal(t, &schedule.Rules[3], schedule.Rule(at(time.Sunday, 23, 59)))
+	})
+
+	t.Run("ranges going past midnight apply until the next day", func(t *testing.T) {
+		assert.Equal(t, &schedule.Rules[2], schedule.Rule(at(time.Friday, 22, 0)))
+		assert.Equal(t, &schedule.Rules[2], schedule.Rule(at(time.Saturday, 5, 59)))
+		assert.Equal(t, &schedule.Rules[3], schedule.Rule(at(time.Saturday, 6, 0)))
+		assert.Nil(t, schedule.Rule(at(time.Thursday, 23, 0)))
+	})
+}
+
+func TestScheduler(t *testing.T) {
+	/*
+		test cases:
+		1. the limits follow the rules as the clock moves, and go back outside of them
+		2. changes made to the limits stay until the next rule starts
+	*/
+
+	var schedule, err = Parse(strings.NewReader(testSchedule))
+	require.Nil(t, err)
+
+	t.Run("the limits follow the rules as the clock moves, and go back outside of them", func(t *testing.T) {
+		var limits = ratelimit.NewLimits(10_000_000, ratelimit.Unlimited)
+		var scheduler = New(schedule, limits)
+
+		var mu sync.Mutex
+		var changes []*Rule
+		scheduler.OnChange = func(rule *Rule) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes = append(changes, rule)
+		}
+
+		var clock = &fakeClock{now: at(time.Monday, 8, 30)}
+		var ctx, cancel = context.WithCancel(context.Background())
+		var done = make(chan struct{})
+		go func() {
+			scheduler.Run(ctx, clock)
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+
+		// moves the clock once the scheduler waits for it, and waits for the scheduler to catch up
+		var advance = func(now time.Time, numChanges int) {
+			require.Eventually(t, clock.waiting, time.Second, time.Millisecond)
+			clock.set(now)
+			require.Eventually(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(changes) == numChanges
+			}, time.Second, time.Millisecond)
+		}
+
+		advance(at(time.Monday, 8, 30), 1)
+		assert.Equal(t, ratelimit.Rate(10_000_000), limits.Download.Rate())
+		assert.Equal(t, ratelimit.Unlimited, limits.Upload.Rate())
+
+		advance(at(time.Monday, 9, 0), 2)
+		assert.Equal(t, ratelimit.Rate(1_000_000), limits.Download.Rate())
+		assert.Equal(t, ratelimit.Rate(200_000), limits.Upload.Rate())
+		assert.False(t, limits.Paused())
+
+		advance(at(time.Monday, 12, 0), 3)
+		assert.True(t, limits.Paused())
+
+		advance(at(time.Monday, 13, 0), 4)
+		assert.False(t, limits.Paused())
+		assert.Equal(t, ratelimit.Rate(1_000_000), limits.Download.Rate())
+
+		advance(at(time.Monday, 18, 0), 5)
+		assert.Equal(t, ratelimit.Rate(10_000_000), limits.Download.Rate())
+		assert.Equal(t, ratelimit.Unlimited, limits.Upload.Rate())
+
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, []*Rule{nil, &schedule.Rules[1], &schedule.Rules[0], &schedule.Rules[1], nil}, changes)
+	})
+
+	t.Run("changes made to the limits stay until the next rule starts", func(t *testing.T) {
+		var limits = ratelimit.NewLimits(ratelimit.Unlimited, ratelimit.Unlimited)
+		var scheduler = New(schedule, limits)
+
+		assert.Equal(t, &schedule.Rules[3], scheduler.Update(at(time.Saturday, 10, 0)))
+		assert.Equal(t, ratelimit.Rate(5_000_000), limits.Download.Rate())
+
+		limits.Download.SetRate(2_000_000)
+		scheduler.Update(at(time.Saturday, 11, 0))
+		assert.Equal(t, ratelimit.Rate(2_000_000), limits.Download.Rate())
+
+		assert.Equal(t, &schedule.Rules[1], scheduler.Update(at(time.Monday, 10, 0)))
+		assert.Equal(t, ratelimit.Rate(1_000_000), limits.Download.Rate())
+	})
+}
@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// allocate reserves the disk space of the first `length` bytes of the file with fallocate, leaving the
+// data in it untouched. File systems that don't support fallocate are left alone.
+func allocate(file *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+
+	var err = syscall.Fallocate(int(file.Fd()), 0, 0, length)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// allocate leaves the file sparse, as there is no fallocate here.
+func allocate(file *os.File, length int64) error {
+	return nil
+}
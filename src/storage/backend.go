@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupported is returned when a storage backend isn't available on this platform.
+var ErrUnsupported = errors.New("storage backend not supported on this platform")
+
+// Backend tells how a storage reads and writes the files it keeps the content in.
+type Backend int
+
+const (
+	BackendFile Backend = iota // plain reads and writes, see FileStorage
+	BackendMmap                // memory mappings, see MmapStorage, on Linux only
+)
+
+// ParseBackend returns the storage backend with the given name, "file" or "mmap".
+// Returns an error if there is no such backend.
+func ParseBackend(name string) (Backend, error) {
+	switch name {
+	case "file":
+		return BackendFile, nil
+	case "mmap":
+		return BackendMmap, nil
+	default:
+		return 0, fmt.Errorf("unknown storage backend %q, expected \"file\" or \"mmap\"", name)
+	}
+}
+
+// String returns the name of the storage backend.
+func (backend Backend) String() string {
+	switch backend {
+	case BackendFile:
+		return "file"
+	case BackendMmap:
+		return "mmap"
+	default:
+		return "unknown"
+	}
+}
+
+// OpenFile creates a storage of the given backend that keeps content of `length` bytes, split into pieces of
+// `pieceLength` bytes, in the file at `path`. Memory-mapped storages use the default MmapConfig.
+// Returns ErrUnsupported if the backend isn't available here, or an error if the file could not be opened or
+// sized.
+func OpenFile(backend Backend, path string, pieceLength int, length int64) (Storage, error) {
+	switch backend {
+	case BackendFile:
+		var store, err = NewFile(path, pieceLength, length)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case BackendMmap:
+		return openMmapFile(path, pieceLength, length)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %d", backend)
+	}
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBackend(t *testing.T) {
+	for _, backend := range []Backend{BackendFile, BackendMmap} {
+		var parsed, err = ParseBackend(backend.String())
+		assert.Nil(t, err)
+		assert.Equal(t, backend, parsed)
+	}
+
+	var _, err = ParseBackend("tape")
+	assert.NotNil(t, err)
+}
+
+func TestOpenFile(t *testing.T) {
+	/*
+		test cases:
+		1. the storage of each backend keeps the content in the file
+		2. memory mappings are only available on Linux
+	*/
+
+	t.Run("the storage of each backend keeps the content in the file", func(t *testing.T) {
+		var backends = []Backend{BackendFile}
+		if runtime.GOOS == "linux" {
+			backends = append(backends, BackendMmap)
+		}
+
+		for _, backend := range backends {
+			var store, err = OpenFile(backend, filepath.Join(t.TempDir(), "out"), 4, 10)
+			require.Nil(t, err, backend)
+
+			assert.Nil(t, store.WriteBlock(1, 0, []byte("efgh")))
+			var buf = make([]byte, 4)
+			assert.Nil(t, store.ReadBlock(1, 0, buf))
+			assert.Equal(t, "efgh", string(buf))
+			assert.Nil(t, store.Close())
+		}
+	})
+
+	t.Run("memory mappings are only available on Linux", func(t *testing.T) {
+		if runtime.GOOS == "linux" {
+			t.Skip("memory mappings are available here")
+		}
+
+		var _, err = OpenFile(BackendMmap, filepath.Join(t.TempDir(), "out"), 4, 10)
+		assert.ErrorIs(t, err, ErrUnsupported)
+	})
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// fileEntry is a file of the torrent's content that is open for reading and writing.
+type fileEntry struct {
+	path   string   // where the file is stored
+	offset int64    // offset of the file within the content
+	length int64    // length of the file in bytes
+	handle *os.File // the open file
+}
+
+// FileStorage stores the torrent's content in files on disk: a single file for single-file torrents,
+// or a directory holding the torrent's files for multi-file torrents.
+// Files are created as needed and sized to their final length up front, which leaves them sparse until they
+// are preallocated; existing files keep their data.
+type FileStorage struct {
+	layout layout
+	files  []*fileEntry // ordered by offset
+	pieces *pieceSet    // pieces marked as complete
+}
+
+// NewFile creates a storage that keeps content of `length` bytes, split into pieces of `pieceLength` bytes,
+// in the file at `path`.
+// Returns an error if the file could not be opened or sized.
+func NewFile(path string, pieceLength int, length int64) (*FileStorage, error) {
+	return openFiles(pieceLength, []*fileEntry{{path: path, length: length}})
+}
+
+// NewDir creates a storage that keeps the given files, split into pieces of `pieceLength` bytes,
+// in the directory at `dir`. Missing directories are created along the way.
+// Returns an error if a file's path leads outside of `dir`, or a file could not be opened or sized.
+func NewDir(dir string, pieceLength int, files []File) (*FileStorage, error) {
+	var entries, err = localEntries(dir, files)
+	if err != nil {
+		return nil, err
+	}
+
+	return openFiles(pieceLength, entries)
+}
+
+// openFiles lays out the files one after the other and opens them.
+func openFiles(pieceLength int, entries []*fileEntry) (*FileStorage, error) {
+	var length, err = openEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var l = layout{pieceLength: pieceLength, length: length}
+	return &FileStorage{layout: l, files: entries, pieces: newPieceSet(l.numPieces())}, nil
+}
+
+// openEntries lays out the files one after the other and opens them, creating missing directories along the way.
+// It returns the combined length of the files. On failure the files opened so far are closed again.
+func openEntries(entries []*fileEntry) (int64, error) {
+	var length int64
+	var err error
+	for _, entry := range entries {
+		entry.offset = length
+		length += entry.length
+
+		err = os.MkdirAll(filepath.Dir(entry.path), 0755)
+		if err != nil {
+			goto closeFiles
+		}
+
+		entry.handle, err = openSized(entry.path, entry.length)
+		if err != nil {
+			goto closeFiles
+		}
+	}
+
+	return length, nil
+
+closeFiles:
+	for _, entry := range entries {
+		if entry.handle != nil {
+			entry.handle.Close()
+		}
+	}
+
+	return 0, err
+}
+
+// localEntries turns the files of a multi-file torrent into entries for files in `dir`.
+// Returns an error if a file's path leads outside of `dir`.
+func localEntries(dir string, files []File) ([]*fileEntry, error) {
+	var entries = make([]*fileEntry, len(files))
+	for i, file := range files {
+		if !filepath.IsLocal(file.Path) {
+			return nil, fmt.Errorf("file path %q leads outside of the torrent's directory", file.Path)
+		}
+
+		entries[i] = &fileEntry{path: filepath.Join(dir, file.Path), length: file.Length}
+	}
+
+	return entries, nil
+}
+
+// openSized opens the file at `path` for reading and writing, creating it if needed, and sizes it to `length` bytes.
+func openSized(path string, length int64) (*os.File, error) {
+	var file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	var info os.FileInfo
+	info, err = file.Stat()
+	if err == nil && info.Size() != length {
+		err = file.Truncate(length)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// eachSpan calls `fn` for every file the `n` bytes at offset `off` of the content fall into, in order,
+// with the offset within that file and the range of the bytes that fall into it.
+// `files` must be ordered by offset. It stops at the first error `fn` returns.
+func eachSpan(files []*fileEntry, off int64, n int, fn func(entry *fileEntry, fileOff int64, lo, hi int) error) error {
+	var first = sort.Search(len(files), func(i int) bool {
+		var entry = files[i]
+		return entry.offset+entry.length > off
+	})
+
+	var done int
+	for i := first; i < len(files) && done < n; i++ {
+		var entry = files[i]
+		var fileOff = off + int64(done) - entry.offset
+		var size = int(min(int64(n-done), entry.length-fileOff))
+
+		var err = fn(entry, fileOff, done, done+size)
+		if err != nil {
+			return err
+		}
+
+		done += size
+	}
+
+	return nil
+}
+
+// ReadBlock reads len(buf) bytes starting at offset `begin` of the piece at `index` into `buf`.
+// Returns an error wrapping ErrOutOfBounds if the block doesn't lie within the content, or the error
+// that occurred while reading the files.
+func (storage *FileStorage) ReadBlock(index, begin int, buf []byte) error {
+	var off, err = storage.layout.offset(index, begin, len(buf))
+	if err != nil {
+		return err
+	}
+
+	return eachSpan(storage.files, off, len(buf), func(entry *fileEntry, fileOff int64, lo, hi int) error {
+		var _, err = entry.handle.ReadAt(buf[lo:hi], fileOff)
+		return err
+	})
+}
+
+// WriteBlock writes `data` starting at offset `begin` of the piece at `index`.
+// Returns an error wrapping ErrOutOfBounds if the block doesn't lie within the content, an error wrapping
+// ErrNoSpace if the disk is full, or the error that occurred while writing the files.
+func (storage *FileStorage) WriteBlock(index, begin int, data []byte) error {
+	var off, err = storage.layout.offset(index, begin, len(data))
+	if err != nil {
+		return err
+	}
+
+	return eachSpan(storage.files, off, len(data), func(entry *fileEntry, fileOff int64, lo, hi int) error {
+		var _, err = entry.handle.WriteAt(data[lo:hi], fileOff)
+		return noSpace(err)
+	})
+}
+
+// WriteAt writes `data` at offset `off` of the content, across as many files as it spans.
+// Returns an error wrapping ErrOutOfBounds if the data doesn't lie within the content, an error wrapping
+// ErrNoSpace if the disk is full, or the error that occurred while writing the files.
+func (storage *FileStorage) WriteAt(data []byte, off int64) (int, error) {
+	var err = storage.layout.check(off, len(data))
+	if err != nil {
+		return 0, err
+	}
+
+	err = eachSpan(storage.files, off, len(data), func(entry *fileEntry, fileOff int64, lo, hi int) error {
+		var _, err = entry.handle.WriteAt(data[lo:hi], fileOff)
+		return noSpace(err)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// MarkComplete records that the piece at `index` has been written in full and verified.
+func (storage *FileStorage) MarkComplete(index int) error {
+	return storage.pieces.mark(index)
+}
+
+// IsComplete reports whether the piece at `index` has been marked as complete.
+func (storage *FileStorage) IsComplete(index int) bool {
+	return storage.pieces.has(index)
+}
+
+// Flush commits the content of the files to disk.
+func (storage *FileStorage) Flush() error {
+	var errs []error
+	for _, entry := range storage.files {
+		errs = append(errs, noSpace(entry.handle.Sync()))
+	}
+
+	return errors.Join(errs...)
+}
+
+// CheckSpace returns an error wrapping ErrNoSpace if the disk doesn't have room for the parts of the
+// files that don't take up disk space yet, e.g. because they are sparse.
+// The files are expected to be on the same disk.
+func (storage *FileStorage) CheckSpace() error {
+	return checkSpace(storage.files)
+}
+
+// Preallocate reserves the disk space of the files according to `mode`, leaving the data in them untouched.
+// Full preallocation uses fallocate on Linux; elsewhere files are left sparse.
+// Returns an error wrapping ErrNoSpace if the disk is too full for the files.
+func (storage *FileStorage) Preallocate(mode Preallocation) error {
+	return preallocate(storage.files, mode)
+}
+
+// Close flushes the files and closes them.
+func (storage *FileStorage) Close() error {
+	var errs = []error{storage.Flush()}
+	for _, entry := range storage.files {
+		errs = append(errs, entry.handle.Close())
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFile(t *testing.T) {
+	/*
+		test cases:
+		1. the file is created with the content's length
+		2. blocks written are read back and end up in the file
+		3. existing content of the right size is kept
+	*/
+
+	t.Run("the file is created with the content's length", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "out")
+		var storage, err = NewFile(path, 4, 10)
+		require.Nil(t, err)
+		assert.Nil(t, storage.Close())
+
+		var info os.FileInfo
+		info, err = os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(10), info.Size())
+	})
+
+	t.Run("blocks written are read back and end up in the file", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "out")
+		var storage, err = NewFile(path, 4, 10)
+		require.Nil(t, err)
+
+		assert.Nil(t, storage.WriteBlock(0, 0, []byte("abcd")))
+		assert.Nil(t, storage.WriteBlock(1, 0, []byte("efgh")))
+		assert.Nil(t, storage.WriteBlock(2, 0, []byte("ij")))
+		assert.ErrorIs(t, storage.WriteBlock(2, 0, []byte("ijk")), ErrOutOfBounds)
+
+		var buf = make([]byte, 2)
+		assert.Nil(t, storage.ReadBlock(1, 1, buf))
+		assert.Equal(t, []byte("fg"), buf)
+		assert.Nil(t, storage.Close())
+
+		var got []byte
+		got, err = os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("abcdefghij"), got)
+	})
+
+	t.Run("existing content of the right size is kept", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "out")
+		require.Nil(t, os.WriteFile(path, []byte("abcdefghij"), 0644))
+
+		var storage, err = NewFile(path, 4, 10)
+		require.Nil(t, err)
+		defer storage.Close()
+
+		var buf = make([]byte, 4)
+		assert.Nil(t, storage.ReadBlock(1, 0, buf))
+		assert.Equal(t, []byte("efgh"), buf)
+	})
+}
+
+func TestNewDir(t *testing.T) {
+	/*
+		test cases:
+		1. blocks spanning several files are split across them
+		2. empty files are created
+		3. paths leading outside of the directory are rejected
+		4. pieces are marked as complete
+	*/
+
+	var files = []File{
+		{Path: "a.txt", Length: 3},
+		{Path: filepath.Join("sub", "empty"), Length: 0},
+		{Path: filepath.Join("sub", "b.txt"), Length: 5},
+		{Path: "c.txt", Length: 2},
+	}
+
+	t.Run("blocks spanning several files are split across them", func(t *testing.T) {
+		var dir = t.TempDir()
+		var storage, err = NewDir(dir, 4, files)
+		require.Nil(t, err)
+
+		assert.Nil(t, storage.WriteBlock(0, 0, []byte("abcd")))
+		assert.Nil(t, storage.WriteBlock(1, 0, []byte("efgh")))
+		assert.Nil(t, storage.WriteBlock(2, 0, []byte("ij")))
+
+		// a block reaching from the first file into the last one
+		var buf = make([]byte, 8)
+		assert.Nil(t, storage.ReadBlock(0, 2, buf[:2]))
+		assert.Nil(t, storage.ReadBlock(1, 0, buf[2:6]))
+		assert.Nil(t, storage.ReadBlock(2, 0, buf[6:]))
+		assert.Equal(t, []byte("cdefghij"), buf)
+		assert.Nil(t, storage.Close())
+
+		for path, expected := range map[string]string{"a.txt": "abc", "sub/b.txt": "defgh", "c.txt": "ij"} {
+			var got []byte
+			got, err = os.ReadFile(filepath.Join(dir, path))
+			assert.Nil(t, err)
+			assert.Equal(t, expected, string(got))
+		}
+	})
+
+	t.Run("empty files are created", func(t *testing.T) {
+		var dir = t.TempDir()
+		var storage, err = NewDir(dir, 4, files)
+		require.Nil(t, err)
+		assert.Nil(t, storage.Close())
+
+		var info os.FileInfo
+		info, err = os.Stat(filepath.Join(dir, "sub", "empty"))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), info.Size())
+	})
+
+	t.Run("paths leading outside of the directory are rejected", func(t *testing.T) {
+		var dir = t.TempDir()
+		var _, err = NewDir(dir, 4, []File{{Path: filepath.Join("..", "escape"), Length: 1}})
+		assert.NotNil(t, err)
+
+		_, err = NewDir(dir, 4, []File{{Path: "/etc/passwd", Length: 1}})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("pieces are marked as complete", func(t *testing.T) {
+		var storage, err = NewDir(t.TempDir(), 4, files)
+		require.Nil(t, err)
+		defer storage.Close()
+
+		assert.Nil(t, storage.MarkComplete(1))
+		assert.True(t, storage.IsComplete(1))
+		assert.False(t, storage.IsComplete(0))
+		assert.ErrorIs(t, storage.MarkComplete(3), ErrOutOfBounds)
+	})
+}
@@ -0,0 +1,94 @@
+package storage
+
+import "sync"
+
+// Memory is a storage that keeps the torrent's content in memory.
+// It is meant for small torrents, tests and content that is processed right after it is downloaded.
+type Memory struct {
+	mu     sync.RWMutex
+	layout layout
+	data   []byte
+	pieces *pieceSet // pieces marked as complete
+}
+
+// NewMemory creates an in-memory storage for content of `length` bytes split into pieces of `pieceLength` bytes.
+func NewMemory(pieceLength int, length int64) *Memory {
+	var l = layout{pieceLength: pieceLength, length: length}
+	return &Memory{
+		layout: l,
+		data:   make([]byte, length),
+		pieces: newPieceSet(l.numPieces()),
+	}
+}
+
+// ReadBlock reads len(buf) bytes starting at offset `begin` of the piece at `index` into `buf`.
+// Returns an error wrapping ErrOutOfBounds if the block doesn't lie within the content.
+func (memory *Memory) ReadBlock(index, begin int, buf []byte) error {
+	var off, err = memory.layout.offset(index, begin, len(buf))
+	if err != nil {
+		return err
+	}
+
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+
+	copy(buf, memory.data[off:])
+	return nil
+}
+
+// WriteBlock writes `data` starting at offset `begin` of the piece at `index`.
+// Returns an error wrapping ErrOutOfBounds if the block doesn't lie within the content.
+func (memory *Memory) WriteBlock(index, begin int, data []byte) error {
+	var off, err = memory.layout.offset(index, begin, len(data))
+	if err != nil {
+		return err
+	}
+
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	copy(memory.data[off:], data)
+	return nil
+}
+
+// WriteAt writes `data` at offset `off` of the content.
+// Returns an error wrapping ErrOutOfBounds if the data doesn't lie within the content.
+func (memory *Memory) WriteAt(data []byte, off int64) (int, error) {
+	var err = memory.layout.check(off, len(data))
+	if err != nil {
+		return 0, err
+	}
+
+	memory.mu.Lock()
+	defer memory.mu.Unlock()
+
+	return copy(memory.data[off:], data), nil
+}
+
+// MarkComplete records that the piece at `index` has been written in full and verified.
+func (memory *Memory) MarkComplete(index int) error {
+	return memory.pieces.mark(index)
+}
+
+// IsComplete reports whether the piece at `index` has been marked as complete.
+func (memory *Memory) IsComplete(index int) bool {
+	return memory.pieces.has(index)
+}
+
+// Flush does nothing, as there is nothing to flush memory to.
+func (memory *Memory) Flush() error {
+	return nil
+}
+
+// Close does nothing. The content stays available through Bytes.
+func (memory *Memory) Close() error {
+	return nil
+}
+
+// Bytes returns a copy of the torrent's content.
+func (memory *Memory) Bytes() []byte {
+	memory.mu.RLock()
+	defer memory.mu.RUnlock()
+
+	return append([]byte(nil), memory.data...)
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	/*
+		test cases:
+		1. blocks written are read back
+		2. blocks outside of the content are rejected
+		3. pieces are marked as complete
+	*/
+
+	t.Run("blocks written are read back", func(t *testing.T) {
+		var memory = NewMemory(4, 10)
+
+		assert.Nil(t, memory.WriteBlock(0, 0, []byte("abcd")))
+		assert.Nil(t, memory.WriteBlock(2, 0, []byte("ij")))
+		assert.Nil(t, memory.WriteBlock(1, 2, []byte("gh")))
+
+		var buf = make([]byte, 3)
+		assert.Nil(t, memory.ReadBlock(0, 1, buf))
+		assert.Equal(t, []byte("bcd"), buf)
+		assert.Equal(t, []byte("abcd\x00\x00ghij"), memory.Bytes())
+	})
+
+	t.Run("blocks outside of the content are rejected", func(t *testing.T) {
+		var memory = NewMemory(4, 10)
+
+		assert.ErrorIs(t, memory.WriteBlock(2, 0, []byte("xyz")), ErrOutOfBounds)
+		assert.ErrorIs(t, memory.WriteBlock(0, 2, []byte("xyz")), ErrOutOfBounds)
+		assert.ErrorIs(t, memory.ReadBlock(-1, 0, make([]byte, 1)), ErrOutOfBounds)
+		assert.ErrorIs(t, memory.ReadBlock(3, 0, make([]byte, 1)), ErrOutOfBounds)
+	})
+
+	t.Run("pieces are marked as complete", func(t *testing.T) {
+		var memory = NewMemory(4, 10)
+
+		assert.False(t, memory.IsComplete(2))
+		assert.Nil(t, memory.MarkComplete(2))
+		assert.True(t, memory.IsComplete(2))
+		assert.False(t, memory.IsComplete(1))
+
+		assert.ErrorIs(t, memory.MarkComplete(3), ErrOutOfBounds)
+		assert.Nil(t, memory.Flush())
+		assert.Nil(t, memory.Close())
+	})
+}
@@ -0,0 +1,404 @@
+//go:build linux
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	DefaultSegmentSize = 64 << 20 // bytes of a file mapped at once
+	DefaultMaxSegments = 16       // segments mapped at once before the least recently used ones are unmapped
+)
+
+// MmapConfig controls how much of the files a MmapStorage maps into memory.
+// Zero values are replaced by DefaultSegmentSize and DefaultMaxSegments.
+type MmapConfig struct {
+	SegmentSize int64 // bytes of a file mapped at once, rounded up to a multiple of the page size
+	MaxSegments int   // segments mapped at once, which bounds the address space used
+}
+
+// withDefaults returns the config with its zero values replaced by the defaults and its segment size page aligned.
+func (config MmapConfig) withDefaults() MmapConfig {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = DefaultSegmentSize
+	}
+	if config.MaxSegments <= 0 {
+		config.MaxSegments = DefaultMaxSegments
+	}
+
+	var pageSize = int64(os.Getpagesize())
+	config.SegmentSize = (config.SegmentSize + pageSize - 1) / pageSize * pageSize
+
+	return config
+}
+
+// segment is a mapped window of a file.
+type segment struct {
+	data    []byte // the mapped bytes
+	refs    int    // number of reads and writes using the mapping
+	lastUse uint64 // value of the storage's clock when the segment was last used
+}
+
+// segmentKey identifies a segment: the file it belongs to and its index within the file.
+type segmentKey struct {
+	entry *fileEntry
+	index int64
+}
+
+// MmapStorage stores the torrent's content in files on disk like FileStorage, but reads and writes them
+// through memory mappings, which saves a copy and a system call per block on read-heavy workloads.
+// Files are mapped lazily in segments of a fixed size, and the least recently used segments are unmapped
+// once more than the configured number are mapped, so files larger than the address space can be stored.
+// Completed pieces are synced to disk with msync.
+type MmapStorage struct {
+	layout layout
+	files  []*fileEntry // ordered by offset
+	pieces *pieceSet    // pieces marked as complete
+	config MmapConfig
+
+	mu       sync.Mutex
+	segments map[segmentKey]*segment // segments that are mapped
+	clock    uint64                  // incremented on every use of a segment
+}
+
+// NewMmapFile creates a memory-mapped storage that keeps content of `length` bytes, split into pieces of
+// `pieceLength` bytes, in the file at `path`.
+// Returns an error if the file could not be opened or sized.
+func NewMmapFile(path string, pieceLength int, length int64, config MmapConfig) (*MmapStorage, error) {
+	return openMmap(pieceLength, []*fileEntry{{path: path, length: length}}, config)
+}
+
+// openMmapFile creates a memory-mapped storage with the default config in the file at `path`, see OpenFile.
+func openMmapFile(path string, pieceLength int, length int64) (Storage, error) {
+	var store, err = NewMmapFile(path, pieceLength, length, MmapConfig{})
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// NewMmapDir creates a memory-mapped storage that keeps the given files, split into pieces of `pieceLength`
+// bytes, in the directory at `dir`. Missing directories are created along the way.
+// Returns an error if a file's path leads outside of `dir`, or a file could not be opened or sized.
+func NewMmapDir(dir string, pieceLength int, files []File, config MmapConfig) (*MmapStorage, error) {
+	var entries, err = localEntries(dir, files)
+	if err != nil {
+		return nil, err
+	}
+
+	return openMmap(pieceLength, entries, config)
+}
+
+// openMmap lays out the files one after the other and opens them. Nothing is mapped until it is used.
+func openMmap(pieceLength int, entries []*fileEntry, config MmapConfig) (*MmapStorage, error) {
+	var length, err = openEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var l = layout{pieceLength: pieceLength, length: length}
+	return &MmapStorage{
+		layout:   l,
+		files:    entries,
+		pieces:   newPieceSet(l.numPieces()),
+		config:   config.withDefaults(),
+		segments: make(map[segmentKey]*segment),
+	}, nil
+}
+
+// acquire returns the segment at `index` of the file, mapping it if needed, and holds on to it until released.
+// If too many segments are mapped, the least recently used one nobody holds on to is unmapped first.
+func (storage *MmapStorage) acquire(entry *fileEntry, index int64) (*segment, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.clock++
+
+	var key = segmentKey{entry: entry, index: index}
+	var seg = storage.segments[key]
+	if seg == nil {
+		if len(storage.segments) >= storage.config.MaxSegments {
+			storage.evict()
+		}
+
+		var start = index * storage.config.SegmentSize
+		var length = min(storage.config.SegmentSize, entry.length-start)
+
+		var data, err = syscall.Mmap(int(entry.handle.Fd()), start, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			return nil, &os.PathError{Op: "mmap", Path: entry.path, Err: err}
+		}
+
+		seg = &segment{data: data}
+		storage.segments[key] = seg
+	}
+
+	seg.refs++
+	seg.lastUse = storage.clock
+	return seg, nil
+}
+
+// release lets go of a segment returned by acquire.
+func (storage *MmapStorage) release(seg *segment) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	seg.refs--
+}
+
+// evict unmaps the least recently used segment nobody holds on to. Unmapping a shared mapping
+// leaves its changes in the page cache, so nothing written is lost.
+// The caller must hold the storage's lock.
+func (storage *MmapStorage) evict() {
+	var oldest segmentKey
+	var found bool
+	for key, seg := range storage.segments {
+		if seg.refs != 0 {
+			continue
+		}
+
+		if !found || seg.lastUse < storage.segments[oldest].lastUse {
+			oldest = key
+			found = true
+		}
+	}
+
+	// every segment is in use, so go over the limit for a while
+	if !found {
+		return
+	}
+
+	syscall.Munmap(storage.segments[oldest].data)
+	delete(storage.segments, oldest)
+}
+
+// copyAt copies between `buf` and the file at offset `fileOff`, segment by segment.
+// Data is copied into the file if `write` is set, and out of it otherwise.
+// Returns an error wrapping ErrNoSpace if the disk is too full to write to a sparse part of the file.
+func (storage *MmapStorage) copyAt(entry *fileEntry, fileOff int64, buf []byte, write bool) error {
+	for len(buf) != 0 {
+		var index = fileOff / storage.config.SegmentSize
+		var seg, err = storage.acquire(entry, index)
+		if err != nil {
+			return err
+		}
+
+		var segOff = fileOff - index*storage.config.SegmentSize
+		var n int
+		if write {
+			n, err = copyIn(seg.data[segOff:], buf)
+		} else {
+			n = copy(buf, seg.data[segOff:])
+		}
+		storage.release(seg)
+
+		if err != nil {
+			return &os.PathError{Op: "write", Path: entry.path, Err: err}
+		}
+
+		buf = buf[n:]
+		fileOff += int64(n)
+	}
+
+	return nil
+}
+
+// copyIn copies `buf` into the mapped bytes `data`. Writing to a sparse part of a file makes the kernel
+// allocate disk space for it, and when there is none the write faults. The fault is turned into an error
+// wrapping ErrNoSpace rather than crashing the program.
+func copyIn(data, buf []byte) (n int, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		var r = recover()
+		if r == nil {
+			return
+		}
+
+		// faults carry the address they happened at; anything else is a bug
+		var _, fault = r.(interface{ Addr() uintptr })
+		if !fault {
+			panic(r)
+		}
+
+		err = fmt.Errorf("%w: %v", ErrNoSpace, r)
+	}()
+
+	return copy(data, buf), nil
+}
+
+// ReadBlock reads len(buf) bytes starting at offset `begin` of the piece at `index` into `buf`.
+// Returns an error wrapping ErrOutOfBounds if the block doesn't lie within the content, or the error
+// that occurred while mapping the files.
+func (storage *MmapStorage) ReadBlock(index, begin int, buf []byte) error {
+	var off, err = storage.layout.offset(index, begin, len(buf))
+	if err != nil {
+		return err
+	}
+
+	return eachSpan(storage.files, off, len(buf), func(entry *fileEntry, fileOff int64, lo, hi int) error {
+		return storage.copyAt(entry, fileOff, buf[lo:hi], false)
+	})
+}
+
+// WriteBlock writes `data` starting at offset `begin` of the piece at `index`.
+// Returns an error wrapping ErrOutOfBounds if the block doesn't lie within the content, an error wrapping
+// ErrNoSpace if the disk is full, or the error that occurred while mapping the files.
+func (storage *MmapStorage) WriteBlock(index, begin int, data []byte) error {
+	var off, err = storage.layout.offset(index, begin, len(data))
+	if err != nil {
+		return err
+	}
+
+	return eachSpan(storage.files, off, len(data), func(entry *fileEntry, fileOff int64, lo, hi int) error {
+		return storage.copyAt(entry, fileOff, data[lo:hi], true)
+	})
+}
+
+// WriteAt writes `data` at offset `off` of the content, across as many files and segments as it spans.
+// Returns an error wrapping ErrOutOfBounds if the data doesn't lie within the content, an error wrapping
+// ErrNoSpace if the disk is full, or the error that occurred while mapping the files.
+func (storage *MmapStorage) WriteAt(data []byte, off int64) (int, error) {
+	var err = storage.layout.check(off, len(data))
+	if err != nil {
+		return 0, err
+	}
+
+	err = eachSpan(storage.files, off, len(data), func(entry *fileEntry, fileOff int64, lo, hi int) error {
+		return storage.copyAt(entry, fileOff, data[lo:hi], true)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// MarkComplete syncs the piece at `index` to disk and records that it has been written in full and verified.
+// The parts of the piece that are still mapped are synced with msync, and the files holding parts that
+// have been unmapped in the meantime are synced as a whole.
+func (storage *MmapStorage) MarkComplete(index int) error {
+	var off, err = storage.layout.offset(index, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	var length = min(int64(storage.layout.pieceLength), storage.layout.length-off)
+	err = eachSpan(storage.files, off, int(length), func(entry *fileEntry, fileOff int64, lo, hi int) error {
+		return storage.syncRange(entry, fileOff, int64(hi-lo))
+	})
+	if err != nil {
+		return err
+	}
+
+	return storage.pieces.mark(index)
+}
+
+// syncRange syncs `n` bytes at offset `fileOff` of the file to disk.
+func (storage *MmapStorage) syncRange(entry *fileEntry, fileOff, n int64) error {
+	var pageSize = int64(os.Getpagesize())
+	for end := fileOff + n; fileOff < end; {
+		var index = fileOff / storage.config.SegmentSize
+		var segStart = index * storage.config.SegmentSize
+		var segEnd = min(segStart+storage.config.SegmentSize, end)
+
+		storage.mu.Lock()
+		var seg = storage.segments[segmentKey{entry: entry, index: index}]
+		if seg != nil {
+			seg.refs++
+		}
+		storage.mu.Unlock()
+
+		if seg == nil {
+			// the changes went to the page cache when the segment was unmapped
+			return entry.handle.Sync()
+		}
+
+		// msync wants a page aligned address
+		var from = (fileOff - segStart) / pageSize * pageSize
+		var err = msync(seg.data[from : segEnd-segStart])
+		storage.release(seg)
+		if err != nil {
+			return &os.PathError{Op: "msync", Path: entry.path, Err: err}
+		}
+
+		fileOff = segEnd
+	}
+
+	return nil
+}
+
+// IsComplete reports whether the piece at `index` has been marked as complete.
+func (storage *MmapStorage) IsComplete(index int) bool {
+	return storage.pieces.has(index)
+}
+
+// Flush syncs every mapped segment and the files to disk.
+func (storage *MmapStorage) Flush() error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var errs []error
+	for _, seg := range storage.segments {
+		errs = append(errs, msync(seg.data))
+	}
+
+	for _, entry := range storage.files {
+		errs = append(errs, entry.handle.Sync())
+	}
+
+	return errors.Join(errs...)
+}
+
+// CheckSpace returns an error wrapping ErrNoSpace if the disk doesn't have room for the parts of the
+// files that don't take up disk space yet, e.g. because they are sparse.
+// The files are expected to be on the same disk.
+func (storage *MmapStorage) CheckSpace() error {
+	return checkSpace(storage.files)
+}
+
+// Preallocate reserves the disk space of the files according to `mode`, leaving the data in them untouched.
+// With full preallocation, writes to the mapped files can't run out of disk space later on.
+// Returns an error wrapping ErrNoSpace if the disk is too full for the files.
+func (storage *MmapStorage) Preallocate(mode Preallocation) error {
+	return preallocate(storage.files, mode)
+}
+
+// Close flushes the storage, unmaps every segment and closes the files.
+func (storage *MmapStorage) Close() error {
+	var errs = []error{storage.Flush()}
+
+	storage.mu.Lock()
+	for key, seg := range storage.segments {
+		errs = append(errs, syscall.Munmap(seg.data))
+		delete(storage.segments, key)
+	}
+	storage.mu.Unlock()
+
+	for _, entry := range storage.files {
+		errs = append(errs, entry.handle.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// msync synchronously writes the changes to the mapped bytes back to their file.
+func msync(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var _, _, errno = syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
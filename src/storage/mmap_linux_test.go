@@ -0,0 +1,169 @@
+//go:build linux
+
+package storage
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMmapStorage(t *testing.T) {
+	/*
+		test cases:
+		1. blocks written are read back and end up in the file
+		2. blocks crossing segments and files are split across them
+		3. segments are unmapped once too many are mapped
+		4. completed pieces are synced and marked
+	*/
+
+	var pageSize = int64(os.Getpagesize())
+
+	t.Run("blocks written are read back and end up in the file", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "out")
+		var storage, err = NewMmapFile(path, 4, 10, MmapConfig{})
+		require.Nil(t, err)
+
+		assert.Nil(t, storage.WriteBlock(0, 0, []byte("abcd")))
+		assert.Nil(t, storage.WriteBlock(1, 0, []byte("efgh")))
+		assert.Nil(t, storage.WriteBlock(2, 0, []byte("ij")))
+		assert.ErrorIs(t, storage.WriteBlock(2, 0, []byte("ijk")), ErrOutOfBounds)
+
+		var buf = make([]byte, 2)
+		assert.Nil(t, storage.ReadBlock(1, 1, buf))
+		assert.Equal(t, []byte("fg"), buf)
+		assert.Nil(t, storage.Close())
+
+		var got []byte
+		got, err = os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("abcdefghij"), got)
+	})
+
+	t.Run("blocks crossing segments and files are split across them", func(t *testing.T) {
+		var dir = t.TempDir()
+		var files = []File{{Path: "a", Length: 3*pageSize + 100}, {Path: "b", Length: 0}, {Path: "c", Length: 2 * pageSize}}
+		var length = 5*pageSize + 100
+		var pieceLength = int(pageSize)
+
+		var storage, err = NewMmapDir(dir, pieceLength, files, MmapConfig{SegmentSize: pageSize, MaxSegments: 2})
+		require.Nil(t, err)
+
+		var data = make([]byte, length)
+		rand.New(rand.NewSource(1)).Read(data)
+		for index := 0; index*pieceLength < len(data); index++ {
+			var end = min((index+1)*pieceLength, len(data))
+			assert.Nil(t, storage.WriteBlock(index, 0, data[index*pieceLength:end]))
+		}
+
+		// the piece holding the end of the first file and the start of the last one
+		var buf = make([]byte, pieceLength)
+		assert.Nil(t, storage.ReadBlock(3, 0, buf))
+		assert.Equal(t, data[3*pieceLength:4*pieceLength], buf)
+		assert.Nil(t, storage.Close())
+
+		var got []byte
+		got, err = os.ReadFile(filepath.Join(dir, "a"))
+		assert.Nil(t, err)
+		assert.Equal(t, data[:3*pageSize+100], got)
+
+		got, err = os.ReadFile(filepath.Join(dir, "c"))
+		assert.Nil(t, err)
+		assert.Equal(t, data[3*pageSize+100:], got)
+	})
+
+	t.Run("segments are unmapped once too many are mapped", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "out")
+		var storage, err = NewMmapFile(path, int(pageSize), 8*pageSize, MmapConfig{SegmentSize: pageSize, MaxSegments: 3})
+		require.Nil(t, err)
+		defer storage.Close()
+
+		var block = make([]byte, pageSize)
+		for index := 0; index != 8; index++ {
+			block[0] = byte(index)
+			assert.Nil(t, storage.WriteBlock(index, 0, block))
+			assert.LessOrEqual(t, len(storage.segments), 3)
+		}
+
+		// unmapped segments are mapped again when they are needed
+		for index := 0; index != 8; index++ {
+			assert.Nil(t, storage.ReadBlock(index, 0, block))
+			assert.Equal(t, byte(index), block[0])
+		}
+	})
+
+	t.Run("completed pieces are synced and marked", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "out")
+		var storage, err = NewMmapFile(path, int(pageSize), 4*pageSize, MmapConfig{SegmentSize: pageSize, MaxSegments: 1})
+		require.Nil(t, err)
+		defer storage.Close()
+
+		var block = make([]byte, pageSize)
+		assert.Nil(t, storage.WriteBlock(0, 0, block))
+		assert.Nil(t, storage.WriteBlock(1, 0, block))
+
+		// piece #0 has been unmapped by now, piece #1 is still mapped
+		assert.Nil(t, storage.MarkComplete(0))
+		assert.Nil(t, storage.MarkComplete(1))
+		assert.True(t, storage.IsComplete(0))
+		assert.True(t, storage.IsComplete(1))
+		assert.False(t, storage.IsComplete(2))
+		assert.ErrorIs(t, storage.MarkComplete(4), ErrOutOfBounds)
+	})
+}
+
+// benchmarkStorage writes a 64 MiB torrent in 16 KiB blocks and then reads it back, if `read` is set.
+func benchmarkStorage(b *testing.B, open func(path string) (Storage, error), read bool) {
+	const pieceLength = 256 << 10
+	const blockLength = 16 << 10
+	const length = 64 << 20
+
+	var path = filepath.Join(b.TempDir(), "out")
+	var storage, err = open(path)
+	require.Nil(b, err)
+	defer storage.Close()
+
+	var block = make([]byte, blockLength)
+	rand.New(rand.NewSource(1)).Read(block)
+	for off := 0; off < length; off += blockLength {
+		require.Nil(b, storage.WriteBlock(off/pieceLength, off%pieceLength, block))
+	}
+
+	b.SetBytes(length)
+	b.ResetTimer()
+	for i := 0; i != b.N; i++ {
+		for off := 0; off < length; off += blockLength {
+			if read {
+				err = storage.ReadBlock(off/pieceLength, off%pieceLength, block)
+			} else {
+				err = storage.WriteBlock(off/pieceLength, off%pieceLength, block)
+			}
+
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkWriteBlock(b *testing.B) {
+	b.Run("WriteAt", func(b *testing.B) {
+		benchmarkStorage(b, func(path string) (Storage, error) { return NewFile(path, 256<<10, 64<<20) }, false)
+	})
+	b.Run("mmap", func(b *testing.B) {
+		benchmarkStorage(b, func(path string) (Storage, error) { return NewMmapFile(path, 256<<10, 64<<20, MmapConfig{}) }, false)
+	})
+}
+
+func BenchmarkReadBlock(b *testing.B) {
+	b.Run("ReadAt", func(b *testing.B) {
+		benchmarkStorage(b, func(path string) (Storage, error) { return NewFile(path, 256<<10, 64<<20) }, true)
+	})
+	b.Run("mmap", func(b *testing.B) {
+		benchmarkStorage(b, func(path string) (Storage, error) { return NewMmapFile(path, 256<<10, 64<<20, MmapConfig{}) }, true)
+	})
+}
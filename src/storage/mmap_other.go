@@ -0,0 +1,8 @@
+//go:build !linux
+
+package storage
+
+// openMmapFile reports that memory-mapped storages aren't available here.
+func openMmapFile(path string, pieceLength int, length int64) (Storage, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrNoSpace is returned when the disk doesn't have room for the content of a storage.
+var ErrNoSpace = errors.New("not enough free disk space")
+
+// Preallocation tells how the disk space of a storage's files is reserved.
+type Preallocation int
+
+const (
+	PreallocateSparse Preallocation = iota // files are sized up front, but disk space is only used as data is written
+	PreallocateFull                        // all of the disk space is reserved up front, which keeps the files from fragmenting
+)
+
+// ParsePreallocation returns the preallocation mode with the given name, "sparse" or "full".
+// Returns an error if there is no such mode.
+func ParsePreallocation(name string) (Preallocation, error) {
+	switch name {
+	case "sparse":
+		return PreallocateSparse, nil
+	case "full":
+		return PreallocateFull, nil
+	default:
+		return 0, fmt.Errorf("unknown preallocation mode %q, expected \"sparse\" or \"full\"", name)
+	}
+}
+
+// String returns the name of the preallocation mode.
+func (mode Preallocation) String() string {
+	switch mode {
+	case PreallocateSparse:
+		return "sparse"
+	case PreallocateFull:
+		return "full"
+	default:
+		return "unknown"
+	}
+}
+
+// Allocator is implemented by the storages that keep their content in files on disk,
+// which can make sure there is room for the content before it is written.
+type Allocator interface {
+	// CheckSpace returns an error wrapping ErrNoSpace if the disk doesn't have room for the parts of the
+	// content that don't take up disk space yet.
+	CheckSpace() error
+
+	// Preallocate reserves the disk space of the content according to `mode`.
+	Preallocate(mode Preallocation) error
+}
+
+// checkSpace returns an error wrapping ErrNoSpace if the disk holding the files doesn't have room for the parts
+// of them that don't take up disk space yet. The files are expected to be on the same disk.
+// It does nothing where the free disk space can't be looked up.
+func checkSpace(files []*fileEntry) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	var needed int64
+	for _, entry := range files {
+		var used, err = diskUsage(entry.handle)
+		if err != nil {
+			return err
+		}
+
+		needed += max(entry.length-used, 0)
+	}
+
+	var free, ok, err = freeSpace(filepath.Dir(files[0].path))
+	if err != nil || !ok {
+		return err
+	}
+
+	if needed > free {
+		return fmt.Errorf("%w: %d bytes are needed but only %d are available", ErrNoSpace, needed, free)
+	}
+
+	return nil
+}
+
+// preallocate reserves the disk space of the files according to `mode`.
+// Where files can't be preallocated, they are left sparse.
+func preallocate(files []*fileEntry, mode Preallocation) error {
+	if mode != PreallocateFull {
+		return nil
+	}
+
+	for _, entry := range files {
+		var err = allocate(entry.handle, entry.length)
+		if err != nil {
+			return fmt.Errorf("failed to preallocate %s: %w", entry.path, noSpace(err))
+		}
+	}
+
+	return nil
+}
+
+// noSpace wraps `err` in ErrNoSpace if it tells that the disk is full, and returns it as is otherwise.
+func noSpace(err error) error {
+	if errors.Is(err, syscall.ENOSPC) && !errors.Is(err, ErrNoSpace) {
+		return fmt.Errorf("%w: %w", ErrNoSpace, err)
+	}
+
+	return err
+}
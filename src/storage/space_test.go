@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePreallocation(t *testing.T) {
+	for _, mode := range []Preallocation{PreallocateSparse, PreallocateFull} {
+		var parsed, err = ParsePreallocation(mode.String())
+		assert.Nil(t, err)
+		assert.Equal(t, mode, parsed)
+	}
+
+	var _, err = ParsePreallocation("dense")
+	assert.NotNil(t, err)
+}
+
+func TestPreallocate(t *testing.T) {
+	/*
+		test cases:
+		1. sparse files don't take up the disk space of their content
+		2. full preallocation reserves the disk space and keeps the data
+		3. a disk without room for the content is reported
+		4. a full disk is told apart from other errors
+	*/
+
+	const length = 1 << 20
+
+	t.Run("sparse files don't take up the disk space of their content", func(t *testing.T) {
+		var storage, err = NewFile(filepath.Join(t.TempDir(), "out"), 1<<16, length)
+		require.Nil(t, err)
+		defer storage.Close()
+
+		assert.Nil(t, storage.Preallocate(PreallocateSparse))
+		assert.Nil(t, storage.CheckSpace())
+
+		var used int64
+		used, err = diskUsage(storage.files[0].handle)
+		assert.Nil(t, err)
+		assert.Less(t, used, int64(length))
+	})
+
+	t.Run("full preallocation reserves the disk space and keeps the data", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("files are only preallocated on Linux")
+		}
+
+		var path = filepath.Join(t.TempDir(), "out")
+		var storage, err = NewFile(path, 1<<16, length)
+		require.Nil(t, err)
+
+		require.Nil(t, storage.WriteBlock(0, 0, []byte("abcd")))
+		assert.Nil(t, storage.Preallocate(PreallocateFull))
+
+		var used int64
+		used, err = diskUsage(storage.files[0].handle)
+		assert.Nil(t, err)
+		assert.GreaterOrEqual(t, used, int64(length))
+		require.Nil(t, storage.Close())
+
+		var data []byte
+		data, err = os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("abcd"), data[:4])
+		assert.Len(t, data, length)
+	})
+
+	t.Run("a disk without room for the content is reported", func(t *testing.T) {
+		var dir = t.TempDir()
+		var free, ok, err = freeSpace(dir)
+		require.Nil(t, err)
+		if !ok {
+			t.Skip("the free disk space can't be looked up here")
+		}
+
+		var storage *FileStorage
+		storage, err = NewFile(filepath.Join(dir, "out"), 1<<16, free+1<<30)
+		if err != nil {
+			t.Skip("the file system doesn't take a sparse file that large")
+		}
+		defer storage.Close()
+
+		assert.ErrorIs(t, storage.CheckSpace(), ErrNoSpace)
+	})
+
+	t.Run("a full disk is told apart from other errors", func(t *testing.T) {
+		var full = &os.PathError{Op: "write", Path: "out", Err: syscall.ENOSPC}
+		assert.ErrorIs(t, noSpace(full), ErrNoSpace)
+		assert.ErrorIs(t, noSpace(full), syscall.ENOSPC)
+		assert.ErrorIs(t, noSpace(noSpace(full)), ErrNoSpace)
+
+		var other = &os.PathError{Op: "write", Path: "out", Err: syscall.EIO}
+		assert.Equal(t, other, noSpace(other))
+		assert.Nil(t, noSpace(nil))
+	})
+}
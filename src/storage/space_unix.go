@@ -0,0 +1,36 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskUsage returns the number of bytes of disk space the file takes up, which is less than
+// its size if the file is sparse.
+func diskUsage(file *os.File) (int64, error) {
+	var info, err = file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var stat, ok = info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size(), nil
+	}
+
+	// st_blocks is counted in 512-byte units whatever the block size of the file system
+	return int64(stat.Blocks) * 512, nil
+}
+
+// freeSpace returns the number of bytes available to unprivileged users on the disk holding `dir`.
+func freeSpace(dir string) (int64, bool, error) {
+	var stat syscall.Statfs_t
+	var err = syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), true, nil
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/winterrdog/lean-bit-torrent-client/bitfield"
+)
+
+// ErrOutOfBounds is returned when a block reaches past the end of the torrent's content.
+var ErrOutOfBounds = errors.New("block is out of bounds")
+
+// Storage holds the content of a torrent, addressed by piece index and the offset of a block within the piece.
+// Implementations must be safe for concurrent use.
+type Storage interface {
+	// ReadBlock reads len(buf) bytes starting at offset `begin` of the piece at `index` into `buf`.
+	ReadBlock(index, begin int, buf []byte) error
+
+	// WriteBlock writes `data` starting at offset `begin` of the piece at `index`.
+	WriteBlock(index, begin int, data []byte) error
+
+	// MarkComplete records that the piece at `index` has been written in full and verified.
+	MarkComplete(index int) error
+
+	// IsComplete reports whether the piece at `index` has been marked as complete.
+	IsComplete(index int) bool
+
+	// Flush makes sure everything written so far has reached the underlying storage.
+	Flush() error
+
+	// Close flushes the storage and releases its resources. The storage can't be used afterwards.
+	Close() error
+}
+
+// Every storage in this package also implements io.WriterAt, addressing the torrent's content as a whole.
+// That lets runs of adjacent pieces be written at once.
+
+// File is a file within the torrent's content. The content is the concatenation of the torrent's files.
+type File struct {
+	Path   string // path of the file, relative to the directory the torrent is stored in
+	Length int64  // length of the file in bytes
+}
+
+// layout maps piece blocks to offsets within the torrent's content.
+type layout struct {
+	pieceLength int   // length of every piece but the last one
+	length      int64 // length of the content
+}
+
+// offset returns the offset within the content of `n` bytes at offset `begin` of the piece at `index`.
+// Returns an error wrapping ErrOutOfBounds if the bytes don't lie within the content.
+func (l layout) offset(index, begin, n int) (int64, error) {
+	if index < 0 || begin < 0 || begin+n > l.pieceLength {
+		return 0, fmt.Errorf("%w: %d bytes at offset %d of piece #%d", ErrOutOfBounds, n, begin, index)
+	}
+
+	var off = int64(index)*int64(l.pieceLength) + int64(begin)
+	if off+int64(n) > l.length {
+		return 0, fmt.Errorf("%w: %d bytes at offset %d of piece #%d", ErrOutOfBounds, n, begin, index)
+	}
+
+	return off, nil
+}
+
+// check returns an error wrapping ErrOutOfBounds if the `n` bytes at offset `off` of the content don't lie within it.
+func (l layout) check(off int64, n int) error {
+	if off < 0 || off+int64(n) > l.length {
+		return fmt.Errorf("%w: %d bytes at offset %d", ErrOutOfBounds, n, off)
+	}
+
+	return nil
+}
+
+// numPieces returns the number of pieces the content is split into.
+func (l layout) numPieces() int {
+	return int((l.length + int64(l.pieceLength) - 1) / int64(l.pieceLength))
+}
+
+// pieceSet keeps track of the pieces that have been marked as complete.
+// It is safe for concurrent use.
+type pieceSet struct {
+	mu        sync.Mutex
+	completed bitfield.Bitfield
+	numPieces int
+}
+
+// newPieceSet creates a set for `numPieces` pieces, none of them complete.
+func newPieceSet(numPieces int) *pieceSet {
+	return &pieceSet{completed: bitfield.New(numPieces), numPieces: numPieces}
+}
+
+// mark marks the piece at `index` as complete.
+// Returns an error if the torrent has no such piece.
+func (set *pieceSet) mark(index int) error {
+	if index < 0 || index >= set.numPieces {
+		return fmt.Errorf("%w: piece #%d", ErrOutOfBounds, index)
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	set.completed.SetPiece(index)
+	return nil
+}
+
+// has reports whether the piece at `index` has been marked as complete.
+func (set *pieceSet) has(index int) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	return set.completed.HasPiece(index)
+}
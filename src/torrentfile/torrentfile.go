@@ -2,15 +2,28 @@ package torrentfile
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
 	"fmt"
 	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/jackpal/bencode-go"
+	"github.com/winterrdog/lean-bit-torrent-client/bind"
 	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/connmgr"
+	"github.com/winterrdog/lean-bit-torrent-client/ipfilter"
+	"github.com/winterrdog/lean-bit-torrent-client/listener"
+	"github.com/winterrdog/lean-bit-torrent-client/mse"
 	"github.com/winterrdog/lean-bit-torrent-client/p2p"
-	"github.com/winterrdog/lean-bit-torrent-client/peers"
+	"github.com/winterrdog/lean-bit-torrent-client/peerban"
+	"github.com/winterrdog/lean-bit-torrent-client/proxy"
+	"github.com/winterrdog/lean-bit-torrent-client/ratelimit"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+	"github.com/winterrdog/lean-bit-torrent-client/verify"
 )
 
 /*
@@ -144,44 +157,237 @@ func (bto *BencodeTorrent) ToTorrentFile() (TorrentFile, error) {
 	return torrentFile, nil
 }
 
-// DownloadToFile downloads the torrent file and saves it to the specified path.
-// It generates a peer ID, requests for peers, and then downloads the torrent file.
-// The downloaded file is saved to the specified path.
-//
-// Parameters:
-// - path: The path where the downloaded file will be saved.
-//
-// Returns:
-// - error: An error if any occurred during the download process, otherwise nil.
-func (tf *TorrentFile) DownloadToFile(path string) error {
+// DownloadOptions controls how DownloadToFile downloads a torrent. The zero value is ready to use.
+type DownloadOptions struct {
+	Events      p2p.EventHandler      // Called with every event of the download, including the tracker announces. May be nil.
+	Preallocate storage.Preallocation // How the disk space of the file is reserved. Defaults to a sparse file.
+	Storage     storage.Backend       // How the file is read and written. Defaults to plain reads and writes.
+	Sequential  bool                  // Whether to fetch pieces roughly in order, so the file is usable before it is complete.
+	ReadAhead   int                   // Pieces past the first missing one fetched in order when sequential. Defaults to p2p.DefaultReadAhead.
+	Listener    *listener.Listener    // Listener handing us the connections peers open to us, whose port is announced. May be nil.
+	SeedRatio   float64               // Upload ratio at which to stop seeding once the download completed, see p2p.Torrent.Seed.
+	SeedTime    time.Duration         // Longest time to seed for once the download completed, see p2p.Torrent.Seed.
+	UploadSlots int                   // Peers uploaded to at a time. Defaults to choker.DefaultSlots.
+	Limits      *ratelimit.Limits     // Rate limits shared by every download using them, e.g. of the whole client. May be nil.
+	MaxPeers    int                   // Peers connected at most, incoming ones included. Defaults to connmgr.DefaultConfig's target.
+	Connections *connmgr.Limits       // Connection limits shared by every download using them, e.g. of the whole client. May be nil.
+	Bans        *peerban.List         // Peers banned by every download using it for sending corrupt data. Defaults to a list of the download's own.
+	Filter      *ipfilter.Filter      // Addresses of the peers never to connect to or accept connections from. May be nil.
+	Dialer      proxy.Dialer          // Opens the connections to the tracker and to peers, e.g. through a proxy. Connects directly if nil.
+	Bind        bind.Addrs            // Local addresses the connections leave from, reported to the tracker. A Dialer given must bind them itself.
+	Encryption  mse.Policy            // Whether the connections opened to peers are encrypted. The Listener has a policy of its own. Plaintext by default.
+
+	MaxPeerDownloadRate ratelimit.Rate // Bytes per second downloaded from each peer. Unlimited by default.
+	MaxPeerUploadRate   ratelimit.Rate // Bytes per second uploaded to each peer. Unlimited by default.
+}
+
+// Files returns the files of the torrent's content, in the order they are laid out in it.
+// A torrent with a single file has a single file named after the torrent.
+func (tf *TorrentFile) Files() []storage.File {
+	return []storage.File{{Path: tf.Name, Length: int64(tf.Length)}}
+}
+
+// Download is a download of a torrent file to a file on disk, whose content can be read while it runs
+// through the readers of its torrent.
+type Download struct {
+	Torrent *p2p.Torrent // Torrent being downloaded.
+
+	tracker  *TrackerSource
+	store    storage.Storage
+	listener *listener.Listener // hands us the connections peers open to us, if set
+}
+
+// NewDownload prepares the download of the torrent file to the specified path, opening the file and
+// generating a peer ID. Nothing is downloaded until Run is called.
+// If the file exists already, e.g. from an interrupted download, the data in it is checked first and
+// only the pieces that are missing or corrupt are downloaded.
+// The download must be closed once it is no longer used, which closes the file.
+// Returns an error if the peer ID could not be generated or the file could not be opened, which wraps
+// storage.ErrUnsupported if the storage backend isn't available here.
+func (tf *TorrentFile) NewDownload(path string, options DownloadOptions) (*Download, error) {
 	// generate peer ID
 	var peerId common.Sha1Hash
 	var _, err = rand.Read(peerId[:])
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// request for peers
-	var peers []peers.Peer
-	peers, err = tf.RequestPeers(peerId, common.DefaultBittorrentPort)
-	if err != nil {
-		return err
+	var dialer = options.Dialer
+	if dialer == nil && !options.Bind.IsZero() {
+		dialer = &bind.Dialer{Addrs: options.Bind}
 	}
 
-	// download torrent
-	var torrent = p2p.Torrent{
-		Peers:        peers,
+	var torrent = &p2p.Torrent{
 		PeerId:       peerId,
 		InfoHash:     tf.InfoHash,
 		Name:         tf.Name,
 		Length:       int(tf.Length),
 		PieceLength:  int(tf.PieceLength),
 		PiecesHashes: tf.PiecesHashes,
+		Events:       options.Events,
+		Preallocate:  options.Preallocate,
+		Sequential:   options.Sequential,
+		ReadAhead:    options.ReadAhead,
+		SeedRatio:    options.SeedRatio,
+		SeedTime:     options.SeedTime,
+		UploadSlots:  options.UploadSlots,
+		GlobalLimits: options.Limits,
+		Connections:  connmgr.Config{TargetPeers: options.MaxPeers, Global: options.Connections},
+		GlobalBans:   options.Bans,
+		Filter:       options.Filter,
+		Dialer:       dialer,
+		Encryption:   options.Encryption,
+
+		MaxPeerDownloadRate: options.MaxPeerDownloadRate,
+		MaxPeerUploadRate:   options.MaxPeerUploadRate,
+	}
+	var tracker = &TrackerSource{TorrentFile: tf, PeerId: peerId, Port: common.DefaultBittorrentPort, Torrent: torrent, Dialer: dialer, Addrs: options.Bind}
+	if options.Listener != nil {
+		tracker.Port = options.Listener.Port()
 	}
-	err = torrent.Download(path)
+	torrent.PeerSources = []connmgr.PeerSource{tracker}
+
+	// resume from what is in the file already
+	var _, statErr = os.Stat(path)
+	torrent.Recheck = statErr == nil
+
+	var store storage.Storage
+	store, err = storage.OpenFile(options.Storage, path, torrent.PieceLength, int64(torrent.Length))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Download{Torrent: torrent, tracker: tracker, store: store, listener: options.Listener}, nil
+}
+
+// Run requests peers from the tracker and downloads the torrent into the file, asking the tracker for fresh
+// peers whenever too few peers are connected. The file is left open, so the torrent's readers can still read
+// it once the download is complete.
+// With a listener, the peers connecting to us are uploaded the pieces we have while the download runs, and
+// once it completed the torrent is seeded until the seed ratio or time limit is reached, or `ctx` is cancelled.
+// The tracker is told when the download starts and completes. If the download ends early, e.g. because
+// `ctx` was cancelled, or once seeding ends, the tracker is told that we are leaving the swarm.
+// Returns an error if any occurred during the download process. Seeding cut short by cancelling `ctx` is
+// not an error. If the disk is full, it wraps storage.ErrNoSpace and downloading to the same path again
+// resumes the download.
+func (download *Download) Run(ctx context.Context) error {
+	var torrent, tracker = download.Torrent, download.tracker
+
+	// request for peers
+	var err error
+	torrent.Peers, err = tracker.Announce(ctx, EventStarted)
 	if err != nil {
 		return err
 	}
 
+	if download.listener != nil {
+		download.listener.Add(torrent.InfoHash, torrent.PeerId, torrent.ServePeer)
+		defer download.listener.Remove(torrent.InfoHash)
+	}
+
+	err = torrent.Download(ctx, download.store)
+	if err != nil {
+		download.leave()
+		return err
+	}
+
+	tracker.Announce(ctx, EventCompleted)
+	if download.listener == nil || (torrent.SeedRatio <= 0 && torrent.SeedTime <= 0) {
+		return nil
+	}
+
+	err = torrent.Seed(ctx)
+	download.leave()
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+
 	return nil
 }
+
+// leave tells the tracker that we are leaving the swarm.
+func (download *Download) leave() {
+	// the download's context might be done already, so the tracker gets a moment of its own
+	var ctx, cancel = context.WithTimeout(context.Background(), stoppedTimeout)
+	defer cancel()
+
+	download.tracker.Announce(ctx, EventStopped)
+}
+
+// Close closes the file the torrent is downloaded to.
+// Returns an error if the file could not be closed.
+func (download *Download) Close() error {
+	return download.store.Close()
+}
+
+// DownloadToFile downloads the torrent file and saves it to the specified path, see NewDownload and Run.
+//
+// Parameters:
+// - ctx: Cancelling it stops the download.
+// - path: The path where the downloaded file will be saved.
+// - options: How the download is done and reported on.
+//
+// Returns:
+// - error: An error if any occurred during the download process, otherwise nil. If the disk is full, it wraps
+// storage.ErrNoSpace and downloading to the same path again resumes the download.
+func (tf *TorrentFile) DownloadToFile(ctx context.Context, path string, options DownloadOptions) error {
+	var download, err = tf.NewDownload(path, options)
+	if err != nil {
+		return err
+	}
+
+	err = download.Run(ctx)
+	if err != nil {
+		download.Close()
+		return err
+	}
+
+	return download.Close()
+}
+
+// VerifyFile checks the pieces in the downloaded file at the given path against the torrent's hashes,
+// on as many goroutines as there are CPUs. The file is left untouched.
+// It returns the indices of the pieces that are corrupt, in ascending order.
+// Returns an error if the file doesn't exist, doesn't have the torrent's length or could not be read,
+// or ctx.Err() if `ctx` is cancelled first.
+func (tf *TorrentFile) VerifyFile(ctx context.Context, path string) ([]int, error) {
+	var info, err = os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size() != int64(tf.Length) {
+		return nil, fmt.Errorf("%s has %d bytes, expected %d", path, info.Size(), tf.Length)
+	}
+
+	var store *storage.FileStorage
+	store, err = storage.NewFile(path, int(tf.PieceLength), int64(tf.Length))
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	var pieces = make([]verify.Piece, len(tf.PiecesHashes))
+	for index, hash := range tf.PiecesHashes {
+		var length = min(int64(tf.PieceLength), int64(tf.Length)-int64(index)*int64(tf.PieceLength))
+		pieces[index] = verify.Piece{Index: index, Length: int(length), Hash: hash}
+	}
+
+	var mu sync.Mutex
+	var corrupt []int
+	err = verify.CheckStorage(ctx, store, pieces, 0, func(index int, valid bool) {
+		if valid {
+			return
+		}
+
+		mu.Lock()
+		corrupt = append(corrupt, index)
+		mu.Unlock()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Ints(corrupt)
+	return corrupt, nil
+}
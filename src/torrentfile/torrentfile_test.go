@@ -1,6 +1,10 @@
 package torrentfile
 
 import (
+	"context"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -76,3 +80,56 @@ func TestToTorrentFile(t *testing.T) {
 		assert.Empty(t, torrentFile)
 	})
 }
+
+func TestVerifyFile(t *testing.T) {
+	/*
+		test cases:
+		1. the corrupt pieces of a file are found
+		2. when the file doesn't exist
+		3. when the file doesn't have the torrent's length
+	*/
+
+	var data = []byte("the quick brown fox jumps over the lazy dog")
+	var torrentFile = &TorrentFile{PieceLength: 8, Length: uint32(len(data)), Name: "fox"}
+	for start := 0; start < len(data); start += 8 {
+		torrentFile.PiecesHashes = append(torrentFile.PiecesHashes, sha1.Sum(data[start:min(start+8, len(data))]))
+	}
+
+	t.Run("the corrupt pieces of a file are found", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "fox")
+		var corrupted = append([]byte{}, data...)
+		corrupted[9] = 'X'
+		corrupted[len(data)-1] = 'X'
+		assert.Nil(t, os.WriteFile(path, corrupted, 0644))
+
+		var corrupt, err = torrentFile.VerifyFile(context.Background(), path)
+		assert.Nil(t, err)
+		assert.Equal(t, []int{1, 5}, corrupt)
+
+		var got []byte
+		got, err = os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, corrupted, got)
+	})
+
+	t.Run("when the file doesn't exist", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "fox")
+
+		var _, err = torrentFile.VerifyFile(context.Background(), path)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		_, err = os.Stat(path)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("when the file doesn't have the torrent's length", func(t *testing.T) {
+		var path = filepath.Join(t.TempDir(), "fox")
+		assert.Nil(t, os.WriteFile(path, data[:10], 0644))
+
+		var _, err = torrentFile.VerifyFile(context.Background(), path)
+		assert.NotNil(t, err)
+
+		var info, _ = os.Stat(path)
+		assert.Equal(t, int64(10), info.Size())
+	})
+}
@@ -1,14 +1,18 @@
 package torrentfile
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/jackpal/bencode-go"
+	"github.com/winterrdog/lean-bit-torrent-client/bind"
 	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/p2p"
 	"github.com/winterrdog/lean-bit-torrent-client/peers"
+	"github.com/winterrdog/lean-bit-torrent-client/proxy"
 )
 
 // BencodeTrackerResp represents the response from a Bittorrent tracker
@@ -17,11 +21,74 @@ type BencodeTrackerResp struct {
 	Peers    string `bencode:"peers"`    // peers in compact format
 }
 
+// TrackerEvent tells the tracker why we are announcing ourselves.
+type TrackerEvent string
+
+const (
+	EventNone      TrackerEvent = ""          // regular announce, e.g. to get fresh peers
+	EventStarted   TrackerEvent = "started"   // the download is starting
+	EventCompleted TrackerEvent = "completed" // the download has completed
+	EventStopped   TrackerEvent = "stopped"   // we are leaving the swarm
+)
+
+// stoppedTimeout is how long the tracker is given to take note that we are leaving the swarm.
+const stoppedTimeout = 5 * time.Second
+
+// TrackerSource is a peer source that asks the torrent's tracker for peers.
+type TrackerSource struct {
+	TorrentFile *TorrentFile    // torrent to ask for peers of
+	PeerId      common.Sha1Hash // peer ID we announce ourselves with
+	Port        uint16          // port we announce ourselves on
+	Torrent     *p2p.Torrent    // download the announces are reported to as events, if set
+	Dialer      proxy.Dialer    // opens the connections to the tracker, e.g. through a proxy; directly if nil
+	Addrs       bind.Addrs      // local addresses peers are to reach us on, reported to the tracker if bound
+}
+
+// Peers asks the tracker for peers of the torrent. Unlike Announce, it doesn't report the announce to the
+// torrent: the connection manager asking for peers does.
+func (source *TrackerSource) Peers(ctx context.Context) ([]peers.Peer, error) {
+	return source.announce(ctx, EventNone)
+}
+
+// Announce announces us to the tracker with the given event and returns the peers in its response.
+// If the source has a torrent, the tracker is told how much of it was uploaded and downloaded, and the
+// announce is reported to it, whether it succeeded or not.
+func (source *TrackerSource) Announce(ctx context.Context, event TrackerEvent) ([]peers.Peer, error) {
+	var ps, err = source.announce(ctx, event)
+	if source.Torrent != nil {
+		source.Torrent.Emit(p2p.Event{Type: p2p.EventTrackerAnnounce, NumPeers: len(ps), Err: err})
+	}
+
+	return ps, err
+}
+
+// announce announces us to the tracker like Announce, without reporting it to the torrent.
+func (source *TrackerSource) announce(ctx context.Context, event TrackerEvent) ([]peers.Peer, error) {
+	var progress = transfer{left: int64(source.TorrentFile.Length)}
+	if source.Torrent != nil {
+		var stats = source.Torrent.Stats()
+		progress = transfer{uploaded: stats.Uploaded, downloaded: stats.Received, left: stats.Length - stats.Downloaded}
+	}
+
+	return source.TorrentFile.announce(ctx, source.Dialer, source.Addrs, source.PeerId, source.Port, event, progress)
+}
+
+// transfer is how much of a torrent we report to the tracker as uploaded, downloaded and left to download.
+type transfer struct {
+	uploaded, downloaded, left int64
+}
+
 // BuildTrackerUrl builds the tracker URL for the torrent file.
 // It takes the peer ID and port as parameters and returns the built URL as a string.
 // The URL includes query parameters such as info_hash, peer_id, port, uploaded, downloaded, compact, and left.
+// It reports nothing as uploaded or downloaded yet.
 // If there is an error while parsing the announce URL, it returns an empty string and the error.
 func (torrFile *TorrentFile) BuildTrackerUrl(peerId common.Sha1Hash, port uint16) (string, error) {
+	return torrFile.trackerUrl(peerId, port, transfer{left: int64(torrFile.Length)})
+}
+
+// trackerUrl builds the tracker URL for the torrent file like BuildTrackerUrl, reporting `progress`.
+func (torrFile *TorrentFile) trackerUrl(peerId common.Sha1Hash, port uint16, progress transfer) (string, error) {
 	var base, err = url.Parse(torrFile.Announce)
 	if err != nil {
 		return "", err
@@ -32,10 +99,10 @@ func (torrFile *TorrentFile) BuildTrackerUrl(peerId common.Sha1Hash, port uint16
 		"info_hash":  []string{string(torrFile.InfoHash[:])},
 		"peer_id":    []string{string(peerId[:])},
 		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"uploaded":   []string{strconv.FormatInt(progress.uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(progress.downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(int(torrFile.Length))},
+		"left":       []string{strconv.FormatInt(max(progress.left, 0), 10)},
 	}
 
 	base.RawQuery = params.Encode()
@@ -43,20 +110,56 @@ func (torrFile *TorrentFile) BuildTrackerUrl(peerId common.Sha1Hash, port uint16
 	return base.String(), nil
 }
 
-// RequestPeers sends a request to the tracker to get a list of peers for the given torrent file.
-// It takes the peerId and port as parameters and returns a slice of peers and an error, if any.
-// The function builds the tracker URL using the peerId and port, sends an HTTP GET request to the tracker,
-// and unmarshals the response to extract the list of peers.
-// It returns the unmarshaled list of peers or an error if any error occurs during the process.
-func (tf *TorrentFile) RequestPeers(peerId common.Sha1Hash, port uint16) ([]peers.Peer, error) {
-	var url, err = tf.BuildTrackerUrl(peerId, port)
+// announcedAddrs returns the query parameters telling the tracker the bound `addrs` to give out to peers, which
+// the request may not come from, e.g. when it goes through a proxy. The address of the only bound family is
+// sent as `ip`; with both bound, the IPv6 one is sent as `ipv6` as well (BEP 7).
+func announcedAddrs(addrs bind.Addrs) string {
+	var params = url.Values{}
+	switch {
+	case addrs.IPv4 != nil:
+		params.Set("ip", addrs.IPv4.String())
+		if addrs.IPv6 != nil {
+			params.Set("ipv6", addrs.IPv6.String())
+		}
+	case addrs.IPv6 != nil:
+		params.Set("ip", addrs.IPv6.String())
+	default:
+		return ""
+	}
+
+	return "&" + params.Encode()
+}
+
+// announce announces us to the tracker with the given event and progress, and returns the peers in its response.
+// The event is left out of the request if it is EventNone, and so are the bound `addrs` if neither family is
+// bound, since the tracker then takes the address the request comes from.
+// The connection to the tracker is opened with `dialer`, or as http.DefaultTransport does if it is nil.
+// The request is abandoned as soon as `ctx` is cancelled.
+func (tf *TorrentFile) announce(ctx context.Context, dialer proxy.Dialer, addrs bind.Addrs, peerId common.Sha1Hash, port uint16, event TrackerEvent, progress transfer) ([]peers.Peer, error) {
+	var url, err = tf.trackerUrl(peerId, port, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	if event != EventNone {
+		url += "&event=" + string(event)
+	}
+
+	url += announcedAddrs(addrs)
+
+	var request *http.Request
+	request, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	var response *http.Response
 	var httpClient = &http.Client{Timeout: 15 * time.Second}
-	response, err = httpClient.Get(url)
+	if dialer != nil {
+		// announces are few and far between, so their connections aren't kept around
+		httpClient.Transport = &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true}
+	}
+	response, err = httpClient.Do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -1,13 +1,20 @@
 package torrentfile
 
 import (
+	"context"
+	"errors"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/winterrdog/lean-bit-torrent-client/bind"
+	"github.com/winterrdog/lean-bit-torrent-client/p2p"
 	"github.com/winterrdog/lean-bit-torrent-client/peers"
+	"github.com/winterrdog/lean-bit-torrent-client/proxy"
 )
 
 func TestBuildTrackerUrl(t *testing.T) {
@@ -65,13 +72,14 @@ func TestBuildTrackerUrl(t *testing.T) {
 	})
 }
 
-func TestRequestPeers(t *testing.T) {
+func TestTrackerSourcePeers(t *testing.T) {
 	/*
 		test cases:
 		1. valid tracker response with valid peers
 		2. when a malformed announce URL is provided
 		3. when an error occurs while sending the HTTP GET request
 		4. when an error occurs while unmarshaling the tracker response
+		5. the request is abandoned when the context is cancelled
 	*/
 
 	t.Run("valid tracker response with valid peers", func(t *testing.T) {
@@ -105,8 +113,8 @@ func TestRequestPeers(t *testing.T) {
 		var peerId = [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
 		const port uint16 = 6789
 
-		// call the RequestPeers method
-		ps, err := torrFile.RequestPeers(peerId, port)
+		// ask the tracker for peers
+		ps, err := (&TrackerSource{TorrentFile: &torrFile, PeerId: peerId, Port: port}).Peers(context.Background())
 		var expected = []peers.Peer{
 			{IP: net.IP{192, 168, 1, 1}, Port: 0x1a1b},
 			{IP: net.IP{198, 51, 0, 1}, Port: 0x1a1b},
@@ -138,8 +146,8 @@ func TestRequestPeers(t *testing.T) {
 		var peerId = [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
 		const port uint16 = 6789
 
-		// call the RequestPeers method
-		ps, err := torrFile.RequestPeers(peerId, port)
+		// ask the tracker for peers
+		ps, err := (&TrackerSource{TorrentFile: &torrFile, PeerId: peerId, Port: port}).Peers(context.Background())
 
 		assert.NotNil(t, err)
 		assert.Empty(t, ps)
@@ -160,8 +168,8 @@ func TestRequestPeers(t *testing.T) {
 		var peerId = [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
 		const port uint16 = 6789
 
-		// call the RequestPeers method
-		ps, err := torrFile.RequestPeers(peerId, port)
+		// ask the tracker for peers
+		ps, err := (&TrackerSource{TorrentFile: &torrFile, PeerId: peerId, Port: port}).Peers(context.Background())
 
 		assert.NotNil(t, err)
 		assert.Empty(t, ps)
@@ -182,10 +190,157 @@ func TestRequestPeers(t *testing.T) {
 		var peerId = [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
 		const port uint16 = 6789
 
-		// call the RequestPeers method
-		ps, err := torrFile.RequestPeers(peerId, port)
+		// ask the tracker for peers
+		ps, err := (&TrackerSource{TorrentFile: &torrFile, PeerId: peerId, Port: port}).Peers(context.Background())
 
 		assert.NotNil(t, err)
 		assert.Empty(t, ps)
 	})
+
+	t.Run("the request is abandoned when the context is cancelled", func(t *testing.T) {
+		var unblock = make(chan struct{})
+		var reqHandler = func(w http.ResponseWriter, r *http.Request) {
+			<-unblock // a tracker that never answers
+		}
+		var mockServer = httptest.NewServer(http.HandlerFunc(reqHandler))
+		defer mockServer.Close()
+		defer close(unblock)
+
+		var torrFile = TorrentFile{Announce: mockServer.URL, Length: 351272960}
+		var peerId = [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+
+		var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		ps, err := (&TrackerSource{TorrentFile: &torrFile, PeerId: peerId, Port: 6789}).Peers(ctx)
+
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Empty(t, ps)
+	})
+}
+
+func TestTrackerSource(t *testing.T) {
+	var announces int
+	var query url.Values
+	var reqHandler = func(w http.ResponseWriter, r *http.Request) {
+		announces++
+		query = r.URL.Query()
+		w.Write([]byte("d8:intervali1900e5:peers6:" + string([]byte{192, 168, 1, 1, 0x1A, 0x1B}) + "e"))
+	}
+	var mockServer = httptest.NewServer(http.HandlerFunc(reqHandler))
+	defer mockServer.Close()
+
+	var events []p2p.Event
+	var source = &TrackerSource{
+		TorrentFile: &TorrentFile{Announce: mockServer.URL, Length: 351272960},
+		PeerId:      [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19},
+		Port:        6789,
+		Torrent: &p2p.Torrent{Length: 351272960, Events: func(torrent *p2p.Torrent, event p2p.Event) {
+			events = append(events, event)
+		}},
+	}
+
+	// every call announces to the tracker again, and is reported
+	for i := 1; i <= 2; i++ {
+		var ps, err = source.Announce(context.Background(), EventNone)
+		assert.Nil(t, err)
+		assert.Equal(t, []peers.Peer{{IP: net.IP{192, 168, 1, 1}, Port: 0x1a1b}}, ps)
+		assert.Equal(t, i, announces)
+		assert.Len(t, events, i)
+		assert.Equal(t, p2p.EventTrackerAnnounce, events[i-1].Type)
+		assert.Equal(t, 1, events[i-1].NumPeers)
+	}
+
+	// the tracker is told how far along the torrent is
+	assert.Equal(t, "0", query.Get("uploaded"))
+	assert.Equal(t, "0", query.Get("downloaded"))
+	assert.Equal(t, "351272960", query.Get("left"))
+
+	assert.False(t, query.Has("event"))
+
+	// asking for peers leaves the reporting to the connection manager
+	var ps, err = source.Peers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, ps, 1)
+	assert.Equal(t, 3, announces)
+	assert.Len(t, events, 2)
+
+	// failed announces are reported too
+	mockServer.Close()
+	_, err = source.Announce(context.Background(), EventStopped)
+	assert.NotNil(t, err)
+	assert.Len(t, events, 3)
+	assert.Equal(t, err, events[2].Err)
+}
+
+func TestTrackerSourceDialer(t *testing.T) {
+	var reqHandler = func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1900e5:peers6:" + string([]byte{192, 168, 1, 1, 0x1A, 0x1B}) + "e"))
+	}
+	var mockServer = httptest.NewServer(http.HandlerFunc(reqHandler))
+	defer mockServer.Close()
+
+	// the announces are made through the dialer, e.g. a proxy
+	var dialed []string
+	var source = &TrackerSource{
+		TorrentFile: &TorrentFile{Announce: mockServer.URL, Length: 100},
+		Port:        6789,
+		Dialer: dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			return proxy.Direct.DialContext(ctx, network, addr)
+		}),
+	}
+
+	var ps, err = source.Peers(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, ps, 1)
+	assert.Equal(t, []string{mockServer.Listener.Addr().String()}, dialed)
+
+	// and fail if the dialer can't connect
+	var errUnreachable = errors.New("unreachable")
+	source.Dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errUnreachable
+	})
+	_, err = source.Peers(context.Background())
+	assert.ErrorIs(t, err, errUnreachable)
+}
+
+// dialerFunc is a dialer calling a function.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (dial dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dial(ctx, network, addr)
+}
+
+func TestTrackerSourceAddrs(t *testing.T) {
+	var query url.Values
+	var reqHandler = func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte("d8:intervali1900e5:peers0:e"))
+	}
+	var mockServer = httptest.NewServer(http.HandlerFunc(reqHandler))
+	defer mockServer.Close()
+
+	var source = &TrackerSource{TorrentFile: &TorrentFile{Announce: mockServer.URL, Length: 100}, Port: 6789}
+
+	// without bound addresses the tracker takes the one the request comes from
+	var _, err = source.Peers(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, query.Has("ip"))
+	assert.False(t, query.Has("ipv6"))
+
+	// the address of the only bound family is sent as ip
+	source.Addrs = bind.Addrs{IPv6: net.ParseIP("2001:db8::7")}
+	_, err = source.Peers(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::7", query.Get("ip"))
+	assert.False(t, query.Has("ipv6"))
+
+	// with both bound, the IPv6 one is sent as ipv6 too
+	source.Addrs.IPv4 = net.IP{192, 0, 2, 7}
+	_, err = source.Announce(context.Background(), EventStarted)
+	assert.Nil(t, err)
+	assert.Equal(t, "192.0.2.7", query.Get("ip"))
+	assert.Equal(t, "2001:db8::7", query.Get("ipv6"))
+	assert.Equal(t, "started", query.Get("event"))
 }
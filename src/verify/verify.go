@@ -0,0 +1,145 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"runtime"
+	"sync"
+
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+// Piece describes a piece to check.
+type Piece struct {
+	Index  int             // index of the piece in the torrent
+	Length int             // length of the piece in bytes
+	Hash   common.Sha1Hash // SHA-1 hash the piece's data must have
+}
+
+// Check reports whether `data` has the SHA-1 hash `hash`.
+func Check(data []byte, hash common.Sha1Hash) bool {
+	var sum = sha1.Sum(data)
+	return bytes.Equal(sum[:], hash[:])
+}
+
+// job is a piece waiting to be checked by a pool.
+type job struct {
+	data []byte
+	hash common.Sha1Hash
+	done func(valid bool)
+}
+
+// Pool checks pieces on a fixed number of goroutines, so that hashing neither holds up the goroutines
+// reading from the network nor competes with them for more CPUs than there are.
+// It is safe for concurrent use.
+type Pool struct {
+	jobs    chan job
+	workers sync.WaitGroup
+}
+
+// NewPool creates a pool of `workers` goroutines, or of one goroutine per CPU if `workers` is not positive.
+// The pool must be closed to stop them.
+func NewPool(workers int) *Pool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var pool = &Pool{jobs: make(chan job, 2*workers)}
+	pool.workers.Add(workers)
+	for i := 0; i != workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+// Submit queues `data` to be checked against `hash`. Once it has been checked, `done` is called
+// with the outcome on one of the pool's goroutines.
+// It blocks while the queue is full. The pool must not be closed yet.
+func (pool *Pool) Submit(data []byte, hash common.Sha1Hash, done func(valid bool)) {
+	pool.jobs <- job{data: data, hash: hash, done: done}
+}
+
+// Close checks the pieces that are still queued and stops the pool's goroutines once they are done.
+func (pool *Pool) Close() {
+	close(pool.jobs)
+	pool.workers.Wait()
+}
+
+// work checks queued pieces until the pool is closed.
+func (pool *Pool) work() {
+	defer pool.workers.Done()
+
+	for job := range pool.jobs {
+		job.done(Check(job.data, job.hash))
+	}
+}
+
+// CheckStorage reads the given pieces from the storage and checks them on `workers` goroutines, or on one
+// goroutine per CPU if `workers` is not positive. `found` is called with the outcome of every piece,
+// from several goroutines at once and in no particular order.
+// It returns ctx.Err() if `ctx` is cancelled before every piece has been checked, or the first error
+// that occurred while reading the storage.
+func CheckStorage(ctx context.Context, store storage.Storage, pieces []Piece, workers int, found func(index int, valid bool)) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	var (
+		next    = make(chan Piece)
+		errs    = make(chan error, workers)
+		checked sync.WaitGroup
+	)
+
+	checked.Add(workers)
+	for i := 0; i != workers; i++ {
+		go func() {
+			defer checked.Done()
+
+			var buf []byte
+			for piece := range next {
+				if cap(buf) < piece.Length {
+					buf = make([]byte, piece.Length)
+				}
+				buf = buf[:piece.Length]
+
+				var err = store.ReadBlock(piece.Index, 0, buf)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				found(piece.Index, Check(buf, piece.Hash))
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for _, piece := range pieces {
+		select {
+		case next <- piece:
+		case err = <-errs:
+			break feed
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(next)
+	checked.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	// a read might have failed on the last pieces
+	select {
+	case err = <-errs:
+		return err
+	default:
+		return nil
+	}
+}
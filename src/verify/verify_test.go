@@ -0,0 +1,133 @@
+package verify
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/winterrdog/lean-bit-torrent-client/common"
+	"github.com/winterrdog/lean-bit-torrent-client/storage"
+)
+
+// failingStorage is an in-memory storage whose reads of one piece fail.
+type failingStorage struct {
+	*storage.Memory
+	bad int   // index of the piece that can't be read
+	err error // returned by reads of the bad piece
+}
+
+func (store *failingStorage) ReadBlock(index, begin int, buf []byte) error {
+	if index == store.bad {
+		return store.err
+	}
+
+	return store.Memory.ReadBlock(index, begin, buf)
+}
+
+// newTestStorage creates a storage holding `data` in pieces of `pieceLength` bytes, and the pieces to check it.
+// The hash of the piece at index `corrupt` doesn't match its data.
+func newTestStorage(t *testing.T, data []byte, pieceLength, corrupt int) (*storage.Memory, []Piece) {
+	var store = storage.NewMemory(pieceLength, int64(len(data)))
+	var pieces []Piece
+	for start := 0; start < len(data); start += pieceLength {
+		var end = min(start+pieceLength, len(data))
+		var piece = Piece{Index: len(pieces), Length: end - start, Hash: sha1.Sum(data[start:end])}
+		if piece.Index == corrupt {
+			piece.Hash = common.Sha1Hash{}
+		}
+
+		assert.Nil(t, store.WriteBlock(piece.Index, 0, data[start:end]))
+		pieces = append(pieces, piece)
+	}
+
+	return store, pieces
+}
+
+func TestCheck(t *testing.T) {
+	var data = []byte("abcdef")
+
+	assert.True(t, Check(data, sha1.Sum(data)))
+	assert.False(t, Check(data[1:], sha1.Sum(data)))
+}
+
+func TestPool(t *testing.T) {
+	/*
+		test cases:
+		1. every submitted piece is checked before Close returns
+	*/
+
+	t.Run("every submitted piece is checked before Close returns", func(t *testing.T) {
+		var pool = NewPool(2)
+
+		var mu sync.Mutex
+		var outcomes = make(map[int]bool)
+		for i := 0; i != 20; i++ {
+			var data = []byte{byte(i)}
+			var hash = sha1.Sum(data)
+			if i%2 == 1 {
+				hash = common.Sha1Hash{}
+			}
+
+			pool.Submit(data, hash, func(valid bool) {
+				mu.Lock()
+				defer mu.Unlock()
+				outcomes[i] = valid
+			})
+		}
+		pool.Close()
+
+		assert.Len(t, outcomes, 20)
+		for i, valid := range outcomes {
+			assert.Equal(t, i%2 == 0, valid)
+		}
+	})
+}
+
+func TestCheckStorage(t *testing.T) {
+	/*
+		test cases:
+		1. every piece is checked and the corrupt ones are found
+		2. a failed read is reported
+		3. checking stops when the context is cancelled
+	*/
+
+	var data = []byte("the quick brown fox jumps over the lazy dog")
+
+	t.Run("every piece is checked and the corrupt ones are found", func(t *testing.T) {
+		var store, pieces = newTestStorage(t, data, 4, 3)
+
+		var mu sync.Mutex
+		var outcomes = make(map[int]bool)
+		var err = CheckStorage(context.Background(), store, pieces, 3, func(index int, valid bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			outcomes[index] = valid
+		})
+
+		assert.Nil(t, err)
+		assert.Len(t, outcomes, len(pieces))
+		for index, valid := range outcomes {
+			assert.Equal(t, index != 3, valid)
+		}
+	})
+
+	t.Run("a failed read is reported", func(t *testing.T) {
+		var memory, pieces = newTestStorage(t, data, 4, -1)
+		var store = &failingStorage{Memory: memory, bad: 5, err: errors.New("bad sector")}
+
+		var err = CheckStorage(context.Background(), store, pieces, 2, func(index int, valid bool) {})
+		assert.ErrorIs(t, err, store.err)
+	})
+
+	t.Run("checking stops when the context is cancelled", func(t *testing.T) {
+		var store, pieces = newTestStorage(t, data, 4, -1)
+		var ctx, cancel = context.WithCancel(context.Background())
+		cancel()
+
+		var err = CheckStorage(ctx, store, pieces, 1, func(index int, valid bool) {})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}